@@ -0,0 +1,52 @@
+package duckserver_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestAdminAddress(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AdminAddress = "127.0.0.1:0"
+		return c
+	})
+	admin := *ts
+	admin.URL = ts.srv.AdminURL
+	if admin.URL == "" || admin.URL == ts.URL {
+		t.Fatalf("admin end points should be hosted at another address: %q", admin.URL)
+	}
+
+	// Admin end points are only on the admin address.
+	for _, path := range []string{"/config/", "/status/", "/metrics", "/status/queries/"} {
+		resp, err := doGet(ts, path)
+		if _, err := readResponse2(resp, err, 404, 404); err != nil {
+			t.Errorf("%s should not be found at the query address: %s", path, err)
+		}
+		if _, err := readResponse(doGet(&admin, path)); err != nil {
+			t.Errorf("%s should be found at the admin address: %s", path, err)
+		}
+	}
+	resp, err := doPost(ts, "/status/drain", "")
+	if _, err := readResponse2(resp, err, 404, 404); err != nil {
+		t.Error(err)
+	}
+
+	// Queries are only on the query address.
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+	resp, err = doPost(&admin, "/?f=csv", `SELECT 1 AS N`)
+	if _, err := readResponse2(resp, err, 404, 404); err != nil {
+		t.Error(err)
+	}
+	got, err := readResponse(doGet(ts, "/ping/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "OK\r\n", got)
+
+	// The admin address works with DBs as the query address.
+	if _, err := readResponse(doGet(&admin, "/config/duckdb")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,210 @@
+package duckserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koron/duckpop/internal/accesslog"
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/conndb"
+	"github.com/koron/duckpop/internal/formatter"
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// BatchQuery is a query in a batch request.
+type BatchQuery struct {
+	ID    string `json:"id"`
+	Query string `json:"query"`
+	Args  []any  `json:"args,omitempty"`
+}
+
+// BatchResult is a result of a query in a batch request. Either Rows or Error
+// is set.
+type BatchResult struct {
+	ID    string          `json:"id"`
+	Rows  json.RawMessage `json:"rows,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// handleBatch executes multiple queries in a request, and responds their
+// results in an array of JSON with preserving the order.
+//
+// Queries are executed sequentially on the connection of the client by
+// default.  With "parallel=true", they are executed concurrently on separate
+// connections to the database of the client, so the session states like
+// temporary tables and variables are not shared with them.
+func (srv *Server) handleBatch(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	var queries []BatchQuery
+	if err := json.Unmarshal(b, &queries); err != nil {
+		return httperror.Newf(400, "Invalid batch: %s", err)
+	}
+	parallel := r.URL.Query().Get("parallel") == "true"
+	texts := make([]string, len(queries))
+	for i, bq := range queries {
+		texts[i] = bq.Query
+	}
+	joined := strings.Join(texts, ";\n")
+	auditlog.SetQuery(w, joined)
+	for _, bq := range queries {
+		if err := srv.checkStatements(bq.Query); err != nil {
+			return err
+		}
+	}
+	if err := srv.checkFileReads(r, joined); err != nil {
+		return err
+	}
+	if err := srv.checkExtensions(r, joined); err != nil {
+		return err
+	}
+	if err := srv.checkReadOnly(r, joined); err != nil {
+		return err
+	}
+	timeout, err := srv.queryTimeout(r)
+	if err != nil {
+		return err
+	}
+	maxSize, err := srv.maxResponseSize(r)
+	if err != nil {
+		return err
+	}
+	for i, bq := range queries {
+		if query, limited := srv.autoLimit(bq.Query); limited {
+			queries[i].Query = query
+			w.Header().Set(AutoLimitedHeader, strconv.Itoa(srv.config.AutoLimit))
+		}
+	}
+
+	client, conn, err := srv.clientConn(w, r)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	results := make([]BatchResult, len(queries))
+	if parallel {
+		err = srv.runBatchParallel(r.Context(), client, queries, results, timeout, maxSize)
+	} else {
+		unlock, err := srv.lockQuery(r, client)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		for i, bq := range queries {
+			results[i] = srv.runBatchQuery(r.Context(), client.ID, conn, bq, timeout, maxSize)
+		}
+	}
+	if rep, ok := w.(accesslog.QueryReporter); ok {
+		rep.QueryReport(joined, time.Since(start))
+	}
+	if errors.Is(err, conndb.ErrMaxDB) {
+		return srv.overloaded(429, reasonMaxDB, "%s", err)
+	}
+	if err != nil {
+		return httperror.Newf(500, "Failed to connect DB: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(results)
+}
+
+func (srv *Server) runBatchParallel(ctx context.Context, client *conndb.Client, queries []BatchQuery, results []BatchResult, timeout time.Duration, maxSize int64) error {
+	db, err := client.DB(ctx)
+	if err != nil {
+		return err
+	}
+	limit := max(srv.config.BatchParallel, 1)
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, bq := range queries {
+		// Queries not started yet fail when the request is canceled.
+		if err := ctx.Err(); err != nil {
+			results[i] = BatchResult{ID: bq.ID, Error: err.Error()}
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = BatchResult{ID: bq.ID, Error: ctx.Err().Error()}
+			continue
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				results[i] = BatchResult{ID: bq.ID, Error: err.Error()}
+				return
+			}
+			defer conn.Close()
+			results[i] = srv.runBatchQuery(ctx, client.ID, conn, bq, timeout, maxSize)
+		})
+	}
+	wg.Wait()
+	return nil
+}
+
+// runBatchQuery executes a query of a batch, whose result is limited to
+// maxSize bytes when it is positive.
+func (srv *Server) runBatchQuery(ctx context.Context, connID conndb.ID, conn *sql.Conn, bq BatchQuery, timeout time.Duration, maxSize int64) (result BatchResult) {
+	// A panic in a parallel query should not take down the server.
+	defer func() {
+		if p := recover(); p != nil {
+			result = BatchResult{ID: bq.ID, Error: "Internal error: error ID " + srv.logPanic(p)}
+		}
+	}()
+	release, err := srv.acquireWorker(ctx)
+	if err != nil {
+		return BatchResult{ID: bq.ID, Error: err.Error()}
+	}
+	defer release()
+	q := srv.queryDatabase.AddTimeout(ctx, connID, bq.Query, timeout)
+	defer q.Close()
+	rows, err := conn.QueryContext(q.Context(), bq.Query, bq.Args...)
+	if err != nil {
+		msg, _ := srv.errorMessage("Query error", err)
+		return BatchResult{ID: bq.ID, Error: msg}
+	}
+	defer rows.Close()
+	srv.dataChanged(nil, bq.Query)
+	if columnTypes, err := rows.ColumnTypes(); err == nil {
+		if err := srv.checkColumns(columnTypes); err != nil {
+			return BatchResult{ID: bq.ID, Error: err.Error()}
+		}
+	}
+	bb := &bytes.Buffer{}
+	var out io.Writer = bb
+	if maxSize > 0 {
+		out = &limitWriter{w: bb, limit: maxSize}
+	}
+	_, fw, err := formatter.FindAndCreate(srv.formatDefaults("json"), out)
+	if err != nil {
+		return BatchResult{ID: bq.ID, Error: err.Error()}
+	}
+	if _, err := writeRows(q.Context(), fw, rows, nil); err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			return BatchResult{ID: bq.ID, Error: fmt.Sprintf("Truncated: %s: exceeded the limit %d bytes", err, maxSize)}
+		}
+		return BatchResult{ID: bq.ID, Error: "Serialization error: " + err.Error()}
+	}
+	return BatchResult{ID: bq.ID, Rows: json.RawMessage(bb.Bytes())}
+}
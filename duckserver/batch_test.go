@@ -0,0 +1,88 @@
+package duckserver_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestBatch(t *testing.T) {
+	ts := startServer0(t)
+	const body = `[
+  {"id":"q1","query":"SELECT 1 AS A"},
+  {"id":"q2","query":"SELECT ? AS B, ? AS C","args":["foo", 2]},
+  {"id":"q3","query":"SELECT * FROM no_such_table"},
+  {"id":"q4","query":"SELECT i FROM range(3) t(i)"}
+]`
+	const want = `[{"id":"q1","rows":[{"A":1}]},{"id":"q2","rows":[{"B":"foo","C":2}]},{"id":"q3","error":"Query error: Catalog Error: Table with name no_such_table does not exist!\nDid you mean \"pg_tables\"?\n\nLINE 1: SELECT * FROM no_such_table\n                      ^"},{"id":"q4","rows":[{"i":0},{"i":1},{"i":2}]}]` + "\n"
+
+	t.Run("sequential", func(t *testing.T) {
+		got, err := readResponse(doPost(ts, "/batch/", body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	})
+	t.Run("parallel", func(t *testing.T) {
+		got, err := readResponse(doPost(ts, "/batch/?parallel=true", body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		for _, path := range []string{"/batch/", "/batch/?parallel=true"} {
+			start := time.Now()
+			got, err := readResponse(doPost(ts, path, `[{"id":"q1","query":"SELECT count(*) FROM range(1000000000000) t(i)"}]`, func(req *http.Request) *http.Request {
+				req.Header.Set(duckserver.TimeoutHeader, "100ms")
+				return req
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, `[{"id":"q1","error":"Query error: context deadline exceeded\nINTERRUPT Error: Interrupted!"}]`+"\n", got)
+			if d := time.Since(start); d > 10*time.Second {
+				t.Errorf("%s: the query should be interrupted soon: %s", path, d)
+			}
+		}
+	})
+	t.Run("max response size", func(t *testing.T) {
+		for _, path := range []string{"/batch/", "/batch/?parallel=true"} {
+			got, err := readResponse(doPost(ts, path, `[{"id":"q1","query":"SELECT i FROM range(100) t(i)"},{"id":"q2","query":"SELECT 1 AS A"}]`, func(req *http.Request) *http.Request {
+				req.Header.Set(duckserver.MaxResponseSizeHeader, "20")
+				return req
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, `[{"id":"q1","error":"Truncated: response too large: exceeded the limit 20 bytes"},{"id":"q2","rows":[{"A":1}]}]`+"\n", got)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		resp, err := doPost(ts, "/batch/", `{"id":"q1"}`)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Invalid batch: json: cannot unmarshal object into Go value of type []duckserver.BatchQuery\n", got)
+	})
+}
+
+func TestBatchAutoLimit(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AutoLimit = 2
+		return c
+	})
+	for _, path := range []string{"/batch/", "/batch/?parallel=true"} {
+		resp, err := doPost(ts, path, `[{"id":"q1","query":"SELECT i FROM range(5) t(i)"},{"id":"q2","query":"SELECT i FROM range(5) t(i) LIMIT 3"}]`)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, `[{"id":"q1","rows":[{"i":0},{"i":1}]},{"id":"q2","rows":[{"i":0},{"i":1},{"i":2}]}]`+"\n", got)
+		assert.Equal(t, "2", resp.Header.Get(duckserver.AutoLimitedHeader))
+	}
+}
@@ -0,0 +1,287 @@
+package duckserver
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// coalesceHeaders are headers of a request which change the response of a
+// query, and are a part of the key to coalesce queries.
+var coalesceHeaders = []string{
+	"Accept", ColumnsHeader, IfDataVersionHeader, NoCostLimitHeader,
+	MaxResponseSizeHeader, TimeoutHeader,
+}
+
+// maxCoalescedSize is the maximum size of a response buffered for requests
+// waiting for a shared execution. The waiters of a larger response execute
+// the query by themselves.
+const maxCoalescedSize = 16 << 20
+
+// isCoalescable reports whether a query can share the execution with
+// identical queries: a single read-only query like SELECT, but not by HEAD.
+func isCoalescable(r *http.Request, query string) bool {
+	if r.Method == "HEAD" {
+		return false
+	}
+	_, ok := asSubquery(query)
+	return ok
+}
+
+// coalesceKey returns the key of a query to coalesce identical queries. Only
+// queries on the same DB are identical, so the key includes the tenant of the
+// client.
+func (srv *Server) coalesceKey(r *http.Request, tenant, query string, args []any) string {
+	parts := []string{
+		tenant,
+		r.URL.RawQuery,
+		strings.TrimSpace(sqltext.TrimTerminator(query)),
+		fmt.Sprintf("%#v", args),
+		strconv.FormatBool(srv.isAdmin(r)),
+	}
+	for _, name := range coalesceHeaders {
+		parts = append(parts, r.Header.Get(name))
+	}
+	if name := srv.config.TimeoutHeader; name != "" {
+		parts = append(parts, r.Header.Get(name))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// coalescedQuery tracks requests of a key in flight, which share an execution
+// by singleflight.Group. It is guarded by Server.coalesceMu.
+type coalescedQuery struct {
+	// requests is the number of the requests, which tells the first request
+	// whether others are waiting for its response.
+	requests int
+	// cancel cancels the shared execution, which is canceled when all of the
+	// requests leave.
+	cancel context.CancelFunc
+}
+
+// coalescedResponse is a response of a shared execution for waiters.
+type coalescedResponse struct {
+	// buffered is false when the response isn't buffered, because there were
+	// no waiters at the start or it overflowed maxCoalescedSize. The waiters
+	// execute the query by themselves then.
+	buffered bool
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	err      error
+}
+
+// executeCoalesced executes a query like executeQuery, but identical queries
+// in flight share an execution. The first request executes the query and
+// streams the response as usual, and the response is buffered and replayed to
+// the others only when they are waiting at the start of the response.
+func (srv *Server) executeCoalesced(w http.ResponseWriter, r *http.Request, query string, args ...any) error {
+	client, _, err := srv.clientConn(w, r)
+	if err != nil {
+		return err
+	}
+	key := srv.coalesceKey(r, client.Tenant, query, args)
+
+	cq := srv.joinCoalesced(key)
+	stop := context.AfterFunc(r.Context(), func() { srv.leaveCoalesced(key, cq) })
+	defer func() {
+		if stop() {
+			srv.leaveCoalesced(key, cq)
+		}
+	}()
+	var led bool
+	v, err, _ := srv.coalesceGroup.Do(key, func() (any, error) {
+		led = true
+		return srv.leadCoalesced(w, r, key, cq, query, args...)
+	})
+	if led {
+		return err
+	}
+	if err := r.Context().Err(); err != nil {
+		return err
+	}
+	resp := v.(*coalescedResponse)
+	if !resp.buffered {
+		return srv.executeQuery(w, r, query, args...)
+	}
+	w.Header().Set(CoalescedHeader, "true")
+	return resp.replay(w)
+}
+
+// joinCoalesced counts a request of the key in flight.
+func (srv *Server) joinCoalesced(key string) *coalescedQuery {
+	srv.coalesceMu.Lock()
+	defer srv.coalesceMu.Unlock()
+	cq, ok := srv.coalescing[key]
+	if !ok {
+		cq = &coalescedQuery{}
+		if srv.coalescing == nil {
+			srv.coalescing = map[string]*coalescedQuery{}
+		}
+		srv.coalescing[key] = cq
+	}
+	cq.requests++
+	return cq
+}
+
+// leaveCoalesced removes a request of the key, and cancels the shared
+// execution when no requests remain.
+func (srv *Server) leaveCoalesced(key string, cq *coalescedQuery) {
+	srv.coalesceMu.Lock()
+	defer srv.coalesceMu.Unlock()
+	cq.requests--
+	if cq.requests > 0 {
+		return
+	}
+	delete(srv.coalescing, key)
+	if cq.cancel != nil {
+		cq.cancel()
+	}
+}
+
+// leadCoalesced executes a query shared by the requests of the key, streaming
+// the response to w of the first request. The execution isn't canceled by the
+// first request leaving while others are waiting for it.
+func (srv *Server) leadCoalesced(w http.ResponseWriter, r *http.Request, key string, cq *coalescedQuery, query string, args ...any) (*coalescedResponse, error) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	srv.coalesceMu.Lock()
+	cq.cancel = cancel
+	if cq.requests == 0 {
+		cancel()
+	}
+	srv.coalesceMu.Unlock()
+
+	cw := &coalescingWriter{
+		ResponseWriter: w,
+		srv:            srv,
+		key:            key,
+		cq:             cq,
+		leader:         r.Context(),
+		cancel:         cancel,
+		preset:         slices.Collect(maps.Keys(w.Header())),
+		resp:           &coalescedResponse{},
+	}
+	err := srv.executeQuery(cw, r.WithContext(ctx), query, args...)
+	cw.finish(err)
+	return cw.resp, err
+}
+
+// coalescingWriter is a http.ResponseWriter of the first request of a shared
+// execution, which copies the response for waiters.
+type coalescingWriter struct {
+	http.ResponseWriter
+	srv    *Server
+	key    string
+	cq     *coalescedQuery
+	leader context.Context
+	cancel context.CancelFunc
+	// preset are names of headers set before the execution, which aren't
+	// replayed to waiters.
+	preset []string
+	resp   *coalescedResponse
+
+	started   bool
+	buffering bool
+}
+
+// start starts buffering the response when there are waiters. Otherwise it
+// stops sharing the execution, so that identical queries after it execute
+// by themselves, and the execution is canceled by the first request
+// leaving.
+func (cw *coalescingWriter) start() {
+	if cw.started {
+		return
+	}
+	cw.started = true
+	cw.srv.coalesceMu.Lock()
+	defer cw.srv.coalesceMu.Unlock()
+	waiters := cw.cq.requests
+	if cw.leader.Err() == nil {
+		// The first request is counted until it leaves.
+		waiters--
+	}
+	cw.buffering = waiters > 0
+	if cw.buffering {
+		cw.Header().Set(CoalescedHeader, "true")
+		return
+	}
+	cw.srv.coalesceGroup.Forget(cw.key)
+	cw.cq.cancel = nil
+	context.AfterFunc(cw.leader, cw.cancel)
+}
+
+func (cw *coalescingWriter) WriteHeader(status int) {
+	cw.start()
+	if cw.buffering && cw.resp.status == 0 && status >= 200 {
+		// Informational responses like 100 Continue aren't replayed.
+		cw.resp.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *coalescingWriter) Write(b []byte) (int, error) {
+	cw.start()
+	if !cw.buffering {
+		return cw.ResponseWriter.Write(b)
+	}
+	if cw.resp.body.Len()+len(b) > maxCoalescedSize {
+		// The waiters execute the query by themselves.
+		cw.buffering = false
+		cw.resp.body = bytes.Buffer{}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.resp.status = cmp.Or(cw.resp.status, 200)
+	cw.resp.body.Write(b)
+	// The response continues for waiters even if the first request has left.
+	cw.ResponseWriter.Write(b)
+	return len(b), nil
+}
+
+func (cw *coalescingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// finish completes the response for waiters with the result of the
+// execution.
+func (cw *coalescingWriter) finish(err error) {
+	cw.start()
+	if !cw.buffering {
+		return
+	}
+	cw.resp.buffered = true
+	cw.resp.header = http.Header{}
+	for name, values := range cw.Header() {
+		if !slices.Contains(cw.preset, name) {
+			cw.resp.header[name] = slices.Clone(values)
+		}
+	}
+	cw.resp.err = err
+}
+
+// replay writes the response to w. Headers already set to w, like the
+// connection ID, take precedence, and trailers are written as headers because
+// the body is complete.
+func (resp *coalescedResponse) replay(w http.ResponseWriter) error {
+	h := w.Header()
+	for name, values := range resp.header {
+		if _, ok := h[name]; ok || name == "Trailer" {
+			continue
+		}
+		h[name] = slices.Clone(values)
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+	w.WriteHeader(cmp.Or(resp.status, 200))
+	_, err := w.Write(resp.body.Bytes())
+	return err
+}
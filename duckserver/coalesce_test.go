@@ -0,0 +1,174 @@
+package duckserver_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestCoalesceQueries(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBStrategy = "shared"
+		c.CoalesceQueries = true
+		return c
+	})
+	// Identical queries in flight on the shared DB share an execution.
+	const query = `SELECT count(*) AS C FROM range(50000000) t(i) WHERE i % 7 = 0`
+	const n = 4
+	var wg sync.WaitGroup
+	var start sync.WaitGroup
+	start.Add(1)
+	results := make([]string, n)
+	coalesced := make([]string, n)
+	for i := range n {
+		wg.Go(func() {
+			start.Wait()
+			resp, err := doPost(ts, "/?f=csv", query)
+			got, err := readResponse(resp, err)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = got
+			coalesced[i] = resp.Header.Get(duckserver.CoalescedHeader)
+		})
+	}
+	start.Done()
+	wg.Wait()
+	for i := range n {
+		assert.Equal(t, "C\n7142858\n", results[i])
+		assert.Equal(t, "true", coalesced[i])
+	}
+
+	// A query alone isn't coalesced nor buffered, and sends trailers.
+	resp, err := doPost(ts, "/?f=csv", `SELECT 1 AS N`)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "N\n1\n", got)
+	assert.Equal(t, "", resp.Header.Get(duckserver.CoalescedHeader))
+	assert.Equal(t, "1", resp.Trailer.Get(duckserver.RowCountHeader))
+
+	// Writing queries are never coalesced, even with WITH.
+	testQuery0(t, ts, `CREATE TABLE t (N BIGINT)`, "Count\n")
+	const insert = `WITH a AS (SELECT count(*) AS N FROM range(50000000) t(i) WHERE i % 7 = 0) INSERT INTO t SELECT N FROM a`
+	start.Add(1)
+	for i := range n {
+		wg.Go(func() {
+			start.Wait()
+			resp, err := doPost(ts, "/?f=csv", insert)
+			got, err := readResponse(resp, err)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = got
+			coalesced[i] = resp.Header.Get(duckserver.CoalescedHeader)
+		})
+	}
+	start.Done()
+	wg.Wait()
+	for i := range n {
+		assert.Equal(t, "Count\n1\n", results[i])
+		assert.Equal(t, "", coalesced[i])
+	}
+	testQuery0(t, ts, `SELECT count(*) AS C FROM t`, fmt.Sprintf("C\n%d\n", n))
+}
+
+func TestCoalesceQueriesTenant(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AuthnFile = "testdata/authn.json"
+		c.DBStrategy = "authn"
+		c.CoalesceQueries = true
+		return c
+	})
+	// Identical queries of a tenant share an execution across TCP
+	// connections, but ones of other tenants don't.
+	const query = `SELECT count(*) AS C FROM range(50000000) t(i) WHERE i % 7 = 0`
+	tokens := []string{"token-0123456789abcdef", "token-0123456789abcdef", "foobarbaz"}
+	var wg sync.WaitGroup
+	var start sync.WaitGroup
+	start.Add(1)
+	results := make([]string, len(tokens))
+	coalesced := make([]string, len(tokens))
+	for i, token := range tokens {
+		client := &http.Client{Transport: &http.Transport{}}
+		t.Cleanup(client.CloseIdleConnections)
+		wg.Go(func() {
+			start.Wait()
+			req, err := http.NewRequest("POST", ts.URL+"/?f=csv", strings.NewReader(query))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			authorizationBearer(token)(req)
+			resp, err := client.Do(req)
+			got, err := readResponse(resp, err)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = got
+			coalesced[i] = resp.Header.Get(duckserver.CoalescedHeader)
+		})
+	}
+	start.Done()
+	wg.Wait()
+	for i := range tokens {
+		assert.Equal(t, "C\n7142858\n", results[i])
+	}
+	assert.Equal(t, []string{"true", "true", ""}, coalesced)
+}
+
+func TestCoalesceQueriesLeaderLeaves(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBStrategy = "shared"
+		c.CoalesceQueries = true
+		return c
+	})
+	// The execution continues for a waiter after the first request leaves.
+	const query = `SELECT count(*) AS C FROM range(300000000) t(i) WHERE i % 7 = 0`
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leader := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(leader.CloseIdleConnections)
+	go func() {
+		req, err := http.NewRequestWithContext(ctx, "POST", ts.URL+"/?f=csv", strings.NewReader(query))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if resp, err := leader.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	other := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(other.CloseIdleConnections)
+	resp, err := other.Post(ts.URL+"/?f=csv", "text/plain", strings.NewReader(query))
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "C\n42857143\n", got)
+	assert.Equal(t, "true", resp.Header.Get(duckserver.CoalescedHeader))
+}
+
+func TestCoalesceQueriesConnection(t *testing.T) {
+	c := duckserver.DefaultConfig()
+	c.CoalesceQueries = true
+	_, err := duckserver.New(c)
+	if err == nil {
+		t.Fatal("New should fail with connection strategy")
+	}
+	assert.Equal(t, `coalescing queries needs a DB strategy other than "connection"`, err.Error())
+}
@@ -0,0 +1,46 @@
+package duckserver
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// projectColumns makes the rows emit only the columns listed in ColumnsHeader,
+// in the order of the header. It responds 400 when a column isn't found in the
+// result.
+func projectColumns(r *http.Request, pr *peekRows) error {
+	s := r.Header.Get(ColumnsHeader)
+	if s == "" || pr.err != nil {
+		return nil
+	}
+	names := strings.Split(s, ",")
+	projection := make([]int, len(names))
+	columnTypes := make([]*sql.ColumnType, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		idx := slices.IndexFunc(pr.columnTypes, func(typ *sql.ColumnType) bool {
+			return typ.Name() == name
+		})
+		if idx < 0 {
+			return httperror.Newf(400, "Column of %s not found in the result: %q", ColumnsHeader, name)
+		}
+		if slices.Contains(projection[:i], idx) {
+			return httperror.Newf(400, "Column of %s is duplicated: %q", ColumnsHeader, name)
+		}
+		projection[i] = idx
+		columnTypes[i] = pr.columnTypes[idx]
+	}
+	// Values of the other columns are scanned and discarded.
+	dests := make([]any, len(pr.columnTypes))
+	for i := range dests {
+		dests[i] = new(any)
+	}
+	pr.columnTypes = columnTypes
+	pr.projection = projection
+	pr.dests = dests
+	return nil
+}
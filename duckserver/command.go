@@ -0,0 +1,54 @@
+package duckserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// ackStatements are types of statements which never return rows, responded
+// with CommandAck when CommandResult is "ack". PRAGMA and CALL are excluded,
+// because some of them return rows.
+var ackStatements = []string{
+	"SET", "RESET", "CHECKPOINT", "INSTALL", "LOAD", "ATTACH", "DETACH",
+	"USE", "VACUUM", "BEGIN", "COMMIT", "ROLLBACK", "CREATE", "DROP", "ALTER",
+}
+
+// CommandAck is the response of a statement which returns no rows, instead of
+// an empty result.
+type CommandAck struct {
+	Status       string `json:"status"`
+	Command      string `json:"command"`
+	RowsAffected int64  `json:"rows_affected,omitempty"`
+}
+
+// ackCommand returns the type of the last statement of the query when it is
+// one of ackStatements and CommandResult is "ack", or "" otherwise.
+func (srv *Server) ackCommand(query string) string {
+	if srv.config.CommandResult != "ack" {
+		return ""
+	}
+	stmts := sqltext.Statements(query)
+	if len(stmts) == 0 {
+		return ""
+	}
+	t := sqltext.StatementType(stmts[len(stmts)-1])
+	if !slices.Contains(ackStatements, t) {
+		return ""
+	}
+	return t
+}
+
+// writeCommandAck responds the result of a statement executed by ExecContext.
+func writeCommandAck(w http.ResponseWriter, command string, result sql.Result) error {
+	ack := CommandAck{Status: "ok", Command: command}
+	if n, err := result.RowsAffected(); err == nil {
+		ack.RowsAffected = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(ack)
+}
@@ -0,0 +1,94 @@
+package duckserver
+
+import (
+	"archive/zip"
+	"database/sql"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/conndb"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// connectionDB returns the open DB of the connection, or nil when it has no
+// DBs.
+func (srv *Server) connectionDB(id conndb.ID) *sql.DB {
+	for dbID, db := range srv.connManager.Databases() {
+		if dbID == id {
+			return db
+		}
+	}
+	return nil
+}
+
+// handleExportConnection snapshots the DB of a connection with EXPORT DATABASE
+// to a temporary directory, and responds the directory as a zip archive. The
+// directory is removed after the response. "format" query parameter is
+// "parquet" (default) or "csv".
+func (srv *Server) handleExportConnection(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	// The temporary directory isn't one of allowed_directories.
+	if !srv.dbSettings.EnableExternalAccess {
+		return httperror.Newf(403, "External access is disabled")
+	}
+	id, err := conndb.ParseID(r.PathValue("connID"))
+	if err != nil {
+		return httperror.Newf(400, "ID syntax error: %s", err)
+	}
+	format := "parquet"
+	if s := r.URL.Query().Get("format"); s != "" {
+		format = strings.ToLower(s)
+	}
+	if format != "parquet" && format != "csv" {
+		return httperror.Newf(400, "Unsupported file format: %q", format)
+	}
+	db := srv.connectionDB(id)
+	if db == nil {
+		return httperror.New(404)
+	}
+
+	if err := os.MkdirAll(srv.dbSettings.TempDir, 0700); err != nil {
+		return err
+	}
+	// The prefix lets removeStaleTempFiles remove the directory left by a
+	// terminated process.
+	dir, err := os.MkdirTemp(srv.dbSettings.TempDir, tempFilePrefix+"export-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			srv.logger.Warn("failed to remove export directory", "dir", dir, "error", err)
+		}
+	}()
+
+	// Another connection of the DB doesn't wait for queries of the client.
+	ctx := r.Context()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return srv.queryError(w, 500, "DB error", err)
+	}
+	defer conn.Close()
+	query := "EXPORT DATABASE " + sqltext.QuoteString(dir) + " (FORMAT " + strings.ToUpper(format) + ")"
+	auditlog.SetQuery(w, query)
+	q := srv.queryDatabase.Add(ctx, id, query)
+	w.Header().Set(QueryIDHeader, q.ID.String())
+	defer q.Close()
+	if _, err := conn.ExecContext(q.Context(), query); err != nil {
+		return srv.executionError(w, err)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+id.String()+`.zip"`)
+	w.WriteHeader(200)
+	zw := zip.NewWriter(w)
+	if err := zw.AddFS(os.DirFS(dir)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
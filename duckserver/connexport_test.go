@@ -0,0 +1,110 @@
+package duckserver_test
+
+import (
+	"archive/zip"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestExportConnection(t *testing.T) {
+	ts := startServer0(t)
+	rh := testQuery0(t, ts, `CREATE TABLE items AS SELECT i, 'v' || i AS s FROM range(3) t(i)`, "Count\n3\n")
+
+	t.Run("csv", func(t *testing.T) {
+		resp, err := doPost(ts, "/status/connections/"+rh.ConnectionID+"/export?format=csv", "")
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="`+rh.ConnectionID+`.zip"`, resp.Header.Get("Content-Disposition"))
+		zr, err := zip.NewReader(strings.NewReader(got), int64(len(got)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = string(b)
+		}
+		for _, name := range []string{"schema.sql", "load.sql"} {
+			if _, ok := files[name]; !ok {
+				t.Errorf("no %s in the archive: %v", name, slices.Sorted(maps.Keys(files)))
+			}
+		}
+		if !strings.Contains(files["schema.sql"], "CREATE TABLE items") {
+			t.Errorf("unexpected schema.sql: %q", files["schema.sql"])
+		}
+		data, ok := files["items.csv"]
+		if !ok {
+			t.Fatalf("no items.csv in the archive: %v", slices.Sorted(maps.Keys(files)))
+		}
+		assert.Equal(t, "i,s\n0,v0\n1,v1\n2,v2\n", data)
+	})
+
+	t.Run("parquet", func(t *testing.T) {
+		resp, err := doPost(ts, "/status/connections/"+rh.ConnectionID+"/export", "")
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(strings.NewReader(got), int64(len(got)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		if !slices.Contains(names, "items.parquet") {
+			t.Errorf("no items.parquet in the archive: %v", names)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			path   string
+			status int
+		}{
+			{"/status/connections/" + rh.ConnectionID + "/export?format=json", 400},
+			{"/status/connections/C_00000000/export", 404},
+		} {
+			resp, err := doPost(ts, tc.path, "")
+			if _, err := readResponse2(resp, err, tc.status, tc.status); err != nil {
+				t.Errorf("%s: %s", tc.path, err)
+			}
+		}
+	})
+}
+
+func TestExportConnectionAdmin(t *testing.T) {
+	ts := startServer1(t, configAuthn("testdata/authn.json", false))
+	rh := testQuery1(t, ts, `SELECT 1 AS A`, "A\n1\n", authorizationBearer("token-0123456789abcdef"))
+	path := "/status/connections/" + rh.ConnectionID + "/export"
+	resp, err := doPost(ts, path, "", authorizationBearer("token-0123456789abcdef"))
+	if _, err := readResponse2(resp, err, 403, 403); err != nil {
+		t.Error(err)
+	}
+	resp, err = doPost(ts, path, "")
+	if _, err := readResponse2(resp, err, 401, 401); err != nil {
+		t.Error(err)
+	}
+	resp, err = doPost(ts, path, "", authorizationBearer("token-admin1"))
+	if _, err := readResponse(resp, err); err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+}
@@ -0,0 +1,59 @@
+package duckserver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+)
+
+// dataVersion returns a token of the version of data, which changes when
+// DataVersion, sizes or modification times of DataVersionFiles change, or
+// writing queries are executed. It returns "" when versioning is disabled.
+func (srv *Server) dataVersion() string {
+	c := srv.config
+	if c.DataVersion == "" && len(c.DataVersionFiles) == 0 {
+		return ""
+	}
+	h := fnv.New64a()
+	io.WriteString(h, c.DataVersion)
+	for _, name := range c.DataVersionFiles {
+		fi, err := os.Stat(name)
+		if err != nil {
+			fmt.Fprintf(h, "\x00%s:-", name)
+			continue
+		}
+		fmt.Fprintf(h, "\x00%s:%d:%d", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	fmt.Fprintf(h, "\x00%d", srv.dataGeneration.Load())
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// checkDataVersion sets DataVersionHeader, and responds 304 for a read-only
+// query when IfDataVersionHeader of the request matches it. It reports
+// whether the response is written.
+func (srv *Server) checkDataVersion(w http.ResponseWriter, r *http.Request, query string) bool {
+	v := srv.dataVersion()
+	if v == "" {
+		return false
+	}
+	w.Header().Set(DataVersionHeader, v)
+	if r.Header.Get(IfDataVersionHeader) != v || writingStatement(query) != "" {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// dataChanged bumps the version of data when the executed query writes, like
+// INSERT or ATTACH.
+func (srv *Server) dataChanged(w http.ResponseWriter, query string) {
+	if writingStatement(query) == "" {
+		return
+	}
+	srv.dataGeneration.Add(1)
+	if v := srv.dataVersion(); v != "" && w != nil {
+		w.Header().Set(DataVersionHeader, v)
+	}
+}
@@ -0,0 +1,80 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// DiffRequest is a request to compare results of two queries.
+type DiffRequest struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+// handleDiff responds rows which are in the result of one query but not in the
+// other, with "side" column of "left" or "right" in front, in the format
+// requested as the query end point. Duplicated rows are compared by their
+// counts with EXCEPT ALL.
+func (srv *Server) handleDiff(w http.ResponseWriter, r *http.Request) (retErr error) {
+	defer srv.recoverPanic(w, &retErr)
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	var req DiffRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return httperror.Newf(400, "Invalid diff request: %s", err)
+	}
+	left, ok := asSubquery(req.Left)
+	if !ok {
+		return httperror.Newf(400, "Left of diff needs a single query like SELECT")
+	}
+	right, ok := asSubquery(req.Right)
+	if !ok {
+		return httperror.Newf(400, "Right of diff needs a single query like SELECT")
+	}
+	query := "SELECT 'left' AS side, * FROM (" + left + " EXCEPT ALL " + right + ")\n" +
+		"UNION ALL\n" +
+		"SELECT 'right' AS side, * FROM (" + right + " EXCEPT ALL " + left + ")"
+	auditlog.SetQuery(w, query)
+	if err := srv.checkFileReads(r, query); err != nil {
+		return err
+	}
+	if err := srv.checkExtensions(r, query); err != nil {
+		return err
+	}
+
+	client, conn, err := srv.clientConn(w, r)
+	if err != nil {
+		return err
+	}
+	unlock, err := srv.lockQuery(r, client)
+	if err != nil {
+		return err
+	}
+	leftColumns, err := resultColumns(r.Context(), conn, left)
+	if err != nil {
+		unlock()
+		return srv.executionError(w, err)
+	}
+	rightColumns, err := resultColumns(r.Context(), conn, right)
+	// executeQuery locks again for the diff.
+	unlock()
+	if err != nil {
+		return srv.executionError(w, err)
+	}
+	if len(leftColumns) != len(rightColumns) {
+		return httperror.Newf(400, "Numbers of columns of diff don't match: left %d, right %d", len(leftColumns), len(rightColumns))
+	}
+	return srv.executeQuery(w, r, query)
+}
@@ -0,0 +1,40 @@
+package duckserver_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestDiff(t *testing.T) {
+	ts := startServer0(t)
+	testQuery0(t, ts, `CREATE TABLE t1 AS FROM (VALUES (1, 'a'), (2, 'b'), (2, 'b'), (3, 'c')) t(id, name)`, "Count\n4\n")
+	testQuery0(t, ts, `CREATE TABLE t2 AS FROM (VALUES (2, 'b'), (3, 'c'), (4, 'd')) t(id, name)`, "Count\n3\n")
+
+	got, err := readResponse(doPost(ts, "/diff/?f=csv", `{"left":"SELECT * FROM t1","right":"FROM t2;"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The order of rows isn't specified.
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	slices.Sort(lines[1:])
+	assert.Equal(t, []string{"side,id,name", "left,1,a", "left,2,b", "right,4,d"}, lines)
+
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{`{"left":"SELECT * FROM t1","right":"SELECT id FROM t2"}`, "Numbers of columns of diff don't match: left 2, right 1\n"},
+		{`{"left":"SELECT 1; SELECT 2","right":"SELECT 1"}`, "Left of diff needs a single query like SELECT\n"},
+		{`{"left":"SELECT 1","right":"DROP TABLE t2"}`, "Right of diff needs a single query like SELECT\n"},
+	} {
+		resp, err := doPost(ts, "/diff/?f=csv", tc.body)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+	}
+}
@@ -0,0 +1,46 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// DrainStatus is the draining state of the server.
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+}
+
+// handleDrain starts draining without shutting down the server, so that load
+// balancers take it out of the pool while running queries finish.
+func (srv *Server) handleDrain(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	if prev := srv.draining.Swap(true); !prev {
+		srv.logger.Info("draining by request")
+	}
+	return writeDrainStatus(w, true)
+}
+
+// handleUndrain stops draining started by handleDrain. Draining for the
+// shutdown can't be stopped.
+func (srv *Server) handleUndrain(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	if srv.shuttingDown.Load() {
+		return httperror.Newf(409, "Server is shutting down")
+	}
+	if prev := srv.draining.Swap(false); prev {
+		srv.logger.Info("undrained by request")
+	}
+	return writeDrainStatus(w, false)
+}
+
+func writeDrainStatus(w http.ResponseWriter, draining bool) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(DrainStatus{Draining: draining})
+}
@@ -0,0 +1,60 @@
+package duckserver_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestDrain(t *testing.T) {
+	ts := startServer0(t)
+	drain := func(path string, want bool) {
+		t.Helper()
+		got, err := readResponse(doPost(ts, path, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status duckserver.DrainStatus
+		if err := json.Unmarshal([]byte(got), &status); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, status.Draining)
+	}
+	readStatus := func() duckserver.Status {
+		t.Helper()
+		got, err := readResponse(doGet(ts, "/status/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status duckserver.Status
+		if err := json.Unmarshal([]byte(got), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	drain("/status/drain", true)
+	assert.Equal(t, true, readStatus().Draining)
+	for _, path := range []string{"/ping/", "/?q=SELECT+1"} {
+		resp, err := doGet(ts, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, true, resp.Close)
+		got, err := readResponse2(resp, err, 503, 503)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Server is draining\n", got)
+	}
+
+	// The server resumes without restarting.
+	drain("/status/undrain", false)
+	assert.Equal(t, false, readStatus().Draining)
+	testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+	if _, err := readResponse(doGet(ts, "/ping/")); err != nil {
+		t.Error(err)
+	}
+}
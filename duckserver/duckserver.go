@@ -2,6 +2,8 @@
 package duckserver
 
 import (
+	"cmp"
+	"compress/gzip"
 	"context"
 	"database/sql"
 	"encoding/json"
@@ -10,14 +12,21 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"math/rand/v2"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,20 +35,44 @@ import (
 	"github.com/koron-go/daemonic/hupfile"
 	"github.com/koron-go/daemonic/pidfile"
 	"github.com/koron/duckpop/internal/accesslog"
+	"github.com/koron/duckpop/internal/auditlog"
 	"github.com/koron/duckpop/internal/authn"
 	"github.com/koron/duckpop/internal/conndb"
 	"github.com/koron/duckpop/internal/duckdbinit"
 	"github.com/koron/duckpop/internal/fileserver"
 	"github.com/koron/duckpop/internal/formatter"
+	csvformatter "github.com/koron/duckpop/internal/formatter/csv"
 	"github.com/koron/duckpop/internal/httperror"
 	"github.com/koron/duckpop/internal/querydb"
+	"github.com/koron/duckpop/internal/sqltext"
+	"github.com/koron/duckpop/internal/syncmap"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	AuthnIDHeader      = "Duckpop-Authnid"
-	ConnectionIDHeader = "Duckpop-Connectionid"
-	QueryIDHeader      = "Duckpop-Queryid"
-	DurationHeader     = "Duckpop-Duration"
+	AuthnIDHeader       = "Duckpop-Authnid"
+	ConnectionIDHeader  = "Duckpop-Connectionid"
+	QueryIDHeader       = "Duckpop-Queryid"
+	DurationHeader      = "Duckpop-Duration"
+	RowCountHeader      = "Duckpop-Rowcount"
+	EmptyResultHeader   = "Duckpop-Emptyresult"
+	NoCostLimitHeader   = "Duckpop-Nocostlimit"
+	ErrorIDHeader       = "Duckpop-Errorid"
+	ErrorHeader         = "Duckpop-Error"
+	KeepSessionHeader   = "Duckpop-Keepsession"
+	AutoLimitedHeader   = "Duckpop-Autolimited"
+	EstimatedRowsHeader = "Duckpop-Estimatedrows"
+	ColumnsHeader       = "Duckpop-Columns"
+	QueryTagHeader      = "Duckpop-Querytag"
+	DataVersionHeader   = "Duckpop-Dataversion"
+	IfDataVersionHeader = "Duckpop-Ifdataversion"
+	ReadOnlyHeader      = "Duckpop-Readonly"
+	ResultHashHeader    = "Duckpop-Resulthash"
+	TimeoutHeader       = "Duckpop-Timeout"
+
+	MaxResponseSizeHeader = "Duckpop-Maxresponsesize"
+	TruncatedHeader       = "Duckpop-Truncated"
+	CoalescedHeader       = "Duckpop-Coalesced"
 
 	defaultFormat = "csv"
 )
@@ -53,23 +86,304 @@ type Config struct {
 	EnablePprof    bool
 
 	Address string
-	MaxDB   int
+	// AdminAddress is the address to host admin end points like /config/,
+	// /status/, /metrics and /debug/pprof/, which are removed from Address.
+	// Empty hosts them at Address.
+	AdminAddress string
+	MaxDB        int
+
+	// MaxStatements is the maximum number of statements in a request, or in
+	// each query of a batch. Statements are counted after stripping comments.
+	// Zero means unlimited.
+	MaxStatements int
+
+	// MaxColumns is the maximum number of columns in a result, which is
+	// checked before buffers for rows are allocated. Zero means unlimited.
+	MaxColumns int
+
+	// QueryTimeout cancels a query which runs longer than this, and responds
+	// 504. DuckDB is interrupted by the driver on the cancellation. Zero
+	// means no timeouts.
+	QueryTimeout time.Duration
+
+	// TimeoutHeader is the name of a standard header which requests the
+	// timeout of a query, like "X-Request-Timeout". It is used when
+	// "Duckpop-Timeout" header isn't given. Empty disables it.
+	TimeoutHeader string
+
+	// CoalesceQueries makes identical read-only queries in flight on the
+	// same DB share an execution. The first query streams the result, which
+	// is buffered up to 16MiB and responded to the others with
+	// CoalescedHeader. It needs DBStrategy other than "connection", because
+	// the DB of a connection isn't shared.
+	CoalesceQueries bool
+
+	// AutoLimit appends "LIMIT N" to a query of a request which is a single
+	// SELECT without LIMIT at the top level, to protect consoles from huge
+	// results. Zero disables it.
+	AutoLimit int
+
+	// ConnIDFormat is the format of connection IDs: "hex" or "uuid". "uuid"
+	// is UUID version 7, which includes the timestamp.
+	ConnIDFormat string
+
+	// MaxKeepSession is the upper bound of durations requested with
+	// KeepSessionHeader, to keep the DB of a connection after it is closed.
+	// Zero disables it.
+	MaxKeepSession time.Duration
+
+	// IdleTransactionTimeout rolls back a transaction which a client left
+	// open across requests after it is idle for this duration. The next query
+	// of the client is rejected to tell it. Zero disables it.
+	IdleTransactionTimeout time.Duration
+
+	// BatchParallel is the maximum number of queries executed concurrently
+	// in a batch request with "parallel=true".
+	BatchParallel int
+
+	// Workers is the maximum number of queries executed and serialized at
+	// once across all connections, which keeps goroutines and threads of cgo
+	// predictable. A query waits for a worker up to WorkerWait, then it is
+	// rejected with 503. Zero means unlimited.
+	Workers    int
+	WorkerWait time.Duration
+
+	// MaxBodySize is the maximum size of a request body in bytes, which is
+	// applied after decompression of "Content-Encoding: gzip". Zero means
+	// unlimited.
+	MaxBodySize int64
+
+	// MaxEmbedSize is the maximum size in bytes of a result embedded as a
+	// data URI with "embed=1", which is buffered fully before encoding. Zero
+	// disables embedding.
+	MaxEmbedSize int64
+
+	// MaxResponseSize is the maximum size in bytes of a streamed result,
+	// counted before compression. A result exceeding it is truncated, and
+	// told by TruncatedHeader and ErrorHeader trailers. Zero means
+	// unlimited.
+	MaxResponseSize int64
+
+	// FlushRows and FlushInterval determine when the response is flushed
+	// while writing rows: after the number of rows or the interval, whichever
+	// comes first. Zero disables each of them.
+	FlushRows     int
+	FlushInterval time.Duration
+
+	// DefaultFormat is the format used when a request doesn't specify it. It
+	// can have parameters like "json,envelope".
+	DefaultFormat string
+
+	// JSONBigIntAsString writes 64-bit or larger integers as strings in JSON
+	// by default, as "bigint:string" parameter of the format.
+	JSONBigIntAsString bool
+
+	// JSONNonFinite is how to write NaN and infinities of floats in JSON,
+	// which can't represent them: "null", "string" like "NaN", or "error"
+	// which responds 422, or terminates the response as an error when it is
+	// found after the status is sent.
+	JSONNonFinite string
+
+	// CSVDelimiter and CSVTerminator are the separators of fields and
+	// records of CSV by default, as "delimiter" and "terminator" parameters
+	// of the format. They are written with escape sequences like `\x1e`.
+	CSVDelimiter  string
+	CSVTerminator string
+	// CSVNewline is the policy for CR and LF in fields of CSV by default, as
+	// "newline" parameter: "quote" as RFC 4180, "strip" to spaces or "escape"
+	// to `\n`.
+	CSVNewline string
+
+	// DrainDelay is the time to keep serving after receiving a signal to
+	// shut down, while queries and pings are rejected with 503, so that load
+	// balancers stop routing traffic before the listener is closed.
+	DrainDelay time.Duration
+
+	// ReadOnly starts the server in read-only mode for maintenance, which
+	// rejects statements other than queries like SELECT with 503. It can be
+	// switched at runtime with "/status/maintenance".
+	ReadOnly bool
+
+	// RetryAfter is the time for clients to wait before retrying requests
+	// rejected by limits like MaxDB, DrainDelay and ReadOnly, which is sent
+	// as Retry-After header in seconds.
+	RetryAfter time.Duration
+
+	// EmptyResultStatus is the status code for a query which results no
+	// rows: 200 or 204. The body is omitted with 204.
+	EmptyResultStatus int
+
+	// UnsupportedType is how to handle columns of types which writers can't
+	// represent: "stringify" writes them as best effort, "error" responds
+	// 422, and "cast" executes the query rewritten to cast them to VARCHAR,
+	// finding them by the query with LIMIT 0 without executing it.
+	UnsupportedType string
+
+	// DuplicateColumn is how to handle duplicated names of columns, which
+	// collide in keys of JSON objects: "keep" writes them as they are,
+	// "suffix" renames them like "name_2" in JSON and CSV, and "error"
+	// responds 422.
+	DuplicateColumn string
+
+	// CommandResult is how to respond statements which return no rows, like
+	// SET or CREATE: "rows" responds the result of DuckDB as is, and "ack"
+	// executes them without results and responds CommandAck in JSON.
+	CommandResult string
+
+	// PingPath is the path of the health check (ping) end point. Empty
+	// disables the end point.
+	PingPath string
+
+	// MetricsInterval is the interval to collect metrics of DuckDB engines
+	// for "/metrics". Zero disables the collection.
+	MetricsInterval time.Duration
+
+	// MetricsMaxTags is the maximum number of distinct tags of QueryTagHeader
+	// in metrics of queries, not counting "untagged" and "other". Tags beyond it
+	// are counted as "other".
+	MetricsMaxTags int
+
+	// LogLevel is the minimum level of server logs: "debug", "info", "warn"
+	// or "error". EnableDebugLog overrides it with "debug".
+	LogLevel string
+
+	// LogFile is the file to write server logs, reopened on SIGHUP. Empty
+	// writes them to stderr.
+	LogFile string
 
 	PIDFile         string
 	AccessLogFile   string
 	AccessLogFormat string
 
+	// AccessLogRedact masks string literals of queries in access logs.
+	// Audit logs always record the full queries.
+	AccessLogRedact bool
+
+	// AuditLogFile is the file to write audit logs of queries in JSON lines.
+	// Empty disables audit logs.
+	AuditLogFile string
+
+	// ErrorDetail is verbosity of query errors returned to clients: "full",
+	// "message" or "generic".
+	ErrorDetail string
+
 	AuthnFile string
 	NoAuthz   bool
 
+	// NoGetQuery rejects queries by GET and HEAD with 405, so that queries
+	// are not left in URLs of access logs, proxies and browser histories.
+	NoGetQuery bool
+
+	// TemplateFile is a JSON file which maps names to query templates, which
+	// are invoked with "POST /q/{name}". Empty disables templates.
+	TemplateFile string
+
+	// ScriptDir is a directory of SQL scripts "{name}.sql", which are
+	// executed with "POST /script/{name}". Empty disables scripts.
+	ScriptDir string
+
+	// FileReadPrefixes restricts paths read by table functions like read_csv
+	// in queries to ones under one of them. Local prefixes are compared by
+	// directories after being made absolute, and URL ones as strings.
+	// Rejected reads are logged. The check inspects literals in queries, so it is best-effort
+	// and complements allowed_directories of DuckDB. Empty disables it.
+	FileReadPrefixes []string
+
+	// AllowedExtensions restricts extensions installed or loaded by INSTALL
+	// and LOAD statements in queries to the listed names. Rejected
+	// statements are logged. DBInitQuery is not restricted. Empty disables
+	// it.
+	AllowedExtensions []string
+
+	// DataVersion and DataVersionFiles enable DataVersionHeader, which is a
+	// token derived from DataVersion, sizes and modification times of
+	// DataVersionFiles, and the count of writing queries. Read-only queries
+	// of requests with IfDataVersionHeader of the current token get 304.
+	DataVersion      string
+	DataVersionFiles []string
+
 	DBHomeDir        string
 	DBThreads        int
 	DBMemoryLimit    string
 	DBMaxTempDirSize string
+
+	// DBTempDirPerConn makes each DB use a dedicated sub directory of the
+	// temporary directory, which is removed on close. It makes
+	// DBMaxTempDirSize a limit per DB.
+	DBTempDirPerConn bool
+
 	DBExternalAccess bool
 	DBLockConfig     bool
 	DBInitQuery      string
 
+	// DBGlobViews maps names to globs of files like "/data/events/*.parquet",
+	// which are created as views in each DB before DBInitQuery. Formats are
+	// guessed from extensions of the globs.
+	DBGlobViews map[string]string
+
+	// DBPreludeFile is a file of SQL like "CREATE MACRO ...", which is
+	// executed in each DB after DBInitQuery, so that helper macros are
+	// always available. Empty disables it.
+	DBPreludeFile string
+
+	// DBProgressBar enables the progress bar of DuckDB, which is disabled by
+	// default to keep the output of the server clean.
+	DBProgressBar bool
+
+	// DBWarmupQuery is executed on the DB checked at startup, which is
+	// closed after it, to validate that the data is readable and populate
+	// caches out of DuckDB, like the page cache of the OS. DBs opened for
+	// clients don't share its state, see DBSpares to open them in advance.
+	// Startup fails when it causes an error.
+	DBWarmupQuery string
+
+	// DBSkipStartupCheck skips checking at startup that the DuckDB library
+	// works and a DB can be opened with the settings. DBWarmupQuery is still
+	// executed if given.
+	DBSkipStartupCheck bool
+
+	// DBQueryMemoryLimit caps the memory used by a query, which should be
+	// stricter than DBMemoryLimit. Empty means no caps.
+	DBQueryMemoryLimit string
+
+	// DBMaxEstimatedRows rejects queries whose estimated rows by EXPLAIN
+	// exceed it, before executing them. Zero means no limits.
+	DBMaxEstimatedRows int64
+
+	// DBMaxIdleConns and DBMaxOpenConns tune the connection pool of each DB.
+	DBMaxIdleConns int
+	DBMaxOpenConns int
+
+	// DBResetBetweenQueries drops temporary objects after each query, so
+	// each query starts with a clean session on a warm DB.
+	DBResetBetweenQueries bool
+
+	// DBConcurrentQueries allows queries of a connection to run on its DB
+	// concurrently, which are serialized by default because they share a
+	// dedicated connection of DuckDB.
+	DBConcurrentQueries bool
+
+	// DBMode determines the storage of each DB which isn't backed by a
+	// tenant file: "memory" or "tempfile". "tempfile" makes a DB backed by a
+	// file in the temporary directory, which is removed on close.
+	DBMode string
+
+	// DBStrategy determines the unit to which a DB is assigned: "connection",
+	// "authn", "shared" which is a DB for all requests, or "pooled" which
+	// hands out DBPoolSize DBs to requests in round robin.
+	DBStrategy string
+	// DBTenantFile makes each DB of strategies other than "connection" backed
+	// by a file "tenant-{ID}.duckdb" in DBHomeDir, where ID is the authn ID,
+	// "shared", or "pool-N".
+	DBTenantFile bool
+	// DBPoolSize is the number of DBs of "pooled" strategy.
+	DBPoolSize int
+	// DBSpares is the number of DBs of "connection" strategy opened at
+	// startup and after they are taken, so that the first query of a
+	// connection doesn't wait for opening its DB. Connections with the init
+	// query of an authentication entry don't take them.
+	DBSpares int
+
 	UIResourceFS fs.FS
 }
 
@@ -83,15 +397,41 @@ func getwd() string {
 
 func DefaultConfig() Config {
 	return Config{
-		Address:          "localhost:9281",
-		MaxDB:            20,
-		AccessLogFormat:  "text",
-		DBHomeDir:        filepath.Join(getwd(), ".duckpop"),
-		DBThreads:        1,
-		DBMemoryLimit:    "1GiB",
-		DBMaxTempDirSize: "10GiB",
-		DBExternalAccess: true,
-		DBLockConfig:     true,
+		Address:           "localhost:9281",
+		MaxDB:             20,
+		MaxStatements:     10,
+		MaxColumns:        10000,
+		ConnIDFormat:      "hex",
+		BatchParallel:     4,
+		WorkerWait:        10 * time.Second,
+		MaxBodySize:       64 << 20,
+		FlushRows:         1000,
+		FlushInterval:     200 * time.Millisecond,
+		DefaultFormat:     "csv",
+		CSVDelimiter:      ",",
+		CSVNewline:        "quote",
+		CSVTerminator:     `\n`,
+		EmptyResultStatus: 200,
+		UnsupportedType:   "stringify",
+		DuplicateColumn:   "keep",
+		CommandResult:     "rows",
+		JSONNonFinite:     "null",
+		PingPath:          "/ping/",
+		MetricsInterval:   15 * time.Second,
+		MetricsMaxTags:    20,
+		RetryAfter:        time.Second,
+		LogLevel:          "info",
+		AccessLogFormat:   "text",
+		ErrorDetail:       "full",
+		DBHomeDir:         filepath.Join(getwd(), ".duckpop"),
+		DBThreads:         1,
+		DBMemoryLimit:     "1GiB",
+		DBMaxTempDirSize:  "10GiB",
+		DBExternalAccess:  true,
+		DBLockConfig:      true,
+		DBMode:            "memory",
+		DBStrategy:        "connection",
+		DBPoolSize:        4,
 	}
 }
 
@@ -100,29 +440,88 @@ type Server struct {
 
 	logger       *slog.Logger
 	accessLogger *slog.Logger
+	auditLogger  *auditlog.Logger
 
 	address         string
+	pingPath        string
 	pidFile         string
+	logLevel        slog.Level
+	logFile         string
 	accessLogFile   string
+	auditLogFile    string
 	accessLogFormat logFormat
 
+	errorDetail errorDetail
+
+	// csvParams are parameters of the format added to CSV by default.
+	csvParams []string
+
 	authenticator *authn.Authenticator
 	withoutAuthz  bool
 
+	templates map[string]queryTemplate
+
 	dbSharedDir   string
 	dbPrivateRoot string
 	dbSettings    duckdbinit.Settings
 	dbInitQuery   string
+	dbGlobViews   []string
+	dbPrelude     string
+	dbTenantFile  bool
+	dbTempFile    bool
 
 	connManager   *conndb.Manager
 	queryDatabase querydb.Database
 
+	// poolNext is the count of requests assigned to the pool of "pooled"
+	// strategy.
+	poolNext atomic.Uint64
+
+	// lastErrors holds the last error of queries by connection, until a
+	// query succeeds or the DB is closed.
+	lastErrors syncmap.Map[conndb.ID, *LastError]
+
+	// idleTxns holds transactions which may be open by connection, and
+	// txnResets marks connections whose transactions were rolled back by
+	// IdleTransactionTimeout.
+	idleTxns  syncmap.Map[conndb.ID, *idleTransaction]
+	txnResets syncmap.Map[conndb.ID, struct{}]
+
 	uiFS fs.FS
 
+	lastOpenMu sync.Mutex
+	lastOpen   *OpenParams
+
+	// duckdbConfigs caches responses of /config/duckdb by DB, because
+	// settings may differ between DBs.
+	duckdbConfigMu sync.Mutex
+	duckdbConfigs  map[conndb.ID]*cachedDuckDBConfig
+
 	startedMu   sync.Mutex
 	startedCond *sync.Cond
+	startedAt   time.Time
+
+	draining atomic.Bool
+	// shuttingDown is set with draining on the shutdown, which can't be
+	// undrained.
+	shuttingDown atomic.Bool
+	readOnly     atomic.Bool
+
+	engineMetrics atomic.Pointer[engineMetrics]
+	queryMetrics  queryMetrics
+	workers       *workerPool
+
+	// dataGeneration is the count of writing queries, for dataVersion.
+	dataGeneration atomic.Uint64
+
+	coalesceGroup singleflight.Group
+	coalesceMu    sync.Mutex
+	coalescing    map[string]*coalescedQuery
 
 	URL string
+	// AdminURL is the URL of admin end points, which is set only with
+	// AdminAddress.
+	AdminURL string
 }
 
 func New(c Config) (*Server, error) {
@@ -134,30 +533,144 @@ func New(c Config) (*Server, error) {
 	srv := Server{
 		config:        &c,
 		address:       c.Address,
+		pingPath:      c.PingPath,
 		pidFile:       c.PIDFile,
+		logFile:       c.LogFile,
 		accessLogFile: c.AccessLogFile,
+		auditLogFile:  c.AuditLogFile,
 		withoutAuthz:  c.NoAuthz,
 		dbSharedDir:   filepath.Join(homedir, "shared"),
 		dbPrivateRoot: filepath.Join(homedir, "private"),
 		dbSettings: duckdbinit.Settings{
-			HomeDir:              homedir,
-			Threads:              c.DBThreads,
-			MemoryLimit:          c.DBMemoryLimit,
+			HomeDir:     homedir,
+			Threads:     c.DBThreads,
+			MemoryLimit: c.DBMemoryLimit,
+			// extension_directory is always set explicitly, to avoid the
+			// problem that DuckDB on Windows doesn't derive it from
+			// home_directory correctly.
 			ExtensionDir:         filepath.Join(homedir, "extensions"),
 			SecretDir:            filepath.Join(homedir, "stored_secrets"),
 			TempDir:              filepath.Join(homedir, "tmp"),
 			MaxTempDirSize:       c.DBMaxTempDirSize,
 			EnableExternalAccess: c.DBExternalAccess,
 			LockConfig:           c.DBLockConfig,
+			EnableProgressBar:    c.DBProgressBar,
 		},
-		dbInitQuery: c.DBInitQuery,
-		uiFS:        c.UIResourceFS,
+		dbInitQuery:  c.DBInitQuery,
+		dbTenantFile: c.DBTenantFile,
+		uiFS:         c.UIResourceFS,
+	}
+
+	srv.workers = newWorkerPool(c.Workers)
+
+	srv.config.FileReadPrefixes, err = fileReadPrefixes(c.FileReadPrefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.dbGlobViews, err = globViewQueries(c.DBGlobViews)
+	if err != nil {
+		return nil, err
+	}
+	if c.DBPreludeFile != "" {
+		b, err := os.ReadFile(c.DBPreludeFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prelude file: %w", err)
+		}
+		srv.dbPrelude = string(b)
+	}
+
+	// A DB instance executes a query at once. Therefore the memory limit of a
+	// query is applied as memory_limit of the instance.
+	if c.DBQueryMemoryLimit != "" {
+		if err := checkQueryMemoryLimit(c.DBQueryMemoryLimit, c.DBMemoryLimit); err != nil {
+			return nil, err
+		}
+		srv.dbSettings.MemoryLimit = c.DBQueryMemoryLimit
+	}
+
+	switch c.EmptyResultStatus {
+	case 0, 200, 204:
+	default:
+		return nil, fmt.Errorf("empty result status should be 200 or 204: %d", c.EmptyResultStatus)
+	}
+
+	switch c.UnsupportedType {
+	case "":
+		srv.config.UnsupportedType = "stringify"
+	case "stringify", "error", "cast":
+	default:
+		return nil, fmt.Errorf("unsupported type handling should be \"stringify\", \"error\" or \"cast\": %q", c.UnsupportedType)
+	}
+
+	srv.readOnly.Store(c.ReadOnly)
+
+	switch c.DuplicateColumn {
+	case "":
+		srv.config.DuplicateColumn = "keep"
+	case "keep", "suffix", "error":
+	default:
+		return nil, fmt.Errorf("duplicate column handling should be \"keep\", \"suffix\" or \"error\": %q", c.DuplicateColumn)
+	}
+
+	switch c.CommandResult {
+	case "":
+		srv.config.CommandResult = "rows"
+	case "rows", "ack":
+	default:
+		return nil, fmt.Errorf("command result should be \"rows\" or \"ack\": %q", c.CommandResult)
+	}
+
+	switch c.JSONNonFinite {
+	case "":
+		srv.config.JSONNonFinite = "null"
+	case "null", "string", "error":
+	default:
+		return nil, fmt.Errorf("non-finite floats in JSON should be \"null\", \"string\" or \"error\": %q", c.JSONNonFinite)
+	}
+
+	if c.CSVDelimiter != "" || c.CSVTerminator != "" {
+		delimiter, terminator, err := csvformatter.ParseSeparators(
+			cmp.Or(c.CSVDelimiter, ","), cmp.Or(c.CSVTerminator, `\n`))
+		if err != nil {
+			return nil, err
+		}
+		if delimiter != ',' {
+			srv.csvParams = append(srv.csvParams, "delimiter:"+csvformatter.Escape(string(delimiter)))
+		}
+		if terminator != "\n" {
+			srv.csvParams = append(srv.csvParams, "terminator:"+csvformatter.Escape(terminator))
+		}
+	}
+	if c.CSVNewline == "" {
+		srv.config.CSVNewline = "quote"
+	} else if _, err := csvformatter.NewlineReplacer(c.CSVNewline); err != nil {
+		return nil, err
+	} else if c.CSVNewline != "quote" {
+		srv.csvParams = append(srv.csvParams, "newline:"+c.CSVNewline)
+	}
+
+	if c.DefaultFormat == "" {
+		srv.config.DefaultFormat = defaultFormat
+	} else if _, _, err := formatter.FindAndCreate(c.DefaultFormat, io.Discard); err != nil {
+		return nil, fmt.Errorf("invalid default format %q: %w", c.DefaultFormat, err)
+	}
+
+	if c.PingPath != "" && !strings.HasPrefix(c.PingPath, "/") {
+		return nil, fmt.Errorf("ping path should start with \"/\": %q", c.PingPath)
 	}
 
-	srv.logger = slog.Default()
+	if c.LogLevel != "" {
+		if err := srv.logLevel.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return nil, fmt.Errorf("unsupported log level: %q", c.LogLevel)
+		}
+	}
 	if c.EnableDebugLog {
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+		srv.logLevel = slog.LevelDebug
 	}
+	// The level is applied to the server only, without changing the default
+	// logger.
+	srv.logger = slog.New(&levelHandler{Handler: slog.Default().Handler(), level: srv.logLevel})
 
 	lf, err := parseLogFormat(c.AccessLogFormat)
 	if err != nil {
@@ -165,19 +678,83 @@ func New(c Config) (*Server, error) {
 	}
 	srv.accessLogFormat = lf
 
+	ed, err := parseErrorDetail(c.ErrorDetail)
+	if err != nil {
+		return nil, err
+	}
+	srv.errorDetail = ed
+
 	if c.AuthnFile != "" {
 		a, err := authn.LoadFile(c.AuthnFile)
 		if err != nil {
 			return nil, err
 		}
+		for _, e := range a.Entries() {
+			if !e.Supported() {
+				srv.logger.Warn("ignored an authentication entry of unsupported type", "id", e.ID, "type", e.Type)
+			}
+		}
 		srv.authenticator = a
 	}
 
+	if c.TemplateFile != "" {
+		t, err := loadTemplates(c.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.templates = t
+	}
+
+	srv.queryDatabase.Timeout = c.QueryTimeout
+
 	// Setup DB connection manager
 	srv.connManager = &conndb.Manager{
-		MaxDB:  c.MaxDB,
-		Opener: conndb.OpenerFunc(srv.connectDuckDB),
-		Closer: conndb.CloserFunc(srv.closeDuckDB),
+		MaxDB:        c.MaxDB,
+		Opener:       conndb.OpenerFunc(srv.connectDuckDB),
+		Closer:       conndb.CloserFunc(srv.closeDuckDB),
+		MaxIdleConns: c.DBMaxIdleConns,
+		MaxOpenConns: c.DBMaxOpenConns,
+		Logger:       srv.logger,
+	}
+	switch strings.ToLower(c.DBMode) {
+	case "", "memory":
+	case "tempfile":
+		srv.dbTempFile = true
+	default:
+		return nil, fmt.Errorf("unsupported DB mode: %q", c.DBMode)
+	}
+	switch strings.ToLower(c.ConnIDFormat) {
+	case "", "hex":
+	case "uuid":
+		srv.connManager.NewID = conndb.UUIDID
+	default:
+		return nil, fmt.Errorf("unsupported connection ID format: %q", c.ConnIDFormat)
+	}
+	switch strings.ToLower(c.DBStrategy) {
+	case "", "connection":
+		// Queries on a connection are serial, so they are never coalesced.
+		if c.CoalesceQueries {
+			return nil, errors.New("coalescing queries needs a DB strategy other than \"connection\"")
+		}
+		if c.DBSpares < 0 || c.DBSpares > c.MaxDB {
+			return nil, fmt.Errorf("spare DBs should be between 0 and max DB %d: %d", c.MaxDB, c.DBSpares)
+		}
+		srv.connManager.Spares = c.DBSpares
+		srv.connManager.SpareFunc = withoutAuthnInitQuery
+	case "authn":
+		srv.connManager.TenantFunc = tenantByAuthn
+	case "shared":
+		srv.connManager.TenantFunc = func(context.Context) (string, bool) { return "shared", true }
+	case "pooled":
+		if c.DBPoolSize <= 0 || c.DBPoolSize > c.MaxDB {
+			return nil, fmt.Errorf("DB pool size should be between 1 and max DB %d: %d", c.MaxDB, c.DBPoolSize)
+		}
+		srv.connManager.TenantFunc = srv.tenantByPool
+	default:
+		return nil, fmt.Errorf("unsupported DB strategy: %q", c.DBStrategy)
+	}
+	if c.DBSpares != 0 && srv.connManager.TenantFunc != nil {
+		return nil, errors.New("spare DBs need \"connection\" DB strategy")
 	}
 
 	srv.startedCond = sync.NewCond(&srv.startedMu)
@@ -185,6 +762,58 @@ func New(c Config) (*Server, error) {
 	return &srv, nil
 }
 
+var memorySizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// parseMemorySize parses a memory size in the format of DuckDB, like "1GiB"
+// or "500 MB".
+func parseMemorySize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size: %q", s)
+	}
+	unit, ok := memorySizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid memory size: %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+func checkQueryMemoryLimit(queryLimit, limit string) error {
+	q, err := parseMemorySize(queryLimit)
+	if err != nil {
+		return err
+	}
+	if limit == "" {
+		return nil
+	}
+	l, err := parseMemorySize(limit)
+	if err != nil {
+		return err
+	}
+	if q > l {
+		return fmt.Errorf("query memory limit %s exceeds memory limit %s", queryLimit, limit)
+	}
+	return nil
+}
+
 type logFormat int
 
 const (
@@ -203,21 +832,133 @@ func parseLogFormat(s string) (logFormat, error) {
 	}
 }
 
+type errorDetail int
+
+const (
+	fullErrorDetail errorDetail = iota
+	messageErrorDetail
+	genericErrorDetail
+)
+
+func parseErrorDetail(s string) (errorDetail, error) {
+	switch strings.ToLower(s) {
+	case "", "full":
+		return fullErrorDetail, nil
+	case "message":
+		return messageErrorDetail, nil
+	case "generic":
+		return genericErrorDetail, nil
+	default:
+		return 0, fmt.Errorf("unsupported error detail: %q", s)
+	}
+}
+
+// queryError creates an error to respond for a failed query, according to
+// ErrorDetail configuration.  Except for "full", the whole error is logged
+// with an error ID, and the ID is returned to the client to correlate them.
+func (srv *Server) queryError(w http.ResponseWriter, status int, label string, err error) error {
+	msg, errorID := srv.errorMessage(label, err)
+	if errorID != "" {
+		w.Header().Set(ErrorIDHeader, errorID)
+	}
+	return httperror.Newf(status, "%s", msg)
+}
+
+// errorMessage composes a message for a failed query according to
+// ErrorDetail configuration, and returns it with an error ID if generated.
+func (srv *Server) errorMessage(label string, err error) (string, string) {
+	if srv.errorDetail == fullErrorDetail {
+		return label + ": " + err.Error(), ""
+	}
+	errorID := newErrorID()
+	srv.logger.Warn("query failed", "error_id", errorID, "error", err)
+	if srv.errorDetail == genericErrorDetail {
+		return "Query failed: error ID " + errorID, errorID
+	}
+	// Only the first line of the message, without the path of home directory.
+	msg, _, _ := strings.Cut(err.Error(), "\n")
+	msg = strings.ReplaceAll(msg, srv.dbSettings.HomeDir, "<homedir>")
+	return fmt.Sprintf("%s: %s (error ID %s)", label, msg, errorID), errorID
+}
+
+func newErrorID() string {
+	return fmt.Sprintf("E_%08x", rand.Uint32())
+}
+
+// recoverPanic recovers from a panic in a handler, like the one in the driver,
+// and converts it to an error with status 500 after logging its stack trace.
+// It must be called directly by defer.
+func (srv *Server) recoverPanic(w http.ResponseWriter, errp *error) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	errorID := srv.logPanic(p)
+	w.Header().Set(ErrorIDHeader, errorID)
+	*errp = httperror.Newf(500, "Internal error: error ID %s", errorID)
+}
+
+// logPanic logs a recovered panic with its stack trace, and returns an error
+// ID to correlate with the log.
+func (srv *Server) logPanic(p any) string {
+	errorID := newErrorID()
+	srv.logger.Error("panic recovered", "error_id", errorID, "panic", p, "stack", string(debug.Stack()))
+	return errorID
+}
+
+// noClose is returned as a close function when no log file is opened.
+func noClose() {}
+
+// setupLogger setups the server logger to write to the log file, and returns
+// a function to close the log file. The default logger isn't changed.
+func (srv *Server) setupLogger() (func(), error) {
+	if srv.logFile == "" {
+		return noClose, nil
+	}
+	w, err := hupfile.New(srv.logFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	srv.logger = slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: srv.logLevel}))
+	srv.connManager.Logger = srv.logger
+	return func() { w.Close() }, nil
+}
+
+// levelHandler is slog.Handler which filters records by the level, instead of
+// the level of the handler.
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
 // Setup access logger
-func (srv *Server) setupAccessLogger() error {
+func (srv *Server) setupAccessLogger() (func(), error) {
 	// Special setting to discard access logs during testing
 	if srv.accessLogFile == "test.discard" {
-		return nil
+		return noClose, nil
 	}
 
 	var logw io.Writer = os.Stdout
+	closeLog := noClose
 	if srv.accessLogFile != "" {
 		w, err := hupfile.New(srv.accessLogFile)
 		if err != nil {
-			return fmt.Errorf("failed to open access log file: %w", err)
+			return nil, fmt.Errorf("failed to open access log file: %w", err)
 		}
 		logw = w
-		defer w.Close()
+		closeLog = func() { w.Close() }
 	}
 
 	switch srv.accessLogFormat {
@@ -226,17 +967,51 @@ func (srv *Server) setupAccessLogger() error {
 	case jsonLog:
 		srv.accessLogger = slog.New(slog.NewJSONHandler(logw, nil))
 	default:
-		return errors.New("invalid access log format")
+		closeLog()
+		return nil, errors.New("invalid access log format")
 	}
-	return nil
+	return closeLog, nil
+}
+
+// setupAuditLogger setups the audit logger, and returns a function to close
+// the log file.
+func (srv *Server) setupAuditLogger() (func(), error) {
+	if srv.auditLogFile == "" {
+		return noClose, nil
+	}
+	w, err := hupfile.New(srv.auditLogFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log file: %w", err)
+	}
+	srv.auditLogger = auditlog.New(w)
+	srv.auditLogger.RowCountHeader = RowCountHeader
+	srv.auditLogger.ErrorLogger = srv.logger
+	return func() { w.Close() }, nil
 }
 
 func (srv *Server) Serve(ctx context.Context) error {
-	// Preparement: check database configuration.
-	err := srv.checkDB(ctx)
+	closeLog, err := srv.setupLogger()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if b, err := json.Marshal(srv.effectiveConfig()); err == nil {
+		srv.logger.Info("effective configuration", "config", string(b))
+	}
+
+	// Preparement: create DB directories and check database configuration.
+	err = srv.prepareDBDirs()
+	if err != nil {
+		return err
+	}
+	err = srv.checkDB(ctx)
 	if err != nil {
 		return err
 	}
+	if err := srv.openSpares(ctx); err != nil {
+		return err
+	}
+	defer srv.connManager.CloseSpares()
 
 	// Set PID file
 	if srv.pidFile != "" {
@@ -247,36 +1022,130 @@ func (srv *Server) Serve(ctx context.Context) error {
 		defer pidfile.Close()
 	}
 
-	if err := srv.setupAccessLogger(); err != nil {
+	closeAccessLog, err := srv.setupAccessLogger()
+	if err != nil {
+		return err
+	}
+	defer closeAccessLog()
+	closeAuditLog, err := srv.setupAuditLogger()
+	if err != nil {
 		return err
 	}
+	defer closeAuditLog()
 
 	srvctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	if srv.config.MetricsInterval > 0 {
+		go srv.collectMetrics(srvctx)
+	}
+
+	adminAddress := srv.config.AdminAddress
 	httpsrv := &http.Server{
 		Addr:        srv.address,
-		Handler:     srv.newDuckpopHandler(),
+		Handler:     srv.newDuckpopHandler(true, adminAddress == ""),
 		ConnContext: srv.connManager.ConnContext,
 		ConnState:   srv.connManager.ConnState,
 		BaseContext: func(ln net.Listener) context.Context {
 			srv.startedCond.L.Lock()
 			addr := ln.Addr()
-			srv.logger.Info("listening on", "addr", addr, "pprof", srv.config.EnablePprof)
+			srv.logger.Info("listening on", "addr", addr, "pprof", srv.config.EnablePprof && adminAddress == "")
 			srv.URL = "http://" + addr.String()
+			srv.startedAt = time.Now()
 			srv.startedCond.Broadcast()
 			srv.startedCond.L.Unlock()
 			return context.Background()
 		},
 	}
+	// The admin server shares connections and DBs with the query server.
+	var adminsrv *http.Server
+	if adminAddress != "" {
+		adminsrv = &http.Server{
+			Addr:        adminAddress,
+			Handler:     srv.newDuckpopHandler(false, true),
+			ConnContext: srv.connManager.ConnContext,
+			ConnState:   srv.connManager.ConnState,
+			BaseContext: func(ln net.Listener) context.Context {
+				srv.startedCond.L.Lock()
+				addr := ln.Addr()
+				srv.logger.Info("listening admin on", "addr", addr, "pprof", srv.config.EnablePprof)
+				srv.AdminURL = "http://" + addr.String()
+				srv.startedCond.Broadcast()
+				srv.startedCond.L.Unlock()
+				return context.Background()
+			},
+		}
+	}
+
+	// Start draining on the signal, then shut down after DrainDelay.
+	shutdownCtx, shutdown := context.WithCancel(context.WithoutCancel(srvctx))
+	defer shutdown()
+	go func() {
+		<-srvctx.Done()
+		srv.shuttingDown.Store(true)
+		srv.draining.Store(true)
+		if srv.config.DrainDelay > 0 {
+			srv.logger.Info("draining", "delay", srv.config.DrainDelay)
+			time.Sleep(srv.config.DrainDelay)
+		}
+		shutdown()
+	}()
+
+	// Start servers. When one of them fails, the other is shut down.
+	var adminErr chan error
+	if adminsrv != nil {
+		adminErr = make(chan error, 1)
+		go func() {
+			err := serveHTTP(shutdownCtx, adminsrv)
+			if err != nil {
+				shutdown()
+			}
+			adminErr <- err
+		}()
+	}
+	err = serveHTTP(shutdownCtx, httpsrv)
+	if adminErr != nil {
+		shutdown()
+		if err2 := <-adminErr; err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// serveHTTP serves the HTTP server until ctx is canceled, then shuts it down.
+func serveHTTP(ctx context.Context, httpsrv *http.Server) error {
+	cfg := ctxsrv.HTTP(httpsrv)
+	cfg.Listen = func() (net.Listener, error) {
+		return net.Listen(listenNetwork(httpsrv.Addr), httpsrv.Addr)
+	}
+	return cfg.WithShutdownTimeout(time.Minute).ServeWithContext(ctx)
+}
 
-	// Start server
-	return ctxsrv.HTTP(httpsrv).WithShutdownTimeout(time.Minute).ServeWithContext(srvctx)
+// listenNetwork determines the network to listen by the syntax of the address.
+// An IPv4 address like "0.0.0.0:9281" listens only IPv4, and an IPv6 address
+// like "[::1]:9281" listens only IPv6.  The others, like "[::]:9281", ":9281"
+// or a host name, listen both of them (dual-stack) if possible.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "::" {
+		return "tcp"
+	}
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
 }
 
 func (srv *Server) WaitServe() {
 	srv.startedCond.L.Lock()
-	for srv.URL == "" {
+	for srv.URL == "" || (srv.config.AdminAddress != "" && srv.AdminURL == "") {
 		srv.startedCond.Wait()
 	}
 	srv.startedCond.L.Unlock()
@@ -290,19 +1159,148 @@ func (srv *Server) PrivateRoot() string {
 	return srv.dbPrivateRoot
 }
 
+// prepareDBDirs creates the home directory of DuckDB and its sub directories
+// if missing, and verifies that the home directory is writable.
+func (srv *Server) prepareDBDirs() error {
+	dirs := []string{
+		srv.dbSettings.HomeDir,
+		srv.dbSettings.ExtensionDir,
+		srv.dbSettings.SecretDir,
+		srv.dbSettings.TempDir,
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return fmt.Errorf("failed to create DB directory: %w", err)
+		}
+	}
+	if srv.dbTempFile || srv.config.DBTempDirPerConn {
+		srv.removeStaleTempFiles()
+	}
+	f, err := os.CreateTemp(srv.dbSettings.HomeDir, ".writable-*")
+	if err != nil {
+		return fmt.Errorf("DB home directory is not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 func (srv *Server) checkDB(ctx context.Context) error {
+	if srv.config.DBSkipStartupCheck {
+		if srv.config.DBWarmupQuery == "" {
+			return nil
+		}
+	} else {
+		version, err := checkDuckDB(ctx)
+		if err != nil {
+			return fmt.Errorf("DuckDB library is missing or incompatible (duckdb-go %s): %w", driverVersion(), err)
+		}
+		srv.logger.Info("DuckDB checked", "version", version)
+	}
 	db, conn, err := srv.connectDuckDB(ctx)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 	defer db.Close()
-	return conn.PingContext(ctx)
+	if err := conn.PingContext(ctx); err != nil {
+		return err
+	}
+	if srv.config.DBWarmupQuery != "" {
+		start := time.Now()
+		if _, err := conn.ExecContext(ctx, srv.config.DBWarmupQuery); err != nil {
+			return fmt.Errorf("failed to warm up DB: %w", err)
+		}
+		srv.logger.Info("DB warmed up", "duration", time.Since(start))
+	}
+	return nil
+}
+
+// checkDuckDB checks the DuckDB library works with an in-memory DB without
+// any settings, and returns its version.
+func checkDuckDB(ctx context.Context) (string, error) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT version()").Scan(&version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// driverVersion returns the version of the DuckDB driver module, which
+// bundles the DuckDB library.
+func driverVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/duckdb/duckdb-go/v2" {
+				return dep.Version
+			}
+		}
+	}
+	return "(unknown)"
+}
+
+// openSpares opens spare DBs of DBSpares at startup.
+func (srv *Server) openSpares(ctx context.Context) error {
+	if srv.connManager.Spares <= 0 {
+		return nil
+	}
+	start := time.Now()
+	if err := srv.connManager.OpenSpares(ctx); err != nil {
+		srv.connManager.CloseSpares()
+		return fmt.Errorf("failed to open spare DBs: %w", err)
+	}
+	srv.logger.Info("spare DBs opened", "count", srv.connManager.Spares, "duration", time.Since(start))
+	return nil
+}
+
+// withoutAuthnInitQuery reports whether the authentication entry of a request
+// has no init query, which spare DBs can't execute.
+func withoutAuthnInitQuery(ctx context.Context) bool {
+	entry, ok := authn.AuthnEntry(ctx)
+	return !ok || entry.InitQuery == ""
+}
+
+// tenantByAuthn determines the tenant of a request by its authn ID.
+func tenantByAuthn(ctx context.Context) (string, bool) {
+	id, ok := authn.AuthnID(ctx)
+	if !ok || id == authn.NoAuthn {
+		return "", false
+	}
+	return id.String(), true
+}
+
+// tenantByPool determines the tenant of a request from the pool of "pooled"
+// strategy in round robin.
+func (srv *Server) tenantByPool(context.Context) (string, bool) {
+	n := srv.poolNext.Add(1) - 1
+	return "pool-" + strconv.FormatUint(n%uint64(srv.config.DBPoolSize), 10), true
 }
 
 func (srv *Server) connectDuckDB(ctx context.Context) (*sql.DB, *sql.Conn, error) {
 	// Compose duckdbinit.Settings
 	settings := srv.dbSettings
+	if tenant, ok := conndb.GetTenant(ctx); ok && srv.dbTenantFile {
+		name := "tenant-" + tenant + ".duckdb"
+		if !filepath.IsLocal(name) || filepath.Base(name) != name {
+			return nil, nil, fmt.Errorf("invalid tenant for DB file: %q", tenant)
+		}
+		settings.Path = filepath.Join(settings.HomeDir, name)
+	} else if path, ok := srv.tempFilePath(ctx); ok {
+		settings.Path = path
+	}
+	if dir, ok := srv.connTempDir(ctx); ok {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, nil, err
+		}
+		settings.TempDir = dir
+	}
 	if srv.dbSharedDir != "" {
 		if err := os.MkdirAll(srv.dbSharedDir, 0750); err != nil {
 			return nil, nil, err
@@ -319,17 +1317,23 @@ func (srv *Server) connectDuckDB(ctx context.Context) (*sql.DB, *sql.Conn, error
 	// Prepare initQueries
 	initQueries := make([]string, 0, 4)
 	if srv.dbSharedDir != "" {
-		initQueries = append(initQueries, fmt.Sprintf("CREATE MACRO public_dir(name) AS concat('%s', '/', name)", srv.dbSharedDir))
+		initQueries = append(initQueries, fmt.Sprintf("CREATE OR REPLACE MACRO public_dir(name) AS concat('%s', '/', name)", srv.dbSharedDir))
 	}
 	if privateDir != "" {
-		initQueries = append(initQueries, fmt.Sprintf("CREATE MACRO private_dir(name) AS concat('%s', '/', name)", privateDir))
+		initQueries = append(initQueries, fmt.Sprintf("CREATE OR REPLACE MACRO private_dir(name) AS concat('%s', '/', name)", privateDir))
 	}
+	initQueries = append(initQueries, srv.dbGlobViews...)
 	if srv.dbInitQuery != "" {
 		initQueries = append(initQueries, srv.dbInitQuery)
 	}
+	// The prelude follows DBInitQuery which may load extensions for it.
+	if srv.dbPrelude != "" {
+		initQueries = append(initQueries, srv.dbPrelude)
+	}
 	if entry, ok := authn.AuthnEntry(ctx); ok && entry.InitQuery != "" {
 		initQueries = append(initQueries, entry.InitQuery)
 	}
+	srv.recordOpenParams(ctx, settings, initQueries)
 	// Open and connect to a database.
 	db, conn, err := duckdbinit.Open(ctx, settings, initQueries...)
 	if err != nil {
@@ -338,23 +1342,156 @@ func (srv *Server) connectDuckDB(ctx context.Context) (*sql.DB, *sql.Conn, error
 	return db, conn, nil
 }
 
+// OpenParams describes parameters used to open a DB. Literals in InitQueries
+// are redacted because they may contain secrets.
+type OpenParams struct {
+	ConnID      string              `json:"ConnID"`
+	Time        string              `json:"Time"`
+	DSN         string              `json:"DSN"`
+	Settings    duckdbinit.Settings `json:"Settings"`
+	InitQueries []string            `json:"InitQueries"`
+}
+
+func (srv *Server) recordOpenParams(ctx context.Context, settings duckdbinit.Settings, initQueries []string) {
+	p := &OpenParams{
+		Time:        time.Now().Format(time.RFC3339),
+		DSN:         duckdbinit.DSN(settings),
+		Settings:    settings,
+		InitQueries: make([]string, len(initQueries)),
+	}
+	if id, ok := conndb.GetID(ctx); ok {
+		p.ConnID = id.String()
+	}
+	for i, q := range initQueries {
+		p.InitQueries[i] = sqltext.Redact(q)
+	}
+	srv.logger.Debug("open DB", "connID", p.ConnID, "dsn", p.DSN, "settings", p.Settings, "init_queries", p.InitQueries)
+	srv.lastOpenMu.Lock()
+	srv.lastOpen = p
+	srv.lastOpenMu.Unlock()
+}
+
+// tempObjectsQuery lists temporary objects in the order to drop them.
+const tempObjectsQuery = `SELECT 'VIEW', view_name FROM duckdb_views() WHERE temporary AND NOT internal
+UNION ALL SELECT 'MACRO', function_name FROM duckdb_functions() WHERE database_name = 'temp' AND function_type = 'macro'
+UNION ALL SELECT 'TABLE', table_name FROM duckdb_tables() WHERE temporary
+UNION ALL SELECT 'SEQUENCE', sequence_name FROM duckdb_sequences() WHERE temporary`
+
+// resetTempObjects drops all temporary objects in the session of conn.
+func resetTempObjects(ctx context.Context, conn *sql.Conn) error {
+	rows, err := conn.QueryContext(ctx, tempObjectsQuery)
+	if err != nil {
+		return err
+	}
+	var drops []string
+	for rows.Next() {
+		var kind, name string
+		if err := rows.Scan(&kind, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		drops = append(drops, "DROP "+kind+" IF EXISTS temp.main."+sqltext.QuoteIdent(name))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, drop := range drops {
+		if _, err := conn.ExecContext(ctx, drop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (srv *Server) closeDuckDB(ctx context.Context, db *sql.DB) error {
+	if id, ok := conndb.GetID(ctx); ok {
+		srv.lastErrors.Delete(id)
+		srv.clearIdleTransaction(id)
+	}
 	privateDir, _ := srv.getPrivateDir(ctx, false)
 	if privateDir != "" {
 		if err := os.RemoveAll(privateDir); err != nil {
 			srv.logger.Warn("failed to remove private directory", "dir", privateDir, "error", err)
 		}
 	}
-	return db.Close()
+	err := db.Close()
+	if path, ok := srv.tempFilePath(ctx); ok {
+		removeDBFile(srv.logger, path)
+	}
+	if dir, ok := srv.connTempDir(ctx); ok {
+		if err := os.RemoveAll(dir); err != nil {
+			srv.logger.Warn("failed to remove temporary directory", "dir", dir, "error", err)
+		}
+	}
+	return err
+}
+
+const tempFilePrefix = "conn-"
+
+// tempFilePath returns the path of the temporary DB file for the connection,
+// when "tempfile" DB mode is enabled.
+func (srv *Server) tempFilePath(ctx context.Context) (string, bool) {
+	if !srv.dbTempFile {
+		return "", false
+	}
+	if _, ok := conndb.GetTenant(ctx); ok && srv.dbTenantFile {
+		return "", false
+	}
+	id, ok := conndb.GetDBID(ctx)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(srv.dbSettings.TempDir, tempFilePrefix+id.String()+".duckdb"), true
+}
+
+// connTempDir returns the temporary directory dedicated to the DB of the
+// connection, when DBTempDirPerConn is enabled.
+func (srv *Server) connTempDir(ctx context.Context) (string, bool) {
+	if !srv.config.DBTempDirPerConn {
+		return "", false
+	}
+	id, ok := conndb.GetDBID(ctx)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(srv.dbSettings.TempDir, tempFilePrefix+id.String()), true
+}
+
+// removeDBFile removes a DB file and its WAL file.
+func removeDBFile(logger *slog.Logger, path string) {
+	for _, name := range []string{path, path + ".wal"} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("failed to remove temporary DB file", "file", name, "error", err)
+		}
+	}
+}
+
+// removeStaleTempFiles removes temporary DB files and directories left by the
+// previous process, which was terminated without closing DBs.
+func (srv *Server) removeStaleTempFiles() {
+	names, _ := filepath.Glob(filepath.Join(srv.dbSettings.TempDir, tempFilePrefix+"*"))
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		switch {
+		case err != nil:
+		case fi.IsDir():
+			if err := os.RemoveAll(name); err != nil {
+				srv.logger.Warn("failed to remove temporary directory", "dir", name, "error", err)
+			}
+		case strings.HasSuffix(name, ".duckdb"):
+			removeDBFile(srv.logger, name)
+		}
+	}
 }
 
 func (srv *Server) getPrivateDir(ctx context.Context, makeDir bool) (string, error) {
 	if srv.dbPrivateRoot == "" {
 		return "", nil
 	}
-	connID, ok := conndb.GetID(ctx)
+	connID, ok := conndb.GetDBID(ctx)
 	if !ok {
-		slog.Debug("connection ID cannot be determined")
+		srv.logger.Debug("connection ID cannot be determined")
 		return "", nil
 	}
 	privateDir := filepath.Join(srv.dbPrivateRoot, connID.String())
@@ -366,15 +1503,59 @@ func (srv *Server) getPrivateDir(ctx context.Context, makeDir bool) (string, err
 	return privateDir, nil
 }
 
-func (srv *Server) newDuckpopHandler() http.Handler {
+// newDuckpopHandler returns a handler of end points for queries, admin end
+// points, or both of them. End points which aren't handled respond 404.
+func (srv *Server) newDuckpopHandler(query, admin bool) http.Handler {
 	// Define handlers
 	mux := http.NewServeMux()
-	mux.Handle("/{$}", errorAwareHandler(srv.handleQuery))
-	mux.Handle("GET /ping/{$}", errorAwareHandler(srv.handlePing))
-	mux.Handle("GET /config/", errorAwareHandler(srv.handleConfig))
-	mux.Handle("GET /status/connections/{$}", errorAwareHandler(srv.handleStatusConnections))
-	mux.Handle("GET /status/queries/{$}", errorAwareHandler(srv.handleStatusQueries))
-	mux.Handle("DELETE /status/queries/{queryID}", errorAwareHandler(srv.handleInterruptQuery))
+	if query {
+		srv.registerQueryEndpoints(mux)
+	}
+	if admin {
+		srv.registerAdminEndpoints(mux)
+	}
+
+	// Install middlewares.
+	var h http.Handler = srv.pathsHandler(mux)
+	if srv.accessLogger != nil {
+		var redact func(string) string
+		if srv.config.AccessLogRedact {
+			redact = sqltext.Redact
+		}
+		h = accesslog.WrapRedactedHandler(srv.accessLogger, redact, h)
+	}
+	if srv.auditLogger != nil {
+		h = srv.auditLogger.WrapHandler(h)
+	}
+	h = srv.authenticator.AuthenticateHandler(h)
+	return h
+}
+
+func (srv *Server) registerQueryEndpoints(mux *http.ServeMux) {
+	// Only end points which read SQL or JSON from request bodies decompress
+	// and limit them. Files in /shared/ are stored as they are.
+	withBody := func(handle func(http.ResponseWriter, *http.Request) error) http.Handler {
+		return srv.requestBodyHandler(errorAwareHandler(handle))
+	}
+	mux.Handle("/{$}", withBody(srv.handleQuery))
+	if srv.pingPath != "" {
+		pattern := "GET " + srv.pingPath
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "{$}"
+		}
+		mux.Handle(pattern, errorAwareHandler(srv.handlePing))
+	}
+	mux.Handle("POST /batch/{$}", withBody(srv.handleBatch))
+	mux.Handle("POST /diff/{$}", withBody(srv.handleDiff))
+	mux.Handle("POST /profile/{$}", withBody(srv.handleProfile))
+	mux.Handle("POST /register/{$}", withBody(srv.handleRegister))
+	mux.Handle("POST /export/{$}", withBody(srv.handleExport))
+	mux.Handle("POST /ingest/{$}", withBody(srv.handleIngest))
+	mux.Handle("GET /schema/{table}/sample", errorAwareHandler(srv.handleSchemaSample))
+	mux.Handle("POST /q/{name}", withBody(srv.handleTemplate))
+	if srv.config.ScriptDir != "" {
+		mux.Handle("POST /script/{name}", errorAwareHandler(srv.handleScript))
+	}
 	if srv.dbSharedDir != "" {
 		h := srv.authzChangeOperationHanlder(fileserver.New(srv.dbSharedDir))
 		mux.Handle("/shared/", http.StripPrefix("/shared/", h))
@@ -382,6 +1563,24 @@ func (srv *Server) newDuckpopHandler() http.Handler {
 	if srv.uiFS != nil {
 		mux.Handle("/ui/", http.StripPrefix("/ui/", http.FileServerFS(srv.uiFS)))
 	}
+}
+
+func (srv *Server) registerAdminEndpoints(mux *http.ServeMux) {
+	mux.Handle("GET /config/", errorAwareHandler(srv.handleConfig))
+	mux.Handle("GET /config/duckdb", errorAwareHandler(srv.handleConfigDuckDB))
+	mux.Handle("GET /status/{$}", errorAwareHandler(srv.handleStatus))
+	mux.Handle("POST /status/maintenance", errorAwareHandler(srv.handleMaintenance))
+	mux.Handle("POST /status/drain", errorAwareHandler(srv.handleDrain))
+	mux.Handle("POST /status/undrain", errorAwareHandler(srv.handleUndrain))
+	mux.Handle("GET /metrics", errorAwareHandler(srv.handleMetrics))
+	mux.Handle("GET /status/connections/{$}", errorAwareHandler(srv.handleStatusConnections))
+	mux.Handle("GET /status/connections/{connID}", errorAwareHandler(srv.handleStatusConnection))
+	mux.Handle("POST /status/connections/{connID}/export", errorAwareHandler(srv.handleExportConnection))
+	mux.Handle("GET /status/database", errorAwareHandler(srv.handleStatusDatabase))
+	mux.Handle("GET /status/selftest", errorAwareHandler(srv.handleSelfTest))
+	mux.Handle("GET /status/queries/{$}", errorAwareHandler(srv.handleStatusQueries))
+	mux.Handle("DELETE /status/queries/{$}", errorAwareHandler(srv.handleInterruptConnQueries))
+	mux.Handle("DELETE /status/queries/{queryID}", errorAwareHandler(srv.handleInterruptQuery))
 	if srv.config.EnablePprof {
 		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
 		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
@@ -389,21 +1588,58 @@ func (srv *Server) newDuckpopHandler() http.Handler {
 		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
 		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
 	}
+}
 
-	// Install middlewares.
-	var h http.Handler = mux
-	if srv.accessLogger != nil {
-		h = accesslog.WrapHandler(srv.accessLogger, h)
+// pathsHandler rejects requests which are authenticated with an entry whose
+// paths don't match them.
+func (srv *Server) pathsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if entry, ok := authn.AuthnEntry(r.Context()); ok && !entry.Permits(r) {
+			w.Header().Set(AuthnIDHeader, entry.ID.String())
+			httperror.Write(w, httperror.Newf(403, "The path is not permitted: %s %s", r.Method, r.URL.Path))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestBodyHandler decompresses request bodies with "Content-Encoding:
+// gzip", and limits the size of the bodies.
+func (srv *Server) requestBodyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				httperror.Write(w, httperror.Newf(400, "Invalid gzip body: %s", err))
+				return
+			}
+			defer zr.Close()
+			r.Body = zr
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+		if srv.config.MaxBodySize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, srv.config.MaxBodySize)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// bodyError converts an error of reading a request body to an HTTP error.
+func bodyError(err error) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return httperror.Newf(413, "Request body too large: limit is %d bytes", mbe.Limit)
 	}
-	h = srv.authenticator.AuthenticateHandler(h)
-	return h
+	return httperror.Newf(400, "Failed to read body: %s", err)
 }
 
 func errorAwareHandler(handle func(http.ResponseWriter, *http.Request) error) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := handle(w, r)
 		if err != nil {
-			httperror.Write(w, err)
+			writeError(w, r, err)
 		}
 	})
 }
@@ -423,6 +1659,23 @@ func (srv *Server) checkAuthz(w http.ResponseWriter, r *http.Request) error {
 	return httperror.New(401)
 }
 
+// checkAdmin checks the request is authenticated as an admin. All requests
+// are permitted when authentication is disabled.
+func (srv *Server) checkAdmin(w http.ResponseWriter, r *http.Request) error {
+	if srv.authenticator == nil {
+		return nil
+	}
+	entry, ok := authn.AuthnEntry(r.Context())
+	if !ok {
+		return httperror.New(401)
+	}
+	w.Header().Set(AuthnIDHeader, entry.ID.String())
+	if !entry.Admin {
+		return httperror.New(403)
+	}
+	return nil
+}
+
 func (srv *Server) authzChangeOperationHanlder(handle http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -440,8 +1693,27 @@ func (srv *Server) authzChangeOperationHanlder(handle http.Handler) http.Handler
 	})
 }
 
+// checkDraining rejects a request while the server is draining, on the
+// shutdown or by "/status/drain".
+func (srv *Server) checkDraining(w http.ResponseWriter) error {
+	if !srv.draining.Load() {
+		return nil
+	}
+	w.Header().Set("Connection", "close")
+	if !srv.shuttingDown.Load() {
+		return srv.overloaded(503, reasonDraining, "Server is draining")
+	}
+	return srv.overloaded(503, reasonDraining, "Server is shutting down")
+}
+
 func (srv *Server) handlePing(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
 	w.WriteHeader(200)
+	if r.Method == "HEAD" {
+		return nil
+	}
 	w.Write([]byte("OK\r\n"))
 	return nil
 }
@@ -451,7 +1723,94 @@ func (srv *Server) handleConfig(w http.ResponseWriter, r *http.Request) error {
 	w.WriteHeader(200)
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
-	return enc.Encode(srv.config)
+	return enc.Encode(srv.effectiveConfig())
+}
+
+// effectiveConfig returns the configuration which the server runs with, as
+// /config/ and the startup log show. Literals in queries are redacted because
+// they may contain secrets.
+func (srv *Server) effectiveConfig() Config {
+	c := *srv.config
+	// ReadOnly reflects the current state, which is switched at runtime.
+	c.ReadOnly = srv.readOnly.Load()
+	c.DBInitQuery = sqltext.Redact(c.DBInitQuery)
+	c.DBWarmupQuery = sqltext.Redact(c.DBWarmupQuery)
+	return c
+}
+
+// duckdbConfigTTL is the duration to cache the response of /config/duckdb.
+const duckdbConfigTTL = 5 * time.Second
+
+func (srv *Server) handleConfigDuckDB(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	b, err := srv.duckdbConfig(w, r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write(b)
+	return err
+}
+
+type cachedDuckDBConfig struct {
+	body    []byte
+	expires time.Time
+}
+
+// duckdbConfig returns the JSON of the current DuckDB settings of the DB of
+// the request, which is cached for duckdbConfigTTL.
+func (srv *Server) duckdbConfig(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	client, conn, err := srv.clientConn(w, r)
+	if err != nil {
+		return nil, err
+	}
+	srv.duckdbConfigMu.Lock()
+	defer srv.duckdbConfigMu.Unlock()
+	now := time.Now()
+	for id, c := range srv.duckdbConfigs {
+		if !now.Before(c.expires) {
+			delete(srv.duckdbConfigs, id)
+		}
+	}
+	if c, ok := srv.duckdbConfigs[client.ID]; ok {
+		return c.body, nil
+	}
+
+	unlock, err := srv.lockQuery(r, client)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	rows, err := conn.QueryContext(r.Context(), "SELECT name, value FROM duckdb_settings()")
+	if err != nil {
+		return nil, srv.queryError(w, 500, "DB error", err)
+	}
+	defer rows.Close()
+	settings := map[string]*string{}
+	for rows.Next() {
+		var name string
+		var value *string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, srv.queryError(w, 500, "DB error", err)
+		}
+		settings[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, srv.queryError(w, 500, "DB error", err)
+	}
+	b, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '\n')
+	if srv.duckdbConfigs == nil {
+		srv.duckdbConfigs = map[conndb.ID]*cachedDuckDBConfig{}
+	}
+	srv.duckdbConfigs[client.ID] = &cachedDuckDBConfig{body: b, expires: now.Add(duckdbConfigTTL)}
+	return b, nil
 }
 
 func (srv *Server) shouldRedirectToUI(r *http.Request) bool {
@@ -462,89 +1821,751 @@ func (srv *Server) shouldRedirectToUI(r *http.Request) bool {
 	return errors.Is(err, ErrNoQuery)
 }
 
-func (srv *Server) handleQuery(w http.ResponseWriter, r *http.Request) error {
+func (srv *Server) handleQuery(w http.ResponseWriter, r *http.Request) (retErr error) {
+	// Deferred functions to close rows and queries run before this recovery.
+	defer srv.recoverPanic(w, &retErr)
 	if srv.shouldRedirectToUI(r) {
 		http.Redirect(w, r, "/ui/", http.StatusTemporaryRedirect)
 		return nil
 	}
+	switch r.Method {
+	case "GET", "HEAD":
+		if srv.config.NoGetQuery {
+			w.Header().Set("Allow", srv.queryMethods())
+			return httperror.Newf(405, "Queries by %s are disabled", r.Method)
+		}
+		fallthrough
+	case "POST":
+		if err := srv.checkDraining(w); err != nil {
+			return err
+		}
+	case "OPTIONS":
+		// Preflight requests of CORS don't have credentials.
+		return handleQueryOptions(w, r, srv.queryMethods())
+	default:
+		w.Header().Set("Allow", srv.queryMethods())
+		return httperror.New(405)
+	}
+	// The query is read before authz, to be recorded in the audit log even
+	// if the request is denied.
+	query, args, errQuery := readQuery(r)
+	if errQuery == nil {
+		auditlog.SetQuery(w, query)
+	}
 	if err := srv.checkAuthz(w, r); err != nil {
 		return err
 	}
-	if r.Method != "GET" && r.Method != "POST" {
-		return httperror.New(404)
+	if errQuery != nil {
+		if !errors.Is(errQuery, ErrNoQuery) {
+			return bodyError(errQuery)
+		}
+		return httperror.Newf(400, "No queries: %s", errQuery)
+	}
+	if err := srv.checkStatements(query); err != nil {
+		return err
+	}
+	if err := srv.checkFileReads(r, query); err != nil {
+		return err
+	}
+	if err := srv.checkExtensions(r, query); err != nil {
+		return err
+	}
+	if err := srv.checkReadOnly(r, query); err != nil {
+		return err
+	}
+	query, limited := srv.autoLimit(query)
+	if limited {
+		w.Header().Set(AutoLimitedHeader, strconv.Itoa(srv.config.AutoLimit))
+	}
+	if srv.config.CoalesceQueries && isCoalescable(r, query) {
+		return srv.executeCoalesced(w, r, query, args...)
+	}
+	return srv.executeQuery(w, r, query, args...)
+}
+
+// autoLimit appends LIMIT of AutoLimit to a query which is a single SELECT
+// without LIMIT at the top level, and reports whether it is appended. Others,
+// including WITH, are never modified to be conservative.
+func (srv *Server) autoLimit(query string) (string, bool) {
+	limit := srv.config.AutoLimit
+	if limit <= 0 || sqltext.CountStatements(query) != 1 ||
+		sqltext.StatementType(query) != "SELECT" || sqltext.HasTopLevelLimit(query) {
+		return query, false
+	}
+	return sqltext.TrimTerminator(query) + "\nLIMIT " + strconv.Itoa(limit), true
+}
+
+// checkExtensions rejects a query which installs or loads extensions out of
+// AllowedExtensions.
+func (srv *Server) checkExtensions(r *http.Request, query string) error {
+	allowed := srv.config.AllowedExtensions
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, name := range sqltext.ExtensionNames(query) {
+		if !slices.Contains(allowed, name) {
+			id, _ := authn.AuthnID(r.Context())
+			srv.logger.Warn("extension out of allowed ones rejected", "extension", name, "authnID", id, "remoteAddr", r.RemoteAddr)
+			return httperror.Newf(403, "The extension is not allowed: %q", name)
+		}
+	}
+	return nil
+}
+
+// checkFileReads rejects a query which reads files out of FileReadPrefixes.
+func (srv *Server) checkFileReads(r *http.Request, query string) error {
+	prefixes := srv.config.FileReadPrefixes
+	if len(prefixes) == 0 {
+		return nil
+	}
+	for _, p := range sqltext.FileReadPaths(query) {
+		path := p
+		if !strings.Contains(path, "://") {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+		}
+		if !slices.ContainsFunc(prefixes, func(prefix string) bool {
+			return hasPathPrefix(path, prefix)
+		}) {
+			id, _ := authn.AuthnID(r.Context())
+			srv.logger.Warn("file read out of prefixes rejected", "path", p, "authnID", id, "remoteAddr", r.RemoteAddr)
+			return httperror.Newf(403, "Reading the file is not allowed: %q", p)
+		}
+	}
+	return nil
+}
+
+// fileReadPrefixes normalizes FileReadPrefixes. Prefixes of local paths are
+// cleaned and made absolute to be compared with absolute paths, and ones of
+// URLs are kept as is.
+func fileReadPrefixes(prefixes []string) ([]string, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	list := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		if strings.Contains(prefix, "://") {
+			list[i] = prefix
+			continue
+		}
+		abs, err := filepath.Abs(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file read prefix %q: %w", prefix, err)
+		}
+		list[i] = abs
+	}
+	return list, nil
+}
+
+// hasPathPrefix checks the path is the prefix or under it. A prefix of a URL
+// is compared as a string.
+func hasPathPrefix(path, prefix string) bool {
+	if strings.Contains(prefix, "://") || path == prefix {
+		return strings.HasPrefix(path, prefix)
+	}
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// checkStatements rejects a request which has more statements than
+// MaxStatements, before executing any of them.
+func (srv *Server) checkStatements(query string) error {
+	limit := srv.config.MaxStatements
+	if limit <= 0 {
+		return nil
+	}
+	if n := sqltext.CountStatements(query); n > limit {
+		return httperror.Newf(400, "Too many statements: %d exceed the limit %d", n, limit)
+	}
+	return nil
+}
+
+// checkColumns rejects a result which has more columns than MaxColumns.
+func (srv *Server) checkColumns(columnTypes []*sql.ColumnType) error {
+	limit := srv.config.MaxColumns
+	if limit <= 0 {
+		return nil
+	}
+	if n := len(columnTypes); n > limit {
+		return httperror.Newf(400, "Too many columns: %d exceed the limit %d", n, limit)
+	}
+	return nil
+}
+
+// executeQuery executes a query with args on the connection of the client, and
+// writes its result in the format requested.
+func (srv *Server) executeQuery(w http.ResponseWriter, r *http.Request, query string, args ...any) (err error) {
+	if srv.checkDataVersion(w, r, query) {
+		return nil
 	}
-	query, err := readQuery(r)
+
+	// HEAD executes the query and renders the body to count its length, but
+	// discards it.
+	var out io.Writer = w
+	var counter *countWriter
+	if r.Method == "HEAD" {
+		counter = &countWriter{}
+		out = counter
+	}
+	maxSize, err := srv.maxResponseSize(r)
 	if err != nil {
-		return httperror.Newf(400, "No queries: %s", err)
+		return err
+	}
+	var limited *limitWriter
+	if maxSize > 0 && counter == nil {
+		limited = &limitWriter{w: w, limit: maxSize}
+		out = limited
+	}
+	var embed *embedBuffer
+	if isEmbedRequest(r) {
+		if srv.config.MaxEmbedSize <= 0 {
+			return httperror.Newf(400, "Embedding results is disabled")
+		}
+		if isScalarRequest(r) {
+			return httperror.Newf(400, "embed=1 can't be used with scalar=1")
+		}
+		embed = &embedBuffer{limit: srv.config.MaxEmbedSize}
+		out = embed
 	}
 
 	// determine format from the request
-	format := getFormat(r)
-	factory, formatWriter, err := formatter.FindAndCreate(format, w)
+	format := srv.formatDefaults(getFormat(r, srv.config.DefaultFormat))
+	factory, formatWriter, err := formatter.FindAndCreate(format, out)
 	if err != nil {
 		return httperror.Newf(400, "Unsupported format: %s", err)
 	}
 
+	sink, err := srv.checkSink(w, r)
+	if err != nil {
+		return err
+	}
+	hash, err := getResultHash(r)
+	if err != nil {
+		return err
+	}
+	timeout, err := srv.queryTimeout(r)
+	if err != nil {
+		return err
+	}
+
 	// Determine a database connection which associated with the requenst.
-	client, err := srv.connManager.Client(r.Context())
+	client, conn, err := srv.clientConn(w, r)
 	if err != nil {
-		return httperror.Newf(500, "No associated DB: %s", err)
+		return err
 	}
-	w.Header().Set(ConnectionIDHeader, client.ID.String())
-	conn, err := client.Conn()
+	// An error after the status is sent isn't returned, but tracked too.
+	var streamErr error
+	defer func() { srv.trackLastError(client.ID, query, cmp.Or(err, streamErr)) }()
+	unlock, err := srv.lockQuery(r, client)
 	if err != nil {
-		if errors.Is(err, conndb.ErrMaxDB) {
-			return httperror.Newf(429, err.Error())
-		}
-		return httperror.Newf(500, "Failed to connect DB: %s", err)
+		return err
+	}
+	defer unlock()
+	inTxn, err := srv.beginIdleTransaction(client)
+	if err != nil {
+		return err
+	}
+	defer func() { srv.endIdleTransaction(client, conn, query, inTxn, err != nil) }()
+	release, err := srv.acquireWorker(r.Context())
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	// Register an executing query, and defer unregister it.
-	q := srv.queryDatabase.Add(r.Context(), client.ID, query)
+	// Register an executing query, and defer unregister it. The timeout is
+	// applied to queries to prepare it, like pivot_on and count=1, too.
+	q := srv.queryDatabase.AddTimeout(r.Context(), client.ID, query, timeout)
 	w.Header().Set(QueryIDHeader, q.ID.String())
 	defer q.Close()
 
+	query, err = srv.pivotQuery(q.Context(), w, r, conn, query, args...)
+	if err != nil {
+		return err
+	}
+	if isShowSQLRequest(r) {
+		return writeEffectiveSQL(w, query, args)
+	}
+	if err := srv.checkEstimatedRows(q.Context(), r, conn, query, args...); err != nil {
+		return err
+	}
+	if err := srv.countRows(q.Context(), w, r, conn, query, args...); err != nil {
+		return err
+	}
+	if srv.config.UnsupportedType == "cast" {
+		query, err = castUnsupportedQuery(q.Context(), conn, query, args...)
+		if err != nil {
+			return srv.executionError(w, err)
+		}
+	}
+
 	if r.Header.Get("Expect") == "100-continue" {
 		w.WriteHeader(http.StatusContinue)
 	}
 
+	// Reset the session after the query, which runs after closing rows.
+	if srv.config.DBResetBetweenQueries {
+		defer func() {
+			if err := resetTempObjects(context.WithoutCancel(r.Context()), conn); err != nil {
+				srv.logger.Warn("failed to reset temporary objects", "connID", client.ID, "error", err)
+			}
+		}()
+	}
+
 	// Execute a query
-	rows, err := conn.QueryContext(q.Context(), query)
+	srv.logger.Debug("execute query", "connID", client.ID, "queryID", q.ID.String(), "query", query)
+	command := srv.ackCommand(query)
+	var rows *sql.Rows
+	var result sql.Result
+	if command != "" {
+		result, err = conn.ExecContext(q.Context(), query, args...)
+	} else {
+		rows, err = conn.QueryContext(q.Context(), query, args...)
+	}
 	dur := time.Since(q.Start)
+	srv.queryMetrics.observe(r.Header.Get(QueryTagHeader), dur, srv.config.MetricsMaxTags)
 	if r, ok := w.(accesslog.QueryReporter); ok {
 		r.QueryReport(query, dur)
 	}
 	w.Header().Set(DurationHeader, dur.String())
 	if err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			return httperror.Newf(504, err.Error())
+		return srv.executionError(w, err)
+	}
+	if command != "" {
+		srv.dataChanged(w, query)
+		return writeCommandAck(w, command, result)
+	}
+	defer rows.Close()
+	srv.dataChanged(w, query)
+
+	// Peek the first row to know whether the result is empty before the
+	// status is sent.
+	pr := &peekRows{Rows: rows}
+	has := pr.peek()
+	if err := srv.checkColumns(pr.columnTypes); err != nil {
+		return err
+	}
+	if cols := unsupportedColumns(pr.columnTypes); len(cols) > 0 {
+		switch srv.config.UnsupportedType {
+		case "error", "cast":
+			// Queries which can't be cast by castUnsupportedQuery fail here.
+			return unsupportedTypeError(cols[0])
+		}
+	}
+	if err := projectColumns(r, pr); err != nil {
+		return err
+	}
+	if srv.config.DuplicateColumn == "error" {
+		if name, ok := duplicateColumn(pr.columnTypes); ok {
+			return httperror.Newf(422, "Duplicate column name: %q", name)
 		}
-		if _, ok := err.(*duckdb.Error); !ok {
-			return httperror.Newf(500, "DB error: %s", err)
+	}
+	if !has {
+		if err := rows.Err(); err != nil {
+			return srv.executionError(w, err)
+		}
+	}
+	if hash != "" {
+		return srv.writeResultHash(q.Context(), w, pr)
+	}
+	if sink {
+		return srv.writeNullSink(q.Context(), w, pr)
+	}
+	if isScalarRequest(r) {
+		return writeScalar(w, out, format, pr, has)
+	}
+	if !has {
+		w.Header().Set(EmptyResultHeader, "true")
+		if srv.config.EmptyResultStatus == 204 && embed == nil {
+			w.Header().Set(RowCountHeader, "0")
+			w.WriteHeader(204)
+			return nil
 		}
-		return httperror.Newf(400, "Query error: %s", err)
 	}
-	defer rows.Close()
 
-	// Write the response body
+	if embed != nil {
+		return writeEmbed(q.Context(), w, factory, formatWriter, pr, embed)
+	}
 	w.Header().Set("Content-Type", factory.ContentType())
+	if d, ok := factory.(formatter.Downloader); ok {
+		w.Header().Set("Content-Disposition", `attachment; filename="result`+d.FileExtension()+`"`)
+	}
+	if counter != nil {
+		n, err := writeRows(q.Context(), formatWriter, pr, nil)
+		if err != nil {
+			return serializationError(err)
+		}
+		w.Header().Set(RowCountHeader, strconv.FormatInt(n, 10))
+		w.Header().Set("Content-Length", strconv.FormatInt(counter.n, 10))
+		w.WriteHeader(200)
+		return nil
+	}
+
+	// Write the response body. The number of rows is sent as a trailer.
+	trailers := RowCountHeader + ", " + ErrorHeader
+	if limited != nil {
+		trailers += ", " + TruncatedHeader
+	}
+	w.Header().Set("Trailer", trailers)
 	w.WriteHeader(200)
-	err = writeRows(q.Context(), formatWriter, rows)
+	n, err := writeRows(q.Context(), formatWriter, pr, srv.rowFlusher(w, formatWriter))
+	if errors.Is(err, errResponseTooLarge) {
+		w.Header().Set(TruncatedHeader, "true")
+		err = fmt.Errorf("%w: exceeded the limit %d bytes", err, limited.limit)
+	}
 	if err != nil {
-		return httperror.Newf(500, "Serialization error: %s", err)
+		streamErr = srv.streamError(w, formatWriter, err)
 	}
+	w.Header().Set(RowCountHeader, strconv.FormatInt(n, 10))
 	return nil
 }
 
-func readQuery(r *http.Request) (string, error) {
-	b, err := io.ReadAll(r.Body)
+// serializationError converts an error of writing rows before the status is
+// sent to an HTTP error.
+func serializationError(err error) error {
+	if errors.Is(err, formatter.ErrNonFinite) {
+		return httperror.Newf(422, "Serialization error: %s", err)
+	}
+	return httperror.Newf(500, "Serialization error: %s", err)
+}
+
+// trackLastError records err as the last error of the connection, or clears
+// it when err is nil. The query is redacted as access logs.
+func (srv *Server) trackLastError(id conndb.ID, query string, err error) {
+	if err == nil {
+		srv.lastErrors.Delete(id)
+		return
+	}
+	if srv.config.AccessLogRedact {
+		query = sqltext.Redact(query)
+	}
+	srv.lastErrors.Store(id, &LastError{
+		Message: err.Error(),
+		Time:    time.Now(),
+		Query:   query,
+	})
+}
+
+// streamError reports an error which occurs after the status is sent. The rows
+// written so far are sent, then the error is told with ErrorHeader trailer, and
+// with an error marker if the format supports it. It returns the error as
+// told.
+func (srv *Server) streamError(w http.ResponseWriter, fw formatter.Writer, err error) error {
+	label := "Serialization error"
+	var de *duckdb.Error
+	if errors.As(err, &de) {
+		label = "Query error"
+	} else if errors.Is(err, errResponseTooLarge) {
+		label = "Truncated"
+	}
+	msg, _ := srv.errorMessage(label, err)
+	if ew, ok := fw.(formatter.ErrorWriter); ok {
+		err = ew.WriteError(msg)
+	} else if bf, ok := fw.(formatter.BufferFlusher); ok {
+		err = bf.FlushBuffer()
+	}
+	if err != nil {
+		srv.logger.Debug("failed to write the error marker", "error", err)
+	}
+	w.Header().Set(ErrorHeader, strings.ReplaceAll(msg, "\n", " "))
+	return errors.New(msg)
+}
+
+// executionError converts an error of executing a query to an HTTP error.
+func (srv *Server) executionError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return httperror.Newf(504, "%s", err)
+	}
+	if isOutOfMemory(err) {
+		return srv.queryError(w, 507, "Out of memory", err)
+	}
+	// Errors of ExecContext wrap *duckdb.Error.
+	var de *duckdb.Error
+	if !errors.As(err, &de) {
+		return srv.queryError(w, 500, "DB error", err)
+	}
+	return srv.queryError(w, 400, "Query error", err)
+}
+
+// peekRows is *sql.Rows which can peek the first row. It emits only a part of
+// the columns when projection is set by projectColumns.
+type peekRows struct {
+	*sql.Rows
+	columnTypes []*sql.ColumnType
+	err         error
+	peeked      bool
+	has         bool
+
+	projection []int
+	dests      []any
+}
+
+// peek advances to the first row, and reports whether it exists. Following
+// Next returns the result of it. The column types are retrieved in advance,
+// because they can't be after rows are closed by the end of them.
+func (pr *peekRows) peek() bool {
+	pr.columnTypes, pr.err = pr.Rows.ColumnTypes()
+	pr.peeked = true
+	pr.has = pr.Rows.Next()
+	return pr.has
+}
+
+func (pr *peekRows) ColumnTypes() ([]*sql.ColumnType, error) {
+	if pr.columnTypes != nil || pr.err != nil {
+		return pr.columnTypes, pr.err
+	}
+	return pr.Rows.ColumnTypes()
+}
+
+func (pr *peekRows) Scan(dest ...any) error {
+	if pr.projection == nil {
+		return pr.Rows.Scan(dest...)
+	}
+	for i, idx := range pr.projection {
+		pr.dests[idx] = dest[i]
+	}
+	return pr.Rows.Scan(pr.dests...)
+}
+
+func (pr *peekRows) Next() bool {
+	if pr.peeked {
+		pr.peeked = false
+		return pr.has
+	}
+	return pr.Rows.Next()
+}
+
+// unsupportedColumns returns the columns which writers can't represent.
+func unsupportedColumns(columnTypes []*sql.ColumnType) []*sql.ColumnType {
+	var cols []*sql.ColumnType
+	for _, typ := range columnTypes {
+		if !formatter.IsSupported(typ) {
+			cols = append(cols, typ)
+		}
+	}
+	return cols
+}
+
+func unsupportedTypeError(typ *sql.ColumnType) error {
+	return httperror.Newf(422, "Unsupported type of column %q: %s", typ.Name(), typ.DatabaseTypeName())
+}
+
+// duplicateColumn returns the first name of columns which is duplicated.
+func duplicateColumn(columnTypes []*sql.ColumnType) (string, bool) {
+	seen := make(map[string]bool, len(columnTypes))
+	for _, typ := range columnTypes {
+		if seen[typ.Name()] {
+			return typ.Name(), true
+		}
+		seen[typ.Name()] = true
+	}
+	return "", false
+}
+
+// asSubquery returns a query which can be embedded as a subquery. It fails
+// when the query has multiple statements or isn't a query like SELECT, which
+// includes WITH followed by a statement other than a query.
+func asSubquery(query string) (string, bool) {
+	if sqltext.CountStatements(query) != 1 {
+		return "", false
+	}
+	switch sqltext.StatementVerb(query) {
+	case "SELECT", "FROM", "VALUES", "TABLE":
+	default:
+		return "", false
+	}
+	// A newline ends a comment at the end of the query.
+	return "(" + sqltext.TrimTerminator(query) + "\n)", true
+}
+
+// castUnsupportedQuery rewrites a query to cast columns of unsupported types
+// to VARCHAR, before the query is executed. The types are of the query with
+// LIMIT 0, which DuckDB plans without executing it. The query is returned as
+// is when the columns are supported, or it can't be a subquery.
+func castUnsupportedQuery(ctx context.Context, conn *sql.Conn, query string, args ...any) (string, error) {
+	sub, ok := asSubquery(query)
+	if !ok {
+		return query, nil
+	}
+	rows, err := conn.QueryContext(ctx, "SELECT * FROM "+sub+" LIMIT 0", args...)
 	if err != nil {
 		return "", err
 	}
+	columnTypes, err := rows.ColumnTypes()
+	rows.Close()
+	if err != nil {
+		return "", err
+	}
+	cols := unsupportedColumns(columnTypes)
+	if len(cols) == 0 {
+		return query, nil
+	}
+	replaces := make([]string, len(cols))
+	for i, typ := range cols {
+		name := sqltext.QuoteIdent(typ.Name())
+		replaces[i] = "CAST(" + name + " AS VARCHAR) AS " + name
+	}
+	return "SELECT * REPLACE (" + strings.Join(replaces, ", ") + ") FROM " + sub, nil
+}
+
+// queryMethods returns the list of methods allowed for the query end point.
+func (srv *Server) queryMethods() string {
+	if srv.config.NoGetQuery {
+		return "POST, OPTIONS"
+	}
+	return "GET, POST, HEAD, OPTIONS"
+}
+
+// handleQueryOptions responds the allowed methods and headers for CORS.
+func handleQueryOptions(w http.ResponseWriter, r *http.Request, methods string) error {
+	h := w.Header()
+	h.Set("Allow", methods)
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", methods)
+	h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Expect")
+	h.Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(204)
+	return nil
+}
+
+// countWriter counts bytes written and discards them.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+// isOutOfMemory checks the error is caused by lack of memory or temporary
+// storage.
+func isOutOfMemory(err error) bool {
+	var de *duckdb.Error
+	return errors.As(err, &de) && de.Type == duckdb.ErrorTypeOutOfMemory
+}
+
+// clientConn determines a client and its database connection which associated
+// with the request.
+func (srv *Server) clientConn(w http.ResponseWriter, r *http.Request) (*conndb.Client, *sql.Conn, error) {
+	if err := srv.attachSession(r); err != nil {
+		return nil, nil, err
+	}
+	client, err := srv.connManager.Client(r.Context())
+	if err != nil {
+		return nil, nil, httperror.Newf(500, "No associated DB: %s", err)
+	}
+	w.Header().Set(ConnectionIDHeader, client.ID.String())
+	if err := srv.keepSession(w, r, client); err != nil {
+		return nil, nil, err
+	}
+	conn, err := client.Conn(r.Context())
+	if err != nil {
+		if errors.Is(err, conndb.ErrMaxDB) {
+			return nil, nil, srv.overloaded(429, reasonMaxDB, "%s", err)
+		}
+		return nil, nil, httperror.Newf(500, "Failed to connect DB: %s", err)
+	}
+	return client, conn, nil
+}
+
+// lockQuery waits for other queries of the client to serialize queries on its
+// dedicated connection, unless DBConcurrentQueries is set. The returned
+// function releases the lock.
+func (srv *Server) lockQuery(r *http.Request, client *conndb.Client) (func(), error) {
+	if srv.config.DBConcurrentQueries {
+		return func() {}, nil
+	}
+	unlock, err := client.LockQuery(r.Context())
+	if err != nil {
+		return nil, httperror.Newf(504, "%s", err)
+	}
+	return unlock, nil
+}
+
+// attachSession attaches the DB kept for the connection of
+// ConnectionIDHeader of the request, to the connection of the request.
+func (srv *Server) attachSession(r *http.Request) error {
+	s := r.Header.Get(ConnectionIDHeader)
+	if s == "" || srv.config.MaxKeepSession <= 0 {
+		return nil
+	}
+	id, err := conndb.ParseID(s)
+	if err != nil {
+		return httperror.Newf(400, "ID syntax error: %s", err)
+	}
+	owner, _ := authn.AuthnID(r.Context())
+	switch err := srv.connManager.Attach(r.Context(), id, string(owner)); {
+	case errors.Is(err, conndb.ErrNoKeptClient):
+		return httperror.Newf(404, "No kept sessions: %s", id)
+	case errors.Is(err, conndb.ErrAlreadyOpened):
+		return httperror.Newf(409, "The connection has its own DB already")
+	case err != nil:
+		return httperror.Newf(500, "Failed to attach the session: %s", err)
+	}
+	return nil
+}
+
+// keepSession keeps the DB of the client after its connection is closed, for
+// the duration of KeepSessionHeader bounded by MaxKeepSession.
+func (srv *Server) keepSession(w http.ResponseWriter, r *http.Request, client *conndb.Client) error {
+	s := r.Header.Get(KeepSessionHeader)
+	if s == "" || srv.config.MaxKeepSession <= 0 {
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return httperror.Newf(400, "Invalid %s: %q", KeepSessionHeader, s)
+	}
+	d = min(d, srv.config.MaxKeepSession)
+	owner, _ := authn.AuthnID(r.Context())
+	srv.connManager.Keep(client, d, string(owner))
+	w.Header().Set(KeepSessionHeader, d.String())
+	return nil
+}
+
+func readQuery(r *http.Request) (string, []any, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if query, args, ok := readFormQuery(r, b); ok {
+		return query, args, nil
+	}
 	if len(b) > 0 {
-		return string(b), nil
+		return string(b), nil, nil
 	}
-	return readQparamQuery(r)
+	query, err := readQparamQuery(r)
+	return query, nil, err
+}
+
+// readFormQuery reads a query from "q" or "query" field of a form submitted
+// with POST, and its positional arguments from "arg" fields in order. A body
+// without those fields is treated as a raw query, because "curl -d" sends it
+// as a form too.
+func readFormQuery(r *http.Request, body []byte) (string, []any, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != "POST" || mediaType != "application/x-www-form-urlencoded" {
+		return "", nil, false
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", nil, false
+	}
+	query := form.Get("q")
+	if query == "" {
+		query = form.Get("query")
+	}
+	if query == "" {
+		return "", nil, false
+	}
+	var args []any
+	for _, v := range form["arg"] {
+		args = append(args, v)
+	}
+	return query, args, true
 }
 
 func readQparamQuery(r *http.Request) (string, error) {
@@ -558,62 +2579,211 @@ func readQparamQuery(r *http.Request) (string, error) {
 	return "", ErrNoQuery
 }
 
-func getFormat(r *http.Request) string {
+// acceptFormats are formats selected by media types in Accept header.
+var acceptFormats = map[string]string{
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": "xlsx",
+}
+
+// getFormat returns the format given by "format" or "f" parameter, one of
+// acceptFormats in Accept header, or the default format. Accept header isn't
+// negotiated otherwise, so clients without it, like wget, get the same result
+// as curl which sends "Accept: */*".
+func getFormat(r *http.Request, defaultFormat string) string {
 	q := r.URL.Query()
 	format := q.Get("format")
 	if format == "" {
 		format = q.Get("f")
 	}
+	if format == "" {
+		format = acceptFormat(r)
+	}
 	if format == "" {
 		format = defaultFormat
 	}
 	return format
 }
 
-func writeRows(ctx context.Context, fw formatter.Writer, rows *sql.Rows) error {
+// acceptFormat returns the format of the first media type in Accept header
+// which is one of acceptFormats, or "".
+func acceptFormat(r *http.Request) string {
+	for _, v := range r.Header.Values("Accept") {
+		for s := range strings.SplitSeq(v, ",") {
+			mediaType, _, _ := strings.Cut(s, ";")
+			if format, ok := acceptFormats[strings.ToLower(strings.TrimSpace(mediaType))]; ok {
+				return format
+			}
+		}
+	}
+	return ""
+}
+
+// rowFlusher returns a function which is called after each row is written, to
+// flush the response with FlushRows and FlushInterval. It returns nil when
+// flushing is disabled or not supported by the format.
+func (srv *Server) rowFlusher(w http.ResponseWriter, fw formatter.Writer) func() error {
+	bf, ok := fw.(formatter.BufferFlusher)
+	if !ok || (srv.config.FlushRows <= 0 && srv.config.FlushInterval <= 0) {
+		return nil
+	}
+	rc := http.NewResponseController(w)
+	var n int
+	last := time.Now()
+	return func() error {
+		n++
+		if (srv.config.FlushRows <= 0 || n < srv.config.FlushRows) &&
+			(srv.config.FlushInterval <= 0 || time.Since(last) < srv.config.FlushInterval) {
+			return nil
+		}
+		n = 0
+		last = time.Now()
+		if err := bf.FlushBuffer(); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+}
+
+// formatDefaults adds parameters configured as defaults of the server to the
+// format, unless they are given explicitly.
+func (srv *Server) formatDefaults(format string) string {
+	parts := strings.Split(format, ",")
+	if srv.config.JSONBigIntAsString && strings.EqualFold(parts[0], "json") {
+		if !hasFormatParam(parts[1:], "bigint") {
+			format += ",bigint:string"
+		}
+	}
+	if srv.config.JSONNonFinite != "null" && strings.EqualFold(parts[0], "json") {
+		if !hasFormatParam(parts[1:], "nonfinite") {
+			format += ",nonfinite:" + srv.config.JSONNonFinite
+		}
+	}
+	if srv.config.DuplicateColumn == "suffix" && (strings.EqualFold(parts[0], "json") || strings.EqualFold(parts[0], "csv")) {
+		if !hasFormatParam(parts[1:], "dedup") {
+			format += ",dedup"
+		}
+	}
+	if strings.EqualFold(parts[0], "csv") {
+		for _, param := range srv.csvParams {
+			if name, _, _ := strings.Cut(param, ":"); !hasFormatParam(parts[1:], name) {
+				format += "," + param
+			}
+		}
+	}
+	return format
+}
+
+// hasFormatParam checks the parameter is given in params of a format.
+func hasFormatParam(params []string, name string) bool {
+	return slices.ContainsFunc(params, func(p string) bool {
+		return p == name || strings.HasPrefix(p, name+":")
+	})
+}
+
+// resultRows is an interface of *sql.Rows used by writeRows.
+type resultRows interface {
+	ColumnTypes() ([]*sql.ColumnType, error)
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+}
+
+// writeRows writes all rows with formatter.Writer, and returns the number of
+// written rows. flush is called after each row if not nil.
+func writeRows(ctx context.Context, fw formatter.Writer, rows resultRows, flush func() error) (int64, error) {
 	if err := ctx.Err(); err != nil {
-		return err
+		return 0, err
 	}
 	// Write the header
 	columnTypes, err := rows.ColumnTypes()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	err = fw.WriteHeader(columnTypes)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if err := ctx.Err(); err != nil {
-		return err
+		return 0, err
 	}
 	// Prepare for scan
-	receivers := make([]any, len(columnTypes))
-	values := make([]any, len(columnTypes))
-	for i := range receivers {
-		receivers[i] = new(any)
-	}
+	scanner := formatter.NewScanner(columnTypes)
+	var n int64
 	for rows.Next() {
 		if err := ctx.Err(); err != nil {
-			return err
+			return n, err
 		}
-		err := rows.Scan(receivers...)
+		err := rows.Scan(scanner.Dests()...)
 		if err != nil {
-			return err
-		}
-		for i, pv := range receivers {
-			values[i] = *pv.(*any)
+			return n, err
 		}
-		err = fw.WriteBody(values)
+		err = fw.WriteBody(scanner.Values())
 		if err != nil {
-			return err
+			return n, err
+		}
+		n++
+		if flush != nil {
+			if err := flush(); err != nil {
+				return n, err
+			}
 		}
 	}
-	return fw.Flush()
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, fw.Flush()
+}
+
+// Status is a summary of the server status.
+type Status struct {
+	Connections int    `json:"Connections"`
+	Databases   int    `json:"Databases"`
+	Queries     int    `json:"Queries"`
+	Uptime      string `json:"Uptime"`
+	MaxDB       int    `json:"MaxDB"`
+	ReadOnly    bool   `json:"ReadOnly"`
+	Draining    bool   `json:"Draining"`
+}
+
+// handleStatus responds a summary of the server status. It only reads
+// counters, so it is cheap enough to be used during incidents.
+func (srv *Server) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	srv.startedMu.Lock()
+	startedAt := srv.startedAt
+	srv.startedMu.Unlock()
+	s := Status{
+		Connections: srv.connManager.Connections(),
+		Databases:   srv.connManager.DBCount(),
+		Queries:     srv.queryDatabase.Count(),
+		Uptime:      time.Since(startedAt).Round(time.Second).String(),
+		MaxDB:       srv.connManager.MaxDB,
+		ReadOnly:    srv.readOnly.Load(),
+		Draining:    srv.draining.Load(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(s)
 }
 
 type ConnectionStatus struct {
 	ID      string      `json:"ID"`
 	DBStats sql.DBStats `json:"DBStats"`
+
+	// LastError is the last error of queries, which is included only for
+	// the status of a connection.
+	LastError *LastError `json:"LastError,omitempty"`
+}
+
+// LastError describes the last error of queries of a connection.
+type LastError struct {
+	Message string    `json:"Message"`
+	Time    time.Time `json:"Time"`
+	Query   string    `json:"Query"`
 }
 
 func (srv *Server) handleStatusConnections(w http.ResponseWriter, r *http.Request) error {
@@ -635,6 +2805,55 @@ func (srv *Server) handleStatusConnections(w http.ResponseWriter, r *http.Reques
 	return nil
 }
 
+// handleStatusConnection responds the status of a connection with its last
+// error, which can include a query.
+func (srv *Server) handleStatusConnection(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	id, err := conndb.ParseID(r.PathValue("connID"))
+	if err != nil {
+		return httperror.Newf(400, "ID syntax error: %s", err)
+	}
+	for dbID, db := range srv.connManager.Databases() {
+		if dbID != id {
+			continue
+		}
+		s := ConnectionStatus{
+			ID:      id.String(),
+			DBStats: db.Stats(),
+		}
+		s.LastError, _ = srv.lastErrors.Load(id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+	return httperror.New(404)
+}
+
+// DatabaseStatus describes the status of databases.
+type DatabaseStatus struct {
+	// LastOpen is parameters used to open the last DB. It is null when no DBs
+	// have been opened.
+	LastOpen *OpenParams `json:"LastOpen"`
+}
+
+func (srv *Server) handleStatusDatabase(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	srv.lastOpenMu.Lock()
+	s := DatabaseStatus{LastOpen: srv.lastOpen}
+	srv.lastOpenMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
 func (srv *Server) handleStatusQueries(w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Content-Type", "application/jsonlines")
 	w.WriteHeader(200)
@@ -651,6 +2870,31 @@ func (srv *Server) handleStatusQueries(w http.ResponseWriter, r *http.Request) e
 	return nil
 }
 
+// InterruptResult is the result of interruption of queries.
+type InterruptResult struct {
+	Count int `json:"Count"`
+}
+
+// handleInterruptConnQueries interrupts all queries of the connection
+// specified by "connID" query parameter.
+func (srv *Server) handleInterruptConnQueries(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	s := r.URL.Query().Get("connID")
+	if s == "" {
+		return httperror.Newf(400, "No connID specified")
+	}
+	id, err := conndb.ParseID(s)
+	if err != nil {
+		return httperror.Newf(400, "ID syntax error: %s", err)
+	}
+	n := srv.queryDatabase.CancelConn(id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(InterruptResult{Count: n})
+}
+
 func (srv *Server) handleInterruptQuery(w http.ResponseWriter, r *http.Request) error {
 	if err := srv.checkAuthz(w, r); err != nil {
 		return err
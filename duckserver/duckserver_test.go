@@ -1,18 +1,25 @@
 package duckserver_test
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,6 +29,9 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/koron/duckpop/duckserver"
 	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/formatter"
+	"github.com/koron/duckpop/internal/sqltext"
 )
 
 const (
@@ -336,11 +346,114 @@ func TestPing(t *testing.T) {
 	assert.Equal(t, "OK\r\n", got)
 }
 
+func TestDrainDelay(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DrainDelay = time.Second
+		return c
+	})
+	testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+	ts.cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	for _, path := range []string{"/ping/", "/?q=SELECT+1"} {
+		resp, err := doGet(ts, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, true, resp.Close)
+		got, err := readResponse2(resp, err, 503, 503)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Server is shutting down\n", got)
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	ln.Close()
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.Address = "[::1]:0"
+		return c
+	})
+	if !strings.HasPrefix(ts.URL, "http://[::1]:") {
+		t.Errorf("unexpected URL: %s", ts.URL)
+	}
+	rh1 := testQuery0(t, ts, "CREATE TABLE t AS SELECT 1 AS A", "Count\n1\n")
+	rh2 := testQuery0(t, ts, "SELECT * FROM t", "A\n1\n")
+	assert.Equal(t, rh1.ConnectionID, rh2.ConnectionID)
+}
+
+func TestPingPath(t *testing.T) {
+	configPingPath := func(path string) configOption {
+		return func(c *duckserver.Config) *duckserver.Config {
+			c.PingPath = path
+			return c
+		}
+	}
+	t.Run("custom", func(t *testing.T) {
+		ts := startServer1(t, configPingPath("/health"))
+		got, err := readResponse(doGet(ts, "/health"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "OK\r\n", got)
+		resp, err := doGet(ts, "/ping/")
+		_, err = readResponse2(resp, err, 404, 404)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		ts := startServer1(t, configPingPath(""))
+		resp, err := doGet(ts, "/ping/")
+		_, err = readResponse2(resp, err, 404, 404)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("head", func(t *testing.T) {
+		ts := startServer0(t)
+		req, err := http.NewRequest("HEAD", ts.URL+"/ping/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readResponse(doReq(ts, req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", got)
+	})
+}
+
 func TestQueryDuckDBVersion(t *testing.T) {
 	ts := startServer0(t)
 	testQuery0(t, ts, versionQuery, versionWant)
 }
 
+func TestRowCountTrailer(t *testing.T) {
+	ts := startServer0(t)
+	resp, err := doPost(ts, "/?f=csv", `SELECT i FROM range(5) t(i)`)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "i\n0\n1\n2\n3\n4\n", got)
+	assert.Equal(t, "5", resp.Trailer.Get(duckserver.RowCountHeader))
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	ts := startServer0(t)
+	got, err := readResponse(doPost(ts, "/?f=json,envelope", `SELECT i FROM range(2) t(i)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "{\"rows\":[{\"i\":0},\n{\"i\":1}],\"count\":2}\n", got)
+}
+
 type TestConnStatus struct {
 	ID      string      `json:"ID"`
 	DBStats sql.DBStats `json:"DBStats"`
@@ -371,6 +484,32 @@ func TestStatusConnections(t *testing.T) {
 	wg.Wait()
 }
 
+func TestDBConnsPool(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBMaxIdleConns = 1
+		c.DBMaxOpenConns = 3
+		return c
+	})
+	// Open a DB for the connection, and make an idle connection with a
+	// parallel batch.
+	_, err := readResponse(doPost(ts, "/batch/?parallel=true", `[{"id":"q1","query":"SELECT 1"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readJSONL[TestConnStatus](doGet(ts, "/status/connections/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []TestConnStatus{
+		{DBStats: sql.DBStats{
+			MaxOpenConnections: 3,
+			OpenConnections:    2,
+			InUse:              1,
+			Idle:               1,
+		}},
+	}, got, cmpopts.IgnoreFields(TestConnStatus{}, "ID"))
+}
+
 // TestQueryStats contains query statistics.
 type TestQueryStats struct {
 	ID       string `json:"ID"`
@@ -426,6 +565,103 @@ func TestCancelQuery(t *testing.T) {
 	})
 }
 
+func TestCancelConnQueries(t *testing.T) {
+	ts := startServer0(t)
+	t.Run("canceled", func(t *testing.T) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := doPost(ts, "/", `SELECT count(md5(i::VARCHAR)) as count_md5 FROM range(0, 100000000, 1) t1(i)`)
+			if _, err := readResponse2(r, err, 504, 504); err != nil {
+				t.Errorf("slow query failed: %s", err)
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+		queries, err := readJSONL[TestQueryStats](doGet(ts, "/status/queries/"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(queries) != 1 {
+			t.Errorf("unexpected number of queries: %d", len(queries))
+			return
+		}
+		r, err := doDelete(ts, "/status/queries/?connID="+queries[0].ConnID)
+		got, err := readResponse(r, err)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "{\"Count\":1}\n", got)
+		wg.Wait()
+	})
+	t.Run("no queries", func(t *testing.T) {
+		r, err := doDelete(ts, "/status/queries/?connID=C_deadbeaf")
+		got, err := readResponse(r, err)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "{\"Count\":0}\n", got)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		r, err := doDelete(ts, "/status/queries/?connID=dummy")
+		got, err := readResponse2(r, err, 400, 400)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "ID syntax error: connection ID should starts with \"C_\"\n", got)
+	})
+}
+
+// panicFactory is a formatter which panics, to test recovery from it.
+type panicFactory struct{}
+
+func (panicFactory) ContentType() string { return "text/plain" }
+
+func (panicFactory) Create(w io.Writer, params map[string]string) (formatter.Writer, error) {
+	if _, ok := params["create"]; ok {
+		panic("panic in Create")
+	}
+	return panicWriter{}, nil
+}
+
+type panicWriter struct{}
+
+func (panicWriter) WriteHeader([]*sql.ColumnType) error { return nil }
+func (panicWriter) WriteBody([]any) error               { panic("panic in WriteBody") }
+func (panicWriter) Flush() error                        { return nil }
+
+func init() {
+	formatter.Register(panicFactory{}, "test.panic")
+}
+
+func TestRecoverPanic(t *testing.T) {
+	ts := startServer0(t)
+	t.Run("before response", func(t *testing.T) {
+		resp, err := doPost(ts, "/?f=test.panic,create", "SELECT 1")
+		got, err := readResponse2(resp, err, 500, 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errorID := resp.Header.Get(duckserver.ErrorIDHeader)
+		assert.Equal(t, "Internal error: error ID "+errorID+"\n", got)
+	})
+	t.Run("during response", func(t *testing.T) {
+		resp, err := doPost(ts, "/?f=test.panic", "SELECT 1")
+		if _, err := readResponse(resp, err); err != nil {
+			t.Fatal(err)
+		}
+		// The query has been unregistered.
+		queries, err := readJSONL[TestQueryStats](doGet(ts, "/status/queries/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, len(queries))
+	})
+	// The server is still alive.
+	testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+}
+
 func configAuthn(name string, noauthz bool) configOption {
 	return func(c *duckserver.Config) *duckserver.Config {
 		c.AuthnFile = name
@@ -478,137 +714,2706 @@ func TestAuthnInterruptQuery(t *testing.T) {
 	})
 }
 
-func TestSharedDir(t *testing.T) {
-	ts := startServer0(t)
-	testQuery0(t, ts, `COPY (SELECT * FROM duckdb_settings() LIMIT 50) TO (public_dir('settings.csv'))`, "Count\n50\n")
+func TestAuthnInitQuery(t *testing.T) {
+	ts := startServer1(t, configAuthn("testdata/authn.json", false))
+	testAuthorizedQuery(t, ts, "SELECT current_setting('threads') AS T", "T\n2\n", new("threads-2"), authorizationBearer("token-threads-2"))
+}
 
-	assert.IsRegularFile(t, filepath.Join(ts.srv.SharedDir(), "settings.csv"))
-	if t.Failed() {
-		return
-	}
+func TestDBStrategyAuthn(t *testing.T) {
+	var homedir string
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		homedir = c.DBHomeDir
+		c.AuthnFile = "testdata/authn.json"
+		c.DBStrategy = "authn"
+		c.DBTenantFile = true
+		return c
+	})
+	token1 := authorizationBearer("token-0123456789abcdef")
+	token2 := authorizationBearer("foobarbaz")
 
+	rh1 := testQuery1(t, ts, `CREATE TEMP TABLE t1 AS SELECT 1 AS A`, "Count\n1\n", token1)
+	// The temp table persists across connections of the tenant.
 	closeIdleConnections(t, ts)
-	testQuery0(t, ts, `CREATE TABLE shared_settings AS SELECT * FROM read_csv_auto(public_dir('settings.csv'))`, "Count\n50\n")
+	rh2 := testQuery1(t, ts, `SELECT * FROM t1`, "A\n1\n", token1)
+	assert.Equal(t, rh1.ConnectionID, rh2.ConnectionID)
+	// It is invisible to others.
+	resp, err := doPost(ts, "/?f=csv", `SELECT * FROM t1`, token2)
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
+		t.Error(err)
+	}
+
+	assert.IsRegularFile(t, filepath.Join(homedir, "tenant-token1.duckdb"))
 }
 
-func TestPrivateDir(t *testing.T) {
-	ts := startServer0(t)
-	privateRoot := ts.srv.PrivateRoot()
+func TestDBStrategyAuthnEviction(t *testing.T) {
+	var homedir string
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		homedir = c.DBHomeDir
+		c.AuthnFile = "testdata/authn.json"
+		c.DBStrategy = "authn"
+		c.DBTenantFile = true
+		c.MaxDB = 1
+		return c
+	})
+	token1 := authorizationBearer("token-0123456789abcdef")
+	token2 := authorizationBearer("token-viewer1")
 
-	// The contents of the private directory are preserved.
-	rh1 := testQuery0(t, ts, `COPY (SELECT * FROM duckdb_settings() LIMIT 50) TO (private_dir('settings.csv'))`, "Count\n50\n")
-	assert.IsRegularFile(t, filepath.Join(privateRoot, rh1.ConnectionID, "settings.csv"))
-	if t.Failed() {
-		return
+	testQuery1(t, ts, `CREATE TABLE t1 AS SELECT 1 AS A`, "Count\n1\n", token1)
+	// The DB of the tenant with a live connection isn't closed for others.
+	resp, err := doPost(ts, "/?f=csv", `SELECT 2 AS B`, token2)
+	if _, err := readResponse2(resp, err, 429, 429); err != nil {
+		t.Fatal(err)
 	}
-	testQuery0(t, ts, `CREATE TABLE shared_settings AS SELECT * FROM read_csv_auto(private_dir('settings.csv'))`, "Count\n50\n")
-
-	// Verify that the private directory is gone after disconnected.
+	// After the connection is closed, it is closed for others.
 	closeIdleConnections(t, ts)
 	time.Sleep(100 * time.Millisecond)
-	assert.IsNotExist(t, filepath.Join(privateRoot, rh1.ConnectionID))
+	testQuery1(t, ts, `SELECT 2 AS B`, "B\n2\n", token2)
+	closeIdleConnections(t, ts)
+	time.Sleep(100 * time.Millisecond)
+	// The tenant opens the DB again, with tables in the file.
+	testQuery1(t, ts, `SELECT * FROM t1`, "A\n1\n", token1)
+
+	assert.IsRegularFile(t, filepath.Join(homedir, "tenant-token1.duckdb"))
 }
 
-func TestReadQuery(t *testing.T) {
-	ts := startServer0(t)
+func TestDBStrategyShared(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBStrategy = "shared"
+		return c
+	})
+	rh1 := testQuery0(t, ts, `CREATE TEMP TABLE t1 AS SELECT 1 AS A`, "Count\n1\n")
+	// The temp table persists across connections.
+	closeIdleConnections(t, ts)
+	rh2 := testQuery0(t, ts, `SELECT * FROM t1`, "A\n1\n")
+	assert.Equal(t, rh1.ConnectionID, rh2.ConnectionID)
+}
 
-	t.Run("q", func(t *testing.T) {
-		got, err := readResponse(doGet(ts, "/?f=csv&q="+url.QueryEscape(versionQuery)))
+func TestDBStrategyPooled(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBStrategy = "pooled"
+		c.DBPoolSize = 2
+		return c
+	})
+	// Requests are assigned to DBs of the pool in round robin, even in a
+	// connection.
+	var ids []string
+	for range 4 {
+		rh := testQuery0(t, ts, `SELECT 1 AS A`, "A\n1\n")
+		ids = append(ids, rh.ConnectionID)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("requests should be assigned to different DBs: %v", ids)
+	}
+	assert.Equal(t, ids[0:2], ids[2:4])
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		t.Run(fmt.Sprintf("concurrent=%t", concurrent), func(t *testing.T) {
+			ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+				c.AuthnFile = "testdata/authn.json"
+				c.DBStrategy = "authn"
+				c.DBConcurrentQueries = concurrent
+				return c
+			})
+			token1 := authorizationBearer("token-0123456789abcdef")
+			// Concurrent requests use separate connections of HTTP, but all
+			// queries run on the shared DB of the tenant.
+			var wg sync.WaitGroup
+			for range 8 {
+				wg.Go(func() {
+					for range 5 {
+						resp, err := doPost(ts, "/?f=csv", `SELECT sum(i) AS S FROM range(100000) t(i)`, token1)
+						got, err := readResponse(resp, err)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if got != "S\n4999950000\n" {
+							t.Errorf("unexpected result: %q", got)
+						}
+					}
+				})
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestGetConfigDuckDB(t *testing.T) {
+	t.Run("settings", func(t *testing.T) {
+		ts := startServer0(t)
+		resp, err := doGet(ts, "/config/duckdb")
+		got, err := readResponse(resp, err)
 		if err != nil {
+			t.Fatal(err)
+		}
+		var settings map[string]*string
+		if err := json.Unmarshal([]byte(got), &settings); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]string{
+			"threads":                 "1",
+			"memory_limit":            "1.0 GiB",
+			"max_temp_directory_size": "2.0 GiB",
+			"lock_configuration":      "true",
+		} {
+			if v := settings[name]; v == nil {
+				t.Errorf("no setting for %s", name)
+			} else {
+				assert.Equal(t, want, *v)
+			}
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		ts := startServer1(t, configAuthn("testdata/authn.json", false))
+		resp, err := doGet(ts, "/config/duckdb", authorizationBearer("token-admin1"))
+		if _, err := readResponse(resp, err); err != nil {
+			t.Error(err)
+		}
+		resp, err = doGet(ts, "/config/duckdb", authorizationBearer("token-0123456789abcdef"))
+		if _, err := readResponse2(resp, err, 403, 403); err != nil {
+			t.Error(err)
+		}
+		resp, err = doGet(ts, "/config/duckdb")
+		if _, err := readResponse2(resp, err, 401, 401); err != nil {
 			t.Error(err)
 		}
-		assert.Equal(t, versionWant, got)
 	})
 
-	t.Run("query", func(t *testing.T) {
-		got, err := readResponse(doGet(ts, "/?f=csv&query="+url.QueryEscape(versionQuery)))
+	// The cache is of the DB, settings of another DB aren't returned.
+	t.Run("cache", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DBLockConfig = false
+			return c
+		})
+		threads := func(client *http.Client) string {
+			resp, err := client.Get(ts.URL + "/config/duckdb")
+			got, err := readResponse(resp, err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var settings map[string]*string
+			if err := json.Unmarshal([]byte(got), &settings); err != nil {
+				t.Fatal(err)
+			}
+			return *settings["threads"]
+		}
+		testQuery0(t, ts, `SET threads = 2`, "Success\n")
+		assert.Equal(t, "2", threads(ts.Client()))
+		other := &http.Client{Transport: &http.Transport{}}
+		t.Cleanup(other.CloseIdleConnections)
+		assert.Equal(t, "1", threads(other))
+	})
+}
+
+func TestQueryMemoryLimit(t *testing.T) {
+	const query = `SELECT len(list(i)) AS N FROM range(10000000) t(i)`
+
+	t.Run("exceeded", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DBQueryMemoryLimit = "32MB"
+			return c
+		})
+		resp, err := doPost(ts, "/?f=csv", query)
+		got, err := readResponse2(resp, err, 507, 507)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, "Out of memory: ") {
+			t.Errorf("unexpected response: %s", got)
 		}
-		assert.Equal(t, versionWant, got)
 	})
 
-	t.Run("no_queries", func(t *testing.T) {
-		resp, err := doGet(ts, "/?f=csv")
+	t.Run("global", func(t *testing.T) {
+		ts := startServer0(t)
+		testQuery0(t, ts, query, "N\n10000000\n")
+	})
+
+	t.Run("looser", func(t *testing.T) {
+		c := duckserver.DefaultConfig()
+		c.DBQueryMemoryLimit = "2GiB"
+		_, err := duckserver.New(c)
+		if err == nil {
+			t.Fatal("New should fail with looser query memory limit")
+		}
+		assert.Equal(t, "query memory limit 2GiB exceeds memory limit 1GiB", err.Error())
+	})
+}
+
+func TestDBLockConfig(t *testing.T) {
+	t.Run("locked", func(t *testing.T) {
+		ts := startServer0(t)
+		resp, err := doPost(ts, "/?f=csv", `SET memory_limit = '100GB'`)
 		got, err := readResponse2(resp, err, 400, 400)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		assert.Equal(t, "No queries: no queries\n", got)
+		assert.Equal(t, "Query error: Invalid Input Error: Cannot change configuration option \"memory_limit\" - the configuration has been locked\n", got)
+		testQuery0(t, ts, `SELECT current_setting('memory_limit') AS M`, "M\n1.0 GiB\n")
+	})
+
+	t.Run("unlocked", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DBLockConfig = false
+			return c
+		})
+		testQuery0(t, ts, `SET memory_limit = '512MB'`, "Success\n")
+		testQuery0(t, ts, `SELECT current_setting('memory_limit') AS M`, "M\n488.2 MiB\n")
 	})
 }
 
-func TestPIDFile(t *testing.T) {
-	pidfile := filepath.Join(t.TempDir(), "test.pid")
+func TestAccessLogFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
 	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
-		c.PIDFile = pidfile
+		c.AccessLogFile = name
 		return c
 	})
-	assert.IsRegularFile(t, pidfile)
-	ts.Shutdown()
-	assert.IsNotExist(t, pidfile)
+	testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `query="SELECT 1 AS A"`) {
+		t.Errorf("no queries in access log: %s", string(b))
+	}
 }
 
-func TestGetConfigJSON(t *testing.T) {
-	var homedir string
+func TestAccessLogRedact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
 	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
-		homedir = c.DBHomeDir
+		c.AccessLogFile = name
+		c.AccessLogFormat = "json"
+		c.AccessLogRedact = true
 		return c
 	})
-	got, err := readResponse(doGet(ts, "/config/"))
+	testQuery0(t, ts, "SELECT 'it''s secret' AS A", "A\nit's secret\n")
+	if _, err := readResponse(doGet(ts, "/?f=csv&q="+url.QueryEscape("SELECT 'token' AS B"))); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(name)
 	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") || strings.Contains(string(b), "token") {
+		t.Errorf("literals are not redacted: %s", string(b))
+	}
+	if !strings.Contains(string(b), `"query":"SELECT '***' AS A"`) {
+		t.Errorf("no redacted queries in access log: %s", string(b))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AuthnFile = "testdata/authn.json"
+		c.AuditLogFile = name
+		return c
+	})
+	token1 := authorizationBearer("token-0123456789abcdef")
+	testQuery1(t, ts, "SELECT * FROM range(3)", "range\n0\n1\n2\n", token1)
+	testUnauthorizedQuery(t, ts, "DROP TABLE t")
+	resp, err := doPost(ts, "/?f=csv", "CREATE TABLE", token1)
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
 		t.Error(err)
 	}
-	want := `{
-  "EnableDebugLog": false,
-  "EnablePprof": false,
-  "Address": "127.0.0.1:0",
-  "MaxDB": 4,
-  "PIDFile": "",
-  "AccessLogFile": "test.discard",
-  "AccessLogFormat": "text",
-  "AuthnFile": "",
-  "NoAuthz": false,
-  "DBHomeDir": ` + strconv.Quote(homedir) + `,
-  "DBThreads": 1,
-  "DBMemoryLimit": "1GiB",
-  "DBMaxTempDirSize": "2GiB",
-  "DBExternalAccess": true,
-  "DBLockConfig": true,
-  "DBInitQuery": "",
-  "UIResourceFS": null
+	// Requests without queries are not recorded.
+	if _, err := readResponse(doGet(ts, "/ping/")); err != nil {
+		t.Error(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []auditlog.Record
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var rec auditlog.Record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rec)
+	}
+	want := []auditlog.Record{
+		{AuthnID: "token1", RemoteIP: "127.0.0.1", Method: "POST", Path: "/", Query: "SELECT * FROM range(3)", StatementType: "SELECT", Decision: "allowed", Status: 200, RowCount: new(int64(3))},
+		{RemoteIP: "127.0.0.1", Method: "POST", Path: "/", Query: "DROP TABLE t", StatementType: "DROP", Decision: "denied", Status: 401},
+		{AuthnID: "token1", RemoteIP: "127.0.0.1", Method: "POST", Path: "/", Query: "CREATE TABLE", StatementType: "CREATE", Decision: "allowed", Status: 400},
+	}
+	assert.Equal(t, want, got, cmpopts.IgnoreFields(auditlog.Record{}, "Time", "Duration"))
 }
-`
-	assert.Equal(t, want, got)
+
+func TestResetBetweenQueries(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBResetBetweenQueries = true
+		return c
+	})
+	testQuery0(t, ts, `CREATE TEMP TABLE t1 AS SELECT 1 AS A; CREATE TEMP VIEW v1 AS SELECT * FROM t1; CREATE TEMP MACRO m1(x) AS x + 1; CREATE TABLE p1 AS SELECT 2 AS B`, "Count\n1\n")
+	// Temporary objects are dropped, but persistent ones are kept.
+	for _, query := range []string{`SELECT * FROM t1`, `SELECT * FROM v1`, `SELECT m1(1)`} {
+		resp, err := doPost(ts, "/?f=csv", query)
+		if _, err := readResponse2(resp, err, 400, 400); err != nil {
+			t.Errorf("temporary object remains: %s: %s", query, err)
+		}
+	}
+	testQuery0(t, ts, `SELECT * FROM p1`, "B\n2\n")
 }
 
-func TestRedirectToUI(t *testing.T) {
-	t.Run("normal", func(t *testing.T) {
-		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
-			c.UIResourceFS = os.DirFS("./testdata/ui")
+func TestStatusDatabase(t *testing.T) {
+	var homedir string
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		homedir = c.DBHomeDir
+		c.DBInitQuery = "SET VARIABLE token = 'secret-token'"
+		return c
+	})
+	rh := testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+
+	got, err := readResponse(doGet(ts, "/status/database"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status duckserver.DatabaseStatus
+	if err := json.Unmarshal([]byte(got), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.LastOpen == nil {
+		t.Fatal("no LastOpen")
+	}
+	p := status.LastOpen
+	assert.Equal(t, rh.ConnectionID, p.ConnID)
+	assert.Equal(t, "?home_directory="+url.QueryEscape(homedir), p.DSN)
+	assert.Equal(t, filepath.Join(homedir, "extensions"), p.Settings.ExtensionDir)
+	assert.Equal(t, []string{
+		"CREATE OR REPLACE MACRO public_dir(name) AS concat('***', '***', name)",
+		"CREATE OR REPLACE MACRO private_dir(name) AS concat('***', '***', name)",
+		"SET VARIABLE token = '***'",
+	}, p.InitQueries)
+}
+
+func TestStatusConnection(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AccessLogRedact = true
+		return c
+	})
+	getStatus := func(t *testing.T, id string) duckserver.ConnectionStatus {
+		t.Helper()
+		got, err := readResponse(doGet(ts, "/status/connections/"+id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status duckserver.ConnectionStatus
+		if err := json.Unmarshal([]byte(got), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	resp, err := doPost(ts, "/?f=csv", "SELECT * FROM no_such_table WHERE s = 'secret'")
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Header.Get(duckserver.ConnectionIDHeader)
+	status := getStatus(t, id)
+	assert.Equal(t, id, status.ID)
+	if status.LastError == nil {
+		t.Fatal("no LastError")
+	}
+	assert.Equal(t, "SELECT * FROM no_such_table WHERE s = '***'", status.LastError.Query)
+	if !strings.HasPrefix(status.LastError.Message, "Query error: Catalog Error: Table with name no_such_table does not exist!") {
+		t.Errorf("unexpected message: %s", status.LastError.Message)
+	}
+
+	// A successful query clears the last error.
+	testQuery1(t, ts, "SELECT 1 AS A", "A\n1\n")
+	status = getStatus(t, id)
+	if status.LastError != nil {
+		t.Errorf("LastError should be cleared: %+v", status.LastError)
+	}
+
+	resp, err = doGet(ts, "/status/connections/C_00000000")
+	if _, err := readResponse2(resp, err, 404, 404); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	t.Run("counts", func(t *testing.T) {
+		ts := startServer0(t)
+		testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+		got, err := readResponse(doGet(ts, "/status/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status duckserver.Status
+		if err := json.Unmarshal([]byte(got), &status); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, status.Connections)
+		assert.Equal(t, 1, status.Databases)
+		assert.Equal(t, 0, status.Queries)
+		assert.Equal(t, 4, status.MaxDB)
+		if _, err := time.ParseDuration(status.Uptime); err != nil {
+			t.Errorf("invalid uptime: %s", err)
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		ts := startServer1(t, configAuthn("testdata/authn.json", false))
+		resp, err := doGet(ts, "/status/", authorizationBearer("token-0123456789abcdef"))
+		if _, err := readResponse2(resp, err, 403, 403); err != nil {
+			t.Error(err)
+		}
+		if _, err := readResponse(doGet(ts, "/status/", authorizationBearer("token-admin1"))); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestMaxColumns(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MaxColumns = 2
+		return c
+	})
+	testQuery0(t, ts, `SELECT 1 AS A, 2 AS B`, "A,B\n1,2\n")
+	resp, err := doPost(ts, "/?f=csv", `SELECT 1 AS A, 2 AS B, 3 AS C`)
+	got, err := readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Too many columns: 3 exceed the limit 2\n", got)
+
+	got, err = readResponse(doPost(ts, "/batch/", `[{"id":"q1","query":"SELECT 1 AS A, 2 AS B, 3 AS C"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[{"id":"q1","error":"Too many columns: 3 exceed the limit 2"}]`+"\n", got)
+}
+
+func TestWorkers(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.Workers = 1
+		c.WorkerWait = 100 * time.Millisecond
+		c.QueryTimeout = time.Second
+		return c
+	})
+	// A slow query on a connection holds the only worker until the timeout.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, err := doPost(ts, "/?f=csv", `SELECT count(*) FROM range(1000000000000) t(i)`)
+		if _, err := readResponse2(resp, err, 504, 504); err != nil {
+			t.Errorf("slow query failed: %s", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// A query on another connection can't get a worker.
+	other := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(other.CloseIdleConnections)
+	resp, err := other.Post(ts.URL+"/?f=csv", "text/plain", strings.NewReader(`SELECT 1`))
+	got, err := readResponse2(resp, err, 503, 503)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "No workers are available\n", got)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	wg.Wait()
+
+	// The worker is released.
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+}
+
+func TestCommandResult(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.CommandResult = "ack"
+		return c
+	})
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{`SET VARIABLE x = 1`, `{"status":"ok","command":"SET"}`},
+		{`CREATE TABLE t AS SELECT * FROM range(3) t(i)`, `{"status":"ok","command":"CREATE"}`},
+		{`SELECT 1; CHECKPOINT`, `{"status":"ok","command":"CHECKPOINT"}`},
+	} {
+		resp, err := doPost(ts, "/?f=csv", tc.query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want+"\n", got)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	}
+	// Others respond their results.
+	testQuery0(t, ts, `SELECT getvariable('x') AS x, count(*) AS n FROM t`, "x,n\n1,3\n")
+	testQuery0(t, ts, `INSERT INTO t VALUES (3)`, "Count\n1\n")
+}
+
+func TestQueryTimeout(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.QueryTimeout = 100 * time.Millisecond
+		return c
+	})
+	start := time.Now()
+	resp, err := doPost(ts, "/?f=csv", `SELECT count(*) FROM range(1000000000000) t(i)`)
+	got, err := readResponse2(resp, err, 504, 504)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("timed out: %q", got)
+	// The driver interrupts DuckDB, so the query doesn't run until the end.
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("the query should be interrupted soon: %s", d)
+	}
+	// The DB is still available after the interruption.
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+
+	// The timeout is applied to queries which prepare the query, too.
+	for _, path := range []string{
+		"/?f=csv&count=1",
+		"/?f=csv&pivot_on=k&pivot_value=v",
+	} {
+		start := time.Now()
+		resp, err := doPost(ts, path, `SELECT 'a' AS k, i AS v FROM range(1000000000000) t(i) ORDER BY i DESC`)
+		if _, err := readResponse2(resp, err, 504, 504); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("%s: the query should be interrupted soon: %s", path, d)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.TimeoutHeader = "X-Request-Timeout"
+		return c
+	})
+	header := func(name, v string) RequestOption {
+		return func(req *http.Request) *http.Request {
+			req.Header.Set(name, v)
+			return req
+		}
+	}
+	const slow = `SELECT count(*) FROM range(1000000000000) t(i)`
+	for _, opt := range []RequestOption{
+		header(duckserver.TimeoutHeader, "100ms"),
+		header("X-Request-Timeout", "0.1"),
+		// Duckpop-Timeout takes precedence over the configured header.
+		func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.TimeoutHeader, "100ms")
+			req.Header.Set("X-Request-Timeout", "1h")
+			return req
+		},
+	} {
+		start := time.Now()
+		resp, err := doPost(ts, "/?f=csv", slow, opt)
+		if _, err := readResponse2(resp, err, 504, 504); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("the query should be interrupted soon: %s", d)
+		}
+	}
+	for _, v := range []string{"soon", "0", "-1s", "NaN"} {
+		resp, err := doPost(ts, "/?f=csv", `SELECT 1 AS N`, header(duckserver.TimeoutHeader, v))
+		if _, err := readResponse2(resp, err, 400, 400); err != nil {
+			t.Errorf("timeout %q: %s", v, err)
+		}
+	}
+	testQuery1(t, ts, `SELECT 1 AS N`, "N\n1\n", header(duckserver.TimeoutHeader, "10s"))
+	// Too many seconds don't overflow.
+	testQuery1(t, ts, `SELECT 1 AS N`, "N\n1\n", header(duckserver.TimeoutHeader, "1e30"))
+	testQuery1(t, ts, `SELECT 1 AS N`, "N\n1\n", header("X-Request-Timeout", "1e30"))
+}
+
+func TestRequestTimeoutLimit(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.QueryTimeout = 100 * time.Millisecond
+		return c
+	})
+	// A client can't extend the timeout of the server.
+	resp, err := doPost(ts, "/?f=csv", `SELECT count(*) FROM range(1000000000000) t(i)`, func(req *http.Request) *http.Request {
+		req.Header.Set(duckserver.TimeoutHeader, "1h")
+		return req
+	})
+	if _, err := readResponse2(resp, err, 504, 504); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataVersion(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DataVersion = "v1"
+		return c
+	})
+	ifDataVersion := func(v string) RequestOption {
+		return func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.IfDataVersionHeader, v)
+			return req
+		}
+	}
+	query := func(q, v string) *http.Response {
+		t.Helper()
+		resp, err := doPost(ts, "/?f=csv", q, ifDataVersion(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := query(`SELECT 1 AS N`, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	v1 := resp.Header.Get(duckserver.DataVersionHeader)
+	if v1 == "" {
+		t.Fatal("no data version")
+	}
+
+	// A read-only query of the same version isn't executed.
+	resp = query(`SELECT 1 AS N`, v1)
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Equal(t, v1, resp.Header.Get(duckserver.DataVersionHeader))
+	assert.Equal(t, "", resp.Header.Get(duckserver.QueryIDHeader))
+
+	// A writing query is always executed, and changes the version.
+	resp = query(`CREATE TABLE t AS SELECT 1 AS N`, v1)
+	assert.Equal(t, 200, resp.StatusCode)
+	v2 := resp.Header.Get(duckserver.DataVersionHeader)
+	if v2 == "" || v2 == v1 {
+		t.Fatalf("data version should change: %q", v2)
+	}
+	resp = query(`SELECT * FROM t`, v1)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp = query(`SELECT * FROM t`, v2)
+	assert.Equal(t, 304, resp.StatusCode)
+}
+
+func TestMaintenance(t *testing.T) {
+	ts := startServer0(t)
+	testQuery0(t, ts, `CREATE TABLE t AS SELECT 1 AS N`, "Count\n1\n")
+	setReadOnly := func(readOnly bool) {
+		t.Helper()
+		body := fmt.Sprintf(`{"readonly":%t}`, readOnly)
+		got, err := readResponse(doPost(ts, "/status/maintenance", body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, body+"\n", got)
+	}
+	readStatus := func() duckserver.Status {
+		t.Helper()
+		got, err := readResponse(doGet(ts, "/status/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status duckserver.Status
+		if err := json.Unmarshal([]byte(got), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	setReadOnly(true)
+	assert.Equal(t, true, readStatus().ReadOnly)
+	got, err := readResponse(doGet(ts, "/config/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, `"ReadOnly": true`) {
+		t.Errorf("config should reflect read-only mode: %s", got)
+	}
+	testQuery1(t, ts, `SELECT * FROM t`, "N\n1\n")
+	testQuery1(t, ts, `WITH a AS (SELECT 2 AS N) SELECT * FROM a`, "N\n2\n")
+	for _, query := range []string{
+		`INSERT INTO t VALUES (2)`,
+		`SELECT 1; DROP TABLE t`,
+		`WITH a AS (SELECT 2 AS N) INSERT INTO t SELECT * FROM a`,
+		`WITH a AS (SELECT 1 AS N) DELETE FROM t WHERE N IN (SELECT N FROM a)`,
+	} {
+		resp, err := doPost(ts, "/?f=csv", query)
+		got, err := readResponse2(resp, err, 503, 503)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, "Server is read-only for maintenance") {
+			t.Errorf("unexpected message: %q", got)
+		}
+	}
+
+	// A rejection has Retry-After, and the JSON body when it is accepted.
+	resp, err := doPost(ts, "/?f=csv", `INSERT INTO t VALUES (2)`, func(req *http.Request) *http.Request {
+		req.Header.Set("Accept", "application/json")
+		return req
+	})
+	got, err = readResponse2(resp, err, 503, 503)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"error":"overloaded","reason":"read_only","retryAfterSeconds":1}`+"\n", got)
+
+	setReadOnly(false)
+	assert.Equal(t, false, readStatus().ReadOnly)
+	testQuery1(t, ts, `INSERT INTO t VALUES (2)`, "Count\n1\n")
+}
+
+func TestMaxDBOverload(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MaxDB = 1
+		c.RetryAfter = 1500 * time.Millisecond
+		return c
+	})
+	// The kept-alive connection holds the only DB.
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+
+	// Requests from another connection are rejected.
+	other := &http.Client{Transport: &http.Transport{}}
+	t.Cleanup(other.CloseIdleConnections)
+	for _, accept := range []string{"", "application/json"} {
+		req, err := http.NewRequest("POST", ts.URL+"/?f=csv", strings.NewReader(`SELECT 1 AS N`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := other.Do(req)
+		got, err := readResponse2(resp, err, 429, 429)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+		if accept == "" {
+			assert.Equal(t, "reached maximum number of DB\n", got)
+			continue
+		}
+		assert.Equal(t, `{"error":"overloaded","reason":"max_db","retryAfterSeconds":2}`+"\n", got)
+	}
+}
+
+func TestUnsupportedType(t *testing.T) {
+	const query = `SELECT 1 AS i, 1::UNION(n INTEGER, s VARCHAR) AS u;`
+	startServer := func(t *testing.T, mode string) *testServer {
+		return startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.UnsupportedType = mode
 			return c
 		})
-		got, err := readResponse(doGet(ts, "/"))
+	}
+	t.Run("error", func(t *testing.T) {
+		ts := startServer(t, "error")
+		resp, err := doPost(ts, "/?f=csv", query)
+		got, err := readResponse2(resp, err, 422, 422)
 		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Unsupported type of column \"u\": UNION(\"n\" INTEGER, \"s\" VARCHAR)\n", got)
+		testQuery1(t, ts, "SELECT 1 AS i", "i\n1\n")
+	})
+	t.Run("cast", func(t *testing.T) {
+		ts := startServer(t, "cast")
+		testQuery1(t, ts, query, "i,u\n1,1\n")
+		testQuery1(t, ts, "SELECT 1 AS i, '101'::BIT AS b -- comment", "i,b\n1,101\n")
+		// Multiple statements aren't cast.
+		resp, err := doPost(ts, "/?f=csv", "SELECT 1; "+query)
+		if _, err := readResponse2(resp, err, 422, 422); err != nil {
 			t.Error(err)
-			return
 		}
-		assert.Equal(t, "<h1>Test UI</h1>\n", got)
+		// The query is executed only once.
+		testQuery1(t, ts, "CREATE SEQUENCE seq", "Count\n")
+		testQuery1(t, ts, "SELECT nextval('seq') AS n, 1::UNION(n INTEGER, s VARCHAR) AS u", "n,u\n1,1\n")
+		testQuery1(t, ts, "SELECT nextval('seq') AS n", "n\n2\n")
 	})
+}
 
-	t.Run("authn", func(t *testing.T) {
-		// Even if authentication is enabled but authentication credentials are
-		// not provided, redirect to the UI.
-		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
-			c.UIResourceFS = os.DirFS("testdata/ui")
-			c.AuthnFile = "testdata/authn.json"
+func TestDuplicateColumn(t *testing.T) {
+	const query = `SELECT 1 AS a, 2 AS a, 3 AS b`
+	startServer := func(t *testing.T, mode string) *testServer {
+		return startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DuplicateColumn = mode
 			return c
 		})
-		got, err := readResponse(doGet(ts, "/"))
+	}
+	t.Run("keep", func(t *testing.T) {
+		ts := startServer0(t)
+		testQuery1(t, ts, query, "a,a,b\n1,2,3\n")
+	})
+	t.Run("suffix", func(t *testing.T) {
+		ts := startServer(t, "suffix")
+		testQuery1(t, ts, query, "a,a_2,b\n1,2,3\n")
+		resp, err := doPost(ts, "/?f=json", query)
+		got, err := readResponse(resp, err)
 		if err != nil {
-			t.Error(err)
-			return
+			t.Fatal(err)
 		}
-		assert.Equal(t, "<h1>Test UI</h1>\n", got)
+		assert.Equal(t, "[{\"a\":1,\"a_2\":2,\"b\":3}]\n", got)
+	})
+	t.Run("error", func(t *testing.T) {
+		ts := startServer(t, "error")
+		resp, err := doPost(ts, "/?f=csv", query)
+		got, err := readResponse2(resp, err, 422, 422)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Duplicate column name: \"a\"\n", got)
+		testQuery1(t, ts, "SELECT 1 AS a, 2 AS A", "a,A\n1,2\n")
 	})
 }
+
+func TestEmptyResult(t *testing.T) {
+	const query = `SELECT i AS N FROM range(0) t(i)`
+	t.Run("default", func(t *testing.T) {
+		ts := startServer0(t)
+		resp, err := doPost(ts, "/?f=csv", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "true", resp.Header.Get(duckserver.EmptyResultHeader))
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "N\n", got)
+
+		resp, err = doPost(ts, "/?f=csv", "SELECT 1 AS A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", resp.Header.Get(duckserver.EmptyResultHeader))
+		resp.Body.Close()
+	})
+
+	t.Run("204", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.EmptyResultStatus = 204
+			return c
+		})
+		resp, err := doPost(ts, "/?f=json", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "true", resp.Header.Get(duckserver.EmptyResultHeader))
+		got, err := readResponse2(resp, err, 204, 204)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", got)
+		testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+	})
+}
+
+func TestAuthnPaths(t *testing.T) {
+	ts := startServer1(t, configAuthn("testdata/authn.json", false))
+	reader := authorizationBearer("token-reader1")
+	testQuery1(t, ts, `SELECT 1 AS N`, "N\n1\n", reader)
+	testQuery1(t, ts, `CREATE TABLE t1 AS SELECT 1 AS N`, "Count\n1\n", reader)
+	resp, err := doGet(ts, "/schema/t1/sample?f=csv", reader)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "N\n1\n", got)
+
+	for _, path := range []string{"/ingest/?table=t1", "/batch/"} {
+		resp, err := doPost(ts, path, `{"N":2}`, reader)
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "The path is not permitted: POST "+strings.TrimSuffix(path, "?table=t1")+"\n", got)
+		assert.Equal(t, "reader1", resp.Header.Get(duckserver.AuthnIDHeader))
+	}
+	// Entries without paths are permitted all.
+	resp, err = doPost(ts, "/ingest/?table=t1", `{"N":2}`, authorizationBearer("token-0123456789abcdef"))
+	if _, err := readResponse(resp, err); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnlyAccess(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c = configAuthn("testdata/authn.json", false)(c)
+		c.DBStrategy = "shared"
+		return c
+	})
+	writer := authorizationBearer("token-0123456789abcdef")
+	viewer := authorizationBearer("token-viewer1")
+	readOnly := func(req *http.Request) *http.Request {
+		req.Header.Set(duckserver.ReadOnlyHeader, "true")
+		return req
+	}
+	testQuery1(t, ts, `CREATE TABLE t AS SELECT 1 AS N`, "Count\n1\n", writer)
+
+	// Read-only requests can query the shared DB, but can't write.
+	for _, opts := range [][]RequestOption{{viewer}, {writer, readOnly}} {
+		testQuery1(t, ts, `SELECT * FROM t`, "N\n1\n", opts...)
+		resp, err := doPost(ts, "/?f=csv", `INSERT INTO t VALUES (2)`, opts...)
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Read-only access: INSERT is rejected\n", got)
+		resp, err = doPost(ts, "/?f=csv", `WITH a AS (SELECT 2 AS N) INSERT INTO t SELECT * FROM a`, opts...)
+		got, err = readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Read-only access: INSERT is rejected\n", got)
+		resp, err = doPost(ts, "/ingest/?table=t", `{"N":2}`, opts...)
+		got, err = readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Read-only access: POST /ingest/ is rejected\n", got)
+	}
+	testQuery1(t, ts, `INSERT INTO t VALUES (2)`, "Count\n1\n", writer)
+	testQuery1(t, ts, `SELECT count(*) AS C FROM t`, "C\n2\n", viewer)
+}
+
+func TestMaxEstimatedRows(t *testing.T) {
+	const crossJoin = `SELECT count(*) AS N FROM range(1000) a, range(1000) b`
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBMaxEstimatedRows = 10000
+		return c
+	})
+	testQuery0(t, ts, `SELECT count(*) AS N FROM range(100)`, "N\n100\n")
+	testQuery0(t, ts, `SET VARIABLE x = 1`, "Success\n")
+
+	resp, err := doPost(ts, "/?f=csv", crossJoin)
+	got, err := readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Estimated rows 1000000 exceed the limit 10000\n", got)
+
+	// Each statement is estimated.
+	testQuery0(t, ts, `SET VARIABLE x = 1; SELECT count(*) AS N FROM range(100)`, "N\n100\n")
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{`SELECT 1; ` + crossJoin, "Estimated rows 1000000 exceed the limit 10000\n"},
+		{`CREATE TEMP VIEW v AS ` + crossJoin + `; SELECT * FROM v`, "Rows of the statement 2 can't be estimated\n"},
+	} {
+		resp, err := doPost(ts, "/?f=csv", tc.query)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+	}
+
+	// Admins can skip the limit.
+	noCostLimit := func(req *http.Request) *http.Request {
+		req.Header.Set(duckserver.NoCostLimitHeader, "true")
+		return req
+	}
+	testQuery1(t, ts, crossJoin, "N\n1000000\n", noCostLimit)
+
+	ts = startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AuthnFile = "testdata/authn.json"
+		c.DBMaxEstimatedRows = 10000
+		return c
+	})
+	resp, err = doPost(ts, "/?f=csv", crossJoin, noCostLimit, authorizationBearer("token-0123456789abcdef"))
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
+		t.Error(err)
+	}
+	testQuery1(t, ts, crossJoin, "N\n1000000\n", noCostLimit, authorizationBearer("token-admin1"))
+}
+
+func TestMaxStatements(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MaxStatements = 2
+		return c
+	})
+	testQuery0(t, ts, "SELECT 1 AS N; -- SELECT 2;\n; SELECT 3 AS N", "N\n3\n")
+	// Semicolons in dollar-quoted literals don't separate statements.
+	testQuery0(t, ts, "SELECT 1; SELECT $$a;b;c$$ AS S, $x$;$x$ AS T;", "S,T\na;b;c,;\n")
+
+	resp, err := doPost(ts, "/?f=csv", `CREATE TEMP TABLE t (i INTEGER); INSERT INTO t VALUES (1); SELECT * FROM t`)
+	got, err := readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Too many statements: 3 exceed the limit 2\n", got)
+	// Nothing is executed.
+	testQuery0(t, ts, `SELECT count(*) AS N FROM duckdb_tables() WHERE table_name = 't'`, "N\n0\n")
+
+	// "$" in an identifier doesn't start a dollar-quoted literal which hides
+	// the following statements.
+	resp, err = doPost(ts, "/?f=csv", `SELECT 1 AS x$y$; CREATE TABLE z AS SELECT 42 AS N; SELECT * FROM z`)
+	got, err = readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Too many statements: 3 exceed the limit 2\n", got)
+
+	// The limit is applied to each query of a batch.
+	resp, err = doPost(ts, "/batch/", `[{"id":"q1","query":"SELECT 1 AS A"},{"id":"q2","query":"SELECT 2; SELECT 3 AS B"}]`)
+	got, err = readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[{"id":"q1","rows":[{"A":1}]},{"id":"q2","rows":[{"B":3}]}]`+"\n", got)
+	resp, err = doPost(ts, "/batch/", `[{"id":"q1","query":"SELECT 1"},{"id":"q2","query":"SELECT 2; SELECT 3; SELECT 4"}]`)
+	got, err = readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Too many statements: 3 exceed the limit 2\n", got)
+}
+
+func TestConnIDFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		re     string
+	}{
+		{"hex", `^C_[0-9a-f]{8}$`},
+		{"uuid", `^C_[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+	} {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.ConnIDFormat = tc.format
+			return c
+		})
+		rh := testQuery0(t, ts, "SELECT 1 AS A", "A\n1\n")
+		if !regexp.MustCompile(tc.re).MatchString(rh.ConnectionID) {
+			t.Errorf("unexpected connection ID for %s: %s", tc.format, rh.ConnectionID)
+		}
+		got, err := readResponse(doDelete(ts, "/status/queries/?connID="+rh.ConnectionID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, `{"Count":0}`+"\n", got)
+	}
+}
+
+func TestDBTempDirPerConn(t *testing.T) {
+	var tmpdir string
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBTempDirPerConn = true
+		tmpdir = filepath.Join(c.DBHomeDir, "tmp")
+		// A directory left by the previous process.
+		if err := os.MkdirAll(filepath.Join(tmpdir, "conn-C_stale"), 0750); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+	assert.IsNotExist(t, filepath.Join(tmpdir, "conn-C_stale"))
+
+	resp, err := doPost(ts, "/?f=csv", `SELECT current_setting('temp_directory') AS D`)
+	rh := parseResponseHeader(resp)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(tmpdir, "conn-"+rh.ConnectionID)
+	assert.Equal(t, "D\n"+dir+"\n", got)
+	assert.IsDir(t, dir)
+
+	// The directory is removed after disconnected.
+	closeIdleConnections(t, ts)
+	time.Sleep(100 * time.Millisecond)
+	assert.IsNotExist(t, dir)
+}
+
+func TestDBModeTempFile(t *testing.T) {
+	var tmpdir string
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBMode = "tempfile"
+		tmpdir = filepath.Join(c.DBHomeDir, "tmp")
+		// A file left by the previous process.
+		if err := os.MkdirAll(tmpdir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpdir, "conn-C_stale.duckdb"), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+	assert.IsNotExist(t, filepath.Join(tmpdir, "conn-C_stale.duckdb"))
+
+	rh := testQuery0(t, ts, "CREATE TABLE t AS SELECT i FROM range(10) t(i)", "Count\n10\n")
+	testQuery0(t, ts, "SELECT count(*) AS N FROM t", "N\n10\n")
+	name := filepath.Join(tmpdir, "conn-"+rh.ConnectionID+".duckdb")
+	assert.IsRegularFile(t, name)
+
+	// The file is removed after disconnected.
+	closeIdleConnections(t, ts)
+	time.Sleep(100 * time.Millisecond)
+	assert.IsNotExist(t, name)
+
+	// The file is removed after abrupt disconnection too.
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const query = "SELECT i FROM range(100000) t(i)"
+	fmt.Fprintf(c, "POST / HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s", u.Host, len(query), query)
+	if _, err := c.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	names, _ := filepath.Glob(filepath.Join(tmpdir, "conn-*.duckdb"))
+	assert.Equal(t, []string(nil), names)
+}
+
+func TestQueryOptions(t *testing.T) {
+	ts := startServer1(t, configAuthn("testdata/authn.json", false))
+	req, err := http.NewRequest("OPTIONS", ts.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doReq(ts, req)
+	got, err := readResponse2(resp, err, 204, 204)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", got)
+	assert.Equal(t, "GET, POST, HEAD, OPTIONS", resp.Header.Get("Allow"))
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST, HEAD, OPTIONS", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type, Expect", resp.Header.Get("Access-Control-Allow-Headers"))
+}
+
+func TestQueryHead(t *testing.T) {
+	ts := startServer0(t)
+	path := "/?f=csv&q=" + url.QueryEscape("SELECT * FROM range(3)")
+	req, err := http.NewRequest("HEAD", ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doReq(ts, req)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", got)
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "3", resp.Header.Get(duckserver.RowCountHeader))
+	assert.Equal(t, int64(len("range\n0\n1\n2\n")), resp.ContentLength)
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	ts := startServer0(t)
+	for _, tc := range []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"PUT", "/", "GET, POST, HEAD, OPTIONS"},
+		{"DELETE", "/", "GET, POST, HEAD, OPTIONS"},
+		{"GET", "/batch/", "POST"},
+		{"PUT", "/status/queries/", "DELETE, GET, HEAD"},
+	} {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := doReq(ts, req)
+		if _, err := readResponse2(resp, err, 405, 405); err != nil {
+			t.Errorf("%s %s: %s", tc.method, tc.path, err)
+			continue
+		}
+		assert.Equal(t, tc.allow, resp.Header.Get("Allow"))
+	}
+	// Unknown paths are still 404.
+	resp, err := doGet(ts, "/unknown/")
+	if _, err := readResponse2(resp, err, 404, 404); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExternalAccess(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBExternalAccess = false
+		return c
+	})
+	testQuery0(t, ts, `SELECT 1 + 2 AS A`, "A\n3\n")
+	for _, q := range []string{
+		`SELECT * FROM read_csv('http://127.0.0.1:1/data.csv')`,
+		`SELECT * FROM read_csv(` + sqltext.QuoteString(filepath.Join(t.TempDir(), "data.csv")) + `)`,
+		`SET enable_external_access = true`,
+	} {
+		resp, err := doPost(ts, "/?f=csv", q)
+		if _, err := readResponse2(resp, err, 400, 599); err != nil {
+			t.Errorf("query should be rejected: %s: %s", q, err)
+		}
+	}
+}
+
+func gzipString(t *testing.T, s string) string {
+	t.Helper()
+	bb := &bytes.Buffer{}
+	zw := gzip.NewWriter(bb)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bb.String()
+}
+
+func contentEncodingGzip(req *http.Request) *http.Request {
+	req.Header.Set("Content-Encoding", "gzip")
+	return req
+}
+
+func TestGzipBody(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MaxBodySize = 1000
+		return c
+	})
+
+	testQuery1(t, ts, gzipString(t, `SELECT 1 + 2 AS A`), "A\n3\n", contentEncodingGzip)
+
+	resp, err := doPost(ts, "/batch/", gzipString(t, `[{"id":"q1","query":"SELECT 1 AS A"}]`), contentEncodingGzip)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[{"id":"q1","rows":[{"A":1}]}]`+"\n", got)
+
+	// Not a gzip stream.
+	resp, err = doPost(ts, "/?f=csv", `SELECT 1`, contentEncodingGzip)
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
+		t.Error(err)
+	}
+
+	// The limit is applied to the decompressed size.
+	large := `SELECT 1 AS A -- ` + strings.Repeat("x", 2000)
+	resp, err = doPost(ts, "/?f=csv", gzipString(t, large), contentEncodingGzip)
+	got, err = readResponse2(resp, err, 413, 413)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Request body too large: limit is 1000 bytes\n", got)
+
+	// Files in /shared/ are neither limited nor decompressed.
+	req, err := http.NewRequest("PUT", ts.URL+"/shared/large.gz", strings.NewReader(gzipString(t, large)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readResponse(doReq(ts, req, contentEncodingGzip)); err != nil {
+		t.Fatal(err)
+	}
+	got, err = readResponse(doGet(ts, "/shared/large.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, gzipString(t, large), got)
+}
+
+// readChunks posts a query with a raw connection, and returns chunks of the
+// chunked response body as they are sent.
+func readChunks(t *testing.T, ts *testServer, path, query string) []string {
+	t.Helper()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "POST %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", path, u.Host, len(query), query)
+	br := bufio.NewReader(c)
+	chunked := false
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.EqualFold(strings.TrimSpace(line), "Transfer-Encoding: chunked") {
+			chunked = true
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	if !chunked {
+		t.Fatal("the response isn't chunked")
+	}
+	var chunks []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return chunks
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, string(b[:n]))
+	}
+}
+
+func TestFlushRows(t *testing.T) {
+	const query = `SELECT i AS N FROM range(3) t(i)`
+	for _, c := range []struct {
+		rows     int
+		interval time.Duration
+		csv      []string
+		json     []string
+	}{
+		{1, 0, []string{"N\n0\n", "1\n", "2\n"}, []string{"[{\"N\":0}", ",\n{\"N\":1}", ",\n{\"N\":2}", "]\n"}},
+		{2, 0, []string{"N\n0\n1\n", "2\n"}, []string{"[{\"N\":0},\n{\"N\":1}", ",\n{\"N\":2}]\n"}},
+		{0, time.Nanosecond, []string{"N\n0\n", "1\n", "2\n"}, []string{"[{\"N\":0}", ",\n{\"N\":1}", ",\n{\"N\":2}", "]\n"}},
+		{0, 0, []string{"N\n0\n1\n2\n"}, []string{"[{\"N\":0},\n{\"N\":1},\n{\"N\":2}]\n"}},
+	} {
+		ts := startServer1(t, func(config *duckserver.Config) *duckserver.Config {
+			config.FlushRows = c.rows
+			config.FlushInterval = c.interval
+			return config
+		})
+		testQuery1(t, ts, query, "N\n0\n1\n2\n")
+		resp, err := doPost(ts, "/?f=json", query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "[{\"N\":0},\n{\"N\":1},\n{\"N\":2}]\n", got)
+
+		// Each flush sends a chunk.
+		assert.Equal(t, c.csv, readChunks(t, ts, "/?f=csv", query))
+		assert.Equal(t, c.json, readChunks(t, ts, "/?f=json", query))
+	}
+}
+
+func TestWarmupQuery(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBWarmupQuery = `SELECT count(*) FROM range(1000)`
+		return c
+	})
+	testQuery0(t, ts, `SELECT 1 AS A`, "A\n1\n")
+
+	c := duckserver.DefaultConfig()
+	c.DBHomeDir = t.TempDir()
+	c.DBWarmupQuery = `SELECT * FROM no_such_table`
+	srv, err := duckserver.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.Serve(t.Context())
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to warm up DB: ") {
+		t.Errorf("Serve should fail with warm-up query: %v", err)
+	}
+}
+
+func TestSkipStartupCheck(t *testing.T) {
+	const initQuery = `SELECT * FROM no_such_table`
+	c := duckserver.DefaultConfig()
+	c.DBHomeDir = t.TempDir()
+	c.DBInitQuery = initQuery
+	srv, err := duckserver.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(t.Context()); err == nil {
+		t.Error("Serve should fail with the broken init query")
+	}
+
+	// The server starts, but queries fail.
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBInitQuery = initQuery
+		c.DBSkipStartupCheck = true
+		return c
+	})
+	resp, err := doPost(ts, "/?f=csv", `SELECT 1 AS A`)
+	if _, err := readResponse2(resp, err, 500, 500); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJSONBigIntAsString(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.JSONBigIntAsString = true
+		return c
+	})
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"json", `[{"A":"9007199254740993"}]` + "\n"},
+		{"json,bigint:number", `[{"A":9007199254740993}]` + "\n"},
+	} {
+		resp, err := doPost(ts, "/?f="+tc.format, `SELECT 9007199254740993::BIGINT AS A`)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+	}
+}
+
+func TestJSONNonFinite(t *testing.T) {
+	const query = `SELECT 'nan'::DOUBLE AS A, 'inf'::DOUBLE AS B`
+	ts := startServer0(t)
+	resp, err := doPost(ts, "/?f=json", query)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[{"A":null,"B":null}]`+"\n", got)
+
+	ts = startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.JSONNonFinite = "string"
+		return c
+	})
+	resp, err = doPost(ts, "/?f=json", query)
+	got, err = readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `[{"A":"NaN","B":"Infinity"}]`+"\n", got)
+
+	// The error is found before the status is sent for HEAD.
+	ts = startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.JSONNonFinite = "error"
+		return c
+	})
+	req, err := http.NewRequest("HEAD", ts.URL+"/?f=json&q="+url.QueryEscape(query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = doReq(ts, req)
+	if _, err := readResponse2(resp, err, 422, 422); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedDir(t *testing.T) {
+	ts := startServer0(t)
+	testQuery0(t, ts, `COPY (SELECT * FROM duckdb_settings() LIMIT 50) TO (public_dir('settings.csv'))`, "Count\n50\n")
+
+	assert.IsRegularFile(t, filepath.Join(ts.srv.SharedDir(), "settings.csv"))
+	if t.Failed() {
+		return
+	}
+
+	closeIdleConnections(t, ts)
+	testQuery0(t, ts, `CREATE TABLE shared_settings AS SELECT * FROM read_csv_auto(public_dir('settings.csv'))`, "Count\n50\n")
+}
+
+func TestPrivateDir(t *testing.T) {
+	ts := startServer0(t)
+	privateRoot := ts.srv.PrivateRoot()
+
+	// The contents of the private directory are preserved.
+	rh1 := testQuery0(t, ts, `COPY (SELECT * FROM duckdb_settings() LIMIT 50) TO (private_dir('settings.csv'))`, "Count\n50\n")
+	assert.IsRegularFile(t, filepath.Join(privateRoot, rh1.ConnectionID, "settings.csv"))
+	if t.Failed() {
+		return
+	}
+	testQuery0(t, ts, `CREATE TABLE shared_settings AS SELECT * FROM read_csv_auto(private_dir('settings.csv'))`, "Count\n50\n")
+
+	// Verify that the private directory is gone after disconnected.
+	closeIdleConnections(t, ts)
+	time.Sleep(100 * time.Millisecond)
+	assert.IsNotExist(t, filepath.Join(privateRoot, rh1.ConnectionID))
+}
+
+func TestReadQuery(t *testing.T) {
+	ts := startServer0(t)
+
+	t.Run("q", func(t *testing.T) {
+		got, err := readResponse(doGet(ts, "/?f=csv&q="+url.QueryEscape(versionQuery)))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, versionWant, got)
+	})
+
+	t.Run("query", func(t *testing.T) {
+		got, err := readResponse(doGet(ts, "/?f=csv&query="+url.QueryEscape(versionQuery)))
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, versionWant, got)
+	})
+
+	t.Run("no_queries", func(t *testing.T) {
+		resp, err := doGet(ts, "/?f=csv")
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "No queries: no queries\n", got)
+	})
+}
+
+func TestErrorDetail(t *testing.T) {
+	const badQuery = `SELECT * FROM no_such_table`
+	configErrorDetail := func(detail string) configOption {
+		return func(c *duckserver.Config) *duckserver.Config {
+			c.ErrorDetail = detail
+			return c
+		}
+	}
+	t.Run("full", func(t *testing.T) {
+		ts := startServer1(t, configErrorDetail("full"))
+		resp, err := doPost(ts, "/", badQuery)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "Query error: Catalog Error: Table with name no_such_table does not exist!\nDid you mean \"pg_tables\"?\n\nLINE 1: SELECT * FROM no_such_table\n                      ^\n"
+		assert.Equal(t, want, got)
+		assert.Equal(t, "", resp.Header.Get(duckserver.ErrorIDHeader))
+	})
+	t.Run("message", func(t *testing.T) {
+		ts := startServer1(t, configErrorDetail("message"))
+		resp, err := doPost(ts, "/", badQuery)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errorID := resp.Header.Get(duckserver.ErrorIDHeader)
+		if errorID == "" {
+			t.Fatal("no error ID")
+		}
+		want := "Query error: Catalog Error: Table with name no_such_table does not exist! (error ID " + errorID + ")\n"
+		assert.Equal(t, want, got)
+	})
+	t.Run("generic", func(t *testing.T) {
+		ts := startServer1(t, configErrorDetail("generic"))
+		resp, err := doPost(ts, "/", badQuery)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errorID := resp.Header.Get(duckserver.ErrorIDHeader)
+		if errorID == "" {
+			t.Fatal("no error ID")
+		}
+		assert.Equal(t, "Query failed: error ID "+errorID+"\n", got)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		config := duckserver.DefaultConfig()
+		config.ErrorDetail = "verbose"
+		_, err := duckserver.New(config)
+		assert.Equal(t, `unsupported error detail: "verbose"`, err.Error())
+	})
+}
+
+func TestPIDFile(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "test.pid")
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.PIDFile = pidfile
+		return c
+	})
+	assert.IsRegularFile(t, pidfile)
+	ts.Shutdown()
+	assert.IsNotExist(t, pidfile)
+}
+
+func TestDBHomeDir(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		homedir := filepath.Join(t.TempDir(), "a", "b", "duckpop")
+		startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DBHomeDir = homedir
+			return c
+		})
+		assert.IsDir(t, homedir)
+		assert.IsDir(t, filepath.Join(homedir, "extensions"))
+		assert.IsDir(t, filepath.Join(homedir, "stored_secrets"))
+		assert.IsDir(t, filepath.Join(homedir, "tmp"))
+	})
+
+	t.Run("not writable", func(t *testing.T) {
+		// A regular file prevents to create the home directory.
+		file := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := duckserver.DefaultConfig()
+		config.Address = "127.0.0.1:0"
+		config.AccessLogFile = "test.discard"
+		config.DBHomeDir = filepath.Join(file, "duckpop")
+		srv, err := duckserver.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = srv.Serve(t.Context())
+		if err == nil {
+			t.Fatal("Serve should fail with not writable home directory")
+		}
+		if !strings.HasPrefix(err.Error(), "failed to create DB directory: ") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
+
+func TestGetConfigJSON(t *testing.T) {
+	var homedir string
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		homedir = c.DBHomeDir
+		return c
+	})
+	got, err := readResponse(doGet(ts, "/config/"))
+	if err != nil {
+		t.Error(err)
+	}
+	want := `{
+  "EnableDebugLog": false,
+  "EnablePprof": false,
+  "Address": "127.0.0.1:0",
+  "AdminAddress": "",
+  "MaxDB": 4,
+  "MaxStatements": 10,
+  "MaxColumns": 10000,
+  "QueryTimeout": 0,
+  "TimeoutHeader": "",
+  "CoalesceQueries": false,
+  "AutoLimit": 0,
+  "ConnIDFormat": "hex",
+  "MaxKeepSession": 0,
+  "IdleTransactionTimeout": 0,
+  "BatchParallel": 4,
+  "Workers": 0,
+  "WorkerWait": 10000000000,
+  "MaxBodySize": 67108864,
+  "MaxEmbedSize": 0,
+  "MaxResponseSize": 0,
+  "FlushRows": 1000,
+  "FlushInterval": 200000000,
+  "DefaultFormat": "csv",
+  "JSONBigIntAsString": false,
+  "JSONNonFinite": "null",
+  "CSVDelimiter": ",",
+  "CSVTerminator": "\\n",
+  "CSVNewline": "quote",
+  "DrainDelay": 0,
+  "ReadOnly": false,
+  "RetryAfter": 1000000000,
+  "EmptyResultStatus": 200,
+  "UnsupportedType": "stringify",
+  "DuplicateColumn": "keep",
+  "CommandResult": "rows",
+  "PingPath": "/ping/",
+  "MetricsInterval": 15000000000,
+  "MetricsMaxTags": 20,
+  "LogLevel": "info",
+  "LogFile": "",
+  "PIDFile": "",
+  "AccessLogFile": "test.discard",
+  "AccessLogFormat": "text",
+  "AccessLogRedact": false,
+  "AuditLogFile": "",
+  "ErrorDetail": "full",
+  "AuthnFile": "",
+  "NoAuthz": false,
+  "NoGetQuery": false,
+  "TemplateFile": "",
+  "ScriptDir": "",
+  "FileReadPrefixes": null,
+  "AllowedExtensions": null,
+  "DataVersion": "",
+  "DataVersionFiles": null,
+  "DBHomeDir": ` + strconv.Quote(homedir) + `,
+  "DBThreads": 1,
+  "DBMemoryLimit": "1GiB",
+  "DBMaxTempDirSize": "2GiB",
+  "DBTempDirPerConn": false,
+  "DBExternalAccess": true,
+  "DBLockConfig": true,
+  "DBInitQuery": "",
+  "DBGlobViews": null,
+  "DBPreludeFile": "",
+  "DBProgressBar": false,
+  "DBWarmupQuery": "",
+  "DBSkipStartupCheck": false,
+  "DBQueryMemoryLimit": "",
+  "DBMaxEstimatedRows": 0,
+  "DBMaxIdleConns": 0,
+  "DBMaxOpenConns": 0,
+  "DBResetBetweenQueries": false,
+  "DBConcurrentQueries": false,
+  "DBMode": "memory",
+  "DBStrategy": "connection",
+  "DBTenantFile": false,
+  "DBPoolSize": 4,
+  "DBSpares": 0,
+  "UIResourceFS": null
+}
+`
+	assert.Equal(t, want, got)
+}
+
+func TestRedirectToUI(t *testing.T) {
+	t.Run("normal", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.UIResourceFS = os.DirFS("./testdata/ui")
+			return c
+		})
+		got, err := readResponse(doGet(ts, "/"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert.Equal(t, "<h1>Test UI</h1>\n", got)
+	})
+
+	t.Run("authn", func(t *testing.T) {
+		// Even if authentication is enabled but authentication credentials are
+		// not provided, redirect to the UI.
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.UIResourceFS = os.DirFS("testdata/ui")
+			c.AuthnFile = "testdata/authn.json"
+			return c
+		})
+		got, err := readResponse(doGet(ts, "/"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		assert.Equal(t, "<h1>Test UI</h1>\n", got)
+	})
+}
+
+func TestMidStreamError(t *testing.T) {
+	ts := startServer0(t)
+	// JSON can't represent NaN, so it fails after some rows are written with
+	// "nonfinite:error".
+	const query = `SELECT CASE WHEN i < 2 THEN i::DOUBLE ELSE 'nan'::DOUBLE END AS v FROM range(3) t(i)`
+
+	t.Run("envelope", func(t *testing.T) {
+		resp, err := doPost(ts, "/?f=json,envelope,nonfinite:error", query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "{\"rows\":[{\"v\":0},\n{\"v\":1}],\"count\":2,\"error\":\"Serialization error: non-finite float: NaN\"}\n", got)
+		assert.Equal(t, "2", resp.Trailer.Get(duckserver.RowCountHeader))
+		assert.Equal(t, "Serialization error: non-finite float: NaN", resp.Trailer.Get(duckserver.ErrorHeader))
+	})
+
+	t.Run("array", func(t *testing.T) {
+		resp, err := doPost(ts, "/?f=json,nonfinite:error", query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "[{\"v\":0},\n{\"v\":1}", got)
+		assert.Equal(t, "2", resp.Trailer.Get(duckserver.RowCountHeader))
+		assert.Equal(t, "Serialization error: non-finite float: NaN", resp.Trailer.Get(duckserver.ErrorHeader))
+	})
+
+	t.Run("last error", func(t *testing.T) {
+		resp, err := doPost(ts, "/?f=json,nonfinite:error", query)
+		if _, err := readResponse(resp, err); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readResponse(doGet(ts, "/status/connections/"+resp.Header.Get(duckserver.ConnectionIDHeader)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status duckserver.ConnectionStatus
+		if err := json.Unmarshal([]byte(got), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.LastError == nil {
+			t.Fatal("no LastError")
+		}
+		assert.Equal(t, "Serialization error: non-finite float: NaN", status.LastError.Message)
+		assert.Equal(t, query, status.LastError.Query)
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		resp, err := doPost(ts, "/?f=json", `SELECT 1 AS v`)
+		if _, err := readResponse(resp, err); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", resp.Trailer.Get(duckserver.ErrorHeader))
+	})
+}
+
+func TestFormQuery(t *testing.T) {
+	ts := startServer0(t)
+	formContentType := func(req *http.Request) *http.Request {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	form := url.Values{
+		"q":   {"SELECT $1::INTEGER + $2::INTEGER AS N, $3 AS S"},
+		"arg": {"1", "2", "a b"},
+	}
+	got, err := readResponse(doPost(ts, "/?f=csv", form.Encode(), formContentType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "N,S\n3,a b\n", got)
+
+	// A body without query fields is a raw query, like "curl -d".
+	got, err = readResponse(doPost(ts, "/?f=csv", "SELECT 1 AS N", formContentType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "N\n1\n", got)
+}
+
+func TestDefaultFormat(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DefaultFormat = "json,envelope"
+		return c
+	})
+	resp, err := doPost(ts, "/", `SELECT 1 AS N`)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "{\"rows\":[{\"N\":1}],\"count\":1}\n", got)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+
+	config := duckserver.DefaultConfig()
+	config.DefaultFormat = "unknown"
+	if _, err := duckserver.New(config); err == nil {
+		t.Error("unknown default format should be rejected")
+	}
+}
+
+func TestDefaultFormatAccept(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DefaultFormat = "json"
+		return c
+	})
+	accept := func(value string) RequestOption {
+		return func(req *http.Request) *http.Request {
+			if value == "" {
+				req.Header.Del("Accept")
+			} else {
+				req.Header.Set("Accept", value)
+			}
+			return req
+		}
+	}
+	// Accept header doesn't change the format, even when it is missing.
+	for _, value := range []string{"", "*/*", "text/csv"} {
+		resp, err := doPost(ts, "/", `SELECT 1 AS N`, accept(value))
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatalf("accept=%q: %s", value, err)
+		}
+		assert.Equal(t, "[{\"N\":1}]\n", got)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestXLSX(t *testing.T) {
+	ts := startServer0(t)
+	resp, err := doPost(ts, "/?f=xlsx", `SELECT 1 AS N`)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="result.xlsx"`, resp.Header.Get("Content-Disposition"))
+	if _, err := zip.NewReader(strings.NewReader(got), int64(len(got))); err != nil {
+		t.Errorf("invalid workbook: %s", err)
+	}
+
+	// The media type in Accept header selects xlsx, but the parameter takes
+	// precedence over it.
+	for _, tc := range []struct {
+		path, accept, contentType string
+	}{
+		{"/", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"/", "text/html;q=0.9, Application/vnd.openxmlformats-officedocument.spreadsheetml.sheet;q=0.8", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"/?f=json", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/json"},
+	} {
+		resp, err := doPost(ts, tc.path, `SELECT 1 AS N`, func(req *http.Request) *http.Request {
+			req.Header.Set("Accept", tc.accept)
+			return req
+		})
+		if _, err := readResponse(resp, err); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.contentType, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestCSVSeparators(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.CSVDelimiter = `\x1f`
+		c.CSVTerminator = `\x1e`
+		return c
+	})
+	testQuery0(t, ts, `SELECT 1 AS A, 'a,b' AS B`, "A\x1fB\x1e1\x1fa,b\x1e")
+	// Parameters of the request take precedence.
+	got, err := readResponse(doGet(ts, "/?f=csv,delimiter:|&q="+url.QueryEscape("SELECT 1 AS A, 2 AS B")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "A|B\x1e1|2\x1e", got)
+
+	config := duckserver.DefaultConfig()
+	config.CSVTerminator = `,`
+	if _, err := duckserver.New(config); err == nil {
+		t.Error("terminator containing the delimiter should be rejected")
+	}
+}
+
+func TestCSVNewline(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.CSVNewline = "escape"
+		return c
+	})
+	testQuery0(t, ts, `SELECT 'a' || chr(10) || 'b' AS A`, "A\na\\nb\n")
+	// Parameters of the request take precedence.
+	got, err := readResponse(doGet(ts, "/?f=csv,newline:quote&q="+url.QueryEscape(`SELECT 'a' || chr(10) || 'b' AS A`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "A\n\"a\nb\"\n", got)
+
+	config := duckserver.DefaultConfig()
+	config.CSVNewline = "drop"
+	if _, err := duckserver.New(config); err == nil {
+		t.Error("unsupported newline policy should be rejected")
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.log")
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.LogLevel = "debug"
+		c.LogFile = name
+		// Quotes in comments and escaped quotes don't expose the secrets.
+		c.DBInitQuery = "-- it's the token\nSET VARIABLE token = 'secret-token'; SET VARIABLE key = E'a\\'secret-key'"
+		return c
+	})
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Debug logs of queries are written to the file.
+	got := string(b)
+	// The effective configuration is logged on startup, as /config/ responds
+	// it with literals in queries redacted.
+	if !strings.Contains(got, `msg="effective configuration"`) || !strings.Contains(got, `\"LogLevel\":\"debug\"`) {
+		t.Errorf("the configuration isn't logged: %s", got)
+	}
+	conf, err := readResponse(doGet(ts, "/config/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(got, "secret-") || strings.Contains(conf, "secret-") {
+		t.Errorf("literals in DBInitQuery should be redacted: %s", conf)
+	}
+	assert.Equal(t, true, strings.Contains(conf, `SET VARIABLE token = '***'`))
+	if !strings.Contains(got, `msg="execute query"`) || !strings.Contains(got, `query="SELECT 1 AS N"`) {
+		t.Errorf("the query isn't logged: %s", got)
+	}
+	// Logs of DBs by the connection manager go to the file too.
+	if !strings.Contains(got, `msg="DB opened"`) {
+		t.Errorf("the DB isn't logged: %s", got)
+	}
+	// The level and the file are of the server, the default logger isn't
+	// changed.
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("the default logger shouldn't be changed")
+	}
+
+	config := duckserver.DefaultConfig()
+	config.LogLevel = "verbose"
+	if _, err := duckserver.New(config); err == nil {
+		t.Error("unsupported log level should be rejected")
+	}
+}
+
+func TestNoGetQuery(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.NoGetQuery = true
+		return c
+	})
+	resp, err := doGet(ts, "/?f=csv&q="+url.QueryEscape("SELECT 1"))
+	got, err := readResponse2(resp, err, 405, 405)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Queries by GET are disabled\n", got)
+	assert.Equal(t, "POST, OPTIONS", resp.Header.Get("Allow"))
+
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+	if _, err := readResponse(doGet(ts, "/ping/")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MetricsInterval = 50 * time.Millisecond
+		return c
+	})
+	testQuery0(t, ts, "CREATE TABLE t AS SELECT i FROM range(100000) t(i)", "Count\n100000\n")
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err := doGet(ts, "/metrics")
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	for _, want := range []string{
+		"\nduckpop_connections 1\n",
+		"\nduckpop_databases 1\n",
+		"\nduckpop_workers_active 0\n",
+		"\nduckpop_duckdb_collected_databases 1\n",
+		"\n# TYPE duckpop_duckdb_memory_bytes gauge\n",
+		"\nduckpop_duckdb_temporary_storage_bytes{tag=\"BASE_TABLE\"} ",
+		"\nduckpop_duckdb_temporary_files_bytes 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q is not found in metrics:\n%s", want, got)
+		}
+	}
+
+	// Metrics of engines are omitted without the collection.
+	ts = startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MetricsInterval = 0
+		c.MetricsMaxTags = 2
+		return c
+	})
+	got, err = readResponse(doGet(ts, "/metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, false, strings.Contains(got, "duckpop_duckdb_"))
+
+	// Queries are counted by tag, up to the max, and others are counted as
+	// "other". "untagged" and "other" don't use up the max.
+	queryTag := func(tag string) RequestOption {
+		return func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.QueryTagHeader, tag)
+			return req
+		}
+	}
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+	for _, tag := range []string{"bad tag", "report", "report", "search", "export"} {
+		testQuery1(t, ts, `SELECT 1 AS N`, "N\n1\n", queryTag(tag))
+	}
+	got, err = readResponse(doGet(ts, "/metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\n# TYPE duckpop_query_duration_seconds histogram\n",
+		"\nduckpop_query_duration_seconds_count{tag=\"report\"} 2\n",
+		"\nduckpop_query_duration_seconds_count{tag=\"search\"} 1\n",
+		"\nduckpop_query_duration_seconds_count{tag=\"other\"} 2\n",
+		"\nduckpop_query_duration_seconds_count{tag=\"untagged\"} 1\n",
+		"\nduckpop_query_duration_seconds_bucket{tag=\"report\",le=\"+Inf\"} 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q is not found in metrics:\n%s", want, got)
+		}
+	}
+}
+
+func TestFileReadPrefixes(t *testing.T) {
+	var shared string
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		shared = filepath.Join(c.DBHomeDir, "shared")
+		c.FileReadPrefixes = []string{shared + string(filepath.Separator)}
+		return c
+	})
+	testQuery0(t, ts, "COPY (SELECT 1 AS N) TO (public_dir('a.csv'))", "Count\n1\n")
+	testQuery0(t, ts, "SELECT * FROM read_csv('"+filepath.Join(shared, "a.csv")+"')", "N\n1\n")
+
+	for _, path := range []string{
+		filepath.Join(shared, "..", "private", "a.csv"),
+		"a.csv",
+		"https://example.com/a.csv",
+	} {
+		resp, err := doPost(ts, "/?f=csv", "SELECT * FROM read_csv(['"+filepath.Join(shared, "a.csv")+"', '"+path+"'])")
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, fmt.Sprintf("Reading the file is not allowed: %q\n", path), got)
+	}
+
+	resp, err := doPost(ts, "/batch/", `[{"id":"q1","query":"SELECT * FROM read_parquet('/etc/passwd')"}]`)
+	if _, err := readResponse2(resp, err, 403, 403); err != nil {
+		t.Error(err)
+	}
+
+	// Prefixes are compared by directories, not by strings.
+	ts = startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.FileReadPrefixes = []string{"/data", "s3://bucket/a"}
+		return c
+	})
+	for _, path := range []string{"/database/x.csv", "/data-other/x.csv", "/data/../etc/passwd", "s3://other/a/x.csv"} {
+		resp, err := doPost(ts, "/?f=csv", "SELECT * FROM read_csv('"+path+"')")
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, fmt.Sprintf("Reading the file is not allowed: %q\n", path), got)
+	}
+	for _, path := range []string{"/data", "/data/x.csv", "/data/sub/../x.csv"} {
+		// The files don't exist, so they fail at reading but aren't rejected.
+		resp, err := doPost(ts, "/?f=csv", "SELECT * FROM read_csv('"+path+"')")
+		got, err := readResponse2(resp, err, 400, 599)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(got, "Reading the file is not allowed") {
+			t.Errorf("reading %q should be allowed: %s", path, got)
+		}
+	}
+}
+
+func TestDBGlobViews(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{"2026-01-01.csv", "2026-01-02.csv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), fmt.Appendf(nil, "N\n%d\n", i+1), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBGlobViews = map[string]string{"events": filepath.Join(dir, "*.csv")}
+		return c
+	})
+	testQuery0(t, ts, `SELECT count(*) AS C, sum(N) AS S FROM events`, "C,S\n2,3\n")
+
+	for _, views := range []map[string]string{
+		{"events": filepath.Join(dir, "*.parquet")},
+		{"events": filepath.Join(dir, "*.txt")},
+		{"bad name": filepath.Join(dir, "*.csv")},
+	} {
+		config := duckserver.DefaultConfig()
+		config.DBGlobViews = views
+		if _, err := duckserver.New(config); err == nil {
+			t.Errorf("glob views should be rejected: %v", views)
+		}
+	}
+}
+
+func TestDBPreludeFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "prelude.sql")
+	if err := os.WriteFile(name, []byte("CREATE MACRO add_base(x) AS x + getvariable('base');\nCREATE MACRO twice(x) AS x * 2;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBInitQuery = `SET VARIABLE base = 10`
+		c.DBPreludeFile = name
+		return c
+	})
+	testQuery0(t, ts, `SELECT add_base(1) AS A, twice(3) AS B`, "A,B\n11,6\n")
+
+	config := duckserver.DefaultConfig()
+	config.DBPreludeFile = filepath.Join(dir, "missing.sql")
+	if _, err := duckserver.New(config); err == nil {
+		t.Error("missing prelude file should be rejected")
+	}
+
+	// An error of the prelude fails the startup.
+	bad := filepath.Join(dir, "bad.sql")
+	if err := os.WriteFile(bad, []byte("CREATE MACRO broken(x) AS;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config = duckserver.DefaultConfig()
+	config.DBHomeDir = filepath.Join(dir, "home")
+	config.DBPreludeFile = bad
+	config.AccessLogFile = "test.discard"
+	srv, err := duckserver.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(t.Context()); err == nil {
+		t.Error("the startup should fail by the prelude")
+	}
+}
+
+func TestAllowedExtensions(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AllowedExtensions = []string{"json", "icu"}
+		return c
+	})
+	testQuery0(t, ts, "LOAD json", "Success\n")
+
+	for _, query := range []string{
+		"LOAD spatial",
+		"SELECT 1; FORCE INSTALL 'httpfs' FROM community",
+		"LOAD '/tmp/json.duckdb_extension'",
+	} {
+		resp, err := doPost(ts, "/?f=csv", query)
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, "The extension is not allowed: ") {
+			t.Errorf("unexpected response for %q: %s", query, got)
+		}
+	}
+
+	resp, err := doPost(ts, "/batch/", `[{"id":"q1","query":"LOAD spatial"}]`)
+	if _, err := readResponse2(resp, err, 403, 403); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScalar(t *testing.T) {
+	ts := startServer0(t)
+	for _, tc := range []struct {
+		path  string
+		query string
+		want  string
+		ctype string
+	}{
+		{"/?scalar=1", `SELECT count(*) FROM range(42)`, "42\n", "text/plain; charset=utf-8"},
+		{"/?scalar=1", `SELECT 'a,"b"'`, "a,\"b\"\n", "text/plain; charset=utf-8"},
+		{"/?scalar=1", `SELECT NULL`, "NULL\n", "text/plain; charset=utf-8"},
+		{"/?scalar=1&f=json", `SELECT 'a"b'`, "\"a\\\"b\"\n", "application/json"},
+		{"/?scalar=1&f=json", `SELECT '2026-03-30'::DATE`, "\"2026-03-30\"\n", "application/json"},
+	} {
+		resp, err := doPost(ts, tc.path, tc.query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+		assert.Equal(t, tc.ctype, resp.Header.Get("Content-Type"))
+	}
+
+	for _, query := range []string{
+		`SELECT 1, 2`,
+		`SELECT i FROM range(2) t(i)`,
+		`SELECT i FROM range(0) t(i)`,
+	} {
+		resp, err := doPost(ts, "/?scalar=1", query)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Scalar result needs exactly 1 row and 1 column\n", got)
+	}
+}
+
+func TestKeepSession(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MaxKeepSession = 200 * time.Millisecond
+		return c
+	})
+	keepSession := func(d string) RequestOption {
+		return func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.KeepSessionHeader, d)
+			return req
+		}
+	}
+	attach := func(id string) RequestOption {
+		return func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.ConnectionIDHeader, id)
+			return req
+		}
+	}
+
+	resp, err := doPost(ts, "/?f=csv", "CREATE TEMP TABLE t AS SELECT 42 AS N", keepSession("10m"))
+	if _, err := readResponse(resp, err); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "200ms", resp.Header.Get(duckserver.KeepSessionHeader))
+	id := resp.Header.Get(duckserver.ConnectionIDHeader)
+	closeIdleConnections(t, ts)
+	time.Sleep(50 * time.Millisecond)
+
+	// A new connection attaches the kept DB.
+	rh := testQuery1(t, ts, "SELECT N FROM t", "N\n42\n", attach(id))
+	assert.Equal(t, id, rh.ConnectionID)
+	closeIdleConnections(t, ts)
+	time.Sleep(50 * time.Millisecond)
+
+	// The DB is closed because the attached request didn't ask to keep it.
+	resp, err = doPost(ts, "/?f=csv", "SELECT 1", attach(id))
+	if _, err := readResponse2(resp, err, 404, 404); err != nil {
+		t.Error(err)
+	}
+	closeIdleConnections(t, ts)
+
+	// The kept DB is closed after the duration.
+	resp, err = doPost(ts, "/?f=csv", "SELECT 1", keepSession("1m"))
+	if _, err := readResponse(resp, err); err != nil {
+		t.Fatal(err)
+	}
+	id = resp.Header.Get(duckserver.ConnectionIDHeader)
+	closeIdleConnections(t, ts)
+	time.Sleep(400 * time.Millisecond)
+	resp, err = doPost(ts, "/?f=csv", "SELECT 1", attach(id))
+	if _, err := readResponse2(resp, err, 404, 404); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MaxEmbedSize = 100
+		return c
+	})
+	got, err := readResponse(doGet(ts, "/?embed=1&f=csv&q="+url.QueryEscape("SELECT 1 AS A, 'foo' AS B")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"contentType":"text/csv","data":"data:text/csv;base64,QSxCCjEsZm9vCg=="}`+"\n", got)
+
+	resp, err := doGet(ts, "/?embed=1&f=csv&q="+url.QueryEscape("SELECT * FROM range(100)"))
+	got, err = readResponse2(resp, err, 413, 413)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Embedded result too large: limit is 100 bytes\n", got)
+
+	resp, err = doGet(ts, "/?embed=1&scalar=1&q="+url.QueryEscape("SELECT 1"))
+	got, err = readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "embed=1 can't be used with scalar=1\n", got)
+
+	// Disabled by default.
+	ts = startServer0(t)
+	resp, err = doGet(ts, "/?embed=1&q="+url.QueryEscape("SELECT 1"))
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoLimit(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AutoLimit = 3
+		return c
+	})
+	for _, tc := range []struct {
+		query   string
+		want    string
+		limited string
+	}{
+		{"SELECT * FROM range(5) t(N); -- comment", "N\n0\n1\n2\n", "3"},
+		{"SELECT * FROM range(5) t(N) LIMIT 4", "N\n0\n1\n2\n3\n", ""},
+		{"SELECT * FROM (SELECT * FROM range(5) LIMIT 4) t(N)", "N\n0\n1\n2\n", "3"},
+		{"WITH t(N) AS (SELECT * FROM range(5)) SELECT * FROM t", "N\n0\n1\n2\n3\n4\n", ""},
+		{"FROM range(5) t(N)", "N\n0\n1\n2\n3\n4\n", ""},
+	} {
+		resp, err := doPost(ts, "/?f=csv", tc.query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+		assert.Equal(t, tc.limited, resp.Header.Get(duckserver.AutoLimitedHeader))
+	}
+}
+
+func TestShowSQL(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AutoLimit = 3
+		return c
+	})
+	for _, tc := range []struct {
+		path  string
+		query string
+		want  string
+	}{
+		{"/?show_sql=1", "SELECT * FROM range(5) t(N)", `{"sql":"SELECT * FROM range(5) t(N)\nLIMIT 3"}`},
+		{"/?show_sql=1&pivot_on=k&pivot_value=v", "FROM (VALUES ('a', 1)) t(k, v)", `{"sql":"PIVOT (FROM (VALUES ('a', 1)) t(k, v)\n) ON \"k\" USING sum(\"v\")"}`},
+	} {
+		resp, err := doPost(ts, tc.path, tc.query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want+"\n", got)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	}
+	// The query isn't executed.
+	testQuery0(t, ts, `SELECT 1 AS N`, "N\n1\n")
+	resp, err := doPost(ts, "/?show_sql=1", `CREATE TABLE t1 AS SELECT 1 AS N`)
+	if _, err := readResponse(resp, err); err != nil {
+		t.Fatal(err)
+	}
+	testQuery0(t, ts, `CREATE TABLE t1 AS SELECT 2 AS N`, "Count\n1\n")
+}
+
+func TestNullSink(t *testing.T) {
+	ts := startServer1(t, configAuthn("testdata/authn.json", false))
+	admin := authorizationBearer("token-admin1")
+	resp, err := doPost(ts, "/?sink=null", `SELECT * FROM range(1000) t(N)`, admin)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result duckserver.SinkResult
+	if err := json.Unmarshal([]byte(got), &result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1000), result.Rows)
+	assert.Equal(t, "1000", resp.Header.Get(duckserver.RowCountHeader))
+
+	resp, err = doPost(ts, "/?sink=null", `SELECT 1`, authorizationBearer("token-0123456789abcdef"))
+	if _, err := readResponse2(resp, err, 403, 403); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = doPost(ts, "/?sink=file", `SELECT 1`, admin)
+	got, err = readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Unsupported sink: \"file\"\n", got)
+}
+
+func TestResultHash(t *testing.T) {
+	ts := startServer0(t)
+	const query = `SELECT i, if(i % 2 = 0, NULL, 'a' || i) AS s FROM range(5) t(i) ORDER BY i`
+	resp, err := doPost(ts, "/?hash=sha256", query)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result duckserver.SinkResult
+	if err := json.Unmarshal([]byte(got), &result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(5), result.Rows)
+	assert.Equal(t, result.Hash, resp.Header.Get(duckserver.ResultHashHeader))
+
+	// The hash is of the result in pg-text.
+	text, err := readResponse(doPost(ts, "/?f=pg-text", query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(text))
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), result.Hash)
+
+	resp, err = doPost(ts, "/?hash=md5", query)
+	got, err = readResponse2(resp, err, 400, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Unsupported hash: \"md5\"\n", got)
+}
+
+func TestCountRows(t *testing.T) {
+	ts := startServer0(t)
+	for _, tc := range []struct {
+		query string
+		want  string
+		count string
+	}{
+		{"SELECT * FROM range(3) t(N); -- comment", "N\n0\n1\n2\n", "3"},
+		{"FROM range(0) t(N)", "N\n", "0"},
+	} {
+		resp, err := doPost(ts, "/?f=csv&count=1", tc.query)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+		assert.Equal(t, tc.count, resp.Header.Get(duckserver.EstimatedRowsHeader))
+	}
+
+	// Without the parameter, rows aren't counted.
+	resp, err := doPost(ts, "/?f=csv", "SELECT 1 AS N")
+	if _, err := readResponse(resp, err); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", resp.Header.Get(duckserver.EstimatedRowsHeader))
+
+	resp, err = doPost(ts, "/?f=csv&count=1", "SET threads = 1")
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestColumnsHeader(t *testing.T) {
+	ts := startServer0(t)
+	const query = `SELECT i AS id, 'n' || i AS name, i * 10 AS total FROM range(2) t(i)`
+	selectColumns := func(columns string) RequestOption {
+		return func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.ColumnsHeader, columns)
+			return req
+		}
+	}
+	for _, tc := range []struct {
+		columns string
+		format  string
+		want    string
+	}{
+		{"total,id", "csv", "total,id\n0,0\n10,1\n"},
+		{" name ", "json", "[{\"name\":\"n0\"},\n{\"name\":\"n1\"}]\n"},
+	} {
+		resp, err := doPost(ts, "/?f="+tc.format, query, selectColumns(tc.columns))
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+	}
+	for _, columns := range []string{"id,missing", "id,id", "ID"} {
+		resp, err := doPost(ts, "/?f=csv", query, selectColumns(columns))
+		if _, err := readResponse2(resp, err, 400, 400); err != nil {
+			t.Errorf("columns=%q: %s", columns, err)
+		}
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	ts := startServer0(t)
+	// Queries of a connection run on the dedicated DuckDB connection, so its
+	// variables and temporary objects persist across requests.
+	rh := testQuery0(t, ts, `SET VARIABLE x = 5`, "Success\n")
+	testQuery0(t, ts, `CREATE TEMP TABLE t AS SELECT getvariable('x') AS N`, "Count\n1\n")
+	rh2 := testQuery0(t, ts, `SELECT N, getvariable('x') AS X FROM t`, "N,X\n5,5\n")
+	assert.Equal(t, rh.ConnectionID, rh2.ConnectionID)
+
+	// Another connection has its own state.
+	closeIdleConnections(t, ts)
+	testQuery0(t, ts, `SELECT getvariable('x') AS X`, "X\nNULL\n")
+}
+
+func TestPivot(t *testing.T) {
+	ts := startServer0(t)
+	const query = `SELECT * FROM (VALUES ('a', 'jan', 1), ('a', 'feb', 2), ('b', 'jan', 3), ('a', 'jan', 4)) t(shop, month, revenue) ORDER BY shop`
+	for _, tc := range []struct {
+		params string
+		want   string
+	}{
+		{"pivot_on=month&pivot_value=revenue", "shop,feb,jan\na,2,5\nb,NULL,3\n"},
+		{"pivot_on=MONTH&pivot_value=revenue&pivot_agg=max", "shop,feb,jan\na,2,4\nb,NULL,3\n"},
+	} {
+		got, err := readResponse(doPost(ts, "/?f=csv&"+tc.params, query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+	}
+	for _, tc := range []struct {
+		params string
+		query  string
+		want   string
+	}{
+		{"pivot_on=day&pivot_value=revenue", query, "Column of pivot_on not found in the result: \"day\"\n"},
+		{"pivot_on=month&pivot_value=price", query, "Column of pivot_value not found in the result: \"price\"\n"},
+		{"pivot_on=month", query, "pivot_value is required with pivot_on\n"},
+		{"pivot_on=month&pivot_value=revenue&pivot_agg=string_agg", query, "Unsupported pivot_agg: \"string_agg\"\n"},
+		{"pivot_on=month&pivot_value=revenue", "SELECT 1; " + query, "Pivot needs a single query like SELECT\n"},
+	} {
+		resp, err := doPost(ts, "/?f=csv&"+tc.params, tc.query)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+	}
+}
+
+func TestSchemaSample(t *testing.T) {
+	ts := startServer0(t)
+	testQuery0(t, ts, `CREATE TABLE t AS SELECT * FROM range(20) r(N)`, "Count\n20\n")
+	testQuery0(t, ts, `CREATE VIEW v AS SELECT N * 2 AS M FROM t`, "Count\n")
+
+	got, err := readResponse(doGet(ts, "/schema/t/sample?n=3&f=csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "N\n0\n1\n2\n", got)
+	got, err = readResponse(doGet(ts, "/schema/v/sample?f=csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "M\n0\n2\n4\n6\n8\n10\n12\n14\n16\n18\n", got)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/schema/no_such_table/sample", 404},
+		{"/schema/t;DROP/sample", 400},
+		{"/schema/t/sample?n=0", 400},
+		{"/schema/t/sample?n=1001", 400},
+	} {
+		resp, err := doGet(ts, tc.path)
+		if _, err := readResponse2(resp, err, tc.status, tc.status); err != nil {
+			t.Errorf("%s: %s", tc.path, err)
+		}
+	}
+}
+
+func TestDBSpares(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBSpares = 2
+		return c
+	})
+	databases := func() int {
+		t.Helper()
+		got, err := readResponse(doGet(ts, "/status/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status duckserver.Status
+		if err := json.Unmarshal([]byte(got), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status.Databases
+	}
+	assert.Equal(t, 2, databases())
+
+	// A connection takes a spare DB, and its private directory is named by
+	// the ID of the DB.
+	testQuery0(t, ts, `COPY (SELECT 1 AS A) TO (private_dir('a.csv'))`, "Count\n1\n")
+	testQuery0(t, ts, `SELECT * FROM read_csv_auto(private_dir('a.csv'))`, "A\n1\n")
+	files, err := filepath.Glob(filepath.Join(ts.srv.PrivateRoot(), "*", "a.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasPrefix(filepath.Base(filepath.Dir(files[0])), "S_") {
+		t.Errorf("the private directory should be named by the spare DB: %v", files)
+	}
+
+	// The taken spare is refilled in background.
+	for i := 0; databases() != 3; i++ {
+		if i >= 50 {
+			t.Fatalf("spare DBs are not refilled: %d", databases())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, opt := range []configOption{
+		func(c *duckserver.Config) *duckserver.Config {
+			c.DBSpares = 5
+			return c
+		},
+		func(c *duckserver.Config) *duckserver.Config {
+			c.DBStrategy = "shared"
+			c.DBSpares = 1
+			return c
+		},
+	} {
+		config := duckserver.DefaultConfig()
+		config.MaxDB = 4
+		config = *opt(&config)
+		if _, err := duckserver.New(config); err == nil {
+			t.Errorf("invalid spare DBs should be rejected: strategy=%s spares=%d", config.DBStrategy, config.DBSpares)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package duckserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/koron/duckpop/internal/formatter"
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// EmbedResponse is the result of a query embedded as a data URI with
+// "embed=1" parameter.
+type EmbedResponse struct {
+	ContentType string `json:"contentType"`
+	Data        string `json:"data"`
+}
+
+// isEmbedRequest checks the request wants the result embedded in JSON as a
+// data URI with "embed=1" parameter.
+func isEmbedRequest(r *http.Request) bool {
+	switch r.URL.Query().Get("embed") {
+	case "1", "true":
+		return true
+	default:
+		return false
+	}
+}
+
+var errEmbedTooLarge = errors.New("embedded result too large")
+
+// embedBuffer buffers the output of a format up to limit bytes.
+type embedBuffer struct {
+	bytes.Buffer
+	limit int64
+}
+
+func (b *embedBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.limit {
+		return 0, errEmbedTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// writeEmbed writes all rows into the buffer, then responds them as a base64
+// data URI in JSON. It responds 413 when the output exceeds the limit.
+func writeEmbed(ctx context.Context, w http.ResponseWriter, factory formatter.Factory, fw formatter.Writer, rows resultRows, buf *embedBuffer) error {
+	n, err := writeRows(ctx, fw, rows, nil)
+	if err != nil {
+		if errors.Is(err, errEmbedTooLarge) {
+			return httperror.Newf(413, "Embedded result too large: limit is %d bytes", buf.limit)
+		}
+		return serializationError(err)
+	}
+	contentType := factory.ContentType()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(RowCountHeader, strconv.FormatInt(n, 10))
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(EmbedResponse{
+		ContentType: contentType,
+		Data:        "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	})
+}
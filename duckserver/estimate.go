@@ -0,0 +1,152 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/koron/duckpop/internal/authn"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// planNode is a node of the physical plan given by "EXPLAIN (FORMAT JSON)".
+type planNode struct {
+	Name      string         `json:"name"`
+	Children  []planNode     `json:"children"`
+	ExtraInfo map[string]any `json:"extra_info"`
+}
+
+// estimate returns the estimated cardinality of the node, and the maximum one
+// in the subtree. A node without estimation, like CROSS_PRODUCT, is estimated
+// with its children.
+func (n planNode) estimate() (int64, int64) {
+	var self, peak int64
+	if n.Name == "CROSS_PRODUCT" && len(n.Children) > 0 {
+		self = 1
+	}
+	for _, c := range n.Children {
+		e, p := c.estimate()
+		peak = max(peak, p)
+		if n.Name == "CROSS_PRODUCT" {
+			self *= e
+		} else {
+			self = max(self, e)
+		}
+	}
+	if s, ok := n.ExtraInfo["Estimated Cardinality"].(string); ok {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			self = v
+		}
+	}
+	return self, max(peak, self)
+}
+
+// estimateRows estimates the maximum number of rows which the query processes
+// with EXPLAIN. It returns false when it can't estimate, like for SET
+// statements.
+func estimateRows(ctx context.Context, conn *sql.Conn, query string, args ...any) (int64, bool) {
+	rows, err := conn.QueryContext(ctx, "EXPLAIN (FORMAT JSON) "+query, args...)
+	if err != nil {
+		return 0, false
+	}
+	defer rows.Close()
+	var peak int64
+	var found bool
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return 0, false
+		}
+		if key != "physical_plan" {
+			continue
+		}
+		var nodes []planNode
+		if err := json.Unmarshal([]byte(value), &nodes); err != nil {
+			return 0, false
+		}
+		for _, n := range nodes {
+			_, p := n.estimate()
+			peak = max(peak, p)
+		}
+		found = true
+	}
+	if rows.Err() != nil {
+		return 0, false
+	}
+	return peak, found
+}
+
+// isAdmin checks the request is made by an admin. All requests are treated
+// as admins when authentication is disabled.
+func (srv *Server) isAdmin(r *http.Request) bool {
+	if srv.authenticator == nil {
+		return true
+	}
+	entry, ok := authn.AuthnEntry(r.Context())
+	return ok && entry.Admin
+}
+
+// checkEstimatedRows rejects the query when estimated rows of any statement
+// exceed DBMaxEstimatedRows. Admins can skip it with NoCostLimitHeader. A
+// single statement which can't be estimated is executed, but a statement of
+// multiple ones is rejected, because it may depend on the former ones, like a
+// view created by them.
+func (srv *Server) checkEstimatedRows(ctx context.Context, r *http.Request, conn *sql.Conn, query string, args ...any) error {
+	limit := srv.config.DBMaxEstimatedRows
+	if limit <= 0 {
+		return nil
+	}
+	if r.Header.Get(NoCostLimitHeader) == "true" && srv.isAdmin(r) {
+		return nil
+	}
+	stmts := sqltext.Statements(query)
+	for i, stmt := range stmts {
+		// Arguments are bound to the last statement.
+		var stmtArgs []any
+		if i == len(stmts)-1 {
+			stmtArgs = args
+		}
+		n, ok := estimateRows(ctx, conn, stmt, stmtArgs...)
+		if !ok && len(stmts) > 1 {
+			return httperror.Newf(400, "Rows of the statement %d can't be estimated", i+1)
+		}
+		if ok && n > limit {
+			return httperror.Newf(400, "Estimated rows %d exceed the limit %d", n, limit)
+		}
+	}
+	return nil
+}
+
+// isCountRequest checks the request wants the number of rows before the
+// result with "count=1" parameter.
+func isCountRequest(r *http.Request) bool {
+	switch r.URL.Query().Get("count") {
+	case "1", "true":
+		return true
+	default:
+		return false
+	}
+}
+
+// countRows counts rows of the result with "SELECT count(*)" before executing
+// the query, and sets it to EstimatedRowsHeader when "count=1" is given. It
+// costs as much as the query, and the count may differ from the result for
+// queries which aren't deterministic, like with random().
+func (srv *Server) countRows(ctx context.Context, w http.ResponseWriter, r *http.Request, conn *sql.Conn, query string, args ...any) error {
+	if !isCountRequest(r) {
+		return nil
+	}
+	sub, ok := asSubquery(query)
+	if !ok {
+		return httperror.Newf(400, "Counting rows needs a single query like SELECT")
+	}
+	var n int64
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM "+sub, args...).Scan(&n); err != nil {
+		return srv.executionError(w, err)
+	}
+	w.Header().Set(EstimatedRowsHeader, strconv.FormatInt(n, 10))
+	return nil
+}
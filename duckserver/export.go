@@ -0,0 +1,124 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// ExportRequest is a request to export the result of a query to an object
+// storage.
+type ExportRequest struct {
+	Query string `json:"query"`
+	URL   string `json:"url"`
+	// Format is one of "parquet", "csv" or "json". It is guessed from the
+	// extension of URL when omitted, and "parquet" is used if it can't be.
+	Format string `json:"format,omitempty"`
+}
+
+// ExportResponse describes the written object.
+type ExportResponse struct {
+	URL   string `json:"url"`
+	Count int64  `json:"count"`
+}
+
+var exportSchemes = map[string]struct{}{
+	"s3": {},
+}
+
+// handleExport writes the result of a query to an object storage with COPY
+// statement, instead of streaming it to the client. It requires external
+// access of DuckDB, httpfs extension and an admin.
+func (srv *Server) handleExport(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkWritable(r); err != nil {
+		return err
+	}
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	if !srv.dbSettings.EnableExternalAccess {
+		return httperror.Newf(403, "External access is disabled")
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	var req ExportRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return httperror.Newf(400, "Invalid request: %s", err)
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return httperror.Newf(400, "No queries")
+	}
+	if err := srv.checkStatements(req.Query); err != nil {
+		return err
+	}
+	if err := srv.checkFileReads(r, req.Query); err != nil {
+		return err
+	}
+	if err := srv.checkExtensions(r, req.Query); err != nil {
+		return err
+	}
+	sub, ok := asSubquery(req.Query)
+	if !ok {
+		return httperror.Newf(400, "Export needs a single query like SELECT")
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return httperror.Newf(400, "Invalid URL: %s", err)
+	}
+	if _, ok := exportSchemes[strings.ToLower(u.Scheme)]; !ok {
+		return httperror.Newf(400, "Unsupported URL scheme: %q", u.Scheme)
+	}
+	format := req.Format
+	if format == "" {
+		format = guessFormat(u.Path)
+	}
+	if format == "" {
+		format = "parquet"
+	}
+	format = strings.ToLower(format)
+	if _, ok := fileReaders[format]; !ok {
+		return httperror.Newf(400, "Unsupported file format: %q", format)
+	}
+	timeout, err := srv.queryTimeout(r)
+	if err != nil {
+		return err
+	}
+
+	client, conn, err := srv.clientConn(w, r)
+	if err != nil {
+		return err
+	}
+	unlock, err := srv.lockQuery(r, client)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ctx := r.Context()
+	if _, err := conn.ExecContext(ctx, "LOAD httpfs"); err != nil {
+		return httperror.Newf(503, "httpfs extension is not available: %s", err)
+	}
+	query := "COPY " + sub + " TO " + sqltext.QuoteString(req.URL) + " (FORMAT " + strings.ToUpper(format) + ")"
+	auditlog.SetQuery(w, query)
+
+	q := srv.queryDatabase.AddTimeout(ctx, client.ID, query, timeout)
+	w.Header().Set(QueryIDHeader, q.ID.String())
+	defer q.Close()
+	var count int64
+	if err := conn.QueryRowContext(q.Context(), query).Scan(&count); err != nil {
+		return srv.executionError(w, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(ExportResponse{URL: req.URL, Count: count})
+}
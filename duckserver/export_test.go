@@ -0,0 +1,69 @@
+package duckserver_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestExport(t *testing.T) {
+	const body = `{"query":"SELECT 1 AS A","url":"s3://bucket/a.parquet"}`
+
+	t.Run("external access disabled", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DBExternalAccess = false
+			return c
+		})
+		resp, err := doPost(ts, "/export/", body)
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "External access is disabled\n", got)
+	})
+
+	t.Run("not admin", func(t *testing.T) {
+		ts := startServer1(t, configAuthn("testdata/authn.json", false))
+		resp, err := doPost(ts, "/export/", body, authorizationBearer("token-0123456789abcdef"))
+		if _, err := readResponse2(resp, err, 403, 403); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("file reads", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.FileReadPrefixes = []string{"/data/"}
+			return c
+		})
+		resp, err := doPost(ts, "/export/", `{"query":"SELECT * FROM read_csv('/etc/passwd')","url":"s3://bucket/a.csv"}`)
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Reading the file is not allowed: \"/etc/passwd\"\n", got)
+	})
+
+	ts := startServer0(t)
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"no query", `{"url":"s3://bucket/a.parquet"}`, "No queries\n"},
+		{"bad scheme", `{"query":"SELECT 1","url":"file:///tmp/a.parquet"}`, "Unsupported URL scheme: \"file\"\n"},
+		{"bad format", `{"query":"SELECT 1","url":"s3://bucket/a","format":"xlsx"}`, "Unsupported file format: \"xlsx\"\n"},
+		{"multiple statements", `{"query":"SELECT 1; DROP TABLE t","url":"s3://bucket/a.csv"}`, "Export needs a single query like SELECT\n"},
+		{"not a query", `{"query":"SELECT 1) TO 's3://bucket/b.csv'; COPY (SELECT 2","url":"s3://bucket/a.csv"}`, "Export needs a single query like SELECT\n"},
+		{"writing query", `{"query":"WITH a AS (SELECT 1) DELETE FROM t","url":"s3://bucket/a.csv"}`, "Export needs a single query like SELECT\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := doPost(ts, "/export/", tc.body)
+			got, err := readResponse2(resp, err, 400, 400)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/koron/duckpop/internal/conndb"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// idleTransaction is a transaction which a client may have left open after a
+// request, rolled back when it is idle for IdleTransactionTimeout.
+type idleTransaction struct {
+	conn  *sql.Conn
+	timer *time.Timer
+}
+
+// mayLeaveTransaction reports whether a transaction may be open after the
+// query, when it was open before the query if inTxn. Statements closing a
+// transaction are ignored when the query failed, because they may not have
+// been executed.
+func mayLeaveTransaction(query string, inTxn, failed bool) bool {
+	open := inTxn
+	for _, stmt := range sqltext.Statements(query) {
+		switch sqltext.StatementType(stmt) {
+		case "BEGIN", "START":
+			open = true
+		case "COMMIT", "END", "ROLLBACK", "ABORT":
+			if !failed {
+				open = false
+			}
+		}
+	}
+	return open
+}
+
+// beginIdleTransaction stops the timer of the idle transaction of the client
+// for a query, holding the query lock of the client. It fails when the
+// transaction has been rolled back by the timeout since the last query, so
+// that the client doesn't continue it without the transaction. inTxn reports
+// whether a transaction may be open.
+func (srv *Server) beginIdleTransaction(client *conndb.Client) (inTxn bool, err error) {
+	if srv.config.IdleTransactionTimeout <= 0 {
+		return false, nil
+	}
+	if _, ok := srv.txnResets.LoadAndDelete(client.ID); ok {
+		return false, httperror.Newf(409, "Transaction was rolled back by idle timeout")
+	}
+	tx, ok := srv.idleTxns.LoadAndDelete(client.ID)
+	if !ok {
+		return false, nil
+	}
+	tx.timer.Stop()
+	return true, nil
+}
+
+// endIdleTransaction starts the timer of the idle transaction of the client
+// when the query may have left a transaction open.
+func (srv *Server) endIdleTransaction(client *conndb.Client, conn *sql.Conn, query string, inTxn, failed bool) {
+	if srv.config.IdleTransactionTimeout <= 0 || !mayLeaveTransaction(query, inTxn, failed) {
+		return
+	}
+	tx := &idleTransaction{conn: conn}
+	tx.timer = time.AfterFunc(srv.config.IdleTransactionTimeout, func() {
+		srv.rollbackIdleTransaction(client, tx)
+	})
+	srv.idleTxns.Store(client.ID, tx)
+}
+
+// rollbackIdleTransaction rolls back the idle transaction of the client, and
+// marks the session as reset when it was open.
+func (srv *Server) rollbackIdleTransaction(client *conndb.Client, tx *idleTransaction) {
+	// A running query of the client starts the timer again when it ends.
+	unlock, ok := client.TryLockQuery()
+	if !ok {
+		return
+	}
+	defer unlock()
+	if cur, ok := srv.idleTxns.Load(client.ID); !ok || cur != tx {
+		return
+	}
+	srv.idleTxns.Delete(client.ID)
+	// ROLLBACK fails when no transactions are open, like after a failed
+	// COMMIT which ended the transaction.
+	if _, err := tx.conn.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+		srv.logger.Debug("no idle transactions to roll back", "connID", client.ID, "error", err)
+		return
+	}
+	srv.txnResets.Store(client.ID, struct{}{})
+	srv.logger.Warn("rolled back idle transaction", "connID", client.ID, "timeout", srv.config.IdleTransactionTimeout)
+}
+
+// clearIdleTransaction forgets the idle transaction of the closed DB.
+func (srv *Server) clearIdleTransaction(id conndb.ID) {
+	if tx, ok := srv.idleTxns.LoadAndDelete(id); ok {
+		tx.timer.Stop()
+	}
+	srv.txnResets.Delete(id)
+}
@@ -0,0 +1,74 @@
+package duckserver_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestIdleTransactionTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	start := func(t *testing.T) *testServer {
+		return startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.IdleTransactionTimeout = timeout
+			return c
+		})
+	}
+	exec := func(t *testing.T, ts *testServer, query string) {
+		t.Helper()
+		if _, err := readResponse(doPost(ts, "/?f=csv", query)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fail := func(t *testing.T, ts *testServer, query string, status int) string {
+		t.Helper()
+		resp, err := doPost(ts, "/?f=csv", query)
+		got, err := readResponse2(resp, err, status, status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		ts := start(t)
+		exec(t, ts, `BEGIN; CREATE TABLE t AS SELECT * FROM range(3) t(i)`)
+		time.Sleep(timeout * 3)
+		got := fail(t, ts, `SELECT count(*) AS n FROM t`, 409)
+		assert.Equal(t, "Transaction was rolled back by idle timeout\n", got)
+		// The table created in the transaction is gone.
+		fail(t, ts, `SELECT count(*) AS n FROM t`, 400)
+	})
+
+	t.Run("active", func(t *testing.T) {
+		ts := start(t)
+		exec(t, ts, `BEGIN`)
+		exec(t, ts, `CREATE TABLE t AS SELECT * FROM range(3) t(i)`)
+		for range 4 {
+			time.Sleep(timeout / 2)
+			testQuery0(t, ts, `SELECT count(*) AS n FROM t`, "n\n3\n")
+		}
+		exec(t, ts, `COMMIT`)
+		time.Sleep(timeout * 3)
+		testQuery0(t, ts, `SELECT count(*) AS n FROM t`, "n\n3\n")
+	})
+
+	t.Run("failed commit", func(t *testing.T) {
+		ts := start(t)
+		exec(t, ts, `BEGIN; CREATE TABLE t AS SELECT * FROM range(3) t(i)`)
+		// COMMIT isn't executed after the failed statement.
+		fail(t, ts, `SELECT * FROM no_such_table; COMMIT`, 400)
+		time.Sleep(timeout * 3)
+		fail(t, ts, `SELECT 1`, 409)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ts := startServer0(t)
+		exec(t, ts, `BEGIN; CREATE TABLE t AS SELECT * FROM range(3) t(i)`)
+		time.Sleep(timeout * 3)
+		testQuery0(t, ts, `SELECT count(*) AS n FROM t`, "n\n3\n")
+		exec(t, ts, `COMMIT`)
+	})
+}
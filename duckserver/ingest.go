@@ -0,0 +1,109 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// IngestResponse describes the result of ingestion.
+type IngestResponse struct {
+	Table string `json:"table"`
+	// Created is true when the table is created by the ingestion.
+	Created bool  `json:"created"`
+	Count   int64 `json:"count"`
+}
+
+// handleIngest loads records in the body into a table of the client's
+// database. The table is created with the inferred schema if missing,
+// otherwise the records are appended by name, which fails when they aren't
+// compatible. The body is written to a temporary file in the private
+// directory, so it works without external access.
+func (srv *Server) handleIngest(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkWritable(r); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	table := q.Get("table")
+	if !sqltext.IsIdent(table) {
+		return httperror.Newf(400, "Invalid table: %q", table)
+	}
+	if format := q.Get("format"); format != "" && format != "ndjson" {
+		return httperror.Newf(400, "Unsupported ingest format: %q", format)
+	}
+	timeout, err := srv.queryTimeout(r)
+	if err != nil {
+		return err
+	}
+
+	client, conn, err := srv.clientConn(w, r)
+	if err != nil {
+		return err
+	}
+	unlock, err := srv.lockQuery(r, client)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.CreateTemp(filepath.Join(srv.dbPrivateRoot, client.DBID().String()), "ingest-*.ndjson")
+	if err != nil {
+		return httperror.Newf(500, "Failed to create temporary file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r.Body)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return bodyError(err)
+	}
+
+	ctx := r.Context()
+	var n int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM duckdb_tables() WHERE database_name = current_database() AND schema_name = current_schema() AND table_name = $1", table).Scan(&n); err != nil {
+		return srv.queryError(w, 500, "DB error", err)
+	}
+	created := n == 0
+	source := "SELECT * FROM read_json_auto(" + sqltext.QuoteString(f.Name()) + ", format = 'newline_delimited')"
+	var query string
+	if created {
+		query = "CREATE TABLE " + sqltext.QuoteIdent(table) + " AS " + source
+	} else {
+		query = "INSERT INTO " + sqltext.QuoteIdent(table) + " BY NAME " + source
+	}
+	auditlog.SetQuery(w, query)
+
+	qe := srv.queryDatabase.AddTimeout(ctx, client.ID, query, timeout)
+	w.Header().Set(QueryIDHeader, qe.ID.String())
+	defer qe.Close()
+	result, err := conn.ExecContext(qe.Context(), query)
+	if err != nil {
+		return srv.executionError(w, err)
+	}
+	srv.dataChanged(w, query)
+	// CREATE TABLE AS doesn't tell the number of rows.
+	var count int64
+	if created {
+		err = conn.QueryRowContext(ctx, "SELECT count(*) FROM "+sqltext.QuoteIdent(table)).Scan(&count)
+	} else {
+		count, err = result.RowsAffected()
+	}
+	if err != nil {
+		return srv.queryError(w, 500, "DB error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(IngestResponse{Table: table, Created: created, Count: count})
+}
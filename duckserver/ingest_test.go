@@ -0,0 +1,56 @@
+package duckserver_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestIngest(t *testing.T) {
+	// The body is read from the private directory, so it works without
+	// external access.
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.DBExternalAccess = false
+		return c
+	})
+
+	got, err := readResponse(doPost(ts, "/ingest/?table=events&format=ndjson", "{\"id\":1,\"name\":\"foo\"}\n{\"id\":2,\"name\":\"bar\"}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "{\"table\":\"events\",\"created\":true,\"count\":2}\n", got)
+
+	// Records are appended by name.
+	got, err = readResponse(doPost(ts, "/ingest/?table=events", "{\"name\":\"baz\",\"id\":3}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "{\"table\":\"events\",\"created\":false,\"count\":1}\n", got)
+	testQuery0(t, ts, "SELECT id, name FROM events ORDER BY id", "id,name\n1,foo\n2,bar\n3,baz\n")
+
+	// Incompatible records are rejected.
+	resp, err := doPost(ts, "/ingest/?table=events", "{\"id\":4,\"extra\":true}\n")
+	if _, err := readResponse2(resp, err, 400, 400); err != nil {
+		t.Error(err)
+	}
+	testQuery0(t, ts, "SELECT count(*) AS N FROM events", "N\n3\n")
+
+	for _, tc := range []struct {
+		name string
+		path string
+		want string
+	}{
+		{"bad table", "/ingest/?table=t+DROP", "Invalid table: \"t DROP\"\n"},
+		{"bad format", "/ingest/?table=t&format=csv", "Unsupported ingest format: \"csv\"\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := doPost(ts, tc.path, "{}\n")
+			got, err := readResponse2(resp, err, 400, 400)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
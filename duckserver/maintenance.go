@@ -0,0 +1,103 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/koron/duckpop/internal/authn"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// readOnlyStatements are types of statements allowed in read-only mode. The
+// others, including EXPLAIN which can execute a statement with ANALYZE, are
+// rejected. WITH is checked by the statement following its CTEs.
+var readOnlyStatements = []string{
+	"SELECT", "FROM", "VALUES", "TABLE",
+	"SHOW", "DESCRIBE", "SUMMARIZE", "PIVOT", "UNPIVOT",
+}
+
+// MaintenanceRequest changes the maintenance state of the server.
+type MaintenanceRequest struct {
+	ReadOnly bool `json:"readonly"`
+}
+
+// writingStatement returns the type of the first statement in the query which
+// isn't one of readOnlyStatements, or "" when all statements are read-only.
+// A WITH statement whose main statement can't be determined is returned as
+// "WITH".
+func writingStatement(query string) string {
+	for _, stmt := range sqltext.Statements(query) {
+		t := sqltext.StatementVerb(stmt)
+		if t == "" && sqltext.StatementType(stmt) == "WITH" {
+			return "WITH"
+		}
+		if !slices.Contains(readOnlyStatements, t) {
+			return t
+		}
+	}
+	return ""
+}
+
+// isReadOnlyRequest reports whether the request is read-only by
+// ReadOnlyHeader or the authentication entry.
+func isReadOnlyRequest(r *http.Request) bool {
+	if r.Header.Get(ReadOnlyHeader) == "true" {
+		return true
+	}
+	entry, ok := authn.AuthnEntry(r.Context())
+	return ok && entry.ReadOnly
+}
+
+// checkReadOnly rejects a query which has statements other than
+// readOnlyStatements, while the server is in read-only mode or the request is
+// read-only.
+func (srv *Server) checkReadOnly(r *http.Request, query string) error {
+	if !srv.readOnly.Load() && !isReadOnlyRequest(r) {
+		return nil
+	}
+	t := writingStatement(query)
+	if t == "" {
+		return nil
+	}
+	if srv.readOnly.Load() {
+		return srv.overloaded(503, reasonReadOnly, "Server is read-only for maintenance: %s is rejected", t)
+	}
+	return httperror.Newf(403, "Read-only access: %s is rejected", t)
+}
+
+// checkWritable rejects a request which always writes, like ingest, while the
+// server is in read-only mode or the request is read-only.
+func (srv *Server) checkWritable(r *http.Request) error {
+	if srv.readOnly.Load() {
+		return srv.overloaded(503, reasonReadOnly, "Server is read-only for maintenance")
+	}
+	if isReadOnlyRequest(r) {
+		return httperror.Newf(403, "Read-only access: %s %s is rejected", r.Method, r.URL.Path)
+	}
+	return nil
+}
+
+// handleMaintenance switches the read-only mode of the running server, and
+// responds the current state.
+func (srv *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	var req MaintenanceRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return httperror.Newf(400, "Invalid maintenance request: %s", err)
+	}
+	if prev := srv.readOnly.Swap(req.ReadOnly); prev != req.ReadOnly {
+		srv.logger.Info("maintenance state changed", "readonly", req.ReadOnly)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(MaintenanceRequest{ReadOnly: srv.readOnly.Load()})
+}
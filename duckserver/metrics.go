@@ -0,0 +1,205 @@
+package duckserver
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// engineMetrics is a snapshot of metrics of DuckDB engines, which are summed
+// over all open DBs.
+type engineMetrics struct {
+	collectedAt time.Time
+	databases   int
+	// memoryBytes and tempStorageBytes are usages of the buffer pool by tag.
+	memoryBytes      map[string]int64
+	tempStorageBytes map[string]int64
+	tempFileBytes    int64
+}
+
+// collectMetrics collects metrics of DuckDB engines every MetricsInterval,
+// until ctx is canceled.
+func (srv *Server) collectMetrics(ctx context.Context) {
+	ticker := time.NewTicker(srv.config.MetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			srv.engineMetrics.Store(srv.queryEngineMetrics(ctx))
+		}
+	}
+}
+
+// queryEngineMetrics queries duckdb_memory() and duckdb_temporary_files() of
+// all open DBs. DBs which fail, like closed during the collection, are
+// skipped.
+func (srv *Server) queryEngineMetrics(ctx context.Context) *engineMetrics {
+	// Collect DBs first, not to block clients while querying.
+	var dbs []*sql.DB
+	for _, db := range srv.connManager.Databases() {
+		dbs = append(dbs, db)
+	}
+	m := &engineMetrics{
+		memoryBytes:      map[string]int64{},
+		tempStorageBytes: map[string]int64{},
+	}
+	ctx, cancel := context.WithTimeout(ctx, srv.config.MetricsInterval)
+	defer cancel()
+	for _, db := range dbs {
+		if err := m.add(ctx, db); err != nil {
+			srv.logger.Debug("failed to collect metrics", "error", err)
+			continue
+		}
+		m.databases++
+	}
+	m.collectedAt = time.Now()
+	return m
+}
+
+func (m *engineMetrics) add(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT tag, memory_usage_bytes, temporary_storage_bytes FROM duckdb_memory()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		var memory, temp int64
+		if err := rows.Scan(&tag, &memory, &temp); err != nil {
+			return err
+		}
+		m.memoryBytes[tag] += memory
+		m.tempStorageBytes[tag] += temp
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var size int64
+	if err := db.QueryRowContext(ctx, "SELECT coalesce(sum(size), 0)::BIGINT FROM duckdb_temporary_files()").Scan(&size); err != nil {
+		return err
+	}
+	m.tempFileBytes += size
+	return nil
+}
+
+// queryDurationBuckets are upper bounds of buckets of the histogram of
+// durations of queries, in seconds.
+var queryDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// queryTagPattern matches tags which can be labels of metrics as is.
+var queryTagPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// queryMetrics is the histogram of durations of queries by tag.
+type queryMetrics struct {
+	mu   sync.Mutex
+	tags map[string]*queryTagStats
+	// custom is the number of tags other than "untagged" and "other", which
+	// is limited by maxTags.
+	custom int
+}
+
+type queryTagStats struct {
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// observe records a duration of a query with a tag. Queries without tags are
+// recorded as "untagged", and ones with invalid tags or new tags beyond
+// maxTags as "other", to bound the cardinality. "untagged" and "other" aren't
+// counted in maxTags.
+func (m *queryMetrics) observe(tag string, d time.Duration, maxTags int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tags == nil {
+		m.tags = map[string]*queryTagStats{}
+	}
+	switch {
+	case tag == "":
+		tag = "untagged"
+	case !queryTagPattern.MatchString(tag):
+		tag = "other"
+	}
+	s, ok := m.tags[tag]
+	if !ok {
+		reserved := tag == "untagged" || tag == "other"
+		if !reserved && m.custom >= maxTags {
+			tag = "other"
+			reserved = true
+		}
+		if s, ok = m.tags[tag]; !ok {
+			s = &queryTagStats{buckets: make([]int64, len(queryDurationBuckets))}
+			m.tags[tag] = s
+			if !reserved {
+				m.custom++
+			}
+		}
+	}
+	sec := d.Seconds()
+	if i, _ := slices.BinarySearch(queryDurationBuckets, sec); i < len(s.buckets) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.sum += sec
+}
+
+// write writes the histogram in the text format of Prometheus.
+func (m *queryMetrics) write(bw *bufio.Writer, name, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, tag := range slices.Sorted(maps.Keys(m.tags)) {
+		s := m.tags[tag]
+		var n int64
+		for i, le := range queryDurationBuckets {
+			n += s.buckets[i]
+			fmt.Fprintf(bw, "%s_bucket{tag=%q,le=\"%g\"} %d\n", name, tag, le, n)
+		}
+		fmt.Fprintf(bw, "%s_bucket{tag=%q,le=\"+Inf\"} %d\n", name, tag, s.count)
+		fmt.Fprintf(bw, "%s_sum{tag=%q} %g\n", name, tag, s.sum)
+		fmt.Fprintf(bw, "%s_count{tag=%q} %d\n", name, tag, s.count)
+	}
+}
+
+// handleMetrics responds metrics in the text format of Prometheus. Metrics of
+// DuckDB engines are the ones collected last, and omitted when the collection
+// is disabled.
+func (srv *Server) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(200)
+	bw := bufio.NewWriter(w)
+	gauge := func(name, help string, value any) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	gaugeByTag := func(name, help string, values map[string]int64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, tag := range slices.Sorted(maps.Keys(values)) {
+			fmt.Fprintf(bw, "%s{tag=%q} %d\n", name, tag, values[tag])
+		}
+	}
+	gauge("duckpop_connections", "Number of live connections.", srv.connManager.Connections())
+	gauge("duckpop_databases", "Number of open DuckDB instances.", srv.connManager.DBCount())
+	gauge("duckpop_queries", "Number of executing queries.", srv.queryDatabase.Count())
+	gauge("duckpop_workers_active", "Number of workers executing queries and serializing results.", srv.workers.active.Load())
+	srv.queryMetrics.write(bw, "duckpop_query_duration_seconds", "Durations of executing queries until the first results by tag.")
+	if m := srv.engineMetrics.Load(); m != nil {
+		gauge("duckpop_duckdb_collected_timestamp_seconds", "Time when DuckDB metrics were collected.", m.collectedAt.Unix())
+		gauge("duckpop_duckdb_collected_databases", "Number of DuckDB instances which metrics were collected from.", m.databases)
+		gaugeByTag("duckpop_duckdb_memory_bytes", "Memory usage of the buffer pool of DuckDB by tag.", m.memoryBytes)
+		gaugeByTag("duckpop_duckdb_temporary_storage_bytes", "Usage of the temporary storage (spill) of DuckDB by tag.", m.tempStorageBytes)
+		gauge("duckpop_duckdb_temporary_files_bytes", "Size of temporary files of DuckDB on disk.", m.tempFileBytes)
+	}
+	return bw.Flush()
+}
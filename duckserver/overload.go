@@ -0,0 +1,97 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// Reasons of rejections by limits of the server.
+const (
+	reasonMaxDB    = "max_db"
+	reasonDraining = "draining"
+	reasonReadOnly = "read_only"
+	reasonWorkers  = "workers"
+)
+
+// OverloadResponse is the body of a rejection by a limit of the server, for
+// requests which accept JSON.
+type OverloadResponse struct {
+	Error             string `json:"error"`
+	Reason            string `json:"reason"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds"`
+}
+
+// overloadError is an error of a rejection by a limit of the server, which is
+// responded with Retry-After header.
+type overloadError struct {
+	status     int
+	reason     string
+	retryAfter int
+	msg        string
+}
+
+func (err *overloadError) Error() string {
+	return err.msg
+}
+
+// overloaded returns an error of a rejection by the limit of the reason, which
+// clients can retry after RetryAfter.
+func (srv *Server) overloaded(status int, reason, format string, args ...any) error {
+	return &overloadError{
+		status:     status,
+		reason:     reason,
+		retryAfter: retryAfterSeconds(srv.config.RetryAfter),
+		msg:        fmt.Sprintf(format, args...),
+	}
+}
+
+// retryAfterSeconds rounds up d to seconds of Retry-After header.
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// writeError writes the error as the response. A rejection by a limit has
+// Retry-After header, and the body of OverloadResponse when the request
+// accepts JSON.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var oe *overloadError
+	if !errors.As(err, &oe) {
+		httperror.Write(w, err)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(oe.retryAfter))
+	if !acceptsJSON(r) {
+		http.Error(w, oe.msg, oe.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(oe.status)
+	json.NewEncoder(w).Encode(OverloadResponse{
+		Error:             "overloaded",
+		Reason:            oe.reason,
+		RetryAfterSeconds: oe.retryAfter,
+	})
+}
+
+// acceptsJSON reports whether Accept header of the request has
+// "application/json" explicitly.
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for part := range strings.SplitSeq(v, ",") {
+			if t, _, err := mime.ParseMediaType(part); err == nil && t == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package duckserver
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// pivotAggregates are aggregate functions allowed for "pivot_agg" parameter.
+var pivotAggregates = []string{"sum", "avg", "min", "max", "count", "first"}
+
+// pivotQuery wraps the query with PIVOT when "pivot_on" parameter is given,
+// which turns values of the column into columns, aggregating the column of
+// "pivot_value" with "pivot_agg" (default: sum). The columns are validated
+// against the result of the query before wrapping.
+func (srv *Server) pivotQuery(ctx context.Context, w http.ResponseWriter, r *http.Request, conn *sql.Conn, query string, args ...any) (string, error) {
+	q := r.URL.Query()
+	on := q.Get("pivot_on")
+	if on == "" {
+		return query, nil
+	}
+	value := q.Get("pivot_value")
+	if value == "" {
+		return "", httperror.Newf(400, "pivot_value is required with pivot_on")
+	}
+	agg := strings.ToLower(cmp.Or(q.Get("pivot_agg"), "sum"))
+	if !slices.Contains(pivotAggregates, agg) {
+		return "", httperror.Newf(400, "Unsupported pivot_agg: %q", agg)
+	}
+	sub, ok := asSubquery(query)
+	if !ok {
+		return "", httperror.Newf(400, "Pivot needs a single query like SELECT")
+	}
+
+	columns, err := resultColumns(ctx, conn, sub, args...)
+	if err != nil {
+		return "", srv.executionError(w, err)
+	}
+	for _, param := range []struct{ name, column string }{
+		{"pivot_on", on},
+		{"pivot_value", value},
+	} {
+		if !slices.ContainsFunc(columns, func(c string) bool {
+			// DuckDB resolves names of columns case-insensitively.
+			return strings.EqualFold(c, param.column)
+		}) {
+			return "", httperror.Newf(400, "Column of %s not found in the result: %q", param.name, param.column)
+		}
+	}
+	return "PIVOT " + sub + " ON " + sqltext.QuoteIdent(on) + " USING " + agg + "(" + sqltext.QuoteIdent(value) + ")", nil
+}
+
+// resultColumns returns names of columns of the result of a subquery, without
+// fetching any rows.
+func resultColumns(ctx context.Context, conn *sql.Conn, sub string, args ...any) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT * FROM "+sub+" LIMIT 0", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
@@ -4,6 +4,9 @@ import (
 	_ "github.com/koron/duckpop/internal/formatter/avro"
 	_ "github.com/koron/duckpop/internal/formatter/csv"
 	_ "github.com/koron/duckpop/internal/formatter/html"
+	_ "github.com/koron/duckpop/internal/formatter/json"
 	_ "github.com/koron/duckpop/internal/formatter/markdown"
+	_ "github.com/koron/duckpop/internal/formatter/pgtext"
 	_ "github.com/koron/duckpop/internal/formatter/table"
+	_ "github.com/koron/duckpop/internal/formatter/xlsx"
 )
@@ -0,0 +1,62 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// ProfileRequest is a request to profile columns of the result of a query.
+type ProfileRequest struct {
+	Query string `json:"query"`
+}
+
+// profileColumns are columns of SUMMARIZE which are responded by handleProfile.
+const profileColumns = "column_name, column_type, min, max, approx_unique, null_percentage"
+
+// handleProfile responds statistics of each column of the result of a query,
+// or a table given by "table" parameter, by SUMMARIZE in the format requested
+// as the query end point.
+func (srv *Server) handleProfile(w http.ResponseWriter, r *http.Request) (retErr error) {
+	defer srv.recoverPanic(w, &retErr)
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	var target string
+	if table := r.URL.Query().Get("table"); table != "" {
+		if !sqltext.IsIdent(table) {
+			return httperror.Newf(400, "Invalid table: %q", table)
+		}
+		target = sqltext.QuoteIdent(table)
+	} else {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return bodyError(err)
+		}
+		var req ProfileRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			return httperror.Newf(400, "Invalid profile request: %s", err)
+		}
+		sub, ok := asSubquery(req.Query)
+		if !ok {
+			return httperror.Newf(400, "Profile needs a single query like SELECT")
+		}
+		target = sub
+	}
+	query := "SELECT " + profileColumns + " FROM (SUMMARIZE " + target + ")"
+	auditlog.SetQuery(w, query)
+	if err := srv.checkFileReads(r, query); err != nil {
+		return err
+	}
+	if err := srv.checkExtensions(r, query); err != nil {
+		return err
+	}
+	return srv.executeQuery(w, r, query)
+}
@@ -0,0 +1,42 @@
+package duckserver_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestProfile(t *testing.T) {
+	ts := startServer0(t)
+	testQuery0(t, ts, `CREATE TABLE t AS FROM (VALUES (1, 'a'), (2, NULL), (3, 'c'), (4, 'c')) t(id, name)`, "Count\n4\n")
+	want := "column_name,column_type,min,max,approx_unique,null_percentage\n" +
+		"id,INTEGER,1,4,4,0\n" +
+		"name,VARCHAR,a,c,2,25\n"
+
+	got, err := readResponse(doPost(ts, "/profile/?f=csv", `{"query":"SELECT * FROM t;"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+
+	got, err = readResponse(doPost(ts, "/profile/?f=csv&table=t", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+
+	for _, tc := range []struct{ path, body, want string }{
+		{"/profile/?f=csv", `{"query":"DROP TABLE t"}`, "Profile needs a single query like SELECT\n"},
+		{"/profile/?f=csv", `{"query":"SELECT 1; SELECT 2"}`, "Profile needs a single query like SELECT\n"},
+		{"/profile/?f=csv&table=" + "t%20x", "", "Invalid table: \"t x\"\n"},
+	} {
+		resp, err := doPost(ts, tc.path, tc.body)
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.want, got)
+	}
+	// The table is still there.
+	testQuery0(t, ts, `SELECT count(*) AS C FROM t`, "C\n4\n")
+}
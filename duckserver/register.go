@@ -0,0 +1,188 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// RegisterRequest is a request to register a remote file as a view.
+type RegisterRequest struct {
+	URL  string `json:"url"`
+	Name string `json:"name"`
+	// Format is one of "parquet", "csv" or "json". It is guessed from the
+	// extension of URL when omitted.
+	Format string `json:"format,omitempty"`
+}
+
+// RegisterResponse describes the schema of a registered view.
+type RegisterResponse struct {
+	Name    string         `json:"name"`
+	Columns []ColumnSchema `json:"columns"`
+}
+
+type ColumnSchema struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+var remoteSchemes = map[string]struct{}{
+	"http":  {},
+	"https": {},
+	"s3":    {},
+}
+
+var fileReaders = map[string]string{
+	"parquet": "read_parquet",
+	"csv":     "read_csv_auto",
+	"json":    "read_json_auto",
+}
+
+func guessFormat(p string) string {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".parquet":
+		return "parquet"
+	case ".csv", ".tsv":
+		return "csv"
+	case ".json", ".jsonl", ".ndjson":
+		return "json"
+	default:
+		return ""
+	}
+}
+
+// globViewQueries composes queries creating views which read files matching
+// the globs, for DBGlobViews. Local globs should match at least one file.
+func globViewQueries(views map[string]string) ([]string, error) {
+	names := slices.Sorted(maps.Keys(views))
+	queries := make([]string, 0, len(names))
+	for _, name := range names {
+		glob := views[name]
+		if !sqltext.IsIdent(name) {
+			return nil, fmt.Errorf("invalid name of glob view: %q", name)
+		}
+		reader, ok := fileReaders[guessFormat(glob)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported file format of glob view %s: %q", name, glob)
+		}
+		if u, err := url.Parse(glob); err != nil || len(u.Scheme) < 2 {
+			// Not a URL, but a local path. A single letter scheme is a drive
+			// of Windows.
+			files, err := filepath.Glob(glob)
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob of glob view %s: %w", name, err)
+			}
+			if len(files) == 0 {
+				return nil, fmt.Errorf("no files match glob view %s: %q", name, glob)
+			}
+		}
+		queries = append(queries, "CREATE OR REPLACE VIEW "+sqltext.QuoteIdent(name)+" AS SELECT * FROM "+reader+"("+sqltext.QuoteString(glob)+")")
+	}
+	return queries, nil
+}
+
+// handleRegister creates a view which reads a remote file, in the database of
+// the client.  It requires external access of DuckDB and httpfs extension.
+func (srv *Server) handleRegister(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	if err := srv.checkWritable(r); err != nil {
+		return err
+	}
+	if !srv.dbSettings.EnableExternalAccess {
+		return httperror.Newf(403, "External access is disabled")
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	var req RegisterRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return httperror.Newf(400, "Invalid request: %s", err)
+	}
+	if !sqltext.IsIdent(req.Name) {
+		return httperror.Newf(400, "Invalid name: %q", req.Name)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return httperror.Newf(400, "Invalid URL: %s", err)
+	}
+	if _, ok := remoteSchemes[strings.ToLower(u.Scheme)]; !ok {
+		return httperror.Newf(400, "Unsupported URL scheme: %q", u.Scheme)
+	}
+	format := req.Format
+	if format == "" {
+		format = guessFormat(u.Path)
+	}
+	reader, ok := fileReaders[strings.ToLower(format)]
+	if !ok {
+		return httperror.Newf(400, "Unsupported file format: %q", format)
+	}
+	query := "CREATE OR REPLACE VIEW " + sqltext.QuoteIdent(req.Name) + " AS SELECT * FROM " + reader + "(" + sqltext.QuoteString(req.URL) + ")"
+	auditlog.SetQuery(w, query)
+	// URL prefixes of FileReadPrefixes restrict hosts of remote files.
+	if err := srv.checkFileReads(r, query); err != nil {
+		return err
+	}
+	timeout, err := srv.queryTimeout(r)
+	if err != nil {
+		return err
+	}
+
+	client, conn, err := srv.clientConn(w, r)
+	if err != nil {
+		return err
+	}
+	unlock, err := srv.lockQuery(r, client)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	q := srv.queryDatabase.AddTimeout(r.Context(), client.ID, query, timeout)
+	w.Header().Set(QueryIDHeader, q.ID.String())
+	defer q.Close()
+	ctx := q.Context()
+	if _, err := conn.ExecContext(ctx, "LOAD httpfs"); err != nil {
+		return httperror.Newf(503, "httpfs extension is not available: %s", err)
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return srv.executionError(w, err)
+	}
+	srv.dataChanged(w, query)
+
+	// Describe the schema of the view.
+	rows, err := conn.QueryContext(ctx, "SELECT column_name, column_type FROM (DESCRIBE "+sqltext.QuoteIdent(req.Name)+")")
+	if err != nil {
+		return srv.queryError(w, 500, "DB error", err)
+	}
+	defer rows.Close()
+	resp := RegisterResponse{Name: req.Name, Columns: []ColumnSchema{}}
+	for rows.Next() {
+		var c ColumnSchema
+		if err := rows.Scan(&c.Name, &c.Type); err != nil {
+			return srv.queryError(w, 500, "DB error", err)
+		}
+		resp.Columns = append(resp.Columns, c)
+	}
+	if err := rows.Err(); err != nil {
+		return srv.queryError(w, 500, "DB error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,81 @@
+package duckserver_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestRegister(t *testing.T) {
+	t.Run("external access disabled", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DBExternalAccess = false
+			return c
+		})
+		resp, err := doPost(ts, "/register/", `{"url":"https://example.com/data.parquet","name":"t"}`)
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "External access is disabled\n", got)
+	})
+
+	t.Run("file reads", func(t *testing.T) {
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.FileReadPrefixes = []string{"https://data.example.com/"}
+			return c
+		})
+		resp, err := doPost(ts, "/register/", `{"url":"https://example.com/data.parquet","name":"t"}`)
+		got, err := readResponse2(resp, err, 403, 403)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Reading the file is not allowed: \"https://example.com/data.parquet\"\n", got)
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		ts := startServer0(t)
+		if _, err := readResponse(doPost(ts, "/status/drain", "")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := doPost(ts, "/register/", `{"url":"https://example.com/data.parquet","name":"t"}`)
+		got, err := readResponse2(resp, err, 503, 503)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Server is draining\n", got)
+	})
+
+	ts := startServer0(t)
+	t.Run("invalid timeout", func(t *testing.T) {
+		resp, err := doPost(ts, "/register/", `{"url":"https://example.com/data.parquet","name":"t"}`, func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.TimeoutHeader, "soon")
+			return req
+		})
+		got, err := readResponse2(resp, err, 400, 400)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Invalid timeout in "+duckserver.TimeoutHeader+": \"soon\"\n", got)
+	})
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"bad name", `{"url":"https://example.com/data.parquet","name":"t; DROP"}`, "Invalid name: \"t; DROP\"\n"},
+		{"bad scheme", `{"url":"file:///etc/passwd","name":"t"}`, "Unsupported URL scheme: \"file\"\n"},
+		{"bad format", `{"url":"https://example.com/data.xlsx","name":"t"}`, "Unsupported file format: \"\"\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := doPost(ts, "/register/", tc.body)
+			got, err := readResponse2(resp, err, 400, 400)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package duckserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// errResponseTooLarge is returned by limitWriter when a result exceeds the
+// limit of the response size.
+var errResponseTooLarge = errors.New("response too large")
+
+// maxResponseSize returns the limit of the size of a response body in bytes:
+// MaxResponseSize, which MaxResponseSizeHeader can tighten but not loosen.
+// Zero means unlimited.
+func (srv *Server) maxResponseSize(r *http.Request) (int64, error) {
+	limit := srv.config.MaxResponseSize
+	s := r.Header.Get(MaxResponseSizeHeader)
+	if s == "" {
+		return limit, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, httperror.Newf(400, "Invalid %s: %q", MaxResponseSizeHeader, s)
+	}
+	if limit > 0 && n > limit {
+		return limit, nil
+	}
+	return n, nil
+}
+
+// limitWriter counts bytes written to w, and truncates the body at the limit.
+// The write exceeding the limit and all following writes fail with
+// errResponseTooLarge.
+type limitWriter struct {
+	w        io.Writer
+	limit    int64
+	n        int64
+	exceeded bool
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if w.exceeded {
+		return 0, errResponseTooLarge
+	}
+	if rest := w.limit - w.n; int64(len(b)) > rest {
+		w.exceeded = true
+		n, err := w.w.Write(b[:rest])
+		w.n += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, errResponseTooLarge
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
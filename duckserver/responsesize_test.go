@@ -0,0 +1,67 @@
+package duckserver_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestMaxResponseSize(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.MaxResponseSize = 4096
+		c.FlushRows = 10
+		return c
+	})
+	maxSize := func(n int) RequestOption {
+		return func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.MaxResponseSizeHeader, fmt.Sprint(n))
+			return req
+		}
+	}
+
+	// Results within the limit are not affected.
+	resp, err := doPost(ts, "/?f=csv", `SELECT 1 AS N`)
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "N\n1\n", got)
+	assert.Equal(t, "", resp.Trailer.Get(duckserver.TruncatedHeader))
+
+	for _, tc := range []struct {
+		opts  []RequestOption
+		limit int
+	}{
+		{nil, 4096},
+		// The header tightens the limit, but can't loosen it.
+		{[]RequestOption{maxSize(100)}, 100},
+		{[]RequestOption{maxSize(1 << 20)}, 4096},
+	} {
+		resp, err := doPost(ts, "/?f=csv", `SELECT repeat('x', 100) AS S FROM range(1000)`, tc.opts...)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != tc.limit || !strings.HasPrefix(got, "S\nxxx") {
+			t.Errorf("the body should be truncated at %d bytes: %d bytes", tc.limit, len(got))
+		}
+		assert.Equal(t, "true", resp.Trailer.Get(duckserver.TruncatedHeader))
+		if msg := resp.Trailer.Get(duckserver.ErrorHeader); !strings.HasPrefix(msg, "Truncated: response too large") {
+			t.Errorf("unexpected error trailer: %q", msg)
+		}
+	}
+
+	for _, v := range []string{"0", "-1", "large"} {
+		resp, err := doPost(ts, "/?f=csv", `SELECT 1 AS N`, func(req *http.Request) *http.Request {
+			req.Header.Set(duckserver.MaxResponseSizeHeader, v)
+			return req
+		})
+		if _, err := readResponse2(resp, err, 400, 400); err != nil {
+			t.Errorf("%s %q: %s", duckserver.MaxResponseSizeHeader, v, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package duckserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/koron/duckpop/internal/formatter"
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// isScalarRequest checks the request wants the result as a single value with
+// "scalar=1" parameter.
+func isScalarRequest(r *http.Request) bool {
+	switch r.URL.Query().Get("scalar") {
+	case "1", "true":
+		return true
+	default:
+		return false
+	}
+}
+
+// scalarText converts a value to a text without quoting.
+func scalarText(typ *sql.ColumnType, v any) string {
+	if v == nil {
+		return "NULL"
+	}
+	switch typ.DatabaseTypeName() {
+	case "DATE":
+		return formatter.DateToStr(v)
+	case "INTERVAL":
+		return formatter.IntervalToStr(v)
+	case "TIME":
+		return formatter.TimeToStr(v)
+	case "TIMESTAMP":
+		return formatter.TimestampToStr(v)
+	case "BLOB":
+		return formatter.BlobToStr(v)
+	default:
+		if formatter.IsNested(typ.DatabaseTypeName()) {
+			return formatter.NestedToStr(typ.DatabaseTypeName(), formatter.IntervalToStr)(v)
+		}
+		return formatter.AnyToStr(v)
+	}
+}
+
+// scalarJSON converts a value to a JSON value, in the same way as the json
+// format.
+func scalarJSON(typ *sql.ColumnType, v any) ([]byte, error) {
+	if v != nil {
+		switch name := typ.DatabaseTypeName(); {
+		case name == "DATE", name == "INTERVAL", name == "TIME", name == "TIMESTAMP":
+			v = scalarText(typ, v)
+		case formatter.IsNested(name):
+			v = formatter.JSONValue(name, v, formatter.IntervalToStr)
+		}
+	}
+	return json.Marshal(v)
+}
+
+// writeScalar writes the result which has exactly one row and one column as
+// a raw value of text/plain, or of JSON with "json" format. Otherwise it
+// responds 400.
+func writeScalar(w http.ResponseWriter, out io.Writer, format string, rows *peekRows, has bool) error {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return httperror.Newf(500, "DB error: %s", err)
+	}
+	if len(columnTypes) != 1 || !has {
+		return httperror.Newf(400, "Scalar result needs exactly 1 row and 1 column")
+	}
+	scanner := formatter.NewScanner(columnTypes)
+	rows.Next()
+	if err := rows.Scan(scanner.Dests()...); err != nil {
+		return httperror.Newf(500, "DB error: %s", err)
+	}
+	v := scanner.Values()[0]
+	if rows.Next() {
+		return httperror.Newf(400, "Scalar result needs exactly 1 row and 1 column")
+	}
+	if err := rows.Err(); err != nil {
+		return httperror.Newf(500, "DB error: %s", err)
+	}
+
+	var b []byte
+	if name, _, _ := strings.Cut(format, ","); strings.EqualFold(name, "json") {
+		b, err = scalarJSON(columnTypes[0], v)
+		if err != nil {
+			return httperror.Newf(500, "Serialization error: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		b = []byte(scalarText(columnTypes[0], v))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	b = append(b, '\n')
+	w.Header().Set(RowCountHeader, "1")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(200)
+	_, err = out.Write(b)
+	return err
+}
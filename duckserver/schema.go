@@ -0,0 +1,72 @@
+package duckserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+const (
+	sampleRowsDefault = 10
+	sampleRowsMax     = 1000
+)
+
+// handleSchemaSample responds first rows of a table or a view in the client's
+// database, in the format requested as the query end point. The table is
+// validated against the catalog before being put in the query.
+func (srv *Server) handleSchemaSample(w http.ResponseWriter, r *http.Request) (retErr error) {
+	defer srv.recoverPanic(w, &retErr)
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	table := r.PathValue("table")
+	if !sqltext.IsIdent(table) {
+		return httperror.Newf(400, "Invalid table: %q", table)
+	}
+	n := sampleRowsDefault
+	if s := r.URL.Query().Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 || v > sampleRowsMax {
+			return httperror.Newf(400, "n should be between 1 and %d: %q", sampleRowsMax, s)
+		}
+		n = v
+	}
+
+	client, conn, err := srv.clientConn(w, r)
+	if err != nil {
+		return err
+	}
+	unlock, err := srv.lockQuery(r, client)
+	if err != nil {
+		return err
+	}
+	var count int
+	err = conn.QueryRowContext(r.Context(), "SELECT count(*) FROM information_schema.tables WHERE table_catalog = current_database() AND table_schema = current_schema() AND table_name = $1", table).Scan(&count)
+	// executeQuery locks again for the sample.
+	unlock()
+	if err != nil {
+		return srv.queryError(w, 500, "DB error", err)
+	}
+	if count == 0 {
+		return httperror.Newf(404, "No tables: %q", table)
+	}
+
+	query := "SELECT * FROM " + sqltext.QuoteIdent(table) + " LIMIT " + strconv.Itoa(n)
+	auditlog.SetQuery(w, query)
+	if err := srv.checkStatements(query); err != nil {
+		return err
+	}
+	if err := srv.checkFileReads(r, query); err != nil {
+		return err
+	}
+	if err := srv.checkExtensions(r, query); err != nil {
+		return err
+	}
+	return srv.executeQuery(w, r, query)
+}
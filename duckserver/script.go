@@ -0,0 +1,58 @@
+package duckserver
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// readScript reads a script "{name}.sql" in the script directory. Names which
+// point outside of the directory are rejected.
+func (srv *Server) readScript(name string) (string, error) {
+	if name == "" || !filepath.IsLocal(name) || strings.ContainsAny(name, `/\`) {
+		return "", httperror.Newf(400, "Invalid script name: %q", name)
+	}
+	root, err := os.OpenRoot(srv.config.ScriptDir)
+	if err != nil {
+		return "", httperror.Newf(500, "Failed to open script directory: %s", err)
+	}
+	defer root.Close()
+	b, err := root.ReadFile(name + ".sql")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", httperror.Newf(404, "No scripts: %q", name)
+		}
+		return "", httperror.Newf(500, "Failed to read script: %s", err)
+	}
+	return string(b), nil
+}
+
+// handleScript executes a script in the script directory, which can contain
+// multiple statements. The result is same as the query end point.
+func (srv *Server) handleScript(w http.ResponseWriter, r *http.Request) (retErr error) {
+	defer srv.recoverPanic(w, &retErr)
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	if err := srv.checkShowSQL(w, r); err != nil {
+		return err
+	}
+	query, err := srv.readScript(r.PathValue("name"))
+	if err != nil {
+		return err
+	}
+	auditlog.SetQuery(w, query)
+	if err := srv.checkReadOnly(r, query); err != nil {
+		return err
+	}
+	return srv.executeQuery(w, r, query)
+}
@@ -0,0 +1,36 @@
+package duckserver_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestScript(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.ScriptDir = "testdata/scripts"
+		return c
+	})
+
+	resp, err := doPost(ts, "/script/sum?f=csv", "")
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "S\n3\n", got)
+
+	for _, tc := range []struct {
+		name   string
+		status int
+	}{
+		{"none", 404},
+		{"..%2Foutside", 400},
+		{"%2Fetc%2Fpasswd", 400},
+	} {
+		resp, err := doPost(ts, "/script/"+tc.name, "")
+		if _, err := readResponse2(resp, err, tc.status, tc.status); err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/koron/duckpop/internal/formatter"
+)
+
+// selfTestRows is the number of rows inserted and queried back by the self
+// test.
+const selfTestRows = 1000
+
+// SelfTestResult is the result of the self test. Failed is the name of the
+// failed step, and the steps after it are not run.
+type SelfTestResult struct {
+	OK     bool           `json:"OK"`
+	Failed string         `json:"Failed,omitempty"`
+	Steps  []SelfTestStep `json:"Steps"`
+}
+
+// SelfTestStep is the result of a step of the self test.
+type SelfTestStep struct {
+	Name     string `json:"Name"`
+	OK       bool   `json:"OK"`
+	Duration string `json:"Duration"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// selfTest runs the steps of the self test on db and conn, which are set by
+// the "open" step.
+type selfTest struct {
+	result SelfTestResult
+	db     *sql.DB
+	conn   *sql.Conn
+}
+
+// run runs a step unless a previous step failed.
+func (st *selfTest) run(name string, fn func() error) {
+	if st.result.Failed != "" {
+		return
+	}
+	start := time.Now()
+	err := fn()
+	step := SelfTestStep{
+		Name:     name,
+		OK:       err == nil,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		step.Error = err.Error()
+		st.result.Failed = name
+	}
+	st.result.Steps = append(st.result.Steps, step)
+}
+
+// handleSelfTest validates the path of queries on an isolated in-memory DB
+// opened with the settings of the server: creating a temporary table,
+// inserting rows, querying them back with the default format, and dropping the
+// table. It responds 503 with the failed step when a step fails.
+func (srv *Server) handleSelfTest(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.checkAdmin(w, r); err != nil {
+		return err
+	}
+	// The context doesn't have the connection or the tenant of the request,
+	// so that a DB other than the one of the client is opened.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer context.AfterFunc(r.Context(), cancel)()
+
+	st := &selfTest{}
+	defer func() {
+		if st.conn != nil {
+			st.conn.Close()
+		}
+		if st.db != nil {
+			st.db.Close()
+		}
+	}()
+	st.run("tempdir", func() error {
+		f, err := os.CreateTemp(srv.dbSettings.TempDir, ".selftest-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	})
+	st.run("open", func() error {
+		var err error
+		st.db, st.conn, err = srv.connectDuckDB(ctx)
+		return err
+	})
+	st.run("create", func() error {
+		_, err := st.conn.ExecContext(ctx, "CREATE TEMP TABLE selftest (i INTEGER, s VARCHAR, t TIMESTAMP)")
+		return err
+	})
+	st.run("insert", func() error {
+		_, err := st.conn.ExecContext(ctx, "INSERT INTO selftest SELECT i, 's' || i, TIMESTAMP '2026-01-01' + INTERVAL (i) SECOND FROM range($1) t(i)", selfTestRows)
+		return err
+	})
+	st.run("query", func() error {
+		_, fw, err := formatter.FindAndCreate(srv.formatDefaults(srv.config.DefaultFormat), io.Discard)
+		if err != nil {
+			return err
+		}
+		rows, err := st.conn.QueryContext(ctx, "SELECT * FROM selftest ORDER BY i")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		n, err := writeRows(ctx, fw, rows, nil)
+		if err != nil {
+			return err
+		}
+		if n != selfTestRows {
+			return fmt.Errorf("queried %d rows, want %d", n, selfTestRows)
+		}
+		return nil
+	})
+	st.run("drop", func() error {
+		_, err := st.conn.ExecContext(ctx, "DROP TABLE selftest")
+		return err
+	})
+
+	status := 200
+	st.result.OK = st.result.Failed == ""
+	if !st.result.OK {
+		status = 503
+		srv.logger.Warn("self test failed", "step", st.result.Failed)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(st.result)
+}
@@ -0,0 +1,83 @@
+package duckserver_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestSelfTest(t *testing.T) {
+	getResult := func(t *testing.T, ts *testServer, status int) duckserver.SelfTestResult {
+		t.Helper()
+		resp, err := doGet(ts, "/status/selftest")
+		got, err := readResponse2(resp, err, status, status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result duckserver.SelfTestResult
+		if err := json.Unmarshal([]byte(got), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	stepNames := func(result duckserver.SelfTestResult) []string {
+		var names []string
+		for _, step := range result.Steps {
+			names = append(names, step.Name)
+		}
+		return names
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		ts := startServer0(t)
+		result := getResult(t, ts, 200)
+		assert.Equal(t, true, result.OK)
+		assert.Equal(t, "", result.Failed)
+		assert.Equal(t, []string{"tempdir", "open", "create", "insert", "query", "drop"}, stepNames(result))
+		for _, step := range result.Steps {
+			if !step.OK || step.Error != "" || step.Duration == "" {
+				t.Errorf("unexpected step: %+v", step)
+			}
+		}
+		// The DB of the connection is left untouched.
+		testQuery0(t, ts, `SELECT count(*) AS n FROM duckdb_tables() WHERE table_name = 'selftest'`, "n\n0\n")
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		homedir := t.TempDir()
+		ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+			c.DBHomeDir = homedir
+			return c
+		})
+		if err := os.RemoveAll(filepath.Join(homedir, "tmp")); err != nil {
+			t.Fatal(err)
+		}
+		result := getResult(t, ts, 503)
+		assert.Equal(t, false, result.OK)
+		assert.Equal(t, "tempdir", result.Failed)
+		assert.Equal(t, []string{"tempdir"}, stepNames(result))
+		if result.Steps[0].Error == "" {
+			t.Error("no error of the failed step")
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		ts := startServer1(t, configAuthn("testdata/authn.json", false))
+		resp, err := doGet(ts, "/status/selftest", authorizationBearer("token-admin1"))
+		if _, err := readResponse(resp, err); err != nil {
+			t.Error(err)
+		}
+		resp, err = doGet(ts, "/status/selftest", authorizationBearer("token-0123456789abcdef"))
+		if _, err := readResponse2(resp, err, 403, 403); err != nil {
+			t.Error(err)
+		}
+		resp, err = doGet(ts, "/status/selftest")
+		if _, err := readResponse2(resp, err, 401, 401); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package duckserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// EffectiveSQL is a query which the server constructed for a request, with
+// its arguments, responded instead of executing it for "show_sql" parameter.
+type EffectiveSQL struct {
+	SQL  string         `json:"sql"`
+	Args []EffectiveArg `json:"args,omitempty"`
+}
+
+// EffectiveArg is an argument of EffectiveSQL. Name is empty for positional
+// arguments.
+type EffectiveArg struct {
+	Name  string `json:"name,omitempty"`
+	Value any    `json:"value"`
+}
+
+func isShowSQLRequest(r *http.Request) bool {
+	switch r.URL.Query().Get("show_sql") {
+	case "1", "true":
+		return true
+	default:
+		return false
+	}
+}
+
+// checkShowSQL rejects "show_sql" parameter from non-admin users for end
+// points which execute queries stored in the server, like templates, so as
+// not to reveal them.
+func (srv *Server) checkShowSQL(w http.ResponseWriter, r *http.Request) error {
+	if !isShowSQLRequest(r) {
+		return nil
+	}
+	return srv.checkAdmin(w, r)
+}
+
+// writeEffectiveSQL responds the query and its arguments as JSON.
+func writeEffectiveSQL(w http.ResponseWriter, query string, args []any) error {
+	v := EffectiveSQL{SQL: query}
+	for _, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok {
+			v.Args = append(v.Args, EffectiveArg{Name: named.Name, Value: named.Value})
+			continue
+		}
+		v.Args = append(v.Args, EffectiveArg{Value: arg})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,111 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/koron/duckpop/internal/formatter"
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// SinkResult is responded instead of the result for "sink=null" and "hash"
+// parameters.
+type SinkResult struct {
+	Rows int64 `json:"rows"`
+	// ScanDuration is the time to scan all rows, apart from DurationHeader
+	// to execute the query.
+	ScanDuration string `json:"scan_duration"`
+	// Hash is the digest of the result, like "sha256:0123...", which is
+	// also sent as ResultHashHeader.
+	Hash string `json:"hash,omitempty"`
+}
+
+// hashFormat is the canonical serialization of results to be hashed, which
+// has names of columns in their order and `\N` for NULL.
+const hashFormat = "pg-text"
+
+// isNullSinkRequest reports whether the request discards the result, for
+// benchmarks of queries and scans without serialization.
+func isNullSinkRequest(r *http.Request) (bool, error) {
+	switch s := r.URL.Query().Get("sink"); s {
+	case "":
+		return false, nil
+	case "null":
+		return true, nil
+	default:
+		return false, httperror.Newf(400, "Unsupported sink: %q", s)
+	}
+}
+
+// checkSink rejects "sink" parameter from non-admin users.
+func (srv *Server) checkSink(w http.ResponseWriter, r *http.Request) (bool, error) {
+	sink, err := isNullSinkRequest(r)
+	if err != nil || !sink {
+		return false, err
+	}
+	if err := srv.checkAdmin(w, r); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getResultHash returns the algorithm of "hash" parameter, which responds
+// only the digest of the result.
+func getResultHash(r *http.Request) (string, error) {
+	switch s := r.URL.Query().Get("hash"); s {
+	case "", "sha256":
+		return s, nil
+	default:
+		return "", httperror.Newf(400, "Unsupported hash: %q", s)
+	}
+}
+
+// writeResultHash scans all rows with the same loop as other formats, and
+// responds the SHA-256 digest of them in hashFormat as SinkResult.
+func (srv *Server) writeResultHash(ctx context.Context, w http.ResponseWriter, rows resultRows) error {
+	start := time.Now()
+	h := sha256.New()
+	_, fw, err := formatter.FindAndCreate(hashFormat, h)
+	if err != nil {
+		return err
+	}
+	n, err := writeRows(ctx, fw, rows, nil)
+	if err != nil {
+		return srv.executionError(w, err)
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	w.Header().Set(ResultHashHeader, digest)
+	w.Header().Set(RowCountHeader, strconv.FormatInt(n, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(SinkResult{Rows: n, ScanDuration: time.Since(start).String(), Hash: digest})
+}
+
+// nullWriter is formatter.Writer which discards all rows.
+type nullWriter struct{}
+
+func (nullWriter) WriteHeader([]*sql.ColumnType) error { return nil }
+
+func (nullWriter) WriteBody([]any) error { return nil }
+
+func (nullWriter) Flush() error { return nil }
+
+// writeNullSink scans all rows with the same loop as other formats, and
+// responds the number of rows as SinkResult.
+func (srv *Server) writeNullSink(ctx context.Context, w http.ResponseWriter, rows resultRows) error {
+	start := time.Now()
+	n, err := writeRows(ctx, nullWriter{}, rows, nil)
+	if err != nil {
+		return srv.executionError(w, err)
+	}
+	w.Header().Set(RowCountHeader, strconv.FormatInt(n, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(SinkResult{Rows: n, ScanDuration: time.Since(start).String()})
+}
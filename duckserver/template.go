@@ -0,0 +1,141 @@
+package duckserver
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/koron/duckpop/internal/auditlog"
+	"github.com/koron/duckpop/internal/httperror"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// queryTemplate is a named query which is invoked with parameters.
+type queryTemplate struct {
+	query  string
+	params []string
+}
+
+// loadTemplates loads a JSON file which maps names to queries with named
+// parameters like "$name".
+func loadTemplates(name string) (map[string]queryTemplate, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var src map[string]string
+	if err := json.Unmarshal(b, &src); err != nil {
+		return nil, fmt.Errorf("failed to parse template file: %w", err)
+	}
+	templates := make(map[string]queryTemplate, len(src))
+	for k, v := range src {
+		templates[k] = queryTemplate{
+			query:  v,
+			params: sqltext.NamedParams(v),
+		}
+	}
+	return templates, nil
+}
+
+// bindArgs converts values of parameters to the arguments of the template.
+// All parameters of the template should be given, and no other parameters
+// are accepted.
+func (t queryTemplate) bindArgs(values map[string]any) ([]any, error) {
+	var missing []string
+	args := make([]any, 0, len(t.params))
+	for _, p := range t.params {
+		v, ok := values[p]
+		if !ok {
+			missing = append(missing, p)
+			continue
+		}
+		args = append(args, sql.Named(p, v))
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing parameters: %s", strings.Join(missing, ", "))
+	}
+	var extra []string
+	for k := range values {
+		if !slices.Contains(t.params, k) {
+			extra = append(extra, k)
+		}
+	}
+	if len(extra) > 0 {
+		slices.Sort(extra)
+		return nil, fmt.Errorf("unknown parameters: %s", strings.Join(extra, ", "))
+	}
+	return args, nil
+}
+
+// decodeParams decodes values of parameters from a JSON object. Integral
+// numbers are decoded as int64 to keep precision.
+func decodeParams(b []byte) (map[string]any, error) {
+	values := map[string]any{}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return values, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	for k, v := range values {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i, err := n.Int64(); err == nil {
+			values[k] = i
+			continue
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, err
+		}
+		values[k] = f
+	}
+	return values, nil
+}
+
+// handleTemplate executes a query template with parameters given as a JSON
+// object in the body.
+func (srv *Server) handleTemplate(w http.ResponseWriter, r *http.Request) (retErr error) {
+	defer srv.recoverPanic(w, &retErr)
+	if err := srv.checkDraining(w); err != nil {
+		return err
+	}
+	if err := srv.checkAuthz(w, r); err != nil {
+		return err
+	}
+	if err := srv.checkShowSQL(w, r); err != nil {
+		return err
+	}
+	name := r.PathValue("name")
+	t, ok := srv.templates[name]
+	if !ok {
+		return httperror.Newf(404, "No templates: %q", name)
+	}
+	auditlog.SetQuery(w, t.query)
+	if err := srv.checkReadOnly(r, t.query); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	values, err := decodeParams(b)
+	if err != nil {
+		return httperror.Newf(400, "Invalid parameters: %s", err)
+	}
+	args, err := t.bindArgs(values)
+	if err != nil {
+		return httperror.Newf(400, "Invalid parameters: %s", err)
+	}
+	return srv.executeQuery(w, r, t.query, args...)
+}
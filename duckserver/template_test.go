@@ -0,0 +1,75 @@
+package duckserver_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestTemplate(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.TemplateFile = "testdata/templates.json"
+		return c
+	})
+
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"add", `{"a":1,"b":2}`, "sum\n3\n"},
+		{"echo", `{"s":"foo"}`, "s,t\nfoo,foo$s\n"},
+		{"now", ``, "answer\n42\n"},
+		{"now", `{}`, "answer\n42\n"},
+	} {
+		resp, err := doPost(ts, "/q/"+tc.name+"?f=csv", tc.body)
+		got, err := readResponse(resp, err)
+		if err != nil {
+			t.Errorf("%s failed: %s", tc.name, err)
+			continue
+		}
+		assert.Equal(t, tc.want, got)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"add", `{"a":1}`, 400, "Invalid parameters: missing parameters: b\n"},
+		{"add", `{"a":1,"b":2,"c":3,"d":4}`, 400, "Invalid parameters: unknown parameters: c, d\n"},
+		{"add", `[1,2]`, 400, ""},
+		{"none", `{}`, 404, "No templates: \"none\"\n"},
+	} {
+		resp, err := doPost(ts, "/q/"+tc.name+"?f=csv", tc.body)
+		got, err := readResponse2(resp, err, tc.status, tc.status)
+		if err != nil {
+			t.Errorf("%s failed: %s", tc.name, err)
+			continue
+		}
+		if tc.want != "" {
+			assert.Equal(t, tc.want, got)
+		}
+	}
+}
+
+func TestTemplateShowSQL(t *testing.T) {
+	ts := startServer1(t, func(c *duckserver.Config) *duckserver.Config {
+		c.AuthnFile = "testdata/authn.json"
+		c.TemplateFile = "testdata/templates.json"
+		return c
+	})
+	// Only admins can see the query of a template.
+	resp, err := doPost(ts, "/q/add?show_sql=1", `{"a":1,"b":2}`, authorizationBearer("token-0123456789abcdef"))
+	if _, err := readResponse2(resp, err, 403, 403); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = doPost(ts, "/q/add?show_sql=1", `{"a":1,"b":2}`, authorizationBearer("token-admin1"))
+	got, err := readResponse(resp, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"sql":"SELECT $a + $b AS sum","args":[{"name":"a","value":1},{"name":"b","value":2}]}`+"\n", got)
+}
@@ -0,0 +1 @@
+SELECT 'secret' AS X;
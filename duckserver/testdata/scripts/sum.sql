@@ -0,0 +1,2 @@
+CREATE TEMP TABLE s AS SELECT i FROM range(3) t(i);
+SELECT sum(i) AS S FROM s;
@@ -0,0 +1,59 @@
+package duckserver
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// queryTimeout resolves the timeout of a query from the first available of
+// TimeoutHeader, the header named by Config.TimeoutHeader, and QueryTimeout.
+// A timeout requested by a client is limited to QueryTimeout when it is set.
+func (srv *Server) queryTimeout(r *http.Request) (time.Duration, error) {
+	limit := srv.config.QueryTimeout
+	for _, name := range []string{TimeoutHeader, srv.config.TimeoutHeader} {
+		if name == "" {
+			continue
+		}
+		s := r.Header.Get(name)
+		if s == "" {
+			continue
+		}
+		d, err := parseTimeout(s)
+		if err != nil {
+			return 0, httperror.Newf(400, "Invalid timeout in %s: %q", name, s)
+		}
+		if limit > 0 && d > limit {
+			return limit, nil
+		}
+		return d, nil
+	}
+	return limit, nil
+}
+
+// parseTimeout parses a positive duration like "1.5s" or "500ms", or a number
+// of seconds like "30". Too many seconds are capped to the maximum duration.
+func parseTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		f, err2 := strconv.ParseFloat(s, 64)
+		if err2 != nil {
+			return 0, err
+		}
+		switch {
+		case math.IsNaN(f):
+			return 0, strconv.ErrSyntax
+		case f >= math.MaxInt64/float64(time.Second):
+			d = math.MaxInt64
+		default:
+			d = time.Duration(f * float64(time.Second))
+		}
+	}
+	if d <= 0 {
+		return 0, strconv.ErrRange
+	}
+	return d, nil
+}
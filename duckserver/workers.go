@@ -0,0 +1,49 @@
+package duckserver
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/koron/duckpop/internal/httperror"
+)
+
+// workerPool bounds the number of queries executed and serialized at once
+// across all connections. A nil sem means unlimited.
+type workerPool struct {
+	sem    chan struct{}
+	active atomic.Int64
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{}
+	if n > 0 {
+		p.sem = make(chan struct{}, n)
+	}
+	return p
+}
+
+// acquireWorker waits for a worker up to WorkerWait, and returns a function to
+// release it. It fails with 503 when no workers become available, and 504 when
+// the request is canceled while waiting.
+func (srv *Server) acquireWorker(ctx context.Context) (func(), error) {
+	p := srv.workers
+	if p.sem != nil {
+		timer := time.NewTimer(srv.config.WorkerWait)
+		defer timer.Stop()
+		select {
+		case p.sem <- struct{}{}:
+		case <-timer.C:
+			return nil, srv.overloaded(503, reasonWorkers, "No workers are available")
+		case <-ctx.Done():
+			return nil, httperror.Newf(504, "%s", ctx.Err())
+		}
+	}
+	p.active.Add(1)
+	return func() {
+		p.active.Add(-1)
+		if p.sem != nil {
+			<-p.sem
+		}
+	}, nil
+}
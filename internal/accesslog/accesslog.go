@@ -5,6 +5,7 @@ import (
 	"context"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/koron/duckpop/internal/authn"
@@ -43,6 +44,10 @@ func (w *wrapWriter) WriteHeader(statusCode int) {
 	w.status = statusCode
 }
 
+func (w *wrapWriter) Unwrap() http.ResponseWriter {
+	return w.base
+}
+
 func (w *wrapWriter) QueryReport(query string, duration time.Duration) {
 	w.queryReport = &queryReport{
 		query:    query,
@@ -50,7 +55,27 @@ func (w *wrapWriter) QueryReport(query string, duration time.Duration) {
 	}
 }
 
-func writeLog(logger *slog.Logger, ww *wrapWriter, r *http.Request) {
+// redactPath redacts queries in the query parameters of the path.
+func redactPath(u *url.URL, redact func(string) string) string {
+	params := u.Query()
+	changed := false
+	for _, k := range []string{"q", "query"} {
+		if v, ok := params[k]; ok {
+			for i := range v {
+				v[i] = redact(v[i])
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return u.RequestURI()
+	}
+	c := *u
+	c.RawQuery = params.Encode()
+	return c.RequestURI()
+}
+
+func writeLog(logger *slog.Logger, redact func(string) string, ww *wrapWriter, r *http.Request) {
 	attrs := make([]slog.Attr, 0, 12)
 
 	// Basic information: remote, authn
@@ -62,9 +87,13 @@ func writeLog(logger *slog.Logger, ww *wrapWriter, r *http.Request) {
 
 	// Request information: method, path, protocol version, referer,
 	// user-agent, stauts, response size
+	path := r.URL.RequestURI()
+	if redact != nil {
+		path = redactPath(r.URL, redact)
+	}
 	attrs = append(attrs,
 		slog.String("method", r.Method),
-		slog.String("path", r.URL.RequestURI()),
+		slog.String("path", path),
 		slog.String("proto", r.Proto),
 	)
 	if referer := r.Referer(); referer != "" {
@@ -86,8 +115,12 @@ func writeLog(logger *slog.Logger, ww *wrapWriter, r *http.Request) {
 
 	// Query information
 	if ww.queryReport != nil {
+		query := ww.queryReport.query
+		if redact != nil {
+			query = redact(query)
+		}
 		attrs = append(attrs,
-			slog.String("query", ww.queryReport.query),
+			slog.String("query", query),
 			slog.Duration("duration", ww.queryReport.duration),
 		)
 	}
@@ -96,9 +129,15 @@ func writeLog(logger *slog.Logger, ww *wrapWriter, r *http.Request) {
 }
 
 func WrapHandler(logger *slog.Logger, h http.Handler) http.Handler {
+	return WrapRedactedHandler(logger, nil, h)
+}
+
+// WrapRedactedHandler is like WrapHandler, but queries in logs are redacted
+// with redact. It is same as WrapHandler when redact is nil.
+func WrapRedactedHandler(logger *slog.Logger, redact func(string) string, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := &wrapWriter{base: w}
 		h.ServeHTTP(ww, r)
-		writeLog(logger, ww, r)
+		writeLog(logger, redact, ww, r)
 	})
 }
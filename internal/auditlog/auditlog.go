@@ -0,0 +1,168 @@
+// Package auditlog provides audit log of queries for duckpop.
+package auditlog
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/koron/duckpop/internal/authn"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+// Record is a record of the audit log, written as a line of JSON.
+type Record struct {
+	Time          time.Time `json:"time"`
+	AuthnID       string    `json:"authn_id,omitempty"`
+	RemoteIP      string    `json:"remote_ip"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Query         string    `json:"query,omitempty"`
+	StatementType string    `json:"statement_type,omitempty"`
+	Decision      string    `json:"decision"`
+	Status        int       `json:"status"`
+	RowCount      *int64    `json:"row_count,omitempty"`
+	Duration      float64   `json:"duration"`
+}
+
+// Logger writes audit logs of requests.
+type Logger struct {
+	// RowCountHeader is the name of the header or the trailer which contains
+	// the number of rows of the response.
+	RowCountHeader string
+
+	// ErrorLogger is the logger for errors of writing audit logs.
+	// slog.Default() is used when nil.
+	ErrorLogger *slog.Logger
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+func (l *Logger) write(rec *Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(b)
+	return err
+}
+
+type wrapWriter struct {
+	base   http.ResponseWriter
+	status int
+
+	query    string
+	hasQuery bool
+}
+
+func (w *wrapWriter) Header() http.Header {
+	return w.base.Header()
+}
+
+func (w *wrapWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.base.Write(data)
+}
+
+func (w *wrapWriter) WriteHeader(statusCode int) {
+	w.base.WriteHeader(statusCode)
+	if statusCode >= 200 {
+		w.status = statusCode
+	}
+}
+
+func (w *wrapWriter) Unwrap() http.ResponseWriter {
+	return w.base
+}
+
+// SetQuery records the query of the request to the audit log. It is no-op
+// when w is not wrapped by Logger.
+func SetQuery(w http.ResponseWriter, query string) {
+	for {
+		switch x := w.(type) {
+		case *wrapWriter:
+			x.query = query
+			x.hasQuery = true
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = x.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func decision(status int) string {
+	if status == 401 || status == 403 {
+		return "denied"
+	}
+	return "allowed"
+}
+
+func (l *Logger) record(ww *wrapWriter, r *http.Request, start time.Time) *Record {
+	rec := &Record{
+		Time:     start,
+		RemoteIP: remoteIP(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Decision: decision(ww.status),
+		Status:   ww.status,
+		Duration: time.Since(start).Seconds(),
+	}
+	if id, ok := authn.AuthnID(r.Context()); ok {
+		rec.AuthnID = id.String()
+	}
+	if ww.hasQuery {
+		rec.Query = ww.query
+		rec.StatementType = sqltext.StatementType(ww.query)
+	}
+	if l.RowCountHeader != "" {
+		if n, err := strconv.ParseInt(ww.Header().Get(l.RowCountHeader), 10, 64); err == nil {
+			rec.RowCount = &n
+		}
+	}
+	return rec
+}
+
+// WrapHandler writes audit logs of requests which record queries with
+// SetQuery, or are denied.
+func (l *Logger) WrapHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := &wrapWriter{base: w}
+		h.ServeHTTP(ww, r)
+		if ww.status == 0 {
+			ww.status = 200
+		}
+		if !ww.hasQuery && decision(ww.status) != "denied" {
+			return
+		}
+		if err := l.write(l.record(ww, r, start)); err != nil {
+			cmp.Or(l.ErrorLogger, slog.Default()).Warn("failed to write audit log", "error", err)
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -88,6 +89,53 @@ type Entry struct {
 	Token *string `json:"token,omitempty"`
 
 	InitQuery string `json:"init_query,omitempty"`
+
+	// Admin permits the administrative end points.
+	Admin bool `json:"admin,omitempty"`
+
+	// ReadOnly rejects statements other than queries like SELECT, and end
+	// points which write like ingest.
+	ReadOnly bool `json:"readonly,omitempty"`
+
+	// Paths restricts requests to ones which match these patterns of
+	// http.ServeMux, like "/{$}" or "GET /schema/". All requests are
+	// permitted when it is omitted, but none when it is an empty array.
+	Paths []string `json:"paths,omitempty"`
+
+	paths *http.ServeMux
+}
+
+// Permits reports whether the request matches Paths of the entry.
+func (e *Entry) Permits(r *http.Request) bool {
+	if e.Paths == nil {
+		return true
+	}
+	_, pattern := e.paths.Handler(r)
+	return pattern != ""
+}
+
+// compilePaths registers Paths to a http.ServeMux, which panics for invalid
+// or conflicted patterns.
+func (e *Entry) compilePaths() (err error) {
+	if e.Paths == nil {
+		return nil
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("invalid paths of %s: %v", e.ID, v)
+		}
+	}()
+	e.paths = http.NewServeMux()
+	for _, p := range e.Paths {
+		e.paths.Handle(p, http.NotFoundHandler())
+	}
+	return nil
+}
+
+// Supported reports whether the type of the entry is supported. An entry of
+// unsupported types never matches to requests.
+func (e *Entry) Supported() bool {
+	return e.Type == Basic || e.Type == Bearer
 }
 
 func (e *Entry) headerValue() string {
@@ -147,14 +195,23 @@ func readAuthenticator(r io.Reader) (*Authenticator, error) {
 			return nil, fmt.Errorf("duplicated ID: %s", e.ID)
 		}
 		idmap[e.ID] = struct{}{}
-		// 2. Check the type.
-		if e.Type == Basic && e.User == nil {
-			return nil, errors.New("required \"user\" property for \"basic\" type")
+		// 2. Check the type. Entries of unsupported types are kept but never
+		// authenticated, see Supported.
+		switch e.Type {
+		case Basic:
+			if e.User == nil {
+				return nil, errors.New("required \"user\" property for \"basic\" type")
+			}
+		case Bearer:
+			if e.Token == nil {
+				return nil, errors.New("required \"token\" property for \"bearer\" type")
+			}
 		}
-		if e.Type == Bearer && e.Token == nil {
-			return nil, errors.New("required \"token\" property for \"bearer\" type")
+		// 3. Compile the paths.
+		if err := e.compilePaths(); err != nil {
+			return nil, err
 		}
-		// 3. Create a reverse lookup index.
+		// 4. Create a reverse lookup index.
 		x := e.headerValue()
 		if x == "" {
 			continue
@@ -167,6 +224,11 @@ func readAuthenticator(r io.Reader) (*Authenticator, error) {
 	}, nil
 }
 
+// Entries returns the entries loaded to the authenticator.
+func (a *Authenticator) Entries() []Entry {
+	return slices.Clone(a.entries)
+}
+
 func (a *Authenticator) AuthenticateHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Embed authenticity information to request context.
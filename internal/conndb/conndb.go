@@ -11,8 +11,13 @@ import (
 	"math/rand/v2"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/koron/duckpop/internal/syncmap"
 )
 
@@ -21,11 +26,60 @@ type Manager struct {
 	Opener Opener
 	Closer Closer
 
+	// MaxIdleConns and MaxOpenConns are applied to each opened *sql.DB.
+	// MaxOpenConns includes the connection dedicated to the client, and zero
+	// means unlimited.
+	MaxIdleConns int
+	MaxOpenConns int
+
+	// TenantFunc determines the tenant of a request. When it returns true,
+	// Client returns the client shared by all connections of the tenant,
+	// instead of the one dedicated to the connection. Tenant clients are kept
+	// open after their connections are closed, and the least recently used
+	// one without connections is closed when MaxDB is reached.
+	TenantFunc func(ctx context.Context) (string, bool)
+
+	// NewID generates a candidate of new connection ID. Duplicated IDs are
+	// regenerated. HexID is used when nil.
+	NewID func() ID
+
+	// Logger is the logger for opening and closing DBs. slog.Default() is
+	// used when nil.
+	Logger *slog.Logger
+
+	// Spares is the number of DBs opened in advance by OpenSpares. A client
+	// of a connection takes one of them instead of opening its DB, and they
+	// are opened again in background. They count toward MaxDB, and tenant
+	// clients don't take them.
+	Spares int
+	// SpareFunc determines whether the client of a request can take a spare
+	// DB. All clients of connections can take them when nil.
+	SpareFunc func(ctx context.Context) bool
+
 	connToID syncmap.Map[net.Conn, ID]
 	clients  syncmap.Map[ID, *Client]
+	tenants  syncmap.Map[string, *Client]
+
+	// aliases maps IDs of connections to IDs of kept clients attached to
+	// them.
+	aliases syncmap.Map[ID, ID]
+	keepMu  sync.Mutex
 
 	dbCount int
 	dbMutex sync.Mutex
+
+	// spares, openingSpares and sparesClosed are guarded by dbMutex.
+	spares        []*spareDB
+	openingSpares int
+	sparesClosed  bool
+}
+
+// spareDB is a DB opened in advance, with its own ID which is passed to Opener
+// as the connection ID.
+type spareDB struct {
+	id   ID
+	db   *sql.DB
+	conn *sql.Conn
 }
 
 type Opener interface {
@@ -48,16 +102,50 @@ func (fn CloserFunc) Close(ctx context.Context, db *sql.DB) error {
 	return fn(ctx, db)
 }
 
-type ID uint32
+type ID string
 
 func (id ID) String() string {
-	return fmt.Sprintf("C_%08x", uint32(id))
+	return string(id)
+}
+
+// HexID generates an ID from a random 32 bits integer, like "C_0123abcd".
+func HexID() ID {
+	return ID(fmt.Sprintf("C_%08x", rand.Uint32()))
+}
+
+// UUIDID generates an ID from an UUID version 7 including the timestamp, like
+// "C_019a1b2c-3d4e-7f00-8123-456789abcdef".
+func UUIDID() ID {
+	return ID("C_" + uuid.Must(uuid.NewV7()).String())
+}
+
+// ParseID parses an ID of HexID or UUIDID. Hexadecimal digits are case
+// insensitive, and an ID of HexID may omit leading zeros.
+func ParseID(s string) (ID, error) {
+	if !strings.HasPrefix(s, "C_") {
+		return "", errors.New("connection ID should starts with \"C_\"")
+	}
+	if n, err := strconv.ParseUint(s[2:], 16, 32); err == nil {
+		return ID(fmt.Sprintf("C_%08x", n)), nil
+	}
+	u, err := uuid.Parse(s[2:])
+	if err != nil || len(s[2:]) != 36 {
+		return "", fmt.Errorf("invalid connection ID: %q", s)
+	}
+	return ID("C_" + u.String()), nil
+}
+
+func (m *Manager) newID() ID {
+	if m.NewID != nil {
+		return m.NewID()
+	}
+	return HexID()
 }
 
 func (m *Manager) withNewClient(ctx context.Context, c net.Conn) *Client {
-	client := &Client{m: m}
+	client := &Client{m: m, queryLock: make(chan struct{}, 1)}
 	for {
-		id := ID(rand.Uint32())
+		id := m.newID()
 		_, ok := m.clients.LoadOrStore(id, client)
 		if !ok {
 			m.connToID.Store(c, id)
@@ -68,18 +156,43 @@ func (m *Manager) withNewClient(ctx context.Context, c net.Conn) *Client {
 	}
 }
 
+func (m *Manager) withNewTenant(tenant string) *Client {
+	client := &Client{m: m, Tenant: tenant, queryLock: make(chan struct{}, 1), conns: map[ID]struct{}{}}
+	for {
+		id := m.newID()
+		_, ok := m.clients.LoadOrStore(id, client)
+		if !ok {
+			client.ID = id
+			ctx := context.WithValue(context.Background(), tenantKey{}, tenant)
+			client.ctx = context.WithValue(ctx, connIDKey{}, client.ID)
+			return client
+		}
+	}
+}
+
 type connIDKey = struct{}
 
+type tenantKey struct{}
+
+type dbIDKey struct{}
+
 func (m *Manager) ConnContext(ctx context.Context, c net.Conn) context.Context {
 	client := m.withNewClient(ctx, c)
 	return client.Context()
 }
 
+func (m *Manager) logger() *slog.Logger {
+	if m.Logger == nil {
+		return slog.Default()
+	}
+	return m.Logger
+}
+
 func (m *Manager) ConnState(c net.Conn, s http.ConnState) {
 	if s == http.StateClosed {
 		err := m.closeConn(c)
 		if err != nil {
-			slog.Warn("failed to close DB", "error", err)
+			m.logger().Warn("failed to close DB", "error", err)
 		}
 	}
 }
@@ -89,29 +202,119 @@ func (m *Manager) closeConn(c net.Conn) error {
 	if !ok {
 		return fmt.Errorf("no ID for net.Conn=%p", c)
 	}
+	m.releaseTenants(id)
+	if attached, ok := m.aliases.LoadAndDelete(id); ok {
+		id = attached
+	}
 
-	client, ok := m.clients.LoadAndDelete(id)
+	m.keepMu.Lock()
+	client, ok := m.clients.Load(id)
 	if !ok {
+		m.keepMu.Unlock()
+		return nil
+	}
+	if client.keep > 0 {
+		client.detached = true
+		client.timer = time.AfterFunc(client.keep, func() { m.expire(client) })
+		m.keepMu.Unlock()
+		m.logger().Debug("DB kept", "connID", id, "duration", client.keep)
 		return nil
 	}
+	m.clients.Delete(id)
+	m.keepMu.Unlock()
 
 	go func(client *Client) {
 		client.mu.Lock()
 		err := client.close()
 		client.mu.Unlock()
 		if err != nil {
-			slog.Warn("failed to close DB", "connID", client.ID, "error", err)
+			m.logger().Warn("failed to close DB", "connID", client.ID, "error", err)
 		}
 	}(client)
 
 	return nil
 }
 
+// expire closes the kept client unless it is attached again.
+func (m *Manager) expire(client *Client) {
+	m.keepMu.Lock()
+	if !client.detached {
+		m.keepMu.Unlock()
+		return
+	}
+	client.detached = false
+	m.clients.Delete(client.ID)
+	m.keepMu.Unlock()
+
+	client.mu.Lock()
+	err := client.close()
+	client.mu.Unlock()
+	if err != nil {
+		m.logger().Warn("failed to close DB", "connID", client.ID, "error", err)
+	}
+}
+
+// Keep keeps the client open for d after its connection is closed, so that
+// another connection of the same owner can attach it with Attach. Zero
+// cancels it. Tenant clients are ignored, because they are always kept.
+func (m *Manager) Keep(client *Client, d time.Duration, owner string) {
+	if client.Tenant != "" {
+		return
+	}
+	m.keepMu.Lock()
+	client.keep = d
+	client.owner = owner
+	m.keepMu.Unlock()
+}
+
+// Attach attaches the kept client of id, whose connection is closed, to the
+// connection of ctx, which should not have opened its own DB. Then Client
+// returns the kept client for the connection.
+func (m *Manager) Attach(ctx context.Context, id ID, owner string) error {
+	cur, ok := ctx.Value(connIDKey{}).(ID)
+	if !ok {
+		return ErrNoID
+	}
+	if cur == id {
+		return nil
+	}
+	m.keepMu.Lock()
+	defer m.keepMu.Unlock()
+	if attached, ok := m.aliases.Load(cur); ok {
+		if attached == id {
+			return nil
+		}
+		return ErrAlreadyOpened
+	}
+	kept, ok := m.clients.Load(id)
+	if !ok || !kept.detached || kept.owner != owner {
+		return ErrNoKeptClient
+	}
+	if current, ok := m.clients.Load(cur); ok {
+		current.mu.Lock()
+		opened := current.db != nil
+		current.mu.Unlock()
+		if opened {
+			return ErrAlreadyOpened
+		}
+		m.clients.Delete(cur)
+	}
+	kept.timer.Stop()
+	kept.detached = false
+	// The new connection needs to request keeping again.
+	kept.keep = 0
+	m.aliases.Store(cur, id)
+	m.logger().Debug("DB attached", "connID", id, "to", cur)
+	return nil
+}
+
 var (
-	ErrNoID         = errors.New("no IDs assigned for the context")
-	ErrNoConnection = errors.New("no connections assigned for the context")
-	ErrMaxDB        = errors.New("reached maximum number of DB")
-	ErrNoOpener     = errors.New("no Opener specified")
+	ErrNoID          = errors.New("no IDs assigned for the context")
+	ErrNoConnection  = errors.New("no connections assigned for the context")
+	ErrMaxDB         = errors.New("reached maximum number of DB")
+	ErrNoOpener      = errors.New("no Opener specified")
+	ErrNoKeptClient  = errors.New("no kept clients for the ID")
+	ErrAlreadyOpened = errors.New("the connection has opened its DB already")
 )
 
 // GetID extracts associated conndb.ID from context.Context
@@ -120,30 +323,76 @@ func GetID(ctx context.Context) (ID, bool) {
 	return id, ok
 }
 
+// GetDBID extracts the ID which the DB is opened with from context.Context,
+// which is passed to Opener and Closer. It differs from GetID only when the
+// client has taken a spare DB, opened with the ID of the spare.
+func GetDBID(ctx context.Context) (ID, bool) {
+	if id, ok := ctx.Value(dbIDKey{}).(ID); ok {
+		return id, true
+	}
+	return GetID(ctx)
+}
+
+// GetTenant extracts the tenant from context.Context, which is passed to
+// Opener and Closer.
+func GetTenant(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
 func dbToStr(db *sql.DB) string {
 	return fmt.Sprintf("%p", db)
 }
 
-func (m *Manager) openDB(ctx context.Context, id ID) (*sql.DB, *sql.Conn, error) {
-	m.dbMutex.Lock()
-	defer m.dbMutex.Unlock()
-	if m.dbCount >= m.MaxDB {
-		return nil, nil, ErrMaxDB
+func (m *Manager) openDB(ctx context.Context, id ID, tenant string) (*sql.DB, *sql.Conn, error) {
+	for {
+		m.dbMutex.Lock()
+		if m.dbCount < m.MaxDB {
+			break
+		}
+		// Spare DBs give way to ones which can't take them.
+		if n := len(m.spares); n > 0 {
+			spare := m.spares[n-1]
+			m.spares = m.spares[:n-1]
+			m.dbMutex.Unlock()
+			m.closeSpare(spare)
+			continue
+		}
+		victim, unlock := m.idleTenant(id)
+		m.dbMutex.Unlock()
+		if victim == nil {
+			return nil, nil, ErrMaxDB
+		}
+		err := victim.close()
+		victim.mu.Unlock()
+		unlock()
+		m.logger().Debug("DB evicted", "connID", victim.ID, "tenant", victim.Tenant, "for", id)
+		if err != nil {
+			m.logger().Warn("failed to close DB", "connID", victim.ID, "error", err)
+		}
 	}
+	defer m.dbMutex.Unlock()
 	if m.Opener == nil {
 		return nil, nil, ErrNoOpener
 	}
-	db, conn, err := m.Opener.Open(context.WithValue(ctx, connIDKey{}, id))
+	ctx = context.WithValue(ctx, connIDKey{}, id)
+	if tenant != "" {
+		ctx = context.WithValue(ctx, tenantKey{}, tenant)
+	}
+	db, conn, err := m.Opener.Open(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
-	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(m.MaxIdleConns)
+	if m.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(m.MaxOpenConns)
+	}
 	m.dbCount++
-	slog.Debug("DB opened", "connID", id, "DB", dbToStr(db), "count", m.dbCount)
+	m.logger().Debug("DB opened", "connID", id, "DB", dbToStr(db), "count", m.dbCount)
 	return db, conn, nil
 }
 
-func (m *Manager) closeDB(db *sql.DB, id ID) error {
+func (m *Manager) closeDB(db *sql.DB, id, dbID ID, tenant string) error {
 	m.dbMutex.Lock()
 	if m.dbCount > 0 {
 		m.dbCount--
@@ -151,13 +400,111 @@ func (m *Manager) closeDB(db *sql.DB, id ID) error {
 	count := m.dbCount
 	m.dbMutex.Unlock()
 	ctx := context.WithValue(context.Background(), connIDKey{}, id)
+	if dbID != id {
+		ctx = context.WithValue(ctx, dbIDKey{}, dbID)
+	}
+	if tenant != "" {
+		ctx = context.WithValue(ctx, tenantKey{}, tenant)
+	}
 	if m.Closer == nil {
 		return db.Close()
 	}
-	slog.Debug("DB closed", "connID", id, "DB", dbToStr(db), "count", count)
+	m.logger().Debug("DB closed", "connID", id, "DB", dbToStr(db), "count", count)
 	return m.Closer.Close(ctx, db)
 }
 
+// OpenSpares opens DBs until Spares of them are ready. They aren't opened
+// beyond MaxDB. It is called again in background when a spare is taken.
+func (m *Manager) OpenSpares(ctx context.Context) error {
+	for {
+		m.dbMutex.Lock()
+		if m.sparesClosed || len(m.spares)+m.openingSpares >= m.Spares || m.dbCount >= m.MaxDB {
+			m.dbMutex.Unlock()
+			return nil
+		}
+		m.openingSpares++
+		m.dbMutex.Unlock()
+
+		// Spares have IDs other than connections, like "S_0123abcd".
+		id := ID("S_" + strings.TrimPrefix(m.newID().String(), "C_"))
+		db, conn, err := m.openDB(ctx, id, "")
+		m.dbMutex.Lock()
+		m.openingSpares--
+		closed := m.sparesClosed
+		if err == nil && !closed {
+			m.spares = append(m.spares, &spareDB{id: id, db: db, conn: conn})
+		}
+		m.dbMutex.Unlock()
+		if errors.Is(err, ErrMaxDB) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if closed {
+			m.closeSpare(&spareDB{id: id, db: db, conn: conn})
+		}
+	}
+}
+
+// CloseSpares closes spare DBs, and stops opening them.
+func (m *Manager) CloseSpares() {
+	m.dbMutex.Lock()
+	spares := m.spares
+	m.spares = nil
+	m.sparesClosed = true
+	m.dbMutex.Unlock()
+	for _, spare := range spares {
+		m.closeSpare(spare)
+	}
+}
+
+// takeSpare gives a spare DB to the client which opens its DB, and opens
+// another one in background.
+func (m *Manager) takeSpare(ctx context.Context, client *Client) *spareDB {
+	if m.Spares <= 0 || client.Tenant != "" || (m.SpareFunc != nil && !m.SpareFunc(ctx)) {
+		return nil
+	}
+	m.dbMutex.Lock()
+	n := len(m.spares)
+	if n == 0 {
+		m.dbMutex.Unlock()
+		return nil
+	}
+	spare := m.spares[0]
+	m.spares = slices.Delete(m.spares, 0, 1)
+	m.dbMutex.Unlock()
+	m.logger().Debug("spare DB taken", "connID", client.ID, "DB", dbToStr(spare.db), "spare", spare.id)
+	go func() {
+		if err := m.OpenSpares(context.Background()); err != nil {
+			m.logger().Warn("failed to open spare DB", "error", err)
+		}
+	}()
+	return spare
+}
+
+func (m *Manager) closeSpare(spare *spareDB) {
+	err := spare.conn.Close()
+	if err2 := m.closeDB(spare.db, spare.id, spare.id, ""); err == nil {
+		err = err2
+	}
+	if err != nil {
+		m.logger().Warn("failed to close spare DB", "spare", spare.id, "error", err)
+	}
+}
+
+// Connections returns the number of live connections.
+func (m *Manager) Connections() int {
+	return m.connToID.Len()
+}
+
+// DBCount returns the number of open databases.
+func (m *Manager) DBCount() int {
+	m.dbMutex.Lock()
+	defer m.dbMutex.Unlock()
+	return m.dbCount
+}
+
 func (m *Manager) Databases() iter.Seq2[ID, *sql.DB] {
 	return func(yield func(ID, *sql.DB) bool) {
 		m.clients.Range(func(id ID, c *Client) bool {
@@ -171,11 +518,21 @@ func (m *Manager) Databases() iter.Seq2[ID, *sql.DB] {
 	}
 }
 
+// Client returns the client for the request. It is the client of the tenant
+// when TenantFunc determines it, otherwise the one of the connection.
 func (m *Manager) Client(ctx context.Context) (*Client, error) {
+	if m.TenantFunc != nil {
+		if tenant, ok := m.TenantFunc(ctx); ok {
+			return m.tenantClient(ctx, tenant), nil
+		}
+	}
 	id, ok := ctx.Value(connIDKey{}).(ID)
 	if !ok {
 		return nil, ErrNoID
 	}
+	if attached, ok := m.aliases.Load(id); ok {
+		id = attached
+	}
 	client, ok := m.clients.Load(id)
 	if !ok {
 		return nil, ErrNoConnection
@@ -183,38 +540,177 @@ func (m *Manager) Client(ctx context.Context) (*Client, error) {
 	return client, nil
 }
 
+// tenantClient returns the client of the tenant, and records that the
+// connection of ctx uses it.
+func (m *Manager) tenantClient(ctx context.Context, tenant string) *Client {
+	m.dbMutex.Lock()
+	defer m.dbMutex.Unlock()
+	client, ok := m.tenants.Load(tenant)
+	if !ok {
+		client = m.withNewTenant(tenant)
+		m.tenants.Store(tenant, client)
+	}
+	if id, ok := ctx.Value(connIDKey{}).(ID); ok {
+		client.conns[id] = struct{}{}
+	}
+	client.lastUsed = time.Now()
+	return client
+}
+
+// releaseTenants records that the connection of id doesn't use tenant clients
+// anymore.
+func (m *Manager) releaseTenants(id ID) {
+	m.dbMutex.Lock()
+	defer m.dbMutex.Unlock()
+	m.tenants.Range(func(_ string, client *Client) bool {
+		delete(client.conns, id)
+		return true
+	})
+}
+
+// idleTenant removes the least recently used tenant client which has an open
+// DB but no connections nor queries, to close it for the DB of id. The
+// returned client is locked, and the returned function releases the lock of
+// queries. It should be called with dbMutex locked.
+func (m *Manager) idleTenant(id ID) (*Client, func()) {
+	var idles []*Client
+	m.tenants.Range(func(_ string, client *Client) bool {
+		if client.ID != id && len(client.conns) == 0 {
+			idles = append(idles, client)
+		}
+		return true
+	})
+	slices.SortFunc(idles, func(a, b *Client) int { return a.lastUsed.Compare(b.lastUsed) })
+	for _, client := range idles {
+		// Opening and closing DBs lock clients before dbMutex, so these
+		// don't wait to avoid deadlocks.
+		if !client.mu.TryLock() {
+			continue
+		}
+		if client.db == nil {
+			client.mu.Unlock()
+			continue
+		}
+		unlock, ok := client.TryLockQuery()
+		if !ok {
+			client.mu.Unlock()
+			continue
+		}
+		m.tenants.Delete(client.Tenant)
+		m.clients.Delete(client.ID)
+		return client, unlock
+	}
+	return nil, nil
+}
+
 type Client struct {
 	m   *Manager
 	ctx context.Context
 
 	ID ID
 
+	// Tenant is not empty when the client is shared by a tenant.
+	Tenant string
+
 	mu   sync.Mutex
 	db   *sql.DB
 	conn *sql.Conn
+	// dbID is the ID which db is opened with, which differs from ID when
+	// it is a spare DB.
+	dbID ID
+
+	// queryLock serializes queries on conn, see LockQuery.
+	queryLock chan struct{}
+
+	// keep, owner, detached and timer are guarded by keepMu of Manager.
+	keep     time.Duration
+	owner    string
+	detached bool
+	timer    *time.Timer
+
+	// conns are IDs of connections which use the tenant client, and lastUsed
+	// is when it is returned lastly. They are guarded by dbMutex of Manager.
+	conns    map[ID]struct{}
+	lastUsed time.Time
 }
 
 func (clinet *Client) Context() context.Context {
 	return clinet.ctx
 }
 
-func (client *Client) Conn() (*sql.Conn, error) {
+// Conn returns the connection dedicated to the client. It opens the database
+// with ctx if not opened yet.
+func (client *Client) Conn(ctx context.Context) (*sql.Conn, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	if client.conn != nil {
 		return client.conn, nil
 	}
 	if client.db == nil {
-		db, conn, err := client.m.openDB(client.ctx, client.ID)
+		if spare := client.m.takeSpare(ctx, client); spare != nil {
+			client.db, client.conn, client.dbID = spare.db, spare.conn, spare.id
+			return client.conn, nil
+		}
+		db, conn, err := client.m.openDB(ctx, client.ID, client.Tenant)
 		if err != nil {
 			return nil, err
 		}
 		client.db = db
 		client.conn = conn
+		client.dbID = client.ID
 	}
 	return client.conn, nil
 }
 
+// DBID returns the ID which the DB of the client is opened with, which is
+// passed to Opener as the connection ID. It is the ID of a spare DB when the
+// client has taken it, otherwise ID.
+func (client *Client) DBID() ID {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.dbID == "" {
+		return client.ID
+	}
+	return client.dbID
+}
+
+// LockQuery waits until other queries of the client finish, so that a query
+// runs on the dedicated connection exclusively. The returned function releases
+// the lock. It fails when ctx is done while waiting.
+func (client *Client) LockQuery(ctx context.Context) (func(), error) {
+	select {
+	case client.queryLock <- struct{}{}:
+		return func() { <-client.queryLock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TryLockQuery is LockQuery which doesn't wait. It reports false when a query
+// of the client holds the lock.
+func (client *Client) TryLockQuery() (func(), bool) {
+	select {
+	case client.queryLock <- struct{}{}:
+		return func() { <-client.queryLock }, true
+	default:
+		return nil, false
+	}
+}
+
+// DB returns the database of the client. It opens the database if not opened
+// yet.
+func (client *Client) DB(ctx context.Context) (*sql.DB, error) {
+	if _, err := client.Conn(ctx); err != nil {
+		return nil, err
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.db == nil {
+		return nil, ErrNoConnection
+	}
+	return client.db, nil
+}
+
 func (client *Client) close() error {
 	var err1, err2 error
 	if client.conn != nil {
@@ -222,7 +718,7 @@ func (client *Client) close() error {
 		client.conn = nil
 	}
 	if client.db != nil {
-		err2 = client.m.closeDB(client.db, client.ID)
+		err2 = client.m.closeDB(client.db, client.ID, client.dbID, client.Tenant)
 		client.db = nil
 	}
 	if err1 != nil {
@@ -0,0 +1,41 @@
+package conndb_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/conndb"
+)
+
+func TestParseID(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want conndb.ID
+	}{
+		{"C_0123abcd", "C_0123abcd"},
+		{"C_0123ABCD", "C_0123abcd"},
+		{"C_1f", "C_0000001f"},
+		{"C_019a1b2c-3d4e-7f00-8123-456789abcdef", "C_019a1b2c-3d4e-7f00-8123-456789abcdef"},
+		{"C_019A1B2C-3D4E-7F00-8123-456789ABCDEF", "C_019a1b2c-3d4e-7f00-8123-456789abcdef"},
+	} {
+		got, err := conndb.ParseID(tc.s)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", tc.s, err)
+			continue
+		}
+		assert.Equal(t, tc.want, got)
+	}
+	for _, s := range []string{"", "0123abcd", "C_", "C_123456789", "C_-1", "C_+1", "C_0123abcg", "C_019a1b2c3d4e7f008123456789abcdef", "C_{019a1b2c-3d4e-7f00-8123-456789abcdef}"} {
+		if _, err := conndb.ParseID(s); err == nil {
+			t.Errorf("should be invalid: %q", s)
+		}
+	}
+	// IDs generated are parsed as is.
+	for _, id := range []conndb.ID{conndb.HexID(), conndb.UUIDID()} {
+		got, err := conndb.ParseID(id.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, id, got)
+	}
+}
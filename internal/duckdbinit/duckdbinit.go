@@ -7,10 +7,15 @@ import (
 	"net/url"
 )
 
-func Open(ctx context.Context, s Settings, initQueries ...string) (*sql.DB, *sql.Conn, error) {
+// DSN returns the data source name to open a DuckDB instance with s.
+func DSN(s Settings) string {
 	p := url.Values{}
 	p.Add("home_directory", s.HomeDir)
-	db, err := sql.Open("duckdb", "?"+p.Encode())
+	return s.Path + "?" + p.Encode()
+}
+
+func Open(ctx context.Context, s Settings, initQueries ...string) (*sql.DB, *sql.Conn, error) {
+	db, err := sql.Open("duckdb", DSN(s))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -28,6 +33,8 @@ func Open(ctx context.Context, s Settings, initQueries ...string) (*sql.DB, *sql
 }
 
 type Settings struct {
+	// Path is the database file. Empty means an in-memory database.
+	Path    string
 	HomeDir string
 
 	Threads        int
@@ -41,6 +48,10 @@ type Settings struct {
 
 	EnableExternalAccess bool
 	LockConfig           bool
+
+	// EnableProgressBar enables the progress bar of DuckDB on the connection,
+	// which is printed to the console and interleaves with logs of the server.
+	EnableProgressBar bool
 }
 
 func (s Settings) init(ctx context.Context, conn *sql.Conn, initQueries []string) error {
@@ -62,7 +73,7 @@ func (s Settings) init(ctx context.Context, conn *sql.Conn, initQueries []string
 	if s.LockConfig {
 		setNoCheck(ex, "lock_configuration", true)
 	}
-	return nil
+	return ex.err
 }
 
 // apply applies limits for the resources used by a DuckDB instance.
@@ -78,6 +89,8 @@ func (s Settings) apply(ctx context.Context, conn *sql.Conn) error {
 	if len(s.AllowedDirectories) > 0 {
 		setNoCheck(ex, "allowed_directories", s.AllowedDirectories)
 	}
+	// enable_progress_bar is a setting of the connection, not of the instance.
+	setLocal(ex, "enable_progress_bar", s.EnableProgressBar)
 	return ex.err
 }
 
@@ -106,3 +119,11 @@ func setNoCheck(ex *execContext, name string, v any) {
 	_, err := ex.conn.ExecContext(ex.ctx, "SET GLOBAL "+name+" = ?", v)
 	ex.err = err
 }
+
+func setLocal(ex *execContext, name string, v any) {
+	if ex.err != nil {
+		return
+	}
+	_, err := ex.conn.ExecContext(ex.ctx, "SET "+name+" = ?", v)
+	ex.err = err
+}
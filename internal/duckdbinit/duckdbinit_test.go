@@ -37,6 +37,19 @@ func TestSettings(t *testing.T) {
 	testSetting(t, conn, "threads", 3)
 	testSetting(t, conn, "memory_limit", "2.0 GiB")
 	testSetting(t, conn, "lock_configuration", true)
+	testSetting(t, conn, "enable_progress_bar", false)
+}
+
+func TestProgressBar(t *testing.T) {
+	db, conn, err := duckdbinit.Open(t.Context(), duckdbinit.Settings{EnableProgressBar: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		db.Close()
+	})
+	testSetting(t, conn, "enable_progress_bar", true)
 }
 
 func TestLockConfig(t *testing.T) {
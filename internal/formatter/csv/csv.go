@@ -3,14 +3,19 @@ package csv
 
 import (
 	"database/sql"
-	"encoding/csv"
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/koron/duckpop/internal/formatter"
 )
 
 const (
 	nullStrDefault = "NULL"
+
+	// Separators are written with escape sequences.
+	delimiterDefault  = ","
+	terminatorDefault = `\n`
 )
 
 func init() {
@@ -27,38 +32,87 @@ func (f *Factory) ContentType() string {
 }
 
 func (f *Factory) Create(w io.Writer, params map[string]string) (formatter.Writer, error) {
-	ww := csv.NewWriter(w)
 	// Apply params
+	delimiter, terminator, err := ParseSeparators(
+		formatter.Get(params, "delimiter", delimiterDefault),
+		formatter.Get(params, "terminator", terminatorDefault))
+	if err != nil {
+		return nil, err
+	}
 	nullStr, ok := params["null"]
 	if !ok {
 		nullStr = nullStrDefault
 	}
+	interval, err := formatter.IntervalConverter(params)
+	if err != nil {
+		return nil, err
+	}
+	newline, err := NewlineReplacer(formatter.Get(params, "newline", "quote"))
+	if err != nil {
+		return nil, err
+	}
+	_, types := params["types"]
+	_, dedup := params["dedup"]
 	return &Writer{
-		w:       ww,
-		nullStr: nullStr,
+		w:        newRecordWriter(w, delimiter, terminator),
+		nullStr:  nullStr,
+		interval: interval,
+		newline:  newline,
+		types:    types,
+		dedup:    dedup,
 	}, nil
 }
 
+// NewlineReplacer returns a replacer of CR and LF in fields for a policy of
+// "newline" parameter: nil for "quote" which quotes the fields, or a replacer
+// to spaces for "strip" and to `\r` and `\n` for "escape".
+func NewlineReplacer(policy string) (*strings.Replacer, error) {
+	switch policy {
+	case "quote":
+		return nil, nil
+	case "strip":
+		return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " "), nil
+	case "escape":
+		return strings.NewReplacer("\r", `\r`, "\n", `\n`), nil
+	default:
+		return nil, fmt.Errorf("newline should be \"quote\", \"strip\" or \"escape\": %q", policy)
+	}
+}
+
+// Writer writes rows as CSV. When "types" parameter is given, a comment row
+// prefixed with "#" which lists the type names of columns precedes the header.
+// "delimiter" and "terminator" parameters change the separators of fields and
+// records, which are written with escape sequences like `\x1f`. "dedup"
+// parameter suffixes duplicated names of columns in the header like "name_2".
+// "newline" parameter replaces CR and LF in fields as NewlineReplacer, so
+// that each record is a line.
 type Writer struct {
-	w       *csv.Writer
-	nullStr string
+	w        *recordWriter
+	nullStr  string
+	interval func(any) string
+	newline  *strings.Replacer
+	types    bool
+	dedup    bool
 
-	records    []string
+	columns    int
 	converters []func(any) string
 }
 
-var _ formatter.Writer = (*Writer)(nil)
+var (
+	_ formatter.Writer        = (*Writer)(nil)
+	_ formatter.BufferFlusher = (*Writer)(nil)
+)
 
 func (w *Writer) WriteHeader(columnTypes []*sql.ColumnType) error {
-	w.records = make([]string, len(columnTypes))
+	names := formatter.ColumnNames(columnTypes, w.dedup)
+	w.columns = len(names)
 	w.converters = make([]func(any) string, len(columnTypes))
 	for i, typ := range columnTypes {
-		w.records[i] = typ.Name()
 		switch typ.DatabaseTypeName() {
 		case "DATE":
 			w.converters[i] = formatter.DateToStr
 		case "INTERVAL":
-			w.converters[i] = formatter.IntervalToStr
+			w.converters[i] = w.interval
 		case "TIME":
 			w.converters[i] = formatter.TimeToStr
 		case "TIMESTAMP":
@@ -66,30 +120,66 @@ func (w *Writer) WriteHeader(columnTypes []*sql.ColumnType) error {
 		case "BLOB":
 			w.converters[i] = formatter.BlobToStr
 		default:
+			if formatter.IsNested(typ.DatabaseTypeName()) {
+				w.converters[i] = formatter.NestedToStr(typ.DatabaseTypeName(), w.interval)
+				continue
+			}
 			w.converters[i] = formatter.AnyToStr
 		}
 	}
-	return w.w.Write(w.records)
+	if w.types {
+		if err := w.writeTypes(columnTypes); err != nil {
+			return err
+		}
+	}
+	for i, name := range names {
+		w.w.WriteField(i, w.replaceNewlines(name))
+	}
+	return w.w.EndRecord()
 }
 
+func (w *Writer) writeTypes(columnTypes []*sql.ColumnType) error {
+	if err := w.w.WriteRaw("#"); err != nil {
+		return err
+	}
+	types := make([]string, len(columnTypes))
+	for i, typ := range columnTypes {
+		types[i] = typ.DatabaseTypeName()
+	}
+	return w.w.Write(types)
+}
+
+// WriteBody writes fields of a row directly to the output, without holding
+// the converted fields of the row.
 func (w *Writer) WriteBody(values []any) error {
-	if w.records == nil {
+	if w.converters == nil {
 		return formatter.ErrNoHeaderWritten
 	}
-	if len(w.records) != len(values) {
+	if w.columns != len(values) {
 		return formatter.ErrCountMismatch
 	}
 	for i, v := range values {
-		if v == nil {
-			w.records[i] = w.nullStr
-			continue
+		field := w.nullStr
+		if v != nil {
+			field = w.converters[i](v)
 		}
-		w.records[i] = w.converters[i](v)
+		w.w.WriteField(i, w.replaceNewlines(field))
 	}
-	return w.w.Write(w.records)
+	return w.w.EndRecord()
+}
+
+func (w *Writer) replaceNewlines(s string) string {
+	if w.newline == nil {
+		return s
+	}
+	return w.newline.Replace(s)
 }
 
 func (w *Writer) Flush() error {
-	w.w.Flush()
-	return w.w.Error()
+	return w.w.Flush()
+}
+
+// FlushBuffer writes buffered records to the underlying writer.
+func (w *Writer) FlushBuffer() error {
+	return w.Flush()
 }
@@ -1,10 +1,14 @@
 package csv_test
 
 import (
+	"bufio"
 	"database/sql"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/formatter"
 	"github.com/koron/duckpop/internal/formatter/csv"
 	"github.com/koron/duckpop/internal/formatter/formattertest"
 )
@@ -45,6 +49,103 @@ func TestParamNull(t *testing.T) {
 	})
 }
 
+func TestParamTypes(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, "csv,types", []testCase{
+		{`SELECT 1 AS A, 'foo' AS B`, "#INTEGER,VARCHAR\nA,B\n1,foo\n"},
+		{`SELECT 1.5::DECIMAL(18,3) AS A`, "#\"DECIMAL(18,3)\"\nA\n1.5\n"},
+	})
+}
+
+func TestParamDedup(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, "csv", []testCase{
+		{`SELECT 1 AS A, 2 AS A`, "A,A\n1,2\n"},
+	})
+	runCases(t, conn, "csv,dedup", []testCase{
+		{`SELECT 1 AS A, 2 AS A, 3 AS A`, "A,A_2,A_3\n1,2,3\n"},
+		{`SELECT 1 AS A, 2 AS A, 3 AS A_2`, "A,A_3,A_2\n1,2,3\n"},
+	})
+}
+
+func TestParamSeparators(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, `csv,delimiter:\x1f,terminator:\x1e`, []testCase{
+		{`SELECT 1 AS A, 'foo' AS B`, "A\x1fB\x1e1\x1ffoo\x1e"},
+		{`SELECT 'a' || chr(31) || 'b' AS A, 'c' || chr(30) || 'd' AS B, 'e,f' AS C`, "A\x1fB\x1fC\x1e\"a\x1fb\"\x1f\"c\x1ed\"\x1fe,f\x1e"},
+	})
+	runCases(t, conn, `csv,delimiter:;,terminator:\r\n`, []testCase{
+		{`SELECT 1 AS A, 'x"y' AS B`, "A;B\r\n1;\"x\"\"y\"\r\n"},
+	})
+	runCases(t, conn, `csv,types,delimiter:\t`, []testCase{
+		{`SELECT 1 AS A, 'foo' AS B`, "#INTEGER\tVARCHAR\nA\tB\n1\tfoo\n"},
+	})
+}
+
+func TestQuote(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, "csv", []testCase{
+		{`SELECT '"a""b"' AS "C""D", '"' AS E, '' AS F`, "\"C\"\"D\",E,F\n\"\"\"a\"\"\"\"b\"\"\",\"\"\"\",\n"},
+	})
+}
+
+func TestParamNewline(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	const query = `SELECT 'a' || chr(10) || 'b' AS A, 'c' || chr(13) || chr(10) || 'd' AS "B` + "\n" + `C"`
+	runCases(t, conn, "csv", []testCase{
+		{query, "A,\"B\nC\"\n\"a\nb\",\"c\r\nd\"\n"},
+	})
+	runCases(t, conn, "csv,newline:strip", []testCase{
+		{query, "A,B C\na b,c d\n"},
+	})
+	runCases(t, conn, "csv,newline:escape", []testCase{
+		{query, "A,B\\nC\na\\nb,c\\r\\nd\n"},
+	})
+	if _, err := csv.NewlineReplacer("remove"); err == nil {
+		t.Error("unsupported newline policy should be rejected")
+	}
+}
+
+func TestParseSeparators(t *testing.T) {
+	for _, tc := range []struct {
+		delimiter, terminator string
+		ok                    bool
+	}{
+		{",", `\n`, true},
+		{`\x1f`, `\x1e`, true},
+		{`\t`, `\r\n`, true},
+		{"", `\n`, false},
+		{",,", `\n`, false},
+		{`\n`, `\x1e`, false},
+		{`"`, `\n`, false},
+		{",", "", false},
+		{",", ",\\n", false},
+		{",", `\x`, false},
+	} {
+		_, _, err := csv.ParseSeparators(tc.delimiter, tc.terminator)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("unexpected result for %q and %q: %v", tc.delimiter, tc.terminator, err)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, s := range []string{",", "\x1f", "\r\n", "\u00a7", "\U0001f600", "\u00a7\U0001f600\n"} {
+		got, err := csv.Unescape(csv.Escape(s))
+		if err != nil {
+			t.Errorf("failed to unescape %q: %s", csv.Escape(s), err)
+			continue
+		}
+		assert.Equal(t, s, got)
+	}
+	d, term, err := csv.ParseSeparators(csv.Escape("\U0001f600"), csv.Escape("\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, '\U0001f600', d)
+	assert.Equal(t, "\n", term)
+}
+
 func TestDate(t *testing.T) {
 	conn := formattertest.ConnectDB(t)
 	bb := formattertest.Query(t, conn, format, `SELECT '2026-03-30'::DATE AS GOT`)
@@ -104,3 +205,80 @@ func TestFloatTypes(t *testing.T) {
 		{`SELECT (1/2)::DOUBLE AS V`, "V\n0.5\n"},
 	})
 }
+
+func TestIntervalFormats(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	const query = `SELECT INTERVAL '1 year 2 months 3 days 04:05:06.5' AS V`
+	runCases(t, conn, "csv,interval:iso8601", []testCase{
+		{query, "V\nP1Y2M3DT4H5M6.5S\n"},
+		{`SELECT INTERVAL 0 SECOND AS V`, "V\nPT0S\n"},
+	})
+	runCases(t, conn, "csv,interval:duckdb", []testCase{
+		{query, "V\n1 year 2 months 3 days 04:05:06.5\n"},
+		{`SELECT INTERVAL 1 DAY AS V`, "V\n1 day\n"},
+		{`SELECT INTERVAL 0 SECOND AS V`, "V\n00:00:00\n"},
+	})
+}
+
+func TestNestedTypes(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, format, []testCase{
+		{`SELECT [1, 2, NULL]::INTEGER[] AS V`, "V\n\"[1,2,null]\"\n"},
+		{`SELECT {'a': 1, 'b': 'x'} AS V`, "V\n\"{\"\"a\"\":1,\"\"b\"\":\"\"x\"\"}\"\n"},
+		{`SELECT MAP {'k': 1} AS V`, "V\n\"{\"\"k\"\":1}\"\n"},
+		{`SELECT {'b': 1, 'a': 'x'} AS V`, "V\n\"{\"\"b\"\":1,\"\"a\"\":\"\"x\"\"}\"\n"},
+		{`SELECT [INTERVAL 3 HOUR] AS V`, "V\n\"[\"\"3h\"\"]\"\n"},
+	})
+}
+
+// BenchmarkLargeString compares the memory to write a large string with
+// quotes, between converting fields of a row to a slice and quoting them with
+// strings.ReplaceAll before writing, as the writer did before, and the writer.
+func BenchmarkLargeString(b *testing.B) {
+	conn := formattertest.ConnectDB(b)
+	rows, err := conn.QueryContext(b.Context(), `SELECT 'x' AS S, 1 AS N`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	columnTypes, err := rows.ColumnTypes()
+	rows.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	values := []any{strings.Repeat(`x"`, 1<<19), int32(1)}
+
+	b.Run("records", func(b *testing.B) {
+		b.ReportAllocs()
+		w := bufio.NewWriter(io.Discard)
+		for b.Loop() {
+			records := make([]string, len(values))
+			for i, v := range values {
+				records[i] = formatter.AnyToStr(v)
+			}
+			for i, field := range records {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				w.WriteByte('"')
+				w.WriteString(strings.ReplaceAll(field, `"`, `""`))
+				w.WriteByte('"')
+			}
+			w.WriteByte('\n')
+		}
+	})
+	b.Run("writer", func(b *testing.B) {
+		b.ReportAllocs()
+		fw, err := (&csv.Factory{}).Create(io.Discard, map[string]string{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := fw.WriteHeader(columnTypes); err != nil {
+			b.Fatal(err)
+		}
+		for b.Loop() {
+			if err := fw.WriteBody(values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
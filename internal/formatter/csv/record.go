@@ -0,0 +1,141 @@
+package csv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// recordWriter writes CSV records like encoding/csv.Writer, but with any
+// field delimiter and record terminator, which encoding/csv.Writer fixes to
+// "\n" or "\r\n".
+type recordWriter struct {
+	w          *bufio.Writer
+	delimiter  rune
+	terminator string
+	// specials are characters which need a field to be quoted.
+	specials string
+}
+
+func newRecordWriter(w io.Writer, delimiter rune, terminator string) *recordWriter {
+	return &recordWriter{
+		w:          bufio.NewWriter(w),
+		delimiter:  delimiter,
+		terminator: terminator,
+		specials:   "\"\r\n" + string(delimiter) + terminator,
+	}
+}
+
+func (w *recordWriter) fieldNeedsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsAny(field, w.specials) {
+		return true
+	}
+	r1, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r1)
+}
+
+// Write writes a record with necessary quoting. Quotes in a field are doubled,
+// and the other characters are written as they are.
+func (w *recordWriter) Write(record []string) error {
+	for n, field := range record {
+		w.WriteField(n, field)
+	}
+	return w.EndRecord()
+}
+
+// WriteField writes the n-th field of a record with necessary quoting, without
+// copying the field. EndRecord should follow the last field.
+func (w *recordWriter) WriteField(n int, field string) {
+	if n > 0 {
+		w.w.WriteRune(w.delimiter)
+	}
+	if !w.fieldNeedsQuotes(field) {
+		w.w.WriteString(field)
+		return
+	}
+	w.w.WriteByte('"')
+	for {
+		i := strings.IndexByte(field, '"')
+		if i < 0 {
+			break
+		}
+		w.w.WriteString(field[:i+1])
+		w.w.WriteByte('"')
+		field = field[i+1:]
+	}
+	w.w.WriteString(field)
+	w.w.WriteByte('"')
+}
+
+// EndRecord terminates a record written by WriteField.
+func (w *recordWriter) EndRecord() error {
+	// bufio.Writer keeps the first error, which is returned here.
+	_, err := w.w.WriteString(w.terminator)
+	return err
+}
+
+// WriteRaw writes s as it is, like a prefix of a record.
+func (w *recordWriter) WriteRaw(s string) error {
+	_, err := w.w.WriteString(s)
+	return err
+}
+
+func (w *recordWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// Unescape decodes a separator written with escape sequences of Go string
+// literals, like `\t` or `\x1e`.
+func Unescape(s string) (string, error) {
+	if strings.Contains(s, `"`) {
+		return "", errors.New(`separators can't contain '"'`)
+	}
+	return strconv.Unquote(`"` + s + `"`)
+}
+
+// Escape encodes every character of a separator with escape sequences, so
+// that it can be passed as a parameter of the format safely.
+func Escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < 0x80:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		case r > 0xffff:
+			fmt.Fprintf(&b, `\U%08x`, r)
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
+
+// ParseSeparators decodes and validates a field delimiter and a record
+// terminator written with escape sequences. The delimiter should be a single
+// character, and the both should not contain quotes nor include each other.
+func ParseSeparators(delimiter, terminator string) (rune, string, error) {
+	d, err := Unescape(delimiter)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid delimiter %q: %w", delimiter, err)
+	}
+	r, size := utf8.DecodeRuneInString(d)
+	if size == 0 || size != len(d) || r == utf8.RuneError || r == '\r' || r == '\n' {
+		return 0, "", fmt.Errorf("delimiter should be a character except CR and LF: %q", delimiter)
+	}
+	t, err := Unescape(terminator)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid terminator %q: %w", terminator, err)
+	}
+	if t == "" || !utf8.ValidString(t) || strings.ContainsRune(t, r) {
+		return 0, "", fmt.Errorf("terminator should be non-empty and not contain the delimiter: %q", terminator)
+	}
+	return r, t, nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +28,26 @@ type Writer interface {
 	Flush() error
 }
 
+// Downloader is implemented by Factories of which outputs are files to be
+// downloaded rather than shown, like XLSX. FileExtension returns the extension
+// of the file name with ".".
+type Downloader interface {
+	FileExtension() string
+}
+
+// BufferFlusher is implemented by Writers which can write out buffered rows
+// to the underlying writer in the middle of the output. Unlike Flush, it
+// doesn't terminate the output.
+type BufferFlusher interface {
+	FlushBuffer() error
+}
+
+// ErrorWriter is implemented by Writers which can terminate the output with an
+// error marker, when an error occurs after some rows are written.
+type ErrorWriter interface {
+	WriteError(msg string) error
+}
+
 var factories = map[string]Factory{}
 
 func Register(factory Factory, names ...string) {
@@ -48,9 +69,14 @@ var (
 	ErrWithoutFactory  = errors.New("made without a factory")
 	ErrNoHeaderWritten = errors.New("no headers written")
 	ErrCountMismatch   = errors.New("header and body count mismatch")
+	ErrNonFinite       = errors.New("non-finite float")
 )
 
 func AnyToStr(v any) string {
+	// Avoid copying strings, which may be large.
+	if s, ok := v.(string); ok {
+		return s
+	}
 	return fmt.Sprint(v)
 }
 
@@ -115,6 +141,96 @@ func IntervalToStr(v any) string {
 	return strings.Join(parts, " ")
 }
 
+// IntervalToISO8601 converts INTERVAL to a duration of ISO 8601, like
+// "P1Y2M3DT4H5M6.5S".
+func IntervalToISO8601(v any) string {
+	interval, ok := v.(duckdb.Interval)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	var b strings.Builder
+	b.WriteString("P")
+	if y := interval.Months / 12; y != 0 {
+		fmt.Fprintf(&b, "%dY", y)
+	}
+	if m := interval.Months % 12; m != 0 {
+		fmt.Fprintf(&b, "%dM", m)
+	}
+	if interval.Days != 0 {
+		fmt.Fprintf(&b, "%dD", interval.Days)
+	}
+	if us := interval.Micros; us != 0 {
+		b.WriteString("T")
+		if h := us / 3600_000_000; h != 0 {
+			fmt.Fprintf(&b, "%dH", h)
+		}
+		if m := us / 60_000_000 % 60; m != 0 {
+			fmt.Fprintf(&b, "%dM", m)
+		}
+		if s := us % 60_000_000; s != 0 {
+			b.WriteString(strconv.FormatFloat(float64(s)/1e6, 'f', -1, 64))
+			b.WriteString("S")
+		}
+	}
+	if b.Len() == 1 {
+		return "PT0S"
+	}
+	return b.String()
+}
+
+func plural(n int64, unit string) string {
+	if n == 1 || n == -1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// IntervalToDuckDB converts INTERVAL to the textual form of DuckDB, like
+// "1 year 2 months 3 days 04:05:06.5".
+func IntervalToDuckDB(v any) string {
+	interval, ok := v.(duckdb.Interval)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	parts := make([]string, 0, 4)
+	if y := interval.Months / 12; y != 0 {
+		parts = append(parts, plural(int64(y), "year"))
+	}
+	if m := interval.Months % 12; m != 0 {
+		parts = append(parts, plural(int64(m), "month"))
+	}
+	if interval.Days != 0 {
+		parts = append(parts, plural(int64(interval.Days), "day"))
+	}
+	if us := interval.Micros; us != 0 || len(parts) == 0 {
+		sign := ""
+		if us < 0 {
+			sign, us = "-", -us
+		}
+		s := fmt.Sprintf("%s%02d:%02d:%02d", sign, us/3600_000_000, us/60_000_000%60, us/1_000_000%60)
+		if frac := us % 1_000_000; frac != 0 {
+			s += strings.TrimRight(fmt.Sprintf(".%06d", frac), "0")
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+// IntervalConverter returns a converter for INTERVAL, which is chosen by
+// "interval" parameter: "iso8601", "duckdb" or empty for IntervalToStr.
+func IntervalConverter(params map[string]string) (func(any) string, error) {
+	switch s := Get(params, "interval", ""); s {
+	case "":
+		return IntervalToStr, nil
+	case "iso8601":
+		return IntervalToISO8601, nil
+	case "duckdb":
+		return IntervalToDuckDB, nil
+	default:
+		return nil, fmt.Errorf("unsupported interval format: %q", s)
+	}
+}
+
 func TimeToStr(v any) string {
 	t := v.(time.Time)
 	return t.Format("15:04:05")
@@ -129,6 +245,38 @@ func BlobToStr(v any) string {
 	return string(v.([]uint8))
 }
 
+// ColumnNames returns names of columns. When dedup is true, duplicated names
+// are renamed with suffixes like "name_2", so that every name is unique.
+func ColumnNames(columnTypes []*sql.ColumnType, dedup bool) []string {
+	names := make([]string, len(columnTypes))
+	for i, typ := range columnTypes {
+		names[i] = typ.Name()
+	}
+	if !dedup {
+		return names
+	}
+	taken := make(map[string]bool, len(names))
+	for _, name := range names {
+		taken[name] = true
+	}
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			continue
+		}
+		for n := 2; ; n++ {
+			s := name + "_" + strconv.Itoa(n)
+			if !taken[s] {
+				taken[s] = true
+				names[i] = s
+				break
+			}
+		}
+	}
+	return names
+}
+
 func Get(params map[string]string, name, defaultValue string) string {
 	if s, ok := params[name]; ok {
 		return s
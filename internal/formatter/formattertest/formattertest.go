@@ -35,20 +35,13 @@ func WriteRows(formatWriter formatter.Writer, rows *sql.Rows) error {
 		return err
 	}
 	// Prepare for scan
-	receivers := make([]any, len(columnTypes))
-	values := make([]any, len(columnTypes))
-	for i := range receivers {
-		receivers[i] = new(any)
-	}
+	scanner := formatter.NewScanner(columnTypes)
 	for rows.Next() {
-		err := rows.Scan(receivers...)
+		err := rows.Scan(scanner.Dests()...)
 		if err != nil {
 			return err
 		}
-		for i, pv := range receivers {
-			values[i] = *pv.(*any)
-		}
-		err = formatWriter.WriteBody(values)
+		err = formatWriter.WriteBody(scanner.Values())
 		if err != nil {
 			return err
 		}
@@ -56,7 +49,7 @@ func WriteRows(formatWriter formatter.Writer, rows *sql.Rows) error {
 	return formatWriter.Flush()
 }
 
-func ConnectDB(t *testing.T) *sql.Conn {
+func ConnectDB(t testing.TB) *sql.Conn {
 	t.Helper()
 
 	// Open database
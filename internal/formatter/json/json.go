@@ -0,0 +1,353 @@
+// Package json proivdes JSON formatter for Duckpop.
+package json
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/koron/duckpop/internal/formatter"
+)
+
+func init() {
+	formatter.Register(&Factory{}, "json")
+}
+
+type Factory struct {
+}
+
+var _ formatter.Factory = (*Factory)(nil)
+
+func (f *Factory) ContentType() string {
+	return "application/json"
+}
+
+func (f *Factory) Create(w io.Writer, params map[string]string) (formatter.Writer, error) {
+	_, envelope := params["envelope"]
+	_, dedup := params["dedup"]
+	interval, err := formatter.IntervalConverter(params)
+	if err != nil {
+		return nil, err
+	}
+	var bigintString bool
+	switch v := params["bigint"]; v {
+	case "", "number":
+	case "string":
+		bigintString = true
+	default:
+		return nil, fmt.Errorf("unsupported bigint: %q", v)
+	}
+	nonFinite := params["nonfinite"]
+	switch nonFinite {
+	case "":
+		nonFinite = "null"
+	case "null", "string", "error":
+	default:
+		return nil, fmt.Errorf("unsupported nonfinite: %q", nonFinite)
+	}
+	return &Writer{
+		w:            bufio.NewWriter(w),
+		envelope:     envelope,
+		interval:     interval,
+		bigintString: bigintString,
+		dedup:        dedup,
+		nonFinite:    nonFinite,
+	}, nil
+}
+
+// Writer writes rows as an array of JSON objects.  When "envelope" parameter
+// is given, the array is wrapped with an object which has "rows" and "count"
+// properties, so the number of rows can be known at the end of the response.
+// When an error occurs in the middle, the object has "error" property too.
+// When "bigint:string" parameter is given, 64-bit or larger integers are
+// written as strings, to avoid precision loss in JavaScript.
+// When "dedup" parameter is given, duplicated names of columns are suffixed
+// like "name_2", not to lose the values of the same keys.
+// JSON can't represent NaN and infinities, so "nonfinite" parameter tells how
+// to write them: "null" (default), "string" as like "NaN" or "-Infinity", or
+// "error" which fails with formatter.ErrNonFinite.
+type Writer struct {
+	w            *bufio.Writer
+	envelope     bool
+	interval     func(any) string
+	bigintString bool
+	dedup        bool
+	nonFinite    string
+
+	keys       [][]byte
+	converters []func(any) any
+	count      int64
+	encoded    [][]byte
+	strs       []string
+}
+
+var (
+	_ formatter.Writer        = (*Writer)(nil)
+	_ formatter.BufferFlusher = (*Writer)(nil)
+	_ formatter.ErrorWriter   = (*Writer)(nil)
+)
+
+func rawValue(v any) any {
+	return v
+}
+
+func strValue(fn func(any) string) func(any) any {
+	return func(v any) any {
+		return fn(v)
+	}
+}
+
+func (w *Writer) nestedValue(typeName string) func(any) any {
+	convert := formatter.JSONConverter(typeName, w.interval)
+	return func(v any) any {
+		return w.finiteValue(convert(v))
+	}
+}
+
+// finiteValue replaces NaN and infinities in a value, including elements of
+// nested values, by "nonfinite" parameter. They are left as is for "error",
+// to make json.Marshal fail.
+func (w *Writer) finiteValue(v any) any {
+	switch x := v.(type) {
+	case float32:
+		return w.finiteFloat(v, float64(x))
+	case float64:
+		return w.finiteFloat(v, x)
+	case []any:
+		for i, e := range x {
+			x[i] = w.finiteValue(e)
+		}
+		return x
+	case formatter.Object:
+		for i, m := range x {
+			x[i].Value = w.finiteValue(m.Value)
+		}
+		return x
+	default:
+		return v
+	}
+}
+
+func (w *Writer) finiteFloat(v any, f float64) any {
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return v
+	}
+	switch w.nonFinite {
+	case "string":
+		switch {
+		case math.IsNaN(f):
+			return "NaN"
+		case f > 0:
+			return "Infinity"
+		default:
+			return "-Infinity"
+		}
+	case "error":
+		return v
+	default:
+		return nil
+	}
+}
+
+func (w *Writer) WriteHeader(columnTypes []*sql.ColumnType) error {
+	w.keys = make([][]byte, len(columnTypes))
+	w.converters = make([]func(any) any, len(columnTypes))
+	names := formatter.ColumnNames(columnTypes, w.dedup)
+	for i, typ := range columnTypes {
+		b, err := json.Marshal(names[i])
+		if err != nil {
+			return err
+		}
+		w.keys[i] = b
+		switch typ.DatabaseTypeName() {
+		case "DATE":
+			w.converters[i] = strValue(formatter.DateToStr)
+		case "INTERVAL":
+			w.converters[i] = strValue(w.interval)
+		case "TIME":
+			w.converters[i] = strValue(formatter.TimeToStr)
+		case "TIMESTAMP":
+			w.converters[i] = strValue(formatter.TimestampToStr)
+		case "FLOAT", "DOUBLE":
+			w.converters[i] = w.finiteValue
+		case "BIGINT", "UBIGINT", "HUGEINT", "UHUGEINT":
+			if w.bigintString {
+				w.converters[i] = strValue(formatter.AnyToStr)
+				continue
+			}
+			w.converters[i] = rawValue
+		default:
+			if formatter.IsNested(typ.DatabaseTypeName()) {
+				w.converters[i] = w.nestedValue(typ.DatabaseTypeName())
+				continue
+			}
+			w.converters[i] = rawValue
+		}
+	}
+	if w.envelope {
+		_, err := w.w.WriteString(`{"rows":[`)
+		return err
+	}
+	return w.w.WriteByte('[')
+}
+
+func (w *Writer) WriteBody(values []any) error {
+	if w.keys == nil {
+		return formatter.ErrNoHeaderWritten
+	}
+	if len(w.keys) != len(values) {
+		return formatter.ErrCountMismatch
+	}
+	// Encode values before writing, not to leave a broken row on errors.
+	// Strings, which may be large, are written directly without encoded
+	// copies, since it can't fail.
+	if w.encoded == nil {
+		w.encoded = make([][]byte, len(values))
+		w.strs = make([]string, len(values))
+	}
+	for i, v := range values {
+		if v != nil {
+			v = w.converters[i](v)
+		}
+		if s, ok := v.(string); ok {
+			w.encoded[i] = nil
+			w.strs[i] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			var uve *json.UnsupportedValueError
+			if errors.As(err, &uve) && w.nonFinite == "error" {
+				return fmt.Errorf("%w: %s", formatter.ErrNonFinite, uve.Str)
+			}
+			return err
+		}
+		w.encoded[i] = b
+	}
+	if w.count > 0 {
+		w.w.WriteString(",\n")
+	}
+	w.w.WriteByte('{')
+	for i := range values {
+		if i > 0 {
+			w.w.WriteByte(',')
+		}
+		w.w.Write(w.keys[i])
+		w.w.WriteByte(':')
+		if w.encoded[i] == nil {
+			writeString(w.w, w.strs[i])
+			w.strs[i] = ""
+			continue
+		}
+		w.w.Write(w.encoded[i])
+	}
+	w.count++
+	return w.w.WriteByte('}')
+}
+
+// safeBytes tells ASCII bytes which can be written in JSON strings as is.
+var safeBytes = func() (t [utf8.RuneSelf]bool) {
+	for b := range t {
+		t[b] = b >= 0x20 && !strings.ContainsRune(`"\<>&`, rune(b))
+	}
+	return t
+}()
+
+// writeString writes s as a JSON string, escaping in the same way as
+// json.Marshal.
+func writeString(w *bufio.Writer, s string) {
+	const hex = "0123456789abcdef"
+	w.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if safeBytes[b] {
+				i++
+				continue
+			}
+			w.WriteString(s[start:i])
+			switch b {
+			case '"', '\\':
+				w.WriteByte('\\')
+				w.WriteByte(b)
+			case '\b':
+				w.WriteString(`\b`)
+			case '\f':
+				w.WriteString(`\f`)
+			case '\n':
+				w.WriteString(`\n`)
+			case '\r':
+				w.WriteString(`\r`)
+			case '\t':
+				w.WriteString(`\t`)
+			default:
+				w.WriteString(`\u00`)
+				w.WriteByte(hex[b>>4])
+				w.WriteByte(hex[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			w.WriteString(s[start:i])
+			w.WriteString(`\ufffd`)
+		case r == '\u2028' || r == '\u2029':
+			w.WriteString(s[start:i])
+			w.WriteString(`\u202`)
+			w.WriteByte(hex[r&0xf])
+		default:
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	w.WriteString(s[start:])
+	w.WriteByte('"')
+}
+
+func (w *Writer) Flush() error {
+	if w.envelope {
+		w.w.WriteString(`],"count":`)
+		w.w.WriteString(strconv.FormatInt(w.count, 10))
+		w.w.WriteString("}\n")
+	} else {
+		w.w.WriteString("]\n")
+	}
+	return w.w.Flush()
+}
+
+// FlushBuffer writes buffered rows to the underlying writer, without closing
+// the array.
+func (w *Writer) FlushBuffer() error {
+	return w.w.Flush()
+}
+
+// WriteError terminates the output with an error message. Only the envelope
+// can have it, so the array is left unterminated without the envelope, to be
+// distinguished from a complete one.
+func (w *Writer) WriteError(msg string) error {
+	if !w.envelope {
+		return w.w.Flush()
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	w.w.WriteString(`],"count":`)
+	w.w.WriteString(strconv.FormatInt(w.count, 10))
+	w.w.WriteString(`,"error":`)
+	w.w.Write(b)
+	w.w.WriteString("}\n")
+	return w.w.Flush()
+}
@@ -0,0 +1,190 @@
+package json_test
+
+import (
+	"bufio"
+	"database/sql"
+	stdjson "encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/formatter"
+	"github.com/koron/duckpop/internal/formatter/formattertest"
+	"github.com/koron/duckpop/internal/formatter/json"
+)
+
+const (
+	format = "json"
+)
+
+func TestFactory(t *testing.T) {
+	f := formattertest.Find[*json.Factory](t, format)
+	assert.Equal(t, "application/json", f.ContentType())
+}
+
+type testCase struct {
+	Query string
+	Want  string
+}
+
+func runCases(t *testing.T, conn *sql.Conn, format string, cases []testCase) {
+	t.Helper()
+	for i, tc := range cases {
+		bb := formattertest.Query(t, conn, format, tc.Query)
+		if !assert.Equal(t, tc.Want, bb.String()) {
+			t.Logf("failed #%d case: query=%q", i, tc.Query)
+		}
+	}
+}
+
+// Tests
+
+func TestRows(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, format, []testCase{
+		{`SELECT 1 AS A, 'foo' AS B`, "[{\"A\":1,\"B\":\"foo\"}]\n"},
+		{`SELECT i AS N FROM range(3) t(i)`, "[{\"N\":0},\n{\"N\":1},\n{\"N\":2}]\n"},
+		{`SELECT i AS N FROM range(0) t(i)`, "[]\n"},
+		{`SELECT NULL AS GOT`, "[{\"GOT\":null}]\n"},
+	})
+}
+
+func TestEnvelope(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, "json,envelope", []testCase{
+		{`SELECT i AS N FROM range(2) t(i)`, "{\"rows\":[{\"N\":0},\n{\"N\":1}],\"count\":2}\n"},
+		{`SELECT i AS N FROM range(0) t(i)`, "{\"rows\":[],\"count\":0}\n"},
+	})
+}
+
+func TestDedup(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, "json", []testCase{
+		{`SELECT 1 AS A, 2 AS A`, "[{\"A\":1,\"A\":2}]\n"},
+	})
+	runCases(t, conn, "json,dedup", []testCase{
+		{`SELECT 1 AS A, 2 AS A, 3 AS B`, "[{\"A\":1,\"A_2\":2,\"B\":3}]\n"},
+	})
+}
+
+func TestTimeTypes(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, format, []testCase{
+		{`SELECT '2026-03-30'::DATE AS GOT`, "[{\"GOT\":\"2026-03-30\"}]\n"},
+		{`SELECT '12:34:56'::TIME AS GOT`, "[{\"GOT\":\"12:34:56\"}]\n"},
+		{`SELECT '2026-03-30 12:34:56'::TIMESTAMP AS GOT`, "[{\"GOT\":\"2026-03-30 12:34:56\"}]\n"},
+		{`SELECT INTERVAL '3' HOUR AS GOT`, "[{\"GOT\":\"3h\"}]\n"},
+	})
+}
+
+func TestNestedTypes(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	runCases(t, conn, format, []testCase{
+		{`SELECT [1, 2, NULL]::INTEGER[] AS V`, "[{\"V\":[1,2,null]}]\n"},
+		{`SELECT {'a': 1, 'b': [1.5]} AS V`, "[{\"V\":{\"a\":1,\"b\":[1.5]}}]\n"},
+		{`SELECT MAP {'k': 1} AS V`, "[{\"V\":{\"k\":1}}]\n"},
+		{`SELECT [1, 2]::INTEGER[2] AS V`, "[{\"V\":[1,2]}]\n"},
+		// STRUCT and MAP keep the order of fields and keys.
+		{`SELECT {'b': 1, 'a': 2} AS V`, "[{\"V\":{\"b\":1,\"a\":2}}]\n"},
+		{`SELECT MAP {'z': 1, 'a': 2, 'm': 3} AS V`, "[{\"V\":{\"z\":1,\"a\":2,\"m\":3}}]\n"},
+		{`SELECT [{'x y': 1, 'B': {'q': 1, 'p': 2}, 'c"d': MAP {2: 'v', 1: 'w'}}] AS V`, "[{\"V\":[{\"x y\":1,\"B\":{\"q\":1,\"p\":2},\"c\\\"d\":{\"2\":\"v\",\"1\":\"w\"}}]}]\n"},
+	})
+	runCases(t, conn, "json,interval:iso8601", []testCase{
+		{`SELECT INTERVAL 90 MINUTE AS V, [INTERVAL 1 DAY] AS L`, "[{\"V\":\"PT1H30M\",\"L\":[\"P1D\"]}]\n"},
+	})
+}
+
+func TestBigInt(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	const query = `SELECT 9007199254740993::BIGINT AS A, 2::INTEGER AS B, 18446744073709551615::UBIGINT AS C, 170141183460469231731687303715884105727::HUGEINT AS D`
+	runCases(t, conn, format, []testCase{
+		{query, "[{\"A\":9007199254740993,\"B\":2,\"C\":18446744073709551615,\"D\":170141183460469231731687303715884105727}]\n"},
+	})
+	runCases(t, conn, "json,bigint:string", []testCase{
+		{query, "[{\"A\":\"9007199254740993\",\"B\":2,\"C\":\"18446744073709551615\",\"D\":\"170141183460469231731687303715884105727\"}]\n"},
+		{`SELECT NULL::BIGINT AS A`, "[{\"A\":null}]\n"},
+	})
+}
+
+func TestNonFinite(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	const query = `SELECT 'nan'::DOUBLE AS A, 'inf'::FLOAT AS B, '-inf'::DOUBLE AS C, 1.5::DOUBLE AS D, ['nan'::DOUBLE, 2] AS E`
+	runCases(t, conn, format, []testCase{
+		{query, "[{\"A\":null,\"B\":null,\"C\":null,\"D\":1.5,\"E\":[null,2]}]\n"},
+	})
+	runCases(t, conn, "json,nonfinite:string", []testCase{
+		{query, "[{\"A\":\"NaN\",\"B\":\"Infinity\",\"C\":\"-Infinity\",\"D\":1.5,\"E\":[\"NaN\",2]}]\n"},
+	})
+
+	for _, q := range []string{`SELECT 'nan'::DOUBLE AS A`, `SELECT ['inf'::DOUBLE] AS A`} {
+		rows, err := conn.QueryContext(t.Context(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, writer, err := formatter.FindAndCreate("json,nonfinite:error", io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = formattertest.WriteRows(writer, rows)
+		if !errors.Is(err, formatter.ErrNonFinite) {
+			t.Errorf("unexpected error for %q: %v", q, err)
+		}
+	}
+}
+
+func TestStringEscape(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	s := "a\"b\\c<>&\n\r\t\x01\b\f\u2028\u2029\u00e9\u65e5"
+	want, err := stdjson.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb := formattertest.Query(t, conn, format, `SELECT $1::VARCHAR AS S`, s)
+	assert.Equal(t, `[{"S":`+string(want)+"}]\n", bb.String())
+}
+
+// BenchmarkLargeString compares the memory to write a large string, between
+// encoding it with json.Marshal before writing, as the writer did before, and
+// the writer.
+func BenchmarkLargeString(b *testing.B) {
+	conn := formattertest.ConnectDB(b)
+	rows, err := conn.QueryContext(b.Context(), `SELECT 'x' AS S`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	columnTypes, err := rows.ColumnTypes()
+	rows.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	values := []any{strings.Repeat("x", 1<<20)}
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		w := bufio.NewWriter(io.Discard)
+		for b.Loop() {
+			v, err := stdjson.Marshal(values[0])
+			if err != nil {
+				b.Fatal(err)
+			}
+			w.Write(v)
+		}
+	})
+	b.Run("writer", func(b *testing.B) {
+		b.ReportAllocs()
+		fw, err := (&json.Factory{}).Create(io.Discard, map[string]string{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := fw.WriteHeader(columnTypes); err != nil {
+			b.Fatal(err)
+		}
+		for b.Loop() {
+			if err := fw.WriteBody(values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package formatter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+)
+
+// IsNested checks the database type name is one of nested types: LIST, ARRAY,
+// STRUCT and MAP.
+func IsNested(typeName string) bool {
+	return strings.HasSuffix(typeName, "]") ||
+		strings.HasPrefix(typeName, "STRUCT(") ||
+		strings.HasPrefix(typeName, "MAP(")
+}
+
+// Object is a JSON object which keeps the order of members, converted from
+// STRUCT and MAP.
+type Object []Member
+
+// Member is a member of Object.
+type Member struct {
+	Key   string
+	Value any
+}
+
+// MarshalJSON marshals the members in the order.
+func (o Object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(m.Key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// nestedType is a nested type parsed from its database type name, which is
+// needed to know the order of fields of STRUCT, because the driver scans
+// STRUCT into map[string]any.
+type nestedType struct {
+	// elem is the type of elements of LIST and ARRAY, or of values of MAP.
+	elem *nestedType
+	// fields are names and types of fields of STRUCT.
+	fields []string
+	types  []*nestedType
+}
+
+// parseNestedType parses a database type name. It returns nil for types
+// other than nested ones, and for ones which can't be parsed.
+func parseNestedType(name string) *nestedType {
+	name = strings.TrimSpace(name)
+	switch {
+	case strings.HasSuffix(name, "]"):
+		i := strings.LastIndexByte(name, '[')
+		if i < 0 {
+			return nil
+		}
+		return &nestedType{elem: parseNestedType(name[:i])}
+	case strings.HasPrefix(name, "STRUCT(") && strings.HasSuffix(name, ")"):
+		t := &nestedType{}
+		for _, f := range splitTypeList(name[len("STRUCT(") : len(name)-1]) {
+			field, typ, ok := cutFieldName(f)
+			if !ok {
+				return nil
+			}
+			t.fields = append(t.fields, field)
+			t.types = append(t.types, parseNestedType(typ))
+		}
+		return t
+	case strings.HasPrefix(name, "MAP(") && strings.HasSuffix(name, ")"):
+		kv := splitTypeList(name[len("MAP(") : len(name)-1])
+		if len(kv) != 2 {
+			return nil
+		}
+		return &nestedType{elem: parseNestedType(kv[1])}
+	default:
+		return nil
+	}
+}
+
+// splitTypeList splits a list of types or fields by commas out of
+// parentheses and quoted names.
+func splitTypeList(s string) []string {
+	var list []string
+	depth, start := 0, 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			list = append(list, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(list, s[start:])
+}
+
+// cutFieldName cuts a field of STRUCT into the name, which may be quoted, and
+// the type.
+func cutFieldName(s string) (string, string, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, `"`) {
+		return strings.Cut(s, " ")
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			i++
+			continue
+		}
+		return strings.ReplaceAll(s[1:i], `""`, `"`), s[i+1:], true
+	}
+	return "", "", false
+}
+
+// JSONValue converts a value of nested types to a value which can be
+// marshaled as JSON. STRUCT and MAP are converted to Object, whose keys of MAP
+// are stringified. Fields of STRUCT are ordered by their declaration in the
+// database type name, or by names when it is unknown. INTERVAL in the value
+// is converted by interval.
+func JSONValue(typeName string, v any, interval func(any) string) any {
+	return jsonValue(parseNestedType(typeName), v, interval)
+}
+
+// JSONConverter returns a function which converts values of a column by
+// JSONValue, parsing the database type name only once.
+func JSONConverter(typeName string, interval func(any) string) func(any) any {
+	t := parseNestedType(typeName)
+	return func(v any) any {
+		return jsonValue(t, v, interval)
+	}
+}
+
+func jsonValue(t *nestedType, v any, interval func(any) string) any {
+	var elem *nestedType
+	if t != nil {
+		elem = t.elem
+	}
+	switch x := v.(type) {
+	case []any:
+		list := make([]any, len(x))
+		for i, e := range x {
+			list[i] = jsonValue(elem, e, interval)
+		}
+		return list
+	case map[string]any:
+		obj := make(Object, 0, len(x))
+		if t != nil {
+			for i, name := range t.fields {
+				if e, ok := x[name]; ok {
+					obj = append(obj, Member{name, jsonValue(t.types[i], e, interval)})
+				}
+			}
+		}
+		if len(obj) < len(x) {
+			// Fields which aren't found in the type, by names.
+			for _, k := range slices.Sorted(maps.Keys(x)) {
+				if !slices.ContainsFunc(obj, func(m Member) bool { return m.Key == k }) {
+					obj = append(obj, Member{k, jsonValue(nil, x[k], interval)})
+				}
+			}
+		}
+		return obj
+	case duckdb.OrderedMap:
+		keys, values := x.Keys(), x.Values()
+		obj := make(Object, len(keys))
+		for i, k := range keys {
+			obj[i] = Member{fmt.Sprint(k), jsonValue(elem, values[i], interval)}
+		}
+		return obj
+	case duckdb.Interval:
+		return interval(x)
+	case duckdb.Decimal:
+		return json.Number(x.String())
+	case *big.Int:
+		return json.Number(x.String())
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
+
+// NestedToStr converts values of a nested type to JSON strings.
+func NestedToStr(typeName string, interval func(any) string) func(any) string {
+	convert := JSONConverter(typeName, interval)
+	return func(v any) string {
+		b, err := json.Marshal(convert(v))
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+}
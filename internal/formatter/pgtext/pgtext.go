@@ -0,0 +1,140 @@
+// Package pgtext proivdes PostgreSQL text formatter for Duckpop.
+package pgtext
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/koron/duckpop/internal/formatter"
+)
+
+func init() {
+	formatter.Register(&Factory{}, "pg-text")
+}
+
+type Factory struct {
+}
+
+var _ formatter.Factory = (*Factory)(nil)
+
+func (f *Factory) ContentType() string {
+	return "text/plain"
+}
+
+func (f *Factory) Create(w io.Writer, params map[string]string) (formatter.Writer, error) {
+	interval, err := formatter.IntervalConverter(params)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:        bufio.NewWriter(w),
+		interval: interval,
+	}, nil
+}
+
+// Writer writes rows like unaligned output of psql with tabs as separators:
+// the header of names of columns, rows, and "(N rows)" line at the end.
+// Values are escaped as the text format of COPY of PostgreSQL, so NULL is
+// written as `\N`, and booleans are written as "t" or "f".
+type Writer struct {
+	w        *bufio.Writer
+	interval func(any) string
+
+	converters []func(any) string
+	count      int64
+}
+
+var (
+	_ formatter.Writer        = (*Writer)(nil)
+	_ formatter.BufferFlusher = (*Writer)(nil)
+)
+
+func boolToStr(v any) string {
+	if b, ok := v.(bool); ok {
+		if b {
+			return "t"
+		}
+		return "f"
+	}
+	return formatter.AnyToStr(v)
+}
+
+func (w *Writer) WriteHeader(columnTypes []*sql.ColumnType) error {
+	w.converters = make([]func(any) string, len(columnTypes))
+	names := formatter.ColumnNames(columnTypes, false)
+	for i, typ := range columnTypes {
+		switch typ.DatabaseTypeName() {
+		case "BOOLEAN":
+			w.converters[i] = boolToStr
+		case "DATE":
+			w.converters[i] = formatter.DateToStr
+		case "INTERVAL":
+			w.converters[i] = w.interval
+		case "TIME":
+			w.converters[i] = formatter.TimeToStr
+		case "TIMESTAMP":
+			w.converters[i] = formatter.TimestampToStr
+		case "BLOB":
+			w.converters[i] = formatter.BlobToStr
+		default:
+			if formatter.IsNested(typ.DatabaseTypeName()) {
+				w.converters[i] = formatter.NestedToStr(typ.DatabaseTypeName(), w.interval)
+				continue
+			}
+			w.converters[i] = formatter.AnyToStr
+		}
+	}
+	return w.writeLine(names)
+}
+
+func (w *Writer) WriteBody(values []any) error {
+	if w.converters == nil {
+		return formatter.ErrNoHeaderWritten
+	}
+	if len(w.converters) != len(values) {
+		return formatter.ErrCountMismatch
+	}
+	fields := make([]string, len(values))
+	for i, v := range values {
+		if v == nil {
+			fields[i] = `\N`
+			continue
+		}
+		fields[i] = escaper.Replace(w.converters[i](v))
+	}
+	w.count++
+	return w.writeLine(fields)
+}
+
+// escaper escapes characters which can't be in fields of the text format.
+var escaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+func (w *Writer) writeLine(fields []string) error {
+	for i, f := range fields {
+		if i > 0 {
+			w.w.WriteByte('\t')
+		}
+		w.w.WriteString(f)
+	}
+	return w.w.WriteByte('\n')
+}
+
+func (w *Writer) Flush() error {
+	if w.converters == nil {
+		return formatter.ErrNoHeaderWritten
+	}
+	if w.count == 1 {
+		w.w.WriteString("(1 row)\n")
+	} else {
+		w.w.WriteString("(" + strconv.FormatInt(w.count, 10) + " rows)\n")
+	}
+	return w.w.Flush()
+}
+
+// FlushBuffer writes buffered rows to the underlying writer.
+func (w *Writer) FlushBuffer() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,36 @@
+package pgtext_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/formatter/formattertest"
+	"github.com/koron/duckpop/internal/formatter/pgtext"
+)
+
+const (
+	format = "pg-text"
+)
+
+func TestFactory(t *testing.T) {
+	f := formattertest.Find[*pgtext.Factory](t, format)
+	assert.Equal(t, "text/plain", f.ContentType())
+}
+
+func TestRows(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{`SELECT 1 AS A, 'foo' AS B`, "A\tB\n1\tfoo\n(1 row)\n"},
+		{`SELECT i AS N FROM range(2) t(i)`, "N\n0\n1\n(2 rows)\n"},
+		{`SELECT i AS N FROM range(0) t(i)`, "N\n(0 rows)\n"},
+		{`SELECT NULL AS A, true AS B, false AS C`, "A\tB\tC\n\\N\tt\tf\n(1 row)\n"},
+		{`SELECT E'a\tb\nc\\d' AS S`, "S\na\\tb\\nc\\\\d\n(1 row)\n"},
+		{`SELECT '2026-03-30'::DATE AS D, [1, 2] AS L`, "D\tL\n2026-03-30\t[1,2]\n(1 row)\n"},
+	} {
+		bb := formattertest.Query(t, conn, format, tc.query)
+		assert.Equal(t, tc.want, bb.String())
+	}
+}
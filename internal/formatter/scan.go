@@ -0,0 +1,101 @@
+package formatter
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Scanner provides typed destinations for sql.Rows.Scan, which are determined
+// by sql.ColumnType.ScanType(), and values extracted from them.  A NULL is
+// extracted as nil explicitly.  Columns of which scan type is not known are
+// scanned into *any as a fallback.
+type Scanner struct {
+	dests   []any
+	getters []func() any
+	values  []any
+}
+
+// NewScanner creates a Scanner for the columns.
+func NewScanner(columnTypes []*sql.ColumnType) *Scanner {
+	s := &Scanner{
+		dests:   make([]any, len(columnTypes)),
+		getters: make([]func() any, len(columnTypes)),
+		values:  make([]any, len(columnTypes)),
+	}
+	for i, typ := range columnTypes {
+		s.dests[i], s.getters[i] = newDest(typ.ScanType())
+	}
+	return s
+}
+
+// IsSupported checks writers can represent values of the column. Types which
+// the driver doesn't know how to scan, like BIT, and UNION including nested in
+// other types are not supported, because they are written as garbage or fail.
+func IsSupported(typ *sql.ColumnType) bool {
+	if typ.ScanType() == nil {
+		return false
+	}
+	return !strings.Contains(typ.DatabaseTypeName(), "UNION(")
+}
+
+func newDest(t reflect.Type) (any, func() any) {
+	switch t {
+	case reflect.TypeFor[bool]():
+		return nullDest[bool]()
+	case reflect.TypeFor[int8]():
+		return nullDest[int8]()
+	case reflect.TypeFor[int16]():
+		return nullDest[int16]()
+	case reflect.TypeFor[int32]():
+		return nullDest[int32]()
+	case reflect.TypeFor[int64]():
+		return nullDest[int64]()
+	case reflect.TypeFor[uint8]():
+		return nullDest[uint8]()
+	case reflect.TypeFor[uint16]():
+		return nullDest[uint16]()
+	case reflect.TypeFor[uint32]():
+		return nullDest[uint32]()
+	case reflect.TypeFor[uint64]():
+		return nullDest[uint64]()
+	case reflect.TypeFor[float32]():
+		return nullDest[float32]()
+	case reflect.TypeFor[float64]():
+		return nullDest[float64]()
+	case reflect.TypeFor[string]():
+		return nullDest[string]()
+	case reflect.TypeFor[[]byte]():
+		return nullDest[[]byte]()
+	case reflect.TypeFor[time.Time]():
+		return nullDest[time.Time]()
+	default:
+		d := new(any)
+		return d, func() any { return *d }
+	}
+}
+
+func nullDest[T any]() (any, func() any) {
+	d := &sql.Null[T]{}
+	return d, func() any {
+		if !d.Valid {
+			return nil
+		}
+		return d.V
+	}
+}
+
+// Dests returns destinations to be passed to sql.Rows.Scan.
+func (s *Scanner) Dests() []any {
+	return s.dests
+}
+
+// Values returns values of the last scanned row.  The returned slice is
+// reused by following calls.
+func (s *Scanner) Values() []any {
+	for i, get := range s.getters {
+		s.values[i] = get()
+	}
+	return s.values
+}
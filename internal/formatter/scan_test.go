@@ -0,0 +1,55 @@
+package formatter_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/formatter"
+	"github.com/koron/duckpop/internal/formatter/formattertest"
+)
+
+func TestScanner(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	rows, err := conn.QueryContext(t.Context(), `SELECT * FROM (VALUES
+  (1::INTEGER, 'a', 'x'::BLOB, 1.5::DOUBLE, true, 2::UTINYINT, [1]),
+  (NULL, NULL, NULL, NULL, NULL, NULL, NULL)
+) t(i, s, b, d, t, u, l)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := formatter.NewScanner(columnTypes)
+	var got [][]any
+	for rows.Next() {
+		if err := rows.Scan(scanner.Dests()...); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, append([]any(nil), scanner.Values()...))
+	}
+	assert.Equal(t, [][]any{
+		{int32(1), "a", []byte("x"), 1.5, true, uint8(2), []any{int32(1)}},
+		{nil, nil, nil, nil, nil, nil, nil},
+	}, got)
+}
+
+func TestIsSupported(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	rows, err := conn.QueryContext(t.Context(), `SELECT 1 AS i, [1] AS l, 1::UNION(i INT, s VARCHAR) AS u, [1::UNION(i INT)] AS lu, '101'::BIT AS b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []bool
+	for _, typ := range columnTypes {
+		got = append(got, formatter.IsSupported(typ))
+	}
+	assert.Equal(t, []bool{true, true, false, false, false}, got)
+}
@@ -0,0 +1,296 @@
+// Package xlsx proivdes Excel XLSX formatter for Duckpop.
+package xlsx
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+	"github.com/koron/duckpop/internal/formatter"
+)
+
+// MaxRows is the maximum number of rows in a sheet of Excel, including the
+// header.
+const MaxRows = 1048576
+
+func init() {
+	formatter.Register(&Factory{}, "xlsx")
+}
+
+type Factory struct {
+}
+
+var (
+	_ formatter.Factory    = (*Factory)(nil)
+	_ formatter.Downloader = (*Factory)(nil)
+)
+
+func (f *Factory) ContentType() string {
+	return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+}
+
+func (f *Factory) FileExtension() string {
+	return ".xlsx"
+}
+
+func (f *Factory) Create(w io.Writer, params map[string]string) (formatter.Writer, error) {
+	maxRows := MaxRows
+	if s, ok := params["maxrows"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 2 || n > MaxRows {
+			return nil, fmt.Errorf("maxrows should be between 2 and %d: %q", MaxRows, s)
+		}
+		maxRows = n
+	}
+	return &Writer{
+		zw:      zip.NewWriter(w),
+		maxRows: maxRows,
+	}, nil
+}
+
+// Writer writes rows as a sheet of an Excel workbook. Numbers and booleans are
+// written as cells of the types, DATE and TIMESTAMP as dates, and the others as
+// strings. The sheet is streamed, so the workbook has no shared strings.
+// When the rows exceed "maxrows" parameter (default: MaxRows) including the
+// header, the last row of the sheet tells the number of omitted rows.
+type Writer struct {
+	zw      *zip.Writer
+	sheet   *bufio.Writer
+	maxRows int
+
+	converters []func(any) cell
+	row        int
+	omitted    int64
+}
+
+var _ formatter.Writer = (*Writer)(nil)
+
+// cell is a cell of a sheet: the value and the attributes of <c> element.
+type cell struct {
+	typ   string
+	style int
+	value string
+}
+
+// Styles of cells, which are indexes of cellXfs in styles.xml.
+const (
+	styleGeneral = iota
+	styleDate
+	styleDateTime
+	styleHeader
+)
+
+func (w *Writer) WriteHeader(columnTypes []*sql.ColumnType) error {
+	for _, part := range staticParts {
+		f, err := w.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, xml.Header+part.content); err != nil {
+			return err
+		}
+	}
+	f, err := w.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	w.sheet = bufio.NewWriter(f)
+	w.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	w.converters = make([]func(any) cell, len(columnTypes))
+	header := make([]cell, len(columnTypes))
+	for i, typ := range columnTypes {
+		header[i] = cell{typ: "inlineStr", style: styleHeader, value: typ.Name()}
+		switch typ.DatabaseTypeName() {
+		case "DATE":
+			w.converters[i] = timeCell(styleDate)
+		case "TIMESTAMP", "TIMESTAMP_S", "TIMESTAMP_MS", "TIMESTAMP_NS", "TIMESTAMPTZ":
+			w.converters[i] = timeCell(styleDateTime)
+		case "TIME":
+			w.converters[i] = stringCell(formatter.TimeToStr)
+		case "INTERVAL":
+			w.converters[i] = stringCell(formatter.IntervalToStr)
+		case "BLOB":
+			w.converters[i] = stringCell(formatter.BlobToStr)
+		default:
+			if formatter.IsNested(typ.DatabaseTypeName()) {
+				w.converters[i] = stringCell(formatter.NestedToStr(typ.DatabaseTypeName(), formatter.IntervalToStr))
+				continue
+			}
+			w.converters[i] = anyCell
+		}
+	}
+	return w.writeRow(header)
+}
+
+func (w *Writer) WriteBody(values []any) error {
+	if w.sheet == nil {
+		return formatter.ErrNoHeaderWritten
+	}
+	if len(values) != len(w.converters) {
+		return formatter.ErrCountMismatch
+	}
+	// A row is left to tell the omitted rows.
+	if w.row >= w.maxRows-1 {
+		w.omitted++
+		return nil
+	}
+	cells := make([]cell, len(values))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		cells[i] = w.converters[i](v)
+	}
+	return w.writeRow(cells)
+}
+
+func (w *Writer) Flush() error {
+	if w.sheet == nil {
+		return formatter.ErrNoHeaderWritten
+	}
+	if w.omitted > 0 {
+		note := fmt.Sprintf("%d rows are omitted by the limit of %d rows", w.omitted, w.maxRows)
+		if err := w.writeRow([]cell{{typ: "inlineStr", value: note}}); err != nil {
+			return err
+		}
+	}
+	w.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+	return w.zw.Close()
+}
+
+func (w *Writer) writeRow(cells []cell) error {
+	w.row++
+	fmt.Fprintf(w.sheet, `<row r="%d">`, w.row)
+	for i, c := range cells {
+		if c.value == "" && c.typ == "" {
+			continue
+		}
+		fmt.Fprintf(w.sheet, `<c r="%s%d"`, columnName(i), w.row)
+		if c.typ != "" {
+			fmt.Fprintf(w.sheet, ` t="%s"`, c.typ)
+		}
+		if c.style != styleGeneral {
+			fmt.Fprintf(w.sheet, ` s="%d"`, c.style)
+		}
+		if c.typ == "inlineStr" {
+			w.sheet.WriteString(`><is><t xml:space="preserve">`)
+			xml.EscapeText(w.sheet, []byte(c.value))
+			w.sheet.WriteString(`</t></is></c>`)
+			continue
+		}
+		w.sheet.WriteString(`><v>` + c.value + `</v></c>`)
+	}
+	// bufio.Writer keeps the first error, which is returned here.
+	_, err := w.sheet.WriteString(`</row>`)
+	return err
+}
+
+// columnName returns the name of the i-th (0-based) column, like "A" or "AB".
+func columnName(i int) string {
+	var b []byte
+	for i++; i > 0; i = (i - 1) / 26 {
+		b = append([]byte{byte('A' + (i-1)%26)}, b...)
+	}
+	return string(b)
+}
+
+func stringCell(fn func(any) string) func(any) cell {
+	return func(v any) cell {
+		return cell{typ: "inlineStr", value: fn(v)}
+	}
+}
+
+// excelEpoch is the origin of serial numbers of dates in Excel.
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// timeCell converts a time to a serial number of Excel, which is days since
+// excelEpoch in the wall clock of the time.
+func timeCell(style int) func(any) cell {
+	return func(v any) cell {
+		t, ok := v.(time.Time)
+		if !ok {
+			return cell{typ: "inlineStr", value: formatter.AnyToStr(v)}
+		}
+		wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+		days := float64(wall.Sub(excelEpoch)) / float64(24*time.Hour)
+		return cell{style: style, value: strconv.FormatFloat(days, 'f', -1, 64)}
+	}
+}
+
+func anyCell(v any) cell {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return cell{typ: "b", value: "1"}
+		}
+		return cell{typ: "b", value: "0"}
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return cell{value: fmt.Sprint(v)}
+	case float32:
+		return floatCell(float64(v), 32)
+	case float64:
+		return floatCell(v, 64)
+	case *big.Int:
+		return cell{value: v.String()}
+	case duckdb.Decimal:
+		return cell{value: v.String()}
+	default:
+		return cell{typ: "inlineStr", value: formatter.AnyToStr(v)}
+	}
+}
+
+// floatCell converts a float to a number, or a string for NaN and infinities
+// which Excel can't represent.
+func floatCell(v float64, bitSize int) cell {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return cell{typ: "inlineStr", value: strconv.FormatFloat(v, 'g', -1, bitSize)}
+	}
+	return cell{value: strconv.FormatFloat(v, 'g', -1, bitSize)}
+}
+
+// staticParts are parts of the workbook other than the sheet.
+var staticParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	// cellXfs are styleGeneral, styleDate, styleDateTime and styleHeader.
+	{"xl/styles.xml", `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd"/><numFmt numFmtId="165" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="4">` +
+		`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+		`</cellXfs>` +
+		`</styleSheet>`},
+}
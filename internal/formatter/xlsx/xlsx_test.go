@@ -0,0 +1,76 @@
+package xlsx_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/formatter/formattertest"
+	"github.com/koron/duckpop/internal/formatter/xlsx"
+)
+
+func TestFactory(t *testing.T) {
+	f := formattertest.Find[*xlsx.Factory](t, "xlsx")
+	assert.Equal(t, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", f.ContentType())
+	assert.Equal(t, ".xlsx", f.FileExtension())
+}
+
+// readSheet reads the rows of the sheet in the workbook.
+func readSheet(t *testing.T, bb *bytes.Buffer) string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(bb.Bytes()), int64(bb.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("xl/worksheets/sheet1.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	start := strings.Index(s, "<sheetData>")
+	end := strings.Index(s, "</sheetData>")
+	if start < 0 || end < 0 {
+		t.Fatalf("no sheet data: %s", s)
+	}
+	return s[start+len("<sheetData>") : end]
+}
+
+func TestCells(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	bb := formattertest.Query(t, conn, "xlsx", `SELECT 1 AS N, 1.5::DOUBLE AS F, '007' AS S, true AS B, NULL AS X, DATE '2024-01-02' AS D, TIMESTAMP '2024-01-02 12:00:00' AS T, 'a<b' AS E`)
+	assert.Equal(t, `<row r="1">`+
+		`<c r="A1" t="inlineStr" s="3"><is><t xml:space="preserve">N</t></is></c>`+
+		`<c r="B1" t="inlineStr" s="3"><is><t xml:space="preserve">F</t></is></c>`+
+		`<c r="C1" t="inlineStr" s="3"><is><t xml:space="preserve">S</t></is></c>`+
+		`<c r="D1" t="inlineStr" s="3"><is><t xml:space="preserve">B</t></is></c>`+
+		`<c r="E1" t="inlineStr" s="3"><is><t xml:space="preserve">X</t></is></c>`+
+		`<c r="F1" t="inlineStr" s="3"><is><t xml:space="preserve">D</t></is></c>`+
+		`<c r="G1" t="inlineStr" s="3"><is><t xml:space="preserve">T</t></is></c>`+
+		`<c r="H1" t="inlineStr" s="3"><is><t xml:space="preserve">E</t></is></c>`+
+		`</row><row r="2">`+
+		`<c r="A2"><v>1</v></c>`+
+		`<c r="B2"><v>1.5</v></c>`+
+		`<c r="C2" t="inlineStr"><is><t xml:space="preserve">007</t></is></c>`+
+		`<c r="D2" t="b"><v>1</v></c>`+
+		`<c r="F2" s="1"><v>45293</v></c>`+
+		`<c r="G2" s="2"><v>45293.5</v></c>`+
+		`<c r="H2" t="inlineStr"><is><t xml:space="preserve">a&lt;b</t></is></c>`+
+		`</row>`, readSheet(t, bb))
+}
+
+func TestMaxRows(t *testing.T) {
+	conn := formattertest.ConnectDB(t)
+	bb := formattertest.Query(t, conn, "xlsx,maxrows:3", `SELECT i AS N FROM range(5) t(i)`)
+	assert.Equal(t, `<row r="1"><c r="A1" t="inlineStr" s="3"><is><t xml:space="preserve">N</t></is></c></row>`+
+		`<row r="2"><c r="A2"><v>0</v></c></row>`+
+		`<row r="3"><c r="A3" t="inlineStr"><is><t xml:space="preserve">4 rows are omitted by the limit of 3 rows</t></is></c></row>`,
+		readSheet(t, bb))
+}
@@ -15,6 +15,10 @@ import (
 )
 
 type Database struct {
+	// Timeout cancels a query when it runs longer than this. Zero means no
+	// timeouts.
+	Timeout time.Duration
+
 	mu      sync.RWMutex
 	queries map[ID]*Query
 }
@@ -66,7 +70,19 @@ func (db *Database) newID() ID {
 }
 
 func (db *Database) Add(ctx context.Context, connID conndb.ID, query string) *Query {
-	qctx, cancel := context.WithCancel(ctx)
+	return db.AddTimeout(ctx, connID, query, db.Timeout)
+}
+
+// AddTimeout registers a query like Add, but cancels it with the timeout
+// instead of Timeout. Zero means no timeouts.
+func (db *Database) AddTimeout(ctx context.Context, connID conndb.ID, query string, timeout time.Duration) *Query {
+	var qctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		qctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		qctx, cancel = context.WithCancel(ctx)
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if db.queries == nil {
@@ -105,6 +121,13 @@ func (db *Database) Queries() []*Query {
 	return queries
 }
 
+// Count returns the number of executing queries.
+func (db *Database) Count() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.queries)
+}
+
 func (db *Database) Query(id ID) (*Query, bool) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -112,6 +135,24 @@ func (db *Database) Query(id ID) (*Query, bool) {
 	return q, ok
 }
 
+// CancelConn cancels all queries of the connection, and returns the number of
+// canceled queries.
+func (db *Database) CancelConn(connID conndb.ID) int {
+	db.mu.Lock()
+	var canceled []*Query
+	for id, q := range db.queries {
+		if q.ConnID == connID {
+			delete(db.queries, id)
+			canceled = append(canceled, q)
+		}
+	}
+	db.mu.Unlock()
+	for _, q := range canceled {
+		q.cancel()
+	}
+	return len(canceled)
+}
+
 func (q *Query) Context() context.Context {
 	return q.ctx
 }
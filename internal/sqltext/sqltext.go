@@ -0,0 +1,636 @@
+// Package sqltext provides utilities to handle texts of SQL.
+package sqltext
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// QuoteString quotes s as a string literal of SQL.
+func QuoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// QuoteIdent quotes s as an identifier of SQL.
+func QuoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+var rxIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// IsIdent checks s is a simple identifier, which doesn't require quotes.
+func IsIdent(s string) bool {
+	return rxIdent.MatchString(s)
+}
+
+// StatementType returns the first keyword of the statement in upper case, like
+// "SELECT" or "CREATE". Leading spaces and comments are skipped.
+func StatementType(s string) string {
+	s = skipSpaces(s)
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.ToUpper(s[:end])
+}
+
+// StatementVerb returns the type of the statement like StatementType, except
+// that the keyword of the main statement following the common table
+// expressions is returned for WITH, like "INSERT" of
+// "WITH a AS (SELECT 1) INSERT INTO t FROM a". It returns "" when the main
+// statement can't be determined.
+func StatementVerb(s string) string {
+	t := StatementType(s)
+	if t != "WITH" {
+		return t
+	}
+	s = skipSpaces(s)[len(t):]
+	// Each CTE is: name [(columns)] [USING KEY (columns)] AS [[NOT]
+	// MATERIALIZED] (query), and they are separated by commas.
+	const (
+		expectName = iota
+		expectAS
+		expectBody
+		afterBody
+	)
+	state := expectName
+	first := true
+	for {
+		s = skipSpaces(s)
+		if s == "" {
+			return ""
+		}
+		switch {
+		case s[0] == '(':
+			n := groupLen(s)
+			s = s[n:]
+			switch state {
+			case expectAS:
+			case expectBody:
+				state = afterBody
+			default:
+				return ""
+			}
+		case s[0] == ',':
+			if state != afterBody {
+				return ""
+			}
+			s = s[1:]
+			state = expectName
+		case s[0] == '"':
+			if state != expectName {
+				return ""
+			}
+			s = s[quoteLen(s):]
+			state = expectAS
+		case isIdentByte(s[0], true):
+			n := identLen(s)
+			word := strings.ToUpper(s[:n])
+			s = s[n:]
+			switch {
+			case state == expectName && first && word == "RECURSIVE":
+			case state == expectName:
+				state = expectAS
+			case state == expectAS && (word == "USING" || word == "KEY"):
+			case state == expectAS && word == "AS":
+				state = expectBody
+			case state == expectBody && (word == "NOT" || word == "MATERIALIZED"):
+			case state == afterBody:
+				return word
+			default:
+				return ""
+			}
+		default:
+			return ""
+		}
+		first = false
+	}
+}
+
+// groupLen returns the length of the parenthesized group at the head of s,
+// including the parentheses. Literals, quoted identifiers and comments in it
+// are skipped.
+func groupLen(s string) int {
+	var depth int
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			i += quoteLen(s[i:])
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			i = len(s) - len(rest)
+		case isIdentByte(c, true):
+			i += identLen(s[i:])
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(s)
+}
+
+func skipSpaces(s string) string {
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(s, "--"):
+			n := strings.IndexByte(s, '\n')
+			if n < 0 {
+				return ""
+			}
+			s = s[n+1:]
+		case strings.HasPrefix(s, "/*"):
+			n := strings.Index(s, "*/")
+			if n < 0 {
+				return ""
+			}
+			s = s[n+2:]
+		default:
+			return s
+		}
+	}
+}
+
+// Redact replaces all string literals in s with '***', preserving the others.
+// Doubled quotes in literals, escape string literals like E'it\'s',
+// dollar-quoted literals, quoted identifiers and comments are handled.
+func Redact(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			n := quoteLen(s[i:])
+			if c == '"' {
+				b.WriteString(s[i : i+n])
+			} else {
+				b.WriteString("'***'")
+			}
+			i += n
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			b.WriteString(s[i : len(s)-len(rest)])
+			i = len(s) - len(rest)
+		case isIdentByte(c, true):
+			n := identLen(s[i:])
+			b.WriteString(s[i : i+n])
+			i += n
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// isQuote checks s starts with a quote of a literal or an identifier.
+func isQuote(s string) bool {
+	c := s[0]
+	return c == '\'' || c == '"' || isEscapeString(s) || dollarTagLen(s) > 0
+}
+
+// isEscapeString checks s starts with an escape string literal like E'a\n',
+// in which backslashes escape the following characters.
+func isEscapeString(s string) bool {
+	return len(s) > 1 && (s[0] == 'E' || s[0] == 'e') && s[1] == '\''
+}
+
+// isQuoteAt checks a quote of a literal or an identifier starts at s[i]. "$"
+// and "E" following an identifier or a number, like "x$y$", are a part of them
+// and don't start a literal.
+func isQuoteAt(s string, i int) bool {
+	if (s[i] == '$' || isEscapeString(s[i:])) && i > 0 && isIdentTail(s[i-1]) {
+		return false
+	}
+	return isQuote(s[i:])
+}
+
+// quoteLen returns the length of the quoted literal or identifier at the head
+// of s, including the quotes. It returns 0 when s doesn't start with a quote.
+func quoteLen(s string) int {
+	if s == "" {
+		return 0
+	}
+	switch c := s[0]; c {
+	case '\'', '"':
+		return 1 + quotedLen(s[1:], c)
+	case 'E', 'e':
+		if !isEscapeString(s) {
+			return 0
+		}
+		return 2 + escapedLen(s[2:])
+	case '$':
+		n := dollarTagLen(s)
+		if n == 0 {
+			return 0
+		}
+		end := strings.Index(s[n:], s[:n])
+		if end < 0 {
+			return len(s)
+		}
+		return n + end + n
+	default:
+		return 0
+	}
+}
+
+// dollarTagLen returns the length of the tag of a dollar-quoted literal like
+// "$$" or "$tag$" at the head of s, or 0. "$1" and "$name" of parameters
+// aren't tags.
+func dollarTagLen(s string) int {
+	if !strings.HasPrefix(s, "$") {
+		return 0
+	}
+	n := 1
+	for n < len(s) && isIdentByte(s[n], n == 1) {
+		n++
+	}
+	if n < len(s) && s[n] == '$' {
+		return n + 1
+	}
+	return 0
+}
+
+// quotedLen returns the length of the quoted part in s until the closing
+// quote q, including it.
+func quotedLen(s string, q byte) int {
+	n := 0
+	for {
+		end := strings.IndexByte(s[n:], q)
+		if end < 0 {
+			return len(s)
+		}
+		n += end + 1
+		if n < len(s) && s[n] == q {
+			n++
+			continue
+		}
+		return n
+	}
+}
+
+// escapedLen returns the length of the quoted part of an escape string
+// literal in s until the closing quote, including it.
+func escapedLen(s string) int {
+	for n := 0; n < len(s); n++ {
+		switch s[n] {
+		case '\\':
+			n++
+		case '\'':
+			if n+1 < len(s) && s[n+1] == '\'' {
+				n++
+				continue
+			}
+			return n + 1
+		}
+	}
+	return len(s)
+}
+
+// NamedParams returns the names of named parameters like "$name" in s, in the
+// order of their first appearance. Literals, quoted identifiers and comments
+// are skipped.
+func NamedParams(s string) []string {
+	var names []string
+	seen := map[string]struct{}{}
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			i += quoteLen(s[i:])
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			i = len(s) - len(rest)
+		case isIdentByte(c, true):
+			i += identLen(s[i:])
+		case c == '$':
+			n := 1
+			for i+n < len(s) && isIdentByte(s[i+n], n == 1) {
+				n++
+			}
+			if n > 1 {
+				name := s[i+1 : i+n]
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					names = append(names, name)
+				}
+			}
+			i += n
+		default:
+			i++
+		}
+	}
+	return names
+}
+
+// FileReadPaths returns string literals given as the first argument of table
+// functions which read files, which names start with "read_", like
+// read_csv('a.csv') or read_parquet(['a.parquet', 'b.parquet']). It is
+// best-effort: paths given by other expressions, and files read by other
+// ways like "FROM 'a.csv'", aren't returned.
+func FileReadPaths(s string) []string {
+	var paths []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			i += quoteLen(s[i:])
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			i = len(s) - len(rest)
+		case isIdentByte(c, true):
+			n := identLen(s[i:])
+			name := strings.ToLower(s[i : i+n])
+			i += n
+			if !strings.HasPrefix(name, "read_") {
+				continue
+			}
+			rest := skipSpaces(s[i:])
+			if !strings.HasPrefix(rest, "(") {
+				continue
+			}
+			paths = append(paths, literalArgs(skipSpaces(rest[1:]))...)
+		case '0' <= c && c <= '9':
+			// Skip numbers not to take a part of them as identifiers.
+			for i < len(s) && isIdentTail(s[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+	return paths
+}
+
+// literalArgs returns a string literal or a list of them at the head of s.
+func literalArgs(s string) []string {
+	if isLiteral(s) {
+		v, _ := unquoteLiteral(s)
+		return []string{v}
+	}
+	if !strings.HasPrefix(s, "[") {
+		return nil
+	}
+	var values []string
+	s = skipSpaces(s[1:])
+	for isLiteral(s) {
+		v, n := unquoteLiteral(s)
+		values = append(values, v)
+		s = skipSpaces(s[n:])
+		if !strings.HasPrefix(s, ",") {
+			break
+		}
+		s = skipSpaces(s[1:])
+	}
+	return values
+}
+
+// isLiteral checks s starts with a string literal, quoted with "'" or dollars.
+func isLiteral(s string) bool {
+	return strings.HasPrefix(s, "'") || isEscapeString(s) || dollarTagLen(s) > 0
+}
+
+// unquoteLiteral unquotes a string literal at the head of s, and returns it
+// with the length of the literal.
+func unquoteLiteral(s string) (string, int) {
+	if tag := dollarTagLen(s); tag > 0 {
+		n := quoteLen(s)
+		return strings.TrimSuffix(s[tag:n], s[:tag]), n
+	}
+	if isEscapeString(s) {
+		n := quoteLen(s)
+		return unescape(strings.TrimSuffix(s[2:n], "'")), n
+	}
+	n := 1 + quotedLen(s[1:], '\'')
+	v := strings.TrimSuffix(s[1:n], "'")
+	return strings.ReplaceAll(v, "''", "'"), n
+}
+
+// unescape decodes backslash escapes and doubled quotes of an escape string
+// literal. Escapes other than \n, \r and \t are the escaped characters.
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch c = s[i]; c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			}
+		case c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// CountStatements returns the number of statements separated by ";" in s.
+// Empty statements, which have only spaces and comments, are not counted.
+func CountStatements(s string) int {
+	return len(Statements(s))
+}
+
+// Statements splits s into statements separated by ";", without the
+// separators. Empty statements, which have only spaces and comments, are
+// omitted.
+func Statements(s string) []string {
+	var stmts []string
+	var start int
+	var body bool
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			body = true
+			i += quoteLen(s[i:])
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			i = len(s) - len(rest)
+		case c == ';':
+			if body {
+				stmts = append(stmts, s[start:i])
+				body = false
+			}
+			i++
+			start = i
+		case isIdentByte(c, true):
+			body = true
+			i += identLen(s[i:])
+		default:
+			if !unicode.IsSpace(rune(c)) {
+				body = true
+			}
+			i++
+		}
+	}
+	if body {
+		stmts = append(stmts, s[start:])
+	}
+	return stmts
+}
+
+// TrimTerminator removes trailing semicolons, spaces and comments of a
+// statement, so that it can be embedded in another statement as a subquery.
+func TrimTerminator(s string) string {
+	var end int
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			i += quoteLen(s[i:])
+			end = i
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			i = len(s) - len(rest)
+		case c == ';' || unicode.IsSpace(rune(c)):
+			i++
+		case isIdentByte(c, true):
+			i += identLen(s[i:])
+			end = i
+		default:
+			i++
+			end = i
+		}
+	}
+	return s[:end]
+}
+
+// HasTopLevelLimit checks the statement has LIMIT or FETCH clause out of
+// parentheses. Literals, quoted identifiers and comments are skipped.
+func HasTopLevelLimit(s string) bool {
+	var depth int
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			i += quoteLen(s[i:])
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			i = len(s) - len(rest)
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case isIdentByte(c, true):
+			start := i
+			i += identLen(s[i:])
+			if depth == 0 {
+				switch strings.ToUpper(s[start:i]) {
+				case "LIMIT", "FETCH":
+					return true
+				}
+			}
+		default:
+			i++
+		}
+	}
+	return false
+}
+
+// ExtensionNames returns names of extensions installed or loaded by INSTALL
+// and LOAD statements in s, in lower case. A path or a URL of an extension is
+// returned as it is.
+func ExtensionNames(s string) []string {
+	var names []string
+	head := true
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isQuoteAt(s, i):
+			head = false
+			i += quoteLen(s[i:])
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			rest := skipSpaces(s[i:])
+			i = len(s) - len(rest)
+		case c == ';':
+			head = true
+			i++
+		case isIdentByte(c, true):
+			n := identLen(s[i:])
+			word := strings.ToUpper(s[i : i+n])
+			i += n
+			if !head || word == "FORCE" {
+				continue
+			}
+			head = false
+			if word != "INSTALL" && word != "LOAD" {
+				continue
+			}
+			rest := skipSpaces(s[i:])
+			if name, n := extensionName(rest); n > 0 {
+				names = append(names, name)
+				i = len(s) - len(rest) + n
+			}
+		default:
+			if !unicode.IsSpace(rune(c)) {
+				head = false
+			}
+			i++
+		}
+	}
+	return names
+}
+
+// extensionName parses a name of an extension, which is an identifier or a
+// quoted string, at the head of s. It returns the name and its length in s.
+func extensionName(s string) (string, int) {
+	if s == "" {
+		return "", 0
+	}
+	if c := s[0]; c == '\'' || c == '"' {
+		n := 1 + quotedLen(s[1:], c)
+		v := strings.TrimSuffix(s[1:n], string(c))
+		v = strings.ReplaceAll(v, string(c)+string(c), string(c))
+		if c == '"' {
+			v = strings.ToLower(v)
+		}
+		return v, n
+	}
+	n := 0
+	for n < len(s) && isIdentByte(s[n], n == 0) {
+		n++
+	}
+	return strings.ToLower(s[:n]), n
+}
+
+// identLen returns the length of the unquoted identifier or keyword at the
+// head of s, or 0. "$" is allowed after the first byte as DuckDB does.
+func identLen(s string) int {
+	if s == "" || !isIdentByte(s[0], true) {
+		return 0
+	}
+	n := 1
+	for n < len(s) && isIdentTail(s[n]) {
+		n++
+	}
+	return n
+}
+
+// isIdentTail checks c can follow the first byte of an unquoted identifier.
+func isIdentTail(c byte) bool {
+	return isIdentByte(c, false) || c == '$'
+}
+
+func isIdentByte(c byte, first bool) bool {
+	switch {
+	case c == '_', 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z':
+		return true
+	case '0' <= c && c <= '9':
+		return !first
+	default:
+		return false
+	}
+}
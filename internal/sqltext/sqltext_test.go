@@ -0,0 +1,232 @@
+package sqltext_test
+
+import (
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+	"github.com/koron/duckpop/internal/sqltext"
+)
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, `'abc'`, sqltext.QuoteString("abc"))
+	assert.Equal(t, `'it''s'`, sqltext.QuoteString("it's"))
+	assert.Equal(t, `"abc"`, sqltext.QuoteIdent("abc"))
+	assert.Equal(t, `"a""b"`, sqltext.QuoteIdent(`a"b`))
+}
+
+func TestIsIdent(t *testing.T) {
+	for _, s := range []string{"t", "_t1", "Events_2026"} {
+		if !sqltext.IsIdent(s) {
+			t.Errorf("should be an identifier: %q", s)
+		}
+	}
+	for _, s := range []string{"", "1t", "a b", "t;DROP", `a"b`} {
+		if sqltext.IsIdent(s) {
+			t.Errorf("should not be an identifier: %q", s)
+		}
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT"},
+		{"  select\n1", "SELECT"},
+		{"-- comment\nCREATE TABLE t (a INT)", "CREATE"},
+		{"/* comment */ insert into t VALUES (1)", "INSERT"},
+		{"(SELECT 1)", ""},
+		{"", ""},
+		{"-- only comment", ""},
+	} {
+		assert.Equal(t, tc.want, sqltext.StatementType(tc.query))
+	}
+}
+
+func TestStatementVerb(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT"},
+		{"INSERT INTO t VALUES (1)", "INSERT"},
+		{"WITH a AS (SELECT 2 AS N) SELECT * FROM a", "SELECT"},
+		{"WITH a AS (SELECT 2 AS N) INSERT INTO t SELECT * FROM a", "INSERT"},
+		{"with a as (select 1), b (x) as materialized (select ')' from a) delete from t", "DELETE"},
+		{"WITH RECURSIVE r(n) USING KEY (n) AS NOT MATERIALIZED (SELECT 1 UNION SELECT n + 1 FROM r) FROM r", "FROM"},
+		{`WITH "a b" AS (SELECT 1) /* c */ UPDATE t SET x = 1`, "UPDATE"},
+		{"WITH a AS (SELECT 1) (SELECT * FROM a)", ""},
+		{"WITH a AS (SELECT 1", ""},
+		{"WITH", ""},
+	} {
+		assert.Equal(t, tc.want, sqltext.StatementVerb(tc.query))
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT 'foo' AS A", "SELECT '***' AS A"},
+		{"SELECT 'it''s', 'x'", "SELECT '***', '***'"},
+		{`CREATE SECRET (TYPE s3, KEY_ID 'AKIA', SECRET 'xyz')`, `CREATE SECRET (TYPE s3, KEY_ID '***', SECRET '***')`},
+		{`SELECT "it's" FROM t WHERE a = 'b'`, `SELECT "it's" FROM t WHERE a = '***'`},
+		{`SELECT "a""b" FROM t`, `SELECT "a""b" FROM t`},
+		{"SELECT 'unterminated", "SELECT '***'"},
+		{"SELECT $$it's$$, $tag$a$$b$tag$, $1, $name", "SELECT '***', '***', $1, $name"},
+		{"SELECT 1 -- it's\n, 'secret'", "SELECT 1 -- it's\n, '***'"},
+		{"SELECT /* it's */ 'secret', 'x' /* ' */", "SELECT /* it's */ '***', '***' /* ' */"},
+		{`SELECT E'a\'secret', 'x'`, `SELECT '***', '***'`},
+		{`SELECT e'a\\', 'secret'`, `SELECT '***', '***'`},
+		{`SELECT E'it''s', typE'x'`, `SELECT '***', typE'***'`},
+		{"SELECT 1 AS x$y$, 'secret'", "SELECT 1 AS x$y$, '***'"},
+	} {
+		assert.Equal(t, tc.want, sqltext.Redact(tc.query))
+	}
+}
+
+func TestNamedParams(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT 1", nil},
+		{"SELECT * FROM t WHERE a = $a AND b = $b_2", []string{"a", "b_2"}},
+		{"SELECT $x + $x, $y", []string{"x", "y"}},
+		{"SELECT '$no', \"$no\" -- $no\n, $yes /* $no */", []string{"yes"}},
+		{"SELECT $1, $", nil},
+		{"SELECT $$ $no $$, $t$ $no $t$, $yes", []string{"yes"}},
+		{"SELECT x$no$, x$no, $yes", []string{"yes"}},
+	} {
+		assert.Equal(t, tc.want, sqltext.NamedParams(tc.query))
+	}
+}
+
+func TestCountStatements(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"", 0},
+		{"SELECT 1", 1},
+		{"SELECT 1;", 1},
+		{"SELECT 1; SELECT 2", 2},
+		{";;  ;\n", 0},
+		{"SELECT ';'; SELECT \";\"", 2},
+		{"SELECT 1; -- SELECT 2;\n", 1},
+		{"SELECT 1; /* ; */ ; SELECT 2 /* ; */", 2},
+		{"-- only comment", 0},
+		{"SELECT $$a;b$$; SELECT $x$;$x$", 2},
+		{"SELECT $$;", 1},
+		{"SELECT 1 AS x$y$; CREATE TABLE z AS SELECT 42 AS N; SELECT * FROM z", 3},
+		{"SELECT 1$a$; SELECT 2", 2},
+		{`SELECT E'\''; DROP TABLE t; SELECT ''''`, 3},
+		{`SELECT E'\\'; SELECT 2`, 2},
+	} {
+		assert.Equal(t, tc.want, sqltext.CountStatements(tc.query))
+	}
+}
+
+func TestStatements(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", nil},
+		{"SELECT 1;", []string{"SELECT 1"}},
+		{"SELECT ';'; -- c;\n INSERT INTO t VALUES (1)", []string{"SELECT ';'", " -- c;\n INSERT INTO t VALUES (1)"}},
+		{";; /* ; */ ;", nil},
+		{"SELECT $$ a;b $$;SELECT 1 -- a; comment\n;/* a; b */", []string{"SELECT $$ a;b $$", "SELECT 1 -- a; comment\n"}},
+		{"SELECT $fn$ $$;$$ $fn$; SELECT 2", []string{"SELECT $fn$ $$;$$ $fn$", " SELECT 2"}},
+		{"SELECT $1; SELECT $a", []string{"SELECT $1", " SELECT $a"}},
+		{"SELECT 1 AS x$y$; DROP TABLE t", []string{"SELECT 1 AS x$y$", " DROP TABLE t"}},
+	} {
+		assert.Equal(t, tc.want, sqltext.Statements(tc.query))
+	}
+}
+
+func TestFileReadPaths(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT 1", nil},
+		{"SELECT * FROM read_csv('/data/a.csv')", []string{"/data/a.csv"}},
+		{"SELECT * FROM READ_PARQUET ( ['a.parquet', 'it''s.parquet'] , union_by_name = true)", []string{"a.parquet", "it's.parquet"}},
+		{"SELECT * FROM read_json_auto(/* c */ 's3://bucket/x.json') JOIN read_csv_auto('b.csv') USING (id)", []string{"s3://bucket/x.json", "b.csv"}},
+		{"SELECT 'read_csv(''x'')', \"read_csv\"('y') -- read_csv('z')", nil},
+		{"SELECT * FROM read_csv(public_dir('a.csv'))", nil},
+		{"SELECT my_read_csv('a'), 1read_csv('b')", nil},
+		{"SELECT * FROM read_csv($$/data/a.csv$$) JOIN read_json([$p$b.json$p$, 'c.json']) USING (id)", []string{"/data/a.csv", "b.json", "c.json"}},
+		{"SELECT $$read_csv('x')$$", nil},
+		{"SELECT 1 AS a$b$, * FROM read_csv('c.csv')", []string{"c.csv"}},
+		{`SELECT * FROM read_csv(E'/data/it\'s.csv') JOIN read_json([e'a\\b.json']) USING (id)`, []string{"/data/it's.csv", `a\b.json`}},
+	} {
+		assert.Equal(t, tc.want, sqltext.FileReadPaths(tc.query))
+	}
+}
+
+func TestTrimTerminator(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT 1;", "SELECT 1"},
+		{"SELECT 1 ; \n", "SELECT 1"},
+		{"SELECT 1; -- comment", "SELECT 1"},
+		{"SELECT 1 /* ; */;", "SELECT 1"},
+		{"SELECT ';'", "SELECT ';'"},
+		{"SELECT 1 -- x\nFROM t;", "SELECT 1 -- x\nFROM t"},
+		{"SELECT $$;$$;", "SELECT $$;$$"},
+		{"SELECT 1 AS x$y$; -- $z$", "SELECT 1 AS x$y$"},
+	} {
+		assert.Equal(t, tc.want, sqltext.TrimTerminator(tc.query))
+	}
+}
+
+func TestHasTopLevelLimit(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT * FROM t", false},
+		{"SELECT * FROM t LIMIT 10", true},
+		{"select * from t limit 10", true},
+		{"SELECT * FROM t OFFSET 5 FETCH FIRST 10 ROWS ONLY", true},
+		{"SELECT * FROM (SELECT * FROM t LIMIT 10)", false},
+		{"SELECT 'LIMIT 1', \"limit\" FROM t -- LIMIT 1", false},
+		{"SELECT * FROM t /* LIMIT 1 */", false},
+		{"SELECT limited FROM t", false},
+		{"SELECT $$ LIMIT 1 $$ FROM t", false},
+		{"SELECT 1 AS x$y$ FROM t LIMIT 1", true},
+	} {
+		if got := sqltext.HasTopLevelLimit(tc.query); got != tc.want {
+			t.Errorf("unexpected result for %q: want=%t got=%t", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestExtensionNames(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT 1", nil},
+		{"INSTALL json; LOAD json", []string{"json", "json"}},
+		{"install ICU", []string{"icu"}},
+		{"FORCE INSTALL httpfs FROM community", []string{"httpfs"}},
+		{"LOAD '/tmp/x.duckdb_extension'", []string{"/tmp/x.duckdb_extension"}},
+		{"LOAD \"Spatial\"", []string{"spatial"}},
+		{"-- comment\n/* c */ LOAD h3", []string{"h3"}},
+		{"SELECT 'LOAD x'; SELECT install FROM t", nil},
+		{"CREATE TABLE load (i INT)", nil},
+		{"SELECT $$;LOAD x$$; LOAD y", []string{"y"}},
+		{"SELECT 1 AS x$y$; LOAD z", []string{"z"}},
+	} {
+		assert.Equal(t, tc.want, sqltext.ExtensionNames(tc.query))
+	}
+}
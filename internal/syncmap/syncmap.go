@@ -86,3 +86,10 @@ func (m *Map[K, V]) Range(f func(K, V) bool) {
 	}
 	m.runlock()
 }
+
+// Len returns the number of entries.
+func (m *Map[K, V]) Len() int {
+	m.rlock()
+	defer m.runlock()
+	return len(m.m)
+}
@@ -10,11 +10,18 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/koron/duckpop/duckserver"
+	"github.com/koron/duckpop/internal/authn"
 )
 
+// checkAuthnFile is a file to check by -check.authnfile, instead of starting
+// the server.
+var checkAuthnFile string
+
 func main() {
 	if err := run(); err != nil {
 		slog.Error("duckpop terminated", "error", err)
@@ -29,6 +36,9 @@ func run() error {
 	if err != nil {
 		return err
 	}
+	if checkAuthnFile != "" {
+		return checkAuthn(checkAuthnFile)
+	}
 	// Start the server
 	srv, err := duckserver.New(config)
 	if err != nil {
@@ -39,27 +49,97 @@ func run() error {
 
 func flag2config(c *duckserver.Config) error {
 	var (
-		err           error
-		uiResourceDir string
+		err              error
+		fileReadPrefixes string
+		extensions       string
+		dataVersionFiles string
+		uiResourceDir    string
 	)
 
-	flag.BoolVar(&c.EnableDebugLog, "debug", false, `enable debug log`)
+	flag.StringVar(&checkAuthnFile, "check.authnfile", "", `check an authentication file and exit without starting the server`)
+	flag.BoolVar(&c.EnableDebugLog, "debug", false, `enable debug log, same as -log.level=debug`)
+	flag.StringVar(&c.LogLevel, "log.level", "info", `minimum level of server logs: "debug", "info", "warn" or "error"`)
+	flag.StringVar(&c.LogFile, "log.file", "", `server log file (default: stderr)`)
 	flag.BoolVar(&c.EnablePprof, "pprof", false, `enable pprof end point`)
 	flag.StringVar(&c.Address, "addr", "localhost:9281", `address hosts HTTP server`)
+	flag.StringVar(&c.AdminAddress, "admin.addr", "", `address hosts admin end points like /config/ and /metrics, removed from -addr. empty to host them at -addr`)
 	flag.IntVar(&c.MaxDB, "maxdb", 20, `maximum number of DB instances`)
+	flag.IntVar(&c.MaxStatements, "maxstatements", 10, `maximum number of statements in a request. 0 means unlimited`)
+	flag.IntVar(&c.MaxColumns, "maxcolumns", 10000, `maximum number of columns in a result. 0 means unlimited`)
+	flag.DurationVar(&c.QueryTimeout, "query.timeout", 0, `cancel queries which run longer than this. 0 means no timeouts`)
+	flag.BoolVar(&c.CoalesceQueries, "query.coalesce", false, `share an execution among identical read-only queries in flight on the same DB, with -db.strategy other than connection`)
+	flag.StringVar(&c.TimeoutHeader, "query.timeoutheader", "", `name of a header requesting a timeout of a query, like "X-Request-Timeout"`)
+	flag.IntVar(&c.AutoLimit, "autolimit", 0, `append LIMIT to a single SELECT without LIMIT in a request. 0 to disable`)
+	flag.StringVar(&c.ConnIDFormat, "connid.format", "hex", `format of connection IDs: "hex" or "uuid"`)
+	flag.DurationVar(&c.MaxKeepSession, "keepsession.max", 0, `maximum duration to keep a DB after its connection is closed, requested by a header. 0 to disable`)
+	flag.DurationVar(&c.IdleTransactionTimeout, "transaction.idletimeout", 0, `roll back a transaction left open across requests after it is idle for this duration. 0 to disable`)
+	flag.IntVar(&c.BatchParallel, "batch.parallel", 4, `maximum number of parallel queries in a batch request`)
+	flag.IntVar(&c.Workers, "workers", 0, `maximum number of queries executed at once across all connections. 0 means unlimited`)
+	flag.DurationVar(&c.WorkerWait, "workers.wait", 10*time.Second, `maximum time for a query to wait for a worker before 503`)
+	flag.Int64Var(&c.MaxBodySize, "body.maxsize", 64<<20, `maximum size of a request body after decompression. 0 means unlimited`)
+	flag.Int64Var(&c.MaxResponseSize, "response.maxsize", 0, `maximum size of a streamed result, truncated when exceeded. 0 means unlimited`)
+	flag.Int64Var(&c.MaxEmbedSize, "embed.maxsize", 0, `maximum size of a result embedded as a data URI with "embed=1". 0 to disable`)
+	flag.IntVar(&c.FlushRows, "flush.rows", 1000, `flush the response after this number of rows. 0 to disable`)
+	flag.DurationVar(&c.FlushInterval, "flush.interval", 200*time.Millisecond, `flush the response after this interval. 0 to disable`)
+	flag.StringVar(&c.DefaultFormat, "format.default", "csv", `format used when a request doesn't specify it, like "json,envelope"`)
+	flag.BoolVar(&c.JSONBigIntAsString, "json.bigintasstring", false, `write 64-bit or larger integers as strings in JSON`)
+	flag.StringVar(&c.CSVDelimiter, "csv.delimiter", ",", `field delimiter of CSV, with escape sequences like "\x1f"`)
+	flag.StringVar(&c.CSVNewline, "csv.newline", "quote", `policy for newlines in fields of CSV: "quote", "strip" or "escape"`)
+	flag.StringVar(&c.CSVTerminator, "csv.terminator", `\n`, `record terminator of CSV, with escape sequences like "\x1e" or "\r\n"`)
+	flag.BoolVar(&c.ReadOnly, "readonly", false, `start in read-only mode, which rejects statements other than queries like SELECT`)
+	flag.DurationVar(&c.DrainDelay, "shutdown.draindelay", 0, `time to reject queries and pings with 503 before shutting down`)
+	flag.DurationVar(&c.RetryAfter, "retryafter", time.Second, `Retry-After of requests rejected by limits like -maxdb, draining and read-only mode`)
+	flag.IntVar(&c.EmptyResultStatus, "emptyresult.status", 200, `status code for queries which result no rows: 200 or 204`)
+	flag.StringVar(&c.UnsupportedType, "unsupportedtype", "stringify", `handling of columns of types which formats can't represent: "stringify", "error" or "cast"`)
+	flag.StringVar(&c.DuplicateColumn, "duplicatecolumn", "keep", `handling of duplicated names of columns: "keep", "suffix" or "error"`)
+	flag.StringVar(&c.CommandResult, "commandresult", "rows", `response of statements which return no rows like SET: "rows" or "ack"`)
+	flag.StringVar(&c.JSONNonFinite, "json.nonfinite", "null", `writing NaN and infinities in JSON: "null", "string" or "error"`)
+	flag.StringVar(&c.PingPath, "ping.path", "/ping/", `path of the ping end point. empty to disable`)
+	flag.DurationVar(&c.MetricsInterval, "metrics.interval", 15*time.Second, `interval to collect DuckDB metrics for /metrics. 0 to disable`)
+	flag.IntVar(&c.MetricsMaxTags, "metrics.maxtags", 20, `maximum number of distinct query tags in metrics`)
 	flag.StringVar(&c.PIDFile, "pidfile", "", `file to record the process ID`)
 	flag.StringVar(&c.AccessLogFile, "accesslog.file", "", `access log file (default: stdout)`)
 	flag.StringVar(&c.AccessLogFormat, "accesslog.format", "text", `access log format: "text" or "json"`)
+	flag.BoolVar(&c.AccessLogRedact, "accesslog.redact", false, `mask string literals of queries in access logs`)
+	flag.StringVar(&c.AuditLogFile, "auditlog.file", "", `audit log file of queries in JSON lines (default: disabled)`)
+	flag.StringVar(&c.ErrorDetail, "error.detail", "full", `verbosity of query errors: "full", "message" or "generic"`)
 	flag.StringVar(&c.AuthnFile, "authnfile", "", `authentication information file`)
 	flag.BoolVar(&c.NoAuthz, "noauthz", false, `executing queries etc. w/o authz`)
+	flag.BoolVar(&c.NoGetQuery, "nogetquery", false, `reject queries by GET and HEAD, to keep them out of URLs`)
+	flag.StringVar(&c.TemplateFile, "templatefile", "", `query templates file, invoked with "POST /q/{name}"`)
+	flag.StringVar(&c.ScriptDir, "scriptdir", "", `directory of SQL scripts, executed with "POST /script/{name}"`)
+	flag.StringVar(&fileReadPrefixes, "fileread.prefixes", "", `comma separated prefixes of paths which read_csv etc. in queries can read`)
+	flag.StringVar(&extensions, "extensions.allowed", "", `comma separated names of extensions which INSTALL and LOAD in queries can use`)
+	flag.StringVar(&c.DataVersion, "data.version", "", `version of data, enabling the data version header`)
+	flag.StringVar(&dataVersionFiles, "data.versionfiles", "", `comma separated files whose sizes and modification times make the data version`)
 	flag.StringVar(&c.DBHomeDir, "db.homedir", filepath.Join(getwd(), ".duckpop"), `home dir for duckdb`)
 	flag.IntVar(&c.DBThreads, "db.threads", 1, `initial value of DB "threads"`)
 	flag.StringVar(&c.DBMemoryLimit, "db.memorylimit", "1GiB", `initial value of DB "memory_limit"`)
 	flag.StringVar(&c.DBMaxTempDirSize, "db.maxtempdirsize", "10GiB", `max size of temporary dir`)
+	flag.BoolVar(&c.DBTempDirPerConn, "db.tempdirperconn", false, `use a dedicated temporary directory for each DB, removed on close`)
+	flag.StringVar(&c.DBQueryMemoryLimit, "db.querymemorylimit", "", `maximum memory of a query, stricter than -db.memorylimit`)
 	flag.BoolVar(&c.DBExternalAccess, "db.externalaccess", true, `enable external access. to disable -db.externalaccess=false`)
 	flag.BoolVar(&c.DBLockConfig, "db.lockconfig", true, `lock DB settings. to unlock -db.lockconfig=false`)
+	flag.BoolVar(&c.DBProgressBar, "db.progressbar", false, `enable the progress bar of DuckDB, printed to the console`)
 	flag.StringVar(&c.DBInitQuery, "db.initquery", "", `DB initialization query or file (prefixed with '@')`)
+	flag.Var(&globViewsFlag{views: &c.DBGlobViews}, "db.globview", `view of files matching a glob like "events=/data/events/*.parquet", created in each DB. can be repeated`)
+	flag.StringVar(&c.DBPreludeFile, "db.preludefile", "", `file of SQL like CREATE MACRO executed in each DB after the init query`)
+	flag.StringVar(&c.DBWarmupQuery, "db.warmupquery", "", `query or file (prefixed with '@') executed on a DB checked at startup, to validate data and warm up caches of the OS`)
+	flag.BoolVar(&c.DBSkipStartupCheck, "db.skipstartupcheck", false, `skip checking the DuckDB library and DB settings at startup`)
+	flag.Int64Var(&c.DBMaxEstimatedRows, "db.maxestimatedrows", 0, `reject queries whose estimated rows by EXPLAIN exceed this. 0 means unlimited`)
+	flag.IntVar(&c.DBMaxIdleConns, "db.maxidleconns", 0, `maximum number of idle connections per DB`)
+	flag.IntVar(&c.DBMaxOpenConns, "db.maxopenconns", 0, `maximum number of open connections per DB. 0 means unlimited`)
+	flag.BoolVar(&c.DBResetBetweenQueries, "db.resetbetweenqueries", false, `drop temporary objects after each query`)
+	flag.BoolVar(&c.DBConcurrentQueries, "db.concurrentqueries", false, `allow queries of a connection to run concurrently on its DB`)
+	flag.StringVar(&c.DBMode, "db.mode", "memory", `storage of each DB: "memory" or "tempfile"`)
+	flag.StringVar(&c.DBStrategy, "db.strategy", "connection", `unit to assign a DB: "connection", "authn", "shared" or "pooled"`)
+	flag.BoolVar(&c.DBTenantFile, "db.tenantfile", false, `back each DB of strategies other than "connection" with a file in the home dir`)
+	flag.IntVar(&c.DBPoolSize, "db.poolsize", 4, `number of DBs of "pooled" strategy`)
+	flag.IntVar(&c.DBSpares, "db.spares", 0, `number of DBs of "connection" strategy opened in advance for new connections`)
 	flag.StringVar(&uiResourceDir, "ui.resourcedir", "", `UI resource directory for development`)
+	if err := env2flags(flag.CommandLine); err != nil {
+		return err
+	}
 	flag.Parse()
 
 	if c.NoAuthz && c.AuthnFile == "" {
@@ -74,6 +154,23 @@ func flag2config(c *duckserver.Config) error {
 		}
 		c.DBInitQuery = string(b)
 	}
+	if strings.HasPrefix(c.DBWarmupQuery, "@") {
+		b, err := os.ReadFile(c.DBWarmupQuery[1:])
+		if err != nil {
+			return fmt.Errorf("failed to read warm-up query: %s", err)
+		}
+		c.DBWarmupQuery = string(b)
+	}
+
+	if fileReadPrefixes != "" {
+		c.FileReadPrefixes = splitList(fileReadPrefixes)
+	}
+	if extensions != "" {
+		c.AllowedExtensions = splitList(strings.ToLower(extensions))
+	}
+	if dataVersionFiles != "" {
+		c.DataVersionFiles = splitList(dataVersionFiles)
+	}
 
 	c.UIResourceFS, err = getUIFS(uiResourceDir)
 	if err != nil {
@@ -83,6 +180,131 @@ func flag2config(c *duckserver.Config) error {
 	return nil
 }
 
+// envPrefix is the prefix of environment variables for flags.
+const envPrefix = "DUCKPOP_"
+
+// envName returns the name of the environment variable for a flag, like
+// DUCKPOP_DB_HOMEDIR for -db.homedir.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// env2flags sets flags from environment variables before parsing the command
+// line, so that flags take precedence over environment variables and
+// environment variables over defaults.
+func env2flags(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		set := func(s string) error { return fs.Set(f.Name, s) }
+		if ev, ok := f.Value.(envValue); ok {
+			set = ev.SetEnv
+		}
+		if err2 := set(v); err2 != nil {
+			err = fmt.Errorf("invalid value %q for environment variable %s: %w", v, name, err2)
+		}
+	})
+	return err
+}
+
+// envValue is a flag value which is set from an environment variable in a
+// different way from the command line, like repeatable flags.
+type envValue interface {
+	SetEnv(string) error
+}
+
+// globViewsFlag is the value of -db.globview. The environment variable can
+// give multiple views separated by ";", and the command line replaces them
+// instead of adding to them.
+type globViewsFlag struct {
+	views   *map[string]string
+	fromEnv bool
+}
+
+func (f *globViewsFlag) String() string {
+	if f == nil || f.views == nil {
+		return ""
+	}
+	var list []string
+	for name, glob := range *f.views {
+		list = append(list, name+"="+glob)
+	}
+	slices.Sort(list)
+	return strings.Join(list, ";")
+}
+
+func (f *globViewsFlag) Set(s string) error {
+	if f.fromEnv {
+		*f.views = nil
+		f.fromEnv = false
+	}
+	name, glob, ok := strings.Cut(s, "=")
+	if !ok {
+		return errors.New(`should be "name=glob"`)
+	}
+	if *f.views == nil {
+		*f.views = map[string]string{}
+	}
+	(*f.views)[name] = glob
+	return nil
+}
+
+func (f *globViewsFlag) SetEnv(s string) error {
+	for v := range strings.SplitSeq(s, ";") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if err := f.Set(v); err != nil {
+			return err
+		}
+	}
+	f.fromEnv = true
+	return nil
+}
+
+// splitList splits a comma separated list, trimming spaces around items and
+// dropping empty ones.
+func splitList(s string) []string {
+	var list []string
+	for v := range strings.SplitSeq(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// checkAuthn loads an authentication file as the server does, and reports the
+// entries.
+func checkAuthn(name string) error {
+	a, err := authn.LoadFile(name)
+	if err != nil {
+		return fmt.Errorf("invalid authentication file %s: %w", name, err)
+	}
+	var admins, restricted int
+	for _, e := range a.Entries() {
+		if !e.Supported() {
+			fmt.Printf("%s: WARN unsupported type of %s: %q, ignored\n", name, e.ID, e.Type)
+		}
+		if e.Admin {
+			admins++
+		}
+		if e.Paths != nil {
+			restricted++
+		}
+	}
+	fmt.Printf("%s: OK, %d entries (admin: %d, with paths: %d)\n", name, len(a.Entries()), admins, restricted)
+	return nil
+}
+
 func getwd() string {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/koron/duckpop/internal/assert"
+)
+
+func TestEnvName(t *testing.T) {
+	for _, tc := range []struct {
+		flag string
+		want string
+	}{
+		{"addr", "DUCKPOP_ADDR"},
+		{"maxdb", "DUCKPOP_MAXDB"},
+		{"db.homedir", "DUCKPOP_DB_HOMEDIR"},
+		{"check.authnfile", "DUCKPOP_CHECK_AUTHNFILE"},
+		{"ui-dir", "DUCKPOP_UI_DIR"},
+	} {
+		assert.Equal(t, tc.want, envName(tc.flag))
+	}
+}
+
+func TestEnv2Flags(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		addr  string
+		views map[string]string
+		err   string
+	}{
+		{
+			name: "default",
+			addr: "localhost:9281",
+		},
+		{
+			name: "env",
+			env:  map[string]string{"DUCKPOP_ADDR": "0.0.0.0:80"},
+			addr: "0.0.0.0:80",
+		},
+		{
+			name: "flag over env",
+			env:  map[string]string{"DUCKPOP_ADDR": "0.0.0.0:80"},
+			args: []string{"-addr", ":8080"},
+			addr: ":8080",
+		},
+		{
+			name:  "views by env",
+			env:   map[string]string{"DUCKPOP_DB_GLOBVIEW": "a=/x/*.parquet; b=/y/{1,2}.csv;"},
+			addr:  "localhost:9281",
+			views: map[string]string{"a": "/x/*.parquet", "b": "/y/{1,2}.csv"},
+		},
+		{
+			name:  "views by flags over env",
+			env:   map[string]string{"DUCKPOP_DB_GLOBVIEW": "a=/x/*.parquet;b=/y/*.csv"},
+			args:  []string{"-db.globview", "c=/z/*.json", "-db.globview", "d=/w/*.csv"},
+			addr:  "localhost:9281",
+			views: map[string]string{"c": "/z/*.json", "d": "/w/*.csv"},
+		},
+		{
+			name: "invalid env",
+			env:  map[string]string{"DUCKPOP_DB_GLOBVIEW": "a=/x/*.parquet;b"},
+			err:  `invalid value "a=/x/*.parquet;b" for environment variable DUCKPOP_DB_GLOBVIEW: should be "name=glob"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			var (
+				addr  string
+				views map[string]string
+			)
+			fs := flag.NewFlagSet("duckpop", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			fs.StringVar(&addr, "addr", "localhost:9281", "")
+			fs.Var(&globViewsFlag{views: &views}, "db.globview", "")
+			err := env2flags(fs)
+			if tc.err != "" {
+				if err == nil {
+					t.Fatal("should fail")
+				}
+				assert.Equal(t, tc.err, err.Error())
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.addr, addr)
+			assert.Equal(t, tc.views, views)
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []string
+	}{
+		{"/a", []string{"/a"}},
+		{"/a, /b", []string{"/a", "/b"}},
+		{" /a ,,s3://bucket/ ,", []string{"/a", "s3://bucket/"}},
+		{" , ", nil},
+	} {
+		assert.Equal(t, tc.want, splitList(tc.s))
+	}
+}
+
+func TestCheckAuthn(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name string
+		file string
+		ok   bool
+	}{
+		{"valid", `[{"id":"a","type":"bearer","token":"t1"}]`, true},
+		{"unsupported type", `[{"id":"a","type":"bearer","token":"t1"},{"id":"b","type":"oauth2"}]`, true},
+		{"duplicated ID", `[{"id":"a","type":"bearer","token":"t1"},{"id":"a","type":"bearer","token":"t2"}]`, false},
+		{"missing token", `[{"id":"a","type":"bearer"}]`, false},
+	} {
+		name := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".json")
+		if err := os.WriteFile(name, []byte(tc.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkAuthn(name); (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected result: %v", tc.name, err)
+		}
+	}
+}